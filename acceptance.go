@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrKeyTypeNotAllowed     = NewError("key-type-not-allowed", http.StatusBadRequest, "The certificate's key type is not allowed on this server.")
+	ErrValidityNotAllowed    = NewError("validity-not-allowed", http.StatusBadRequest, "The certificate is valid for longer than this server allows.")
+	ErrIssuerNotAllowed      = NewError("issuer-not-allowed", http.StatusBadRequest, "The certificate was issued by a CA that is not allowed on this server.")
+	ErrNameNotAllowed        = NewError("name-not-allowed", http.StatusBadRequest, "The certificate is for a name outside the domains allowed on this server.")
+	ErrExtKeyUsageNotAllowed = NewError("ext-key-usage-not-allowed", http.StatusBadRequest, "The certificate has an extended key usage that is not allowed on this server.")
+	ErrInvalidAcceptanceRule = NewError("invalid-acceptance-rule", http.StatusBadRequest, "Invalid acceptance rule.")
+)
+
+// Extended key usages, by the names rules give them. Every usage crypto/x509 knows has one.
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"any":                            x509.ExtKeyUsageAny,
+	"serverAuth":                     x509.ExtKeyUsageServerAuth,
+	"clientAuth":                     x509.ExtKeyUsageClientAuth,
+	"codeSigning":                    x509.ExtKeyUsageCodeSigning,
+	"emailProtection":                x509.ExtKeyUsageEmailProtection,
+	"ipsecEndSystem":                 x509.ExtKeyUsageIPSECEndSystem,
+	"ipsecTunnel":                    x509.ExtKeyUsageIPSECTunnel,
+	"ipsecUser":                      x509.ExtKeyUsageIPSECUser,
+	"timeStamping":                   x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":                    x509.ExtKeyUsageOCSPSigning,
+	"microsoftServerGatedCrypto":     x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"netscapeServerGatedCrypto":      x509.ExtKeyUsageNetscapeServerGatedCrypto,
+	"microsoftCommercialCodeSigning": x509.ExtKeyUsageMicrosoftCommercialCodeSigning,
+	"microsoftKernelCodeSigning":     x509.ExtKeyUsageMicrosoftKernelCodeSigning,
+}
+
+// The OIDs of the extended key usages crypto/x509 knows, as rules may give them instead of a name
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "2.5.29.37.0",
+	x509.ExtKeyUsageServerAuth:                     "1.3.6.1.5.5.7.3.1",
+	x509.ExtKeyUsageClientAuth:                     "1.3.6.1.5.5.7.3.2",
+	x509.ExtKeyUsageCodeSigning:                    "1.3.6.1.5.5.7.3.3",
+	x509.ExtKeyUsageEmailProtection:                "1.3.6.1.5.5.7.3.4",
+	x509.ExtKeyUsageIPSECEndSystem:                 "1.3.6.1.5.5.7.3.5",
+	x509.ExtKeyUsageIPSECTunnel:                    "1.3.6.1.5.5.7.3.6",
+	x509.ExtKeyUsageIPSECUser:                      "1.3.6.1.5.5.7.3.7",
+	x509.ExtKeyUsageTimeStamping:                   "1.3.6.1.5.5.7.3.8",
+	x509.ExtKeyUsageOCSPSigning:                    "1.3.6.1.5.5.7.3.9",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "1.3.6.1.4.1.311.10.3.3",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "2.16.840.1.113730.4.1",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "1.3.6.1.4.1.311.2.1.22",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "1.3.6.1.4.1.311.61.1.1",
+}
+
+// Is a rule an extended key usage, by name or dotted OID?
+func isExtKeyUsageRule(rule string) bool {
+	if _, ok := extKeyUsageNames[rule]; ok {
+		return true
+	}
+	_, err := ParseOID(rule)
+	return err == nil
+}
+
+// Does a rule, by name or dotted OID, give an extended key usage? Used by the acceptance rules and the usage policy.
+func extKeyUsageMatches(rule string, usage x509.ExtKeyUsage) bool {
+	if named, ok := extKeyUsageNames[rule]; ok {
+		return named == usage
+	}
+	return rule == extKeyUsageOIDs[usage]
+}
+
+// An AcceptancePolicy decides whether a new certificate may be stored, once it has been parsed and verified (see
+// NewCertificateFromData). It may reject the certificate, with an error for each rule it breaks, or accept it, adding
+// any warnings to cert.Warnings. Deployment-specific rules plug in here. The only one so far is ConfigPolicy.
+type AcceptancePolicy interface {
+	Check(cert *Certificate, config *RuntimeConfig) error
+}
+
+// The policy new certificates are checked against
+var Acceptance AcceptancePolicy = ConfigPolicy{}
+
+// The rules of ConfigPolicy, in the AcceptanceRules option. Rules left empty allow anything.
+type AcceptanceRules struct {
+	KeyTypes     []string `json:"keyTypes"`     // "rsa" and "ec". Empty for either.
+	MaxValidity  Duration `json:"maxValidity"`  // The longest a certificate may be valid for, whoever issued it. Zero for no limit.
+	Issuers      []string `json:"issuers"`      // Distinguished names of the CAs that may issue certificates, as in certificate details' "issuer"
+	Domains      []string `json:"domains"`      // DNS names certificates may be for, with every name under them. IP addresses aren't allowed while it is set.
+	ExtKeyUsages []string `json:"extKeyUsages"` // Extended key usages certificates may have, by name (such as "serverAuth") or dotted OID
+}
+
+// Copy the rules, so that a configuration can't change the defaults
+func (rules AcceptanceRules) copy() AcceptanceRules {
+	return AcceptanceRules{
+		KeyTypes:     append([]string(nil), rules.KeyTypes...),
+		MaxValidity:  rules.MaxValidity,
+		Issuers:      append([]string(nil), rules.Issuers...),
+		Domains:      append([]string(nil), rules.Domains...),
+		ExtKeyUsages: append([]string(nil), rules.ExtKeyUsages...),
+	}
+}
+
+// Validate the rules, reporting each invalid one against its field under the given one
+func (rules *AcceptanceRules) validate(field string, errs *ValidationErrors) {
+	for i, keyType := range rules.KeyTypes {
+		if keyType != RuleKeyTypeRSA && keyType != RuleKeyTypeEC {
+			errs.Add(field+".keyTypes["+strconv.Itoa(i)+"]", ErrInvalidAcceptanceRule)
+		}
+	}
+	if rules.MaxValidity < 0 {
+		errs.Add(field+".maxValidity", ErrInvalidAcceptanceRule)
+	}
+	for i, domain := range rules.Domains {
+		if !isDNSName(domain) || domain != strings.ToLower(domain) {
+			errs.Add(field+".domains["+strconv.Itoa(i)+"]", ErrInvalidAcceptanceRule)
+		}
+	}
+	for i, usage := range rules.ExtKeyUsages {
+		if !isExtKeyUsageRule(usage) {
+			errs.Add(field+".extKeyUsages["+strconv.Itoa(i)+"]", ErrInvalidAcceptanceRule)
+		}
+	}
+}
+
+// Does a rule list allow a value? An empty list allows anything.
+func ruleAllows(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Does a certificate's extended key usage have a name or OID the rules allow?
+func (rules *AcceptanceRules) allowsExtKeyUsage(usage x509.ExtKeyUsage) bool {
+	for _, rule := range rules.ExtKeyUsages {
+		if extKeyUsageMatches(rule, usage) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the name a rule would give an extended key usage, for reporting it. Unnamed usages are given by number.
+func extKeyUsageName(usage x509.ExtKeyUsage) string {
+	for name, u := range extKeyUsageNames {
+		if u == usage {
+			return name
+		}
+	}
+	return strconv.Itoa(int(usage))
+}
+
+// ConfigPolicy is the acceptance policy configured in the options: keys must be at least MinimumRSABits or
+// MinimumECBits long (though a sandbox accepts shorter keys, with a warning, see warnings.go), and certificates must
+// meet the AcceptanceRules. A certificate without an extended key usage extension may be used for anything, so it is
+// only allowed if the extKeyUsages rule is empty or allows "any". Every rule a certificate breaks is reported.
+type ConfigPolicy struct{}
+
+func (ConfigPolicy) Check(cert *Certificate, config *RuntimeConfig) error {
+	var errs ValidationErrors
+	rules := &config.AcceptanceRules
+
+	// Check the key
+	switch pub := cert.Cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < config.MinimumRSABits && !OptSandbox {
+			errs.Add("key", ErrKeyTooSmall)
+		}
+		if !ruleAllows(rules.KeyTypes, RuleKeyTypeRSA) {
+			errs.Add("keyType", ErrKeyTypeNotAllowed)
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().BitSize < config.MinimumECBits && !OptSandbox {
+			errs.Add("key", ErrKeyTooSmall)
+		}
+		if !ruleAllows(rules.KeyTypes, RuleKeyTypeEC) {
+			errs.Add("keyType", ErrKeyTypeNotAllowed)
+		}
+	}
+
+	// Check how long it is valid for, and who issued it
+	if rules.MaxValidity > 0 && cert.Cert.NotAfter.Sub(cert.Cert.NotBefore) > time.Duration(rules.MaxValidity) {
+		errs.Add("validity", ErrValidityNotAllowed)
+	}
+	if !ruleAllows(rules.Issuers, cert.Cert.Issuer.String()) {
+		errs.Add("issuer", ErrIssuerNotAllowed)
+	}
+
+	// Check the names it is for
+	if len(rules.Domains) != 0 {
+		for _, name := range certNames(cert.Cert) {
+			allowed := false
+			for _, domain := range rules.Domains {
+				if net.ParseIP(name) == nil && domainCovers(domain, name) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				errs.Add("names."+name, ErrNameNotAllowed)
+			}
+		}
+	}
+
+	// Check what it may be used for
+	if len(rules.ExtKeyUsages) != 0 {
+		if len(cert.Cert.ExtKeyUsage) == 0 && len(cert.Cert.UnknownExtKeyUsage) == 0 && !rules.allowsExtKeyUsage(x509.ExtKeyUsageAny) {
+			errs.Add("extKeyUsages.any", ErrExtKeyUsageNotAllowed)
+		}
+		for _, usage := range cert.Cert.ExtKeyUsage {
+			if !rules.allowsExtKeyUsage(usage) {
+				errs.Add("extKeyUsages."+extKeyUsageName(usage), ErrExtKeyUsageNotAllowed)
+			}
+		}
+		for _, oid := range cert.Cert.UnknownExtKeyUsage {
+			if !ruleAllows(rules.ExtKeyUsages, oid.String()) {
+				errs.Add("extKeyUsages."+oid.String(), ErrExtKeyUsageNotAllowed)
+			}
+		}
+	}
+
+	return errs.Err()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Certificates are read a batch at a time, so the export doesn't hold every stored certificate in memory at once
+const analyticsBatchSize = 500
+
+// The analytics export describes the stored certificates for a central security analytics pipeline, without anything
+// that identifies a person or a service: no user names or email addresses, no certificate names or subjects, and no
+// keys. It has totals by key, signature algorithm, issuer, time to expiry and validity period, and a record for each
+// certificate with its user and itself given by pseudonym. Pseudonyms are HMACs keyed with OptAnalyticsKey,
+// so the pipeline can follow a user or certificate from one export to the next without learning which it is.
+//
+// Issuers are given by distinguished name, except internal ones (see the InternalIssuers option) and self-signed
+// certificates, whose issuer names a team or a host: they are given by pseudonym too. Expiry is given only to the
+// month, since an exact expiry and issuer would find a publicly logged certificate, and with it its names.
+
+// The buckets of time to expiry, and of validity period, in order
+var (
+	analyticsExpiryBuckets = []analyticsBucket{
+		{"expired", 0},
+		{"7d", 7 * 24 * time.Hour},
+		{"30d", 30 * 24 * time.Hour},
+		{"90d", 90 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+	}
+	analyticsValidityBuckets = []analyticsBucket{
+		{"7d", 7 * 24 * time.Hour},
+		{"90d", 90 * 24 * time.Hour},
+		{"398d", 398 * 24 * time.Hour},
+		{"2y", 2 * 365 * 24 * time.Hour},
+	}
+)
+
+// Times beyond the last bucket
+const analyticsBucketLonger = "longer"
+
+// A bucket of durations, up to and including its limit
+type analyticsBucket struct {
+	name  string
+	limit time.Duration
+}
+
+// Get the name of the bucket a duration falls in
+func analyticsBucketOf(buckets []analyticsBucket, d time.Duration) string {
+	for _, bucket := range buckets {
+		if d <= bucket.limit {
+			return bucket.name
+		}
+	}
+	return analyticsBucketLonger
+}
+
+// A certificate, as exported for analytics
+type AnalyticsCert struct {
+	Cert               string `json:"cert"` // Pseudonyms
+	User               string `json:"user"`
+	Issuer             string `json:"issuer"`
+	Active             bool   `json:"active"`
+	KeyType            string `json:"keyType"` // Such as "RSA-2048" or "EC-256"
+	SignatureAlgorithm string `json:"signatureAlgorithm"`
+	CA                 bool   `json:"ca"`
+	Expires            string `json:"expires"`  // The month, such as "2026-10"
+	Validity           string `json:"validity"` // The validity period's bucket
+}
+
+type AnalyticsExport struct {
+	Generated           UTCTime          `json:"generated"`
+	Certs               int              `json:"certs"`
+	Active              int              `json:"active"`
+	Users               int              `json:"users"` // How many users hold certificates
+	KeyTypes            map[string]int   `json:"keyTypes"`
+	SignatureAlgorithms map[string]int   `json:"signatureAlgorithms"`
+	Issuers             map[string]int   `json:"issuers"`
+	Expiry              map[string]int   `json:"expiry"`   // Active certificates by time to expiry: "expired", "7d", "30d", "90d", "1y" or "longer"
+	Validity            map[string]int   `json:"validity"` // Certificates by validity period: "7d", "90d", "398d", "2y" or "longer"
+	Records             []*AnalyticsCert `json:"records"`
+	users               map[string]bool
+}
+
+var (
+	analyticsKeyOnce sync.Once
+	analyticsKey     []byte
+)
+
+// The key pseudonyms are made with. Without OptAnalyticsKey a random key is used, so pseudonyms only match
+// between exports from the same run.
+func analyticsPseudonymKey() []byte {
+	analyticsKeyOnce.Do(func() {
+		if OptAnalyticsKey != "" {
+			analyticsKey = []byte(OptAnalyticsKey)
+			return
+		}
+		analyticsKey = make([]byte, 32)
+		if _, err := rand.Read(analyticsKey); err != nil {
+			panic(err)
+		}
+	})
+	return analyticsKey
+}
+
+// Get the pseudonym of an identifier of a kind, such as a user-id. Identifiers of different kinds have unrelated
+// pseudonyms, even if they are equal.
+func analyticsPseudonym(kind, id string) string {
+	mac := hmac.New(sha256.New, analyticsPseudonymKey())
+	mac.Write([]byte(kind + ":" + id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Get the issuer of a certificate as exported: its distinguished name, or a pseudonym if it is internal
+func analyticsIssuer(details *CertificateDetails, config *RuntimeConfig) string {
+	internal := details.Issuer == details.Subject
+	for _, issuer := range config.InternalIssuers {
+		if details.Issuer == issuer {
+			internal = true
+		}
+	}
+	if internal {
+		return "internal:" + analyticsPseudonym("issuer", details.Issuer)
+	}
+	return details.Issuer
+}
+
+func newAnalyticsExport(now time.Time) *AnalyticsExport {
+	return &AnalyticsExport{
+		Generated:           NewUTCTime(now),
+		KeyTypes:            make(map[string]int),
+		SignatureAlgorithms: make(map[string]int),
+		Issuers:             make(map[string]int),
+		Expiry:              make(map[string]int),
+		Validity:            make(map[string]int),
+		Records:             []*AnalyticsCert{},
+		users:               make(map[string]bool),
+	}
+}
+
+// Add a certificate to the export
+func (export *AnalyticsExport) add(certData *CertificateData, details *CertificateDetails, config *RuntimeConfig) {
+	record := &AnalyticsCert{
+		Cert:               analyticsPseudonym("cert", certData.Id),
+		User:               analyticsPseudonym("user", certData.UserId),
+		Issuer:             analyticsIssuer(details, config),
+		Active:             certData.Active,
+		KeyType:            keyTypeName(details),
+		SignatureAlgorithm: details.SignatureAlgorithm,
+		CA:                 details.IsCA,
+		Expires:            certData.NotAfter.UTC().Format("2006-01"),
+		Validity:           analyticsBucketOf(analyticsValidityBuckets, certData.NotAfter.Sub(certData.NotBefore.Time)),
+	}
+	export.Records = append(export.Records, record)
+
+	export.Certs++
+	export.users[certData.UserId] = true
+	export.Users = len(export.users)
+	export.KeyTypes[record.KeyType]++
+	export.SignatureAlgorithms[record.SignatureAlgorithm]++
+	export.Issuers[record.Issuer]++
+	export.Validity[record.Validity]++
+	if certData.Active {
+		export.Active++
+		export.Expiry[analyticsBucketOf(analyticsExpiryBuckets, certData.NotAfter.Sub(export.Generated.Time))]++
+	}
+}
+
+// Export every stored certificate for analytics. The records are in pseudonym order, so they don't follow the
+// order certificates were stored in.
+func NewAnalyticsExport() (*AnalyticsExport, error) {
+	config := Config()
+	export := newAnalyticsExport(Now())
+	err := DatabaseEachCert(analyticsBatchSize, func(certData *CertificateData) error {
+		details, err := certData.Details()
+		if err != nil {
+			return err
+		}
+		export.add(certData, details, config)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(export.Records, func(i, j int) bool {
+		if export.Records[i].User != export.Records[j].User {
+			return export.Records[i].User < export.Records[j].User
+		}
+		return export.Records[i].Cert < export.Records[j].Cert
+	})
+	return export, nil
+}
+
+// Export the stored certificates for analytics, pseudonymized
+func ExportAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	export, err := NewAnalyticsExport()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, export)
+}
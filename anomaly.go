@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of anomaly
+const (
+	AnomalyBulkExport   = "bulk-key-export" // Many private keys exported in a short time
+	AnomalyNewNetwork   = "new-network"     // A token used from a network it hasn't been used from before
+	AnomalyRequestSpike = "request-spike"   // Many more requests in a minute than usual
+)
+
+// A spike needs at least this many requests in a minute, so that a quiet client doing a little more isn't a spike
+const MinSpikeRequests = 60
+
+// How long a principal's access pattern is remembered after its last request
+const anomalyMemory = 24 * time.Hour
+
+// An Anomaly is an unusual pattern of access by one principal, which may mean its credentials have been stolen.
+// Anomalies are logged, audited and posted to the OptAnomalyWebhook. The text field makes the payload a valid Slack message.
+type Anomaly struct {
+	Type      string      `json:"type"`
+	Principal string      `json:"principal"`
+	Time      UTCTime     `json:"time"`
+	Detail    AuditDetail `json:"detail"`
+	Text      string      `json:"text"`
+}
+
+// An AnomalyDetector tracks the access patterns of each principal: a token, an administrator, or an address
+type AnomalyDetector struct {
+	mu         sync.Mutex
+	principals map[string]*accessPattern
+	recent     []*Anomaly // The most recent anomalies, oldest first
+	lastPrune  time.Time
+	notify     func(*Anomaly)
+}
+
+type accessPattern struct {
+	lastSeen    time.Time
+	networks    map[string]bool
+	exports     []time.Time // Key exports within the anomaly window
+	minute      time.Time   // The minute being counted
+	count       int         // Requests in the minute being counted
+	average     float64     // Moving average of requests per minute, over the minutes with requests
+	lastAlerted map[string]time.Time
+}
+
+// How many anomalies are kept for /admin/anomalies
+const recentAnomalies = 100
+
+// Anomalies tracks access patterns in this process
+var Anomalies = NewAnomalyDetector()
+
+func NewAnomalyDetector() *AnomalyDetector {
+	return &AnomalyDetector{principals: make(map[string]*accessPattern), notify: sendAnomaly}
+}
+
+// Identify who is making a request: the token they present, the administrator logged in, or else their address.
+// Tokens are identified by a prefix of their hash, so that the token itself is never logged.
+func RequestPrincipal(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(auth[7:])))
+		return "token:" + hex.EncodeToString(hash[:8])
+	}
+	if _, session := RequestSession(r); session != nil {
+		return "admin:" + session.Admin
+	}
+	return ClientIPKey(r)
+}
+
+// The network an address belongs to: its /24 for IPv4, or its /48 for IPv6
+func addressNetwork(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// Record a request by a principal
+func (d *AnomalyDetector) RecordRequest(r *http.Request) {
+	d.recordRequest(RequestPrincipal(r), addressNetwork(r), Now())
+}
+
+// Record the export of a private key by the principal making a request
+func (d *AnomalyDetector) RecordExport(r *http.Request, certid string) {
+	d.recordExport(RequestPrincipal(r), certid, Now())
+}
+
+func (d *AnomalyDetector) recordRequest(principal, network string, now time.Time) {
+	config := Config()
+	var found []*Anomaly
+
+	d.mu.Lock()
+	p := d.pattern(principal, now)
+
+	// Addresses are their own network, so only tokens and administrators can turn up somewhere new
+	if !strings.HasPrefix(principal, "ip:") && !p.networks[network] {
+		if len(p.networks) > 0 {
+			found = append(found, d.found(p, AnomalyNewNetwork, principal, now, AuditDetail{"network": network},
+				"%s was used from a new network, %s", principal, network))
+		}
+		p.networks[network] = true
+	}
+
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(p.minute) {
+		if !p.minute.IsZero() {
+			p.average = (p.average*3 + float64(p.count)) / 4
+		}
+		p.minute, p.count = minute, 0
+	}
+	p.count++
+	// Only alert once the principal has a history to compare against
+	if p.average > 0 && p.count >= MinSpikeRequests && float64(p.count) > p.average*float64(config.AnomalySpike) {
+		found = append(found, d.found(p, AnomalyRequestSpike, principal, now, AuditDetail{"requests": p.count, "average": p.average},
+			"%s made %d requests in a minute, against an average of %.0f", principal, p.count, p.average))
+	}
+	d.mu.Unlock()
+
+	d.report(found)
+}
+
+func (d *AnomalyDetector) recordExport(principal, certid string, now time.Time) {
+	config := Config()
+	var found []*Anomaly
+
+	d.mu.Lock()
+	p := d.pattern(principal, now)
+	recent := p.exports[:0]
+	for _, t := range p.exports {
+		if now.Sub(t) < time.Duration(config.AnomalyWindow) {
+			recent = append(recent, t)
+		}
+	}
+	p.exports = append(recent, now)
+	if len(p.exports) > config.AnomalyExports {
+		found = append(found, d.found(p, AnomalyBulkExport, principal, now, AuditDetail{"exports": len(p.exports), "cert": certid},
+			"%s exported %d private keys in %s", principal, len(p.exports), time.Duration(config.AnomalyWindow)))
+	}
+	d.mu.Unlock()
+
+	d.report(found)
+}
+
+// Get a principal's access pattern, creating it if need be. Called with the lock held.
+func (d *AnomalyDetector) pattern(principal string, now time.Time) *accessPattern {
+	if now.Sub(d.lastPrune) > time.Hour {
+		for key, p := range d.principals {
+			if now.Sub(p.lastSeen) > anomalyMemory {
+				delete(d.principals, key)
+			}
+		}
+		d.lastPrune = now
+	}
+	p, ok := d.principals[principal]
+	if !ok {
+		p = &accessPattern{networks: make(map[string]bool), lastAlerted: make(map[string]time.Time)}
+		d.principals[principal] = p
+	}
+	p.lastSeen = now
+	return p
+}
+
+// Note an anomaly, unless the same kind was noted for the principal within the anomaly window.
+// Returns nil if the anomaly was a repeat. Called with the lock held.
+func (d *AnomalyDetector) found(p *accessPattern, kind, principal string, now time.Time, detail AuditDetail, format string, args ...interface{}) *Anomaly {
+	if last, ok := p.lastAlerted[kind]; ok && now.Sub(last) < time.Duration(Config().AnomalyWindow) {
+		return nil
+	}
+	p.lastAlerted[kind] = now
+	anomaly := &Anomaly{
+		Type:      kind,
+		Principal: principal,
+		Time:      NewUTCTime(now),
+		Detail:    detail,
+		Text:      fmt.Sprintf("certstore: "+format, args...),
+	}
+	d.recent = append(d.recent, anomaly)
+	if len(d.recent) > recentAnomalies {
+		d.recent = d.recent[len(d.recent)-recentAnomalies:]
+	}
+	return anomaly
+}
+
+func (d *AnomalyDetector) report(found []*Anomaly) {
+	for _, anomaly := range found {
+		if anomaly != nil {
+			log.Println("Anomaly:", anomaly.Text)
+			d.notify(anomaly)
+		}
+	}
+}
+
+// Get the most recent anomalies, newest first
+func (d *AnomalyDetector) Recent() []*Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	recent := make([]*Anomaly, len(d.recent))
+	for i, anomaly := range d.recent {
+		recent[len(d.recent)-1-i] = anomaly
+	}
+	return recent
+}
+
+var anomalyClient = &http.Client{Timeout: 10 * time.Second}
+
+// Record an anomaly in the audit log, and post it to the webhook if there is one (or capture it, in a sandbox).
+// Both happen in the background, and posting to the webhook is not retried.
+func sendAnomaly(anomaly *Anomaly) {
+	body, err := json.Marshal(anomaly)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go func() {
+		err := DatabaseCreateAudit(context.Background(), &AuditEntry{
+			Action: AuditActionAnomaly,
+			Detail: AuditDetail{"type": anomaly.Type, "principal": anomaly.Principal, "detail": anomaly.Detail},
+			Reason: anomaly.Text,
+		})
+		if err != nil {
+			log.Println(err)
+		}
+
+		if OptAnomalyWebhook == "" {
+			return
+		}
+		if OptSandbox {
+			Outbox.Capture("webhook", OptAnomalyWebhook, body)
+			return
+		}
+		res, err := anomalyClient.Post(OptAnomalyWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			// The webhook URL is a secret (Slack's are), so don't log it
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			log.Println("Unable to send anomaly to webhook:", err)
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			log.Println("Unable to send anomaly to webhook:", res.Status)
+		}
+	}()
+}
+
+// Middleware that records every request with the anomaly detector
+func AnomalyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Anomalies.RecordRequest(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ListAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, Anomalies.Recent())
+}
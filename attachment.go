@@ -0,0 +1,58 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Attachment names are used in URLs and in Content-Disposition headers, so they are kept simple
+const MaxAttachmentNameLength = 100
+
+var (
+	ErrInvalidAttachmentName = NewError("invalid-attachment-name", http.StatusBadRequest, "Invalid attachment name. Names may only contain letters, digits, '.', '-' and '_', and may not start with '.'.")
+	ErrInvalidAttachmentType = NewError("invalid-attachment-type", http.StatusUnsupportedMediaType, "This type of file may not be attached to a certificate.")
+	ErrAttachmentTooLarge    = NewError("attachment-too-large", http.StatusRequestEntityTooLarge, "The attachment is too large.")
+	ErrTooManyAttachments    = NewError("too-many-attachments", http.StatusConflict, "The certificate has too many attachments. Delete one before adding another.")
+)
+
+// An Attachment is a small file kept with one user's copy of a certificate, such as the CSR it was issued for,
+// the CA's response or a reference to the invoice. Attachments are not shared by grants. They move with the
+// certificate when it is transferred, and are deleted with it.
+type Attachment struct {
+	CertId  string     `json:"cert"`
+	UserId  string     `json:"user"`
+	Name    string     `json:"name"`
+	Type    string     `json:"type"` // Media type, as given by the client when the file was attached
+	Size    int        `json:"size"` // Size in bytes
+	Created UTCTime    `json:"created"`
+	Data    StoredBlob `json:"-"`
+}
+
+// Validate an attachment name
+func ValidateAttachmentName(name string) error {
+	if name == "" || len(name) > MaxAttachmentNameLength || name[0] == '.' {
+		return ErrInvalidAttachmentName
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return ErrInvalidAttachmentName
+		}
+	}
+	return nil
+}
+
+// Normalize a media type (from a Content-Type header) and check that it may be attached.
+// Parameters such as charset are kept.
+func NormalizeAttachmentType(contentType string, config *RuntimeConfig) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", ErrInvalidAttachmentType
+	}
+	for _, allowed := range config.AttachmentTypes {
+		if strings.EqualFold(mediaType, allowed) {
+			return mime.FormatMediaType(mediaType, params), nil
+		}
+	}
+	return "", ErrInvalidAttachmentType
+}
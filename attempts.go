@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The longest a failed attempt is delayed by
+const MaxAuthDelay = 8 * time.Second
+
+var (
+	ErrTooManyAttempts = NewError("too-many-attempts", http.StatusTooManyRequests, "Too many failed attempts. Please wait before trying again.")
+)
+
+// An AttemptLimiter tracks failed authentication attempts by key, such as "ip:192.0.2.1" or "user:alice".
+// Each failure is answered more slowly than the last, and a key with too many recent failures is locked out for a while.
+type AttemptLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*attemptState
+	failures int64 // Failures since the process started
+	lockouts int64 // Lockouts since the process started
+}
+
+type attemptState struct {
+	failures    int
+	first       time.Time // The first failure in the current window
+	lockedUntil time.Time
+}
+
+// Counts of failed attempts, and the keys that are locked out now
+type AttemptStats struct {
+	Failures int64        `json:"failures"`
+	Lockouts int64        `json:"lockouts"`
+	Locked   []*LockedKey `json:"locked"`
+	Tracked  int          `json:"tracked"` // Keys with recent failures
+}
+
+type LockedKey struct {
+	Key   string  `json:"key"`
+	Until UTCTime `json:"until"`
+}
+
+// AuthAttempts tracks failed attempts at every kind of authentication in this process
+var AuthAttempts = NewAttemptLimiter()
+
+func NewAttemptLimiter() *AttemptLimiter {
+	return &AttemptLimiter{attempts: make(map[string]*attemptState)}
+}
+
+// Check if any of the keys are locked out, and for how long
+func (l *AttemptLimiter) Locked(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := Now()
+	var longest time.Duration
+	for _, key := range keys {
+		if state, ok := l.attempts[key]; ok && now.Before(state.lockedUntil) {
+			if wait := state.lockedUntil.Sub(now); wait > longest {
+				longest = wait
+			}
+		}
+	}
+	return longest
+}
+
+// Record a failed attempt against each key. Returns how long to delay the response by,
+// and the keys that this failure locked out.
+func (l *AttemptLimiter) Fail(config *RuntimeConfig, keys ...string) (time.Duration, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := Now()
+	l.failures++
+
+	var delay time.Duration
+	var locked []string
+	for _, key := range keys {
+		state, ok := l.attempts[key]
+		if !ok || now.Sub(state.first) > time.Duration(config.AuthFailureWindow) {
+			state = &attemptState{first: now}
+			l.attempts[key] = state
+		}
+		state.failures++
+		if state.failures >= config.AuthMaxFailures && !now.Before(state.lockedUntil) {
+			state.lockedUntil = now.Add(time.Duration(config.AuthLockout))
+			l.lockouts++
+			locked = append(locked, key)
+		}
+
+		// Double the delay with each failure
+		keyDelay := MaxAuthDelay
+		if state.failures <= 16 {
+			keyDelay = time.Duration(config.AuthDelay) << uint(state.failures-1)
+		}
+		if keyDelay > MaxAuthDelay {
+			keyDelay = MaxAuthDelay
+		}
+		if keyDelay > delay {
+			delay = keyDelay
+		}
+	}
+
+	l.forgetExpired(config, now)
+	return delay, locked
+}
+
+// Record a successful attempt, clearing the failures against each key
+func (l *AttemptLimiter) Succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.attempts, key)
+	}
+}
+
+// Get the number of failures and lockouts, and the keys that are locked out now
+func (l *AttemptLimiter) Stats() *AttemptStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := Now()
+	stats := &AttemptStats{Failures: l.failures, Lockouts: l.lockouts, Locked: []*LockedKey{}, Tracked: len(l.attempts)}
+	for key, state := range l.attempts {
+		if now.Before(state.lockedUntil) {
+			stats.Locked = append(stats.Locked, &LockedKey{key, NewUTCTime(state.lockedUntil)})
+		}
+	}
+	sort.Slice(stats.Locked, func(i, j int) bool { return stats.Locked[i].Key < stats.Locked[j].Key })
+	return stats
+}
+
+// Forget keys that are neither locked out nor have recent failures. Called with the lock held.
+func (l *AttemptLimiter) forgetExpired(config *RuntimeConfig, now time.Time) {
+	for key, state := range l.attempts {
+		if now.Sub(state.first) > time.Duration(config.AuthFailureWindow) && !now.Before(state.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// The key for a client's address. Requests aren't expected to come through a proxy, so the connection's address is used.
+func ClientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Reject a request if any of its keys are locked out. Returns false if the request was rejected.
+func allowAttempt(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	wait := AuthAttempts.Locked(keys...)
+	if wait == 0 {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	HandleError(w, r, ErrTooManyAttempts, 0)
+	return false
+}
+
+// Record a failed authentication attempt, and delay the response to it. Lockouts are logged and audited.
+func failedAttempt(r *http.Request, action string, keys ...string) {
+	delay, locked := AuthAttempts.Fail(Config(), keys...)
+	for _, key := range locked {
+		log.Println("Locked out", key, "after too many failed attempts at", action)
+		err := DatabaseCreateAudit(r.Context(), &AuditEntry{
+			Action: AuditActionAuthLockout,
+			Detail: AuditDetail{"key": key, "authentication": action},
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+	}
+}
+
+func ListAuthAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, AuthAttempts.Stats())
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	AuditActionTransferCerts = "transfer-certs"
+	AuditActionMergeUsers    = "merge-users"
+	AuditActionDeleteUser    = "delete-user"
+	AuditActionCreateCert    = "create-cert"
+	AuditActionUpdateCert    = "update-cert"
+	AuditActionDeleteCert    = "delete-cert"
+	AuditActionRevokeCert    = "revoke-cert" // Found on its CRL (see crl.go)
+	AuditActionMintCert      = "mint-cert"   // The detail gives the certificate that minted it (see mint.go)
+	AuditActionCreateBatch   = "create-provision-batch"
+	AuditActionExportBatch   = "export-provision-batch"
+	AuditActionDeleteBatch   = "delete-provision-batch"
+	AuditActionApproveCSR    = "approve-csr"
+	AuditActionDenyCSR       = "deny-csr" // Not tied to a user: the detail gives the CSR (see csrqueue.go)
+	AuditActionCreateDomain  = "create-domain"
+	AuditActionVerifyDomain  = "verify-domain"
+	AuditActionDeleteDomain  = "delete-domain"
+	AuditActionSaveTemplate  = "save-template"
+	AuditActionDropTemplate  = "delete-template"
+	AuditActionNewCampaign   = "create-campaign" // Not tied to a user: the detail gives the campaign (see campaign.go)
+	AuditActionEditCampaign  = "update-campaign"
+	AuditActionEndCampaign   = "delete-campaign" // Not tied to a user
+	AuditActionAttach        = "create-attachment"
+	AuditActionDetach        = "delete-attachment"
+	AuditActionTrustRoot     = "create-trust-root" // Not tied to a user: the detail gives the certificate (see trustroots.go)
+	AuditActionDistrustRoot  = "delete-trust-root" // Not tied to a user
+	AuditActionExportKey     = "export-key"
+	AuditActionDownloadKey   = "download-key"
+	AuditActionImpersonate   = "impersonate-user" // The detail gives the administrator, as for the two below (see impersonation.go)
+	AuditActionUnimpersonate = "end-impersonation"
+	AuditActionImpersonated  = "impersonated-request"
+	AuditActionAuthLockout   = "auth-lockout" // Not tied to a user: the detail gives the locked out key
+	AuditActionAnomaly       = "anomaly"      // Not tied to a user: the detail gives the anomaly (see anomaly.go)
+)
+
+// The header clients use to say why they are making a change
+const ChangeReasonHeader = "X-Change-Reason"
+
+var (
+	ErrInvalidAuditDetail = NewError("invalid-audit-detail", http.StatusInternalServerError, "Unable to read audit record detail from the database.")
+	ErrMissingReason      = NewError("missing-change-reason", http.StatusBadRequest, "A reason for the change is required. Please set the X-Change-Reason header.")
+	ErrReasonTooLong      = NewError("change-reason-too-long", http.StatusBadRequest, "The reason for the change is too long.")
+)
+
+// An AuditEntry records a change made to the store. Audit entries are never updated or deleted, and they
+// outlive the users and certificates they refer to, so the ids are not foreign keys.
+type AuditEntry struct {
+	Id       int64       `json:"id"`
+	Time     UTCTime     `json:"time"`
+	Action   string      `json:"action"`
+	UserId   string      `json:"user"`   // The user the action was performed on
+	TargetId string      `json:"target"` // For actions involving two users, the other user. Otherwise empty.
+	CertId   string      `json:"cert"`   // For actions on a single certificate, the certificate. Otherwise empty.
+	Detail   AuditDetail `json:"detail"`
+	Reason   string      `json:"reason"`   // Why the change was made, if the client said
+	PrevHash string      `json:"prevHash"` // The hash of the entry before (see auditchain.go)
+	Hash     string      `json:"hash"`
+}
+
+// Redact secrets from the entry before it is recorded. A client may paste anything into a change reason.
+func (entry *AuditEntry) Redact() {
+	entry.Reason = Redact(entry.Reason)
+	for key, value := range entry.Detail {
+		entry.Detail[key] = redactValue(value)
+	}
+}
+
+// Get the reason the client gave for a change, from the X-Change-Reason header.
+// If the RequireReason option is set, a reason must be given.
+func ChangeReason(r *http.Request) (string, error) {
+	config := Config()
+	reason := norm.NFC.String(strings.TrimSpace(r.Header.Get(ChangeReasonHeader)))
+	if reason == "" && config.RequireReason {
+		return "", ErrMissingReason
+	}
+	if utf8.RuneCountInString(reason) > config.MaxReasonLength {
+		return "", ErrReasonTooLong
+	}
+	return reason, nil
+}
+
+// AuditDetail holds action-specific detail for an audit entry. It is stored as JSON.
+type AuditDetail map[string]interface{}
+
+// Value implements driver.Valuer for writing to the database.
+func (d AuditDetail) Value() (driver.Value, error) {
+	if d == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(d)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (d *AuditDetail) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*d = nil
+		return nil
+	default:
+		return ErrInvalidAuditDetail
+	}
+	return json.Unmarshal(data, d)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrTimestampRejected        = NewError("timestamp-rejected", http.StatusBadGateway, "The timestamp authority did not grant a timestamp.")
+	ErrInvalidTimestampResponse = NewError("invalid-timestamp-response", http.StatusBadGateway, "The timestamp authority sent an invalid response.")
+)
+
+// The advisory lock held while chaining an audit entry
+const auditLockKey = "7261746500"
+
+// Audit entries are chained: each entry's hash covers the entry and the hash of the entry before it, so changing
+// or deleting an entry breaks the chain from there on. Entries written before chaining have no hash and can't be
+// checked. Deleting the newest entries doesn't break the chain, which is what anchoring (see AnchorAuditLog) is for.
+
+// Chain an audit entry to the entry before it, filling in its time and hash. The detail is normalized to what
+// the database gives back, so the hash can be checked against what is stored.
+func chainAuditEntry(entry *AuditEntry, prevHash string, now time.Time) error {
+	detail, err := json.Marshal(entry.Detail)
+	if err != nil {
+		return err
+	}
+	normalized := AuditDetail{}
+	err = json.Unmarshal(detail, &normalized)
+	if err != nil {
+		return err
+	}
+	entry.Detail = normalized
+	entry.PrevHash = prevHash
+	entry.Time = NewUTCTime(now.Truncate(time.Microsecond)) // Timestamps are stored to the microsecond
+	entry.Hash, err = entry.ComputeHash()
+	return err
+}
+
+// Compute the hash of an audit entry. Everything but the id is covered: ids come from a sequence, which may skip.
+func (entry *AuditEntry) ComputeHash() (string, error) {
+	detail := entry.Detail
+	if detail == nil {
+		detail = AuditDetail{}
+	}
+	data, err := json.Marshal([]interface{}{
+		entry.PrevHash,
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.Action,
+		entry.UserId,
+		entry.TargetId,
+		entry.CertId,
+		detail,
+		entry.Reason,
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// The result of checking the audit chain
+type AuditVerification struct {
+	Valid     bool           `json:"valid"`
+	Entries   int            `json:"entries"`            // Chained entries checked
+	Unchained int            `json:"unchained"`          // Entries from before chaining, which can't be checked
+	BrokenAt  int64          `json:"brokenAt,omitempty"` // The first entry that doesn't match the chain
+	LastHash  string         `json:"lastHash"`
+	Anchors   []*AuditAnchor `json:"anchors"`
+	anchors   map[int64][]*AuditAnchor
+	prevHash  string
+}
+
+// An AuditAnchor is a timestamp from an RFC 3161 timestamp authority over the hash of an audit entry. It proves
+// the chain up to the entry existed at that time. The token can be checked with "openssl ts -verify".
+type AuditAnchor struct {
+	Id      int64   `json:"id"`
+	AuditId int64   `json:"audit"`
+	Hash    string  `json:"hash"`
+	Time    UTCTime `json:"time"`
+	Token   []byte  `json:"token"`        // DER encoded TimeStampToken
+	Valid   bool    `json:"valid" db:"-"` // Does the anchored entry still have this hash?
+}
+
+func NewAuditVerification(anchors []*AuditAnchor) *AuditVerification {
+	v := &AuditVerification{Valid: true, Anchors: anchors, anchors: make(map[int64][]*AuditAnchor)}
+	for _, anchor := range anchors {
+		v.anchors[anchor.AuditId] = append(v.anchors[anchor.AuditId], anchor)
+	}
+	return v
+}
+
+// Check the next audit entry, in order of id
+func (v *AuditVerification) Add(entry *AuditEntry) {
+	if entry.Hash == "" && v.Entries == 0 {
+		v.Unchained++
+		return
+	}
+	v.Entries++
+	hash, err := entry.ComputeHash()
+	if entry.Hash == "" || entry.PrevHash != v.prevHash || err != nil || hash != entry.Hash {
+		if v.Valid {
+			v.Valid = false
+			v.BrokenAt = entry.Id
+		}
+	}
+	for _, anchor := range v.anchors[entry.Id] {
+		anchor.Valid = v.Valid && anchor.Hash == entry.Hash
+	}
+	v.prevHash = entry.Hash
+	v.LastHash = entry.Hash
+}
+
+// Finish checking. An anchor whose entry has gone means the chain was cut short.
+func (v *AuditVerification) Finish() {
+	for _, anchor := range v.Anchors {
+		if !anchor.Valid && v.Valid {
+			v.Valid = false
+		}
+	}
+}
+
+// RFC 3161 timestamp requests and responses
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional,default:false"`
+}
+
+type tsaStatus struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type tsaResponse struct {
+	Status         tsaStatus
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+// Build an RFC 3161 timestamp request for an audit entry's hash. The hash is already a SHA256 digest,
+// so it is the message imprint.
+func newTimestampRequest(hash string) ([]byte, error) {
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(tsaRequest{
+		Version: 1,
+		MessageImprint: tsaMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+}
+
+// Get the timestamp token from an RFC 3161 timestamp response
+func parseTimestampResponse(data []byte) ([]byte, error) {
+	var res tsaResponse
+	_, err := asn1.Unmarshal(data, &res)
+	if err != nil {
+		return nil, ErrInvalidTimestampResponse
+	}
+	// 0 is granted, 1 is granted with modifications
+	if res.Status.Status != 0 && res.Status.Status != 1 {
+		return nil, ErrTimestampRejected
+	}
+	if len(res.TimeStampToken.FullBytes) == 0 {
+		return nil, ErrInvalidTimestampResponse
+	}
+	return res.TimeStampToken.FullBytes, nil
+}
+
+var timestampClient = &http.Client{Timeout: 30 * time.Second}
+
+// Get a timestamp for a hash from the OptTimestampAuthority
+func requestTimestamp(hash string) ([]byte, error) {
+	req, err := newTimestampRequest(hash)
+	if err != nil {
+		return nil, err
+	}
+	res, err := timestampClient.Post(OptTimestampAuthority, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrTimestampRejected
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseTimestampResponse(body)
+}
+
+// Anchor the audit chain with a timestamp every interval, if OptTimestampAuthority is set and this isn't a sandbox or a
+// standby. Nothing is anchored if no entries have been written since the last anchor.
+func AnchorAuditLog(interval time.Duration) {
+	if OptTimestampAuthority == "" || OptSandbox {
+		return
+	}
+	for {
+		<-clock.After(interval)
+		if Replica.Standby() {
+			continue
+		}
+		entry, err := DatabaseReadLastAudit()
+		if err != nil {
+			log.Println("Unable to anchor audit log:", err)
+			continue
+		}
+		if entry == nil || entry.Hash == "" {
+			continue
+		}
+		last, err := DatabaseReadLastAuditAnchor()
+		if err != nil {
+			log.Println("Unable to anchor audit log:", err)
+			continue
+		}
+		if last != nil && last.AuditId == entry.Id {
+			continue
+		}
+		token, err := requestTimestamp(entry.Hash)
+		if err != nil {
+			log.Println("Unable to anchor audit log:", err)
+			continue
+		}
+		err = DatabaseCreateAuditAnchor(&AuditAnchor{AuditId: entry.Id, Hash: entry.Hash, Token: token})
+		if err != nil {
+			log.Println("Unable to anchor audit log:", err)
+		}
+	}
+}
+
+func VerifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	verification, err := DatabaseVerifyAudit()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, verification)
+}
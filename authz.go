@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPolicyDenied      = NewError("policy-denied", http.StatusForbidden, "The authorization policy does not allow this request.")
+	ErrPolicyUnavailable = NewError("policy-unavailable", http.StatusServiceUnavailable, "The authorization policy could not be checked. Try again later.")
+	ErrInvalidPolicyURL  = NewError("invalid-policy-url", http.StatusBadRequest, "Invalid policy URL. It must be an http:// or https:// URL of an OPA decision, such as http://localhost:8181/v1/data/certstore/allow.")
+)
+
+// Authorization policies are written in Rego and evaluated by an Open Policy Agent server, through its Data API:
+// each request is posted to OptPolicyURL as {"input": <AuthzInput>}. The decision is either a boolean, or an
+// object such as {"allow": false, "reason": "..."}. A policy can only deny what certstore would otherwise allow.
+//
+// For example, to stop private keys being exported outside office hours:
+//
+//	package certstore
+//	default allow = true
+//	allow = false { endswith(input.route, "/key/export"); time.clock(time.now_ns())[0] >= 18 }
+//
+// If OPA can't be reached, requests are refused unless OptPolicyFailOpen is set.
+
+// AuthzInput is what a policy decides on
+type AuthzInput struct {
+	Method        string              `json:"method"`
+	Path          string              `json:"path"`
+	Route         string              `json:"route"`                   // The route's path template, such as /user/{user-id}/cert/{cert-id}
+	Principal     string              `json:"principal"`               // Who is asking: a token, an administrator or an address (see RequestPrincipal)
+	Impersonation *Impersonation      `json:"impersonation,omitempty"` // The administrator acting as a user, if one is (see impersonation.go)
+	Org           string              `json:"org"`                     // Always empty for now, so policies can be written ahead of it
+	Resource      AuthzResource       `json:"resource"`
+	Query         map[string][]string `json:"query"`
+	Sandbox       bool                `json:"sandbox"`
+}
+
+// The resource a request is about, from its route
+type AuthzResource struct {
+	Type       string `json:"type"` // "user", "cert", "attachment", "grant", "shared-cert", "domain", "template", "export", "csr", "admin" or "api"
+	UserId     string `json:"user,omitempty"`
+	CertId     string `json:"cert,omitempty"`
+	GranteeId  string `json:"grantee,omitempty"`
+	Attachment string `json:"attachment,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	Template   string `json:"template,omitempty"`
+}
+
+// Describe the resource a route is about
+func routeResource(route string, vars map[string]string) AuthzResource {
+	resource := AuthzResource{
+		UserId:     vars["user-id"],
+		CertId:     vars["cert-id"],
+		GranteeId:  vars["grantee-id"],
+		Attachment: vars["name"],
+		Domain:     vars["domain"],
+		Template:   vars["template"],
+	}
+	switch {
+	case strings.HasPrefix(route, "/admin"):
+		resource.Type = "admin"
+	case strings.HasPrefix(route, "/export/"):
+		resource.Type = "export"
+	case strings.HasPrefix(route, "/csr"):
+		resource.Type = "csr"
+	case strings.Contains(route, "/attachment"):
+		resource.Type = "attachment"
+	case strings.Contains(route, "/grant"):
+		resource.Type = "grant"
+	case strings.Contains(route, "/shared"):
+		resource.Type = "shared-cert"
+	case strings.Contains(route, "/domain"):
+		resource.Type = "domain"
+	case strings.Contains(route, "/template"):
+		resource.Type = "template"
+	case strings.Contains(route, "/cert"):
+		resource.Type = "cert"
+	case strings.HasPrefix(route, "/user"):
+		resource.Type = "user"
+	default:
+		resource.Type = "api"
+	}
+	return resource
+}
+
+// Build the policy input for a request
+func NewAuthzInput(r *http.Request) *AuthzInput {
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+	return &AuthzInput{
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Route:         route,
+		Principal:     RequestPrincipal(r),
+		Impersonation: RequestImpersonation(r),
+		Resource:      routeResource(route, mux.Vars(r)),
+		Query:         r.URL.Query(),
+		Sandbox:       OptSandbox,
+	}
+}
+
+// A decision from OPA
+type authzDecision struct {
+	Allow  bool
+	Reason string
+}
+
+func (d *authzDecision) UnmarshalJSON(data []byte) error {
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err := json.Unmarshal(data, &response)
+	if err != nil {
+		return err
+	}
+	// A policy that isn't loaded gives no result. That is a mistake, not a denial.
+	if len(response.Result) == 0 {
+		return ErrPolicyUnavailable
+	}
+	if json.Unmarshal(response.Result, &d.Allow) == nil {
+		return nil
+	}
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	err = json.Unmarshal(response.Result, &result)
+	if err != nil {
+		return ErrPolicyUnavailable
+	}
+	d.Allow, d.Reason = result.Allow, result.Reason
+	return nil
+}
+
+var policyClient = &http.Client{Timeout: 2 * time.Second}
+
+// Ask OPA for a decision on a request
+func evaluatePolicy(input *AuthzInput) (*authzDecision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	res, err := policyClient.Post(OptPolicyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrPolicyUnavailable
+	}
+	decision := new(authzDecision)
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(decision)
+	if err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+// Middleware that checks each request against the authorization policy, if there is one. It is used on the
+// router, so the matched route is known.
+func AuthorizationPolicyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if OptPolicyURL == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		input := NewAuthzInput(r)
+		decision, err := evaluatePolicy(input)
+		if err != nil {
+			log.Println("Unable to check authorization policy:", err)
+			if !OptPolicyFailOpen {
+				w.Header().Set("Content-Type", "application/json")
+				HandleError(w, r, ErrPolicyUnavailable, 0)
+				return
+			}
+		} else if !decision.Allow {
+			log.Println("Authorization policy denied", input.Principal, input.Method, input.Route+":", decision.Reason)
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrPolicyDenied, 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Validate the policy options, which need a restart to change
+func validatePolicyOptions() error {
+	if OptPolicyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(OptPolicyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidPolicyURL
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key types an auto-approval rule can allow
+const (
+	RuleKeyTypeRSA = "rsa"
+	RuleKeyTypeEC  = "ec"
+)
+
+var (
+	ErrInvalidApprovalRule = NewError("invalid-approval-rule", http.StatusBadRequest, "Invalid auto-approval rule. Rules need a unique name and at least one domain, given as a lower case DNS name.")
+)
+
+// Most CSRs submitted for approval (see csrqueue.go) are routine: a team asking for names under the subdomain
+// delegated to it, with a key that meets the policy. Auto-approval rules, in the CSRAutoApprove option, let those be
+// issued as soon as they are submitted. A CSR matching any rule is approved, by the rule: every DNS name, and the
+// common name if it has one, must be one of the rule's domains or under one, and the key must be of a type the rule
+// allows and at least as long as it asks (and never shorter than the MinimumRSABits and MinimumECBits options).
+// CSRs with IP addresses, email addresses or URIs never match, since rules only delegate DNS names. Everything else
+// waits for an administrator, as do CSRs that match but can't be issued, such as when the CA certificate has expired,
+// CSRs the domain policy rejects (see domains.go), and CSRs their names' CAA records forbid (see caa.go).
+//
+// Auto-approvals are audited like any other approval, decided by "rule:<name>". Rules are configured server-wide.
+
+// A rule for approving CSRs without review
+type CSRApprovalRule struct {
+	Name       string   `json:"name"`
+	Domains    []string `json:"domains"`    // DNS names covered, with every name under them. "example.com" covers "a.example.com" and "*.example.com".
+	KeyTypes   []string `json:"keyTypes"`   // "rsa" and "ec". Empty for either.
+	MinRSABits int      `json:"minRSABits"` // Zero for the MinimumRSABits option
+	MinECBits  int      `json:"minECBits"`  // Zero for the MinimumECBits option
+}
+
+// Check if a DNS name, or a wildcard, is one of the rule's domains or under one
+func (rule *CSRApprovalRule) covers(name string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range rule.Domains {
+		if domainCovers(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the rule allows a key type
+func (rule *CSRApprovalRule) allowsKeyType(keyType string) bool {
+	if len(rule.KeyTypes) == 0 {
+		return true
+	}
+	for _, t := range rule.KeyTypes {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a CSR meets the rule
+func (rule *CSRApprovalRule) Matches(csr *x509.CertificateRequest, config *RuntimeConfig) bool {
+	if len(csr.DNSNames) == 0 || len(csr.IPAddresses)+len(csr.EmailAddresses)+len(csr.URIs) != 0 {
+		return false
+	}
+	if csr.Subject.CommonName != "" && !rule.covers(csr.Subject.CommonName) {
+		return false
+	}
+	for _, name := range csr.DNSNames {
+		if !rule.covers(name) {
+			return false
+		}
+	}
+
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rule.allowsKeyType(RuleKeyTypeRSA) && key.N.BitLen() >= rule.MinRSABits && key.N.BitLen() >= config.MinimumRSABits
+	case *ecdsa.PublicKey:
+		bits := key.Curve.Params().BitSize
+		return rule.allowsKeyType(RuleKeyTypeEC) && bits >= rule.MinECBits && bits >= config.MinimumECBits
+	}
+	return false
+}
+
+// Find the first rule a CSR meets, if any
+func MatchApprovalRule(csr *x509.CertificateRequest, config *RuntimeConfig) *CSRApprovalRule {
+	for _, rule := range config.CSRAutoApprove {
+		if rule.Matches(csr, config) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Approve a newly queued CSR if it meets a rule, issuing its certificate. If it can't be issued, it is left waiting
+// for an administrator.
+func AutoApproveCSR(q *QueuedCSR, config *RuntimeConfig, now time.Time) error {
+	if config.CSRIssuer == nil {
+		return nil
+	}
+	csr, err := q.parse()
+	if err != nil {
+		return err
+	}
+	rule := MatchApprovalRule(csr, config)
+	if rule == nil {
+		return nil
+	}
+
+	parent, err := DatabaseReadKey(config.CSRIssuer.UserId, config.CSRIssuer.CA)
+	if err != nil {
+		return err
+	}
+	approved := *q
+	err = checkQueuedCSRCAA(&approved, config)
+	if errors.Is(err, ErrCAAForbidden) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = IssueQueuedCSR(&approved, parent, &CSRApproval{}, config.CSRIssuer, now)
+	if err != nil {
+		return err
+	}
+	_, err = checkQueuedCSRDomains(&approved, config.CSRIssuer, config)
+	if errors.Is(err, ErrNameOutsideDomains) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	approved.DecidedBy = "rule:" + rule.Name
+	err = DatabaseDecideCSR(context.Background(), &approved, parent)
+	if err != nil {
+		return err
+	}
+	*q = approved
+	Usage.Record(parent.UserId, UsageCertsCreated, 1)
+	return nil
+}
+
+// Validate the auto-approval rules
+func validateApprovalRules(rules []*CSRApprovalRule, errs *ValidationErrors) {
+	names := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		field := "csrAutoApprove[" + strconv.Itoa(i) + "]"
+		if rule == nil || rule.Name == "" || names[rule.Name] || len(rule.Domains) == 0 || rule.MinRSABits < 0 || rule.MinECBits < 0 {
+			errs.Add(field, ErrInvalidApprovalRule)
+			continue
+		}
+		names[rule.Name] = true
+		for _, domain := range rule.Domains {
+			if !isDNSName(domain) {
+				errs.Add(field+".domains", ErrInvalidApprovalRule)
+			}
+		}
+		for _, keyType := range rule.KeyTypes {
+			if keyType != RuleKeyTypeRSA && keyType != RuleKeyTypeEC {
+				errs.Add(field+".keyTypes", ErrInvalidApprovalRule)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a CAA lookup may take, for each name looked up
+const caaLookupTimeout = 5 * time.Second
+
+// The CAA resource record type (RFC 8659)
+const dnsTypeCAA = dnsmessage.Type(257)
+
+// The CAA flag marking a property a CA must understand to issue
+const caaFlagCritical = 128
+
+var (
+	ErrCAAForbidden    = NewError("caa-forbidden", http.StatusBadRequest, "A name's DNS CAA records don't allow this CA to issue certificates for it.")
+	ErrCAALookupFailed = NewError("caa-lookup-failed", http.StatusServiceUnavailable, "A name's DNS CAA records couldn't be looked up, so no certificate was issued. Try again later.")
+)
+
+// Before the built-in CA issues a certificate (minting, and approving a CSR, whether by an administrator or a rule)
+// the DNS CAA records of each of its DNS names are checked, as RFC 8659 asks of public CAs. A name's relevant record
+// set is the first found climbing from the name towards the root. If there is none, any CA may issue. Otherwise an
+// "issue" property (or "issuewild" for a wildcard, if there are any) must name one of the CA's identities, given by
+// the CAAIdentities option, and no critical property may be one this CA doesn't understand. A lookup that fails
+// refuses issuance rather than allowing it. The records each name was checked against are audited with the issuance.
+//
+// CAA checking is off while the CAAIdentities option is empty. Records are looked up from the CAAResolver option's
+// DNS server, or else the system's, which should validate DNSSEC: the records aren't validated here. IP addresses and
+// other names aren't in DNS, so they aren't checked.
+
+// A CAA record
+type CAARecord struct {
+	Flags uint8
+	Tag   string // Lower case
+	Value string
+}
+
+// The CAA check of one name, as audited with its issuance
+type CAAResult struct {
+	Name    string   `json:"name"`
+	Domain  string   `json:"domain,omitempty"`  // Where the relevant record set was found. Empty if there was none.
+	Records []string `json:"records,omitempty"` // The relevant record set, as in a zone file
+}
+
+// Looks up a name's CAA records from a DNS server. Replaced in tests.
+var lookupCAA = dnsLookupCAA
+
+// Write a record as in a zone file, such as: 0 issue "ca.example.net"
+func (r *CAARecord) String() string {
+	return strconv.Itoa(int(r.Flags)) + " " + r.Tag + " " + strconv.Quote(r.Value)
+}
+
+// The DNS server CAA records are looked up from: the configured one, or the system's first nameserver
+func caaResolver(config *RuntimeConfig) string {
+	if config.CAAResolver != "" {
+		return config.CAAResolver
+	}
+	resolvConf, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(resolvConf), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Look up a name's CAA records, over UDP, or TCP if the answer doesn't fit. A name that doesn't exist has none.
+func dnsLookupCAA(resolver, name string) ([]*CAARecord, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsTypeCAA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := dnsExchange("udp", resolver, packed)
+	if err != nil {
+		return nil, err
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err == nil && header.Truncated {
+		response, err = dnsExchange("tcp", resolver, packed)
+		if err != nil {
+			return nil, err
+		}
+		header, err = parser.Start(response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header.ID != query.Header.ID || !header.Response {
+		return nil, errors.New("mismatched DNS response for " + name)
+	}
+	if header.RCode == dnsmessage.RCodeNameError {
+		return nil, nil
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, errors.New("CAA lookup for " + name + " failed: " + header.RCode.String())
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*CAARecord
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if answer.Type != dnsTypeCAA {
+			err = parser.SkipAnswer()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		resource, err := parser.UnknownResource()
+		if err != nil {
+			return nil, err
+		}
+		record, err := parseCAARecord(resource.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Send a DNS query and read its response. Over TCP, messages are prefixed by their length.
+func dnsExchange(network, resolver string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, caaLookupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(caaLookupTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "udp" {
+		_, err = conn.Write(query)
+		if err != nil {
+			return nil, err
+		}
+		response := make([]byte, 4096)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:n], nil
+	}
+
+	_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+	if err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Parse a CAA record's data: its flags, the tag's length, the tag, and the value
+func parseCAARecord(data []byte) (*CAARecord, error) {
+	if len(data) < 2 || int(data[1]) == 0 || len(data) < 2+int(data[1]) {
+		return nil, errors.New("invalid CAA record")
+	}
+	tagEnd := 2 + int(data[1])
+	return &CAARecord{Flags: data[0], Tag: strings.ToLower(string(data[2:tagEnd])), Value: string(data[tagEnd:])}, nil
+}
+
+// Find the relevant CAA record set for a DNS name, without any wildcard: the first climbing towards the root. The
+// domain it was found at is empty if there is none.
+func relevantCAA(resolver, name string) (string, []*CAARecord, error) {
+	for domain := name; domain != ""; {
+		records, err := lookupCAA(resolver, domain)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(records) != 0 {
+			return domain, records, nil
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return "", nil, nil
+}
+
+// Do a relevant CAA record set's properties allow a CA with these identities to issue?
+func caaPermits(records []*CAARecord, wildcard bool, identities []string) bool {
+	tag := "issue"
+	for _, record := range records {
+		switch record.Tag {
+		case "issue", "iodef", "issuemail", "issuevmc", "contactemail", "contactphone":
+		case "issuewild":
+			if wildcard {
+				tag = "issuewild"
+			}
+		default:
+			if record.Flags&caaFlagCritical != 0 {
+				return false
+			}
+		}
+	}
+	for _, record := range records {
+		if record.Tag != tag {
+			continue
+		}
+		issuer, _, _ := strings.Cut(record.Value, ";")
+		for _, identity := range identities {
+			if strings.EqualFold(strings.TrimSpace(issuer), identity) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check that the CAA records of a new certificate's names allow it to be issued, returning what each DNS name was
+// checked against. Nothing is checked, and nil returned, if the CAAIdentities option is empty.
+func CheckCAA(names []string, field string, config *RuntimeConfig) ([]*CAAResult, error) {
+	if len(config.CAAIdentities) == 0 {
+		return nil, nil
+	}
+	resolver := caaResolver(config)
+	var results []*CAAResult
+	checked := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		base := strings.TrimPrefix(name, "*.")
+		if checked[name] || net.ParseIP(name) != nil || !isDNSName(base) {
+			continue
+		}
+		checked[name] = true
+
+		domain, records, err := relevantCAA(resolver, base)
+		if err != nil {
+			log.Println("Unable to look up CAA records:", err)
+			return nil, &FieldError{field, ErrCAALookupFailed}
+		}
+		if len(records) != 0 && !caaPermits(records, base != name, config.CAAIdentities) {
+			return nil, &FieldError{field, ErrCAAForbidden}
+		}
+		result := &CAAResult{Name: name, Domain: domain}
+		for _, record := range records {
+			result.Records = append(result.Records, record.String())
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
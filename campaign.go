@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// The states of a certificate in a campaign
+const (
+	CampaignStatusPending    = "pending"
+	CampaignStatusInProgress = "in-progress"
+	CampaignStatusRenewed    = "renewed" // Replaced by a certificate the campaign doesn't select
+	CampaignStatusRetired    = "retired" // Deleted, or no longer needed
+)
+
+// The most certificates one campaign can take on
+const maxCampaignCerts = 10000
+
+// Certificates are selected a batch at a time, as for the compliance report
+const campaignBatchSize = 500
+
+var (
+	ErrInvalidCampaign         = NewError("invalid-campaign", http.StatusBadRequest, "Invalid campaign. Give it a name, and at least one way of selecting certificates.")
+	ErrInvalidCampaignRule     = NewError("invalid-campaign-rule", http.StatusBadRequest, "Unknown compliance rule. Use one of the rules the compliance report gives.")
+	ErrCampaignTooLarge        = NewError("campaign-too-large", http.StatusBadRequest, "The campaign selects too many certificates. At most 10000 can be in one campaign.")
+	ErrInvalidCampaignStatus   = NewError("invalid-campaign-status", http.StatusBadRequest, "Invalid status. Use pending, in-progress, renewed or retired.")
+	ErrInvalidCampaignSelector = NewError("invalid-campaign-selector", http.StatusInternalServerError, "Invalid campaign selector in the database.")
+)
+
+// A renewal campaign coordinates replacing a set of certificates, such as every SHA-1 certificate, or every one
+// expiring in Q3. An administrator creates it with a selector, and the certificates it selects then are the
+// campaign's: certificates uploaded later don't join it. Each certificate has an owner (who is renewing it, empty for
+// the certificate's user), a status and a note, which administrators update as the work goes on. A dry run shows
+// what a campaign would select without creating it.
+//
+// Refreshing a campaign finds the work already done: a certificate that has been deleted is retired, and one whose
+// user has an active certificate for one of the same names, expiring later, that the selector doesn't select, is
+// renewed by it. Refreshes are audited like any other update. A campaign is complete when every certificate in it is
+// renewed or retired. Campaigns aren't replicated to a standby.
+
+// What a campaign selects. A certificate must meet every criterion given.
+type CampaignSelector struct {
+	Rules               []string `json:"rules,omitempty"`               // Compliance rules it breaks, any of them (see compliance.go)
+	SignatureAlgorithms []string `json:"signatureAlgorithms,omitempty"` // As in certificate details, such as "SHA1-RSA"
+	Issuer              string   `json:"issuer,omitempty"`              // As in certificate details' "issuer"
+	ExpiresAfter        UTCTime  `json:"expiresAfter"`
+	ExpiresBefore       UTCTime  `json:"expiresBefore"`
+	IncludeInactive     bool     `json:"includeInactive"` // Otherwise only active certificates are selected
+}
+
+// A renewal campaign, with its progress
+type Campaign struct {
+	Id          string           `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Selector    CampaignSelector `json:"selector"`
+	Due         UTCTime          `json:"due"` // When the certificates should be renewed by. Null for no deadline.
+	Created     UTCTime          `json:"created"`
+	CreatedBy   string           `json:"createdBy"` // The administrator or admin token that created it (see RequestPrincipal)
+	Progress    CampaignProgress `json:"progress" db:"-"`
+	Certs       []*CampaignCert  `json:"certs,omitempty" db:"-"` // Only when a single campaign is read
+}
+
+// How far a campaign has got: how many of its certificates are in each state
+type CampaignProgress struct {
+	Total      int  `json:"total"`
+	Pending    int  `json:"pending"`
+	InProgress int  `json:"inProgress"`
+	Renewed    int  `json:"renewed"`
+	Retired    int  `json:"retired"`
+	Percent    int  `json:"percent"` // Renewed or retired, rounded down
+	Complete   bool `json:"complete"`
+}
+
+// A certificate in a campaign
+type CampaignCert struct {
+	CampaignId string  `json:"-"`
+	UserId     string  `json:"user"`
+	CertId     string  `json:"cert"`
+	CommonName string  `json:"commonName"`
+	NotAfter   UTCTime `json:"notAfter"`
+	Owner      string  `json:"owner,omitempty"` // Who is renewing it. Empty for the certificate's user.
+	Status     string  `json:"status"`
+	Note       string  `json:"note,omitempty"`
+	RenewedBy  string  `json:"renewedBy,omitempty"` // The certificate that replaced it, if it was found by a refresh
+	Updated    UTCTime `json:"updated"`
+}
+
+// An update to a certificate in a campaign. Fields left out are unchanged.
+type CampaignCertUpdate struct {
+	Owner  *string `json:"owner"`
+	Status *string `json:"status"`
+	Note   *string `json:"note"`
+}
+
+// The compliance rules a campaign can select by
+var campaignRules = map[string]bool{
+	RuleWeakSignature: true, RuleWeakKey: true, RuleExpired: true, RuleLongValidity: true,
+	RuleKeyPolicy: true, RuleExtensionPolicy: true, RuleValidityPolicy: true,
+}
+
+// Value implements driver.Valuer for writing to the database.
+func (s CampaignSelector) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (s *CampaignSelector) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return ErrInvalidCampaignSelector
+	}
+	return json.Unmarshal(data, s)
+}
+
+// Validate a selector, which must select by something
+func (s *CampaignSelector) validate(errs *ValidationErrors) {
+	if len(s.Rules) == 0 && len(s.SignatureAlgorithms) == 0 && s.Issuer == "" && s.ExpiresAfter.IsZero() && s.ExpiresBefore.IsZero() {
+		errs.Add("selector", ErrInvalidCampaign)
+	}
+	for i, rule := range s.Rules {
+		if !campaignRules[rule] {
+			errs.Add("selector.rules["+strconv.Itoa(i)+"]", ErrInvalidCampaignRule)
+		}
+	}
+	if !s.ExpiresAfter.IsZero() && !s.ExpiresBefore.IsZero() && !s.ExpiresAfter.Before(s.ExpiresBefore.Time) {
+		errs.Add("selector.expiresBefore", ErrInvalidCampaign)
+	}
+}
+
+// Does the selector select a certificate?
+func (s *CampaignSelector) Matches(certData *CertificateData, cert *x509.Certificate, config *RuntimeConfig, now time.Time) bool {
+	if !certData.Active && !s.IncludeInactive {
+		return false
+	}
+	if !s.ExpiresAfter.IsZero() && !cert.NotAfter.After(s.ExpiresAfter.Time) {
+		return false
+	}
+	if !s.ExpiresBefore.IsZero() && !cert.NotAfter.Before(s.ExpiresBefore.Time) {
+		return false
+	}
+	details := NewCertificateDetails(cert)
+	if s.Issuer != "" && details.Issuer != s.Issuer {
+		return false
+	}
+	if len(s.SignatureAlgorithms) != 0 {
+		found := false
+		for _, algorithm := range s.SignatureAlgorithms {
+			if details.SignatureAlgorithm == algorithm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Rules) != 0 {
+		rules := make(map[string]bool, len(s.Rules))
+		for _, rule := range s.Rules {
+			rules[rule] = true
+		}
+		found := false
+		for _, violation := range CheckCompliance(cert, config, now) {
+			if rules[violation.Rule] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate a new campaign
+func ValidateCampaign(campaign *Campaign, config *RuntimeConfig) error {
+	var errs ValidationErrors
+	if campaign.Name == "" || utf8.RuneCountInString(campaign.Name) > config.MaxNameLength {
+		errs.Add("name", ErrInvalidCampaign)
+	}
+	if utf8.RuneCountInString(campaign.Description) > config.MaxNotesLength {
+		errs.Add("description", ErrNotesTooLong)
+	}
+	campaign.Selector.validate(&errs)
+	return errs.Err()
+}
+
+// Select the certificates for a new campaign, soonest expiring first
+func SelectCampaignCerts(selector *CampaignSelector, config *RuntimeConfig, now time.Time) ([]*CampaignCert, error) {
+	certs := []*CampaignCert{}
+	err := DatabaseEachCert(campaignBatchSize, func(certData *CertificateData) error {
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			return err
+		}
+		if !selector.Matches(certData, cert, config, now) {
+			return nil
+		}
+		if len(certs) == maxCampaignCerts {
+			return ErrCampaignTooLarge
+		}
+		certs = append(certs, &CampaignCert{
+			UserId:     certData.UserId,
+			CertId:     certData.Id,
+			CommonName: cert.Subject.CommonName,
+			NotAfter:   NewUTCTime(cert.NotAfter),
+			Status:     CampaignStatusPending,
+			Updated:    NewUTCTime(now),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortCampaignCerts(certs)
+	return certs, nil
+}
+
+// Sort a campaign's certificates, soonest expiring first
+func sortCampaignCerts(certs []*CampaignCert) {
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter.Time) })
+}
+
+// Count a campaign's certificates by state
+func NewCampaignProgress(counts map[string]int) CampaignProgress {
+	progress := CampaignProgress{
+		Pending:    counts[CampaignStatusPending],
+		InProgress: counts[CampaignStatusInProgress],
+		Renewed:    counts[CampaignStatusRenewed],
+		Retired:    counts[CampaignStatusRetired],
+	}
+	progress.Total = progress.Pending + progress.InProgress + progress.Renewed + progress.Retired
+	done := progress.Renewed + progress.Retired
+	progress.Complete = done == progress.Total
+	progress.Percent = 100
+	if progress.Total != 0 {
+		progress.Percent = done * 100 / progress.Total
+	}
+	return progress
+}
+
+// Apply an update to a certificate in a campaign
+func (c *CampaignCert) apply(update *CampaignCertUpdate, config *RuntimeConfig) error {
+	var errs ValidationErrors
+	if update.Owner != nil {
+		if utf8.RuneCountInString(*update.Owner) > config.MaxNameLength {
+			errs.Add("owner", ErrInvalidCampaign)
+		}
+		c.Owner = *update.Owner
+	}
+	if update.Status != nil {
+		switch *update.Status {
+		case CampaignStatusPending, CampaignStatusInProgress, CampaignStatusRenewed, CampaignStatusRetired:
+		default:
+			errs.Add("status", ErrInvalidCampaignStatus)
+		}
+		if *update.Status != c.Status {
+			c.RenewedBy = ""
+		}
+		c.Status = *update.Status
+	}
+	if update.Note != nil {
+		if utf8.RuneCountInString(*update.Note) > config.MaxNotesLength {
+			errs.Add("note", ErrNotesTooLong)
+		}
+		c.Note = *update.Note
+	}
+	return errs.Err()
+}
+
+// Find the work done on a campaign's open certificates since they were last updated, and record it. The updated
+// certificates are returned.
+func RefreshCampaign(campaign *Campaign, reason string, config *RuntimeConfig, now time.Time) ([]*CampaignCert, error) {
+	certs, err := DatabaseListCampaignCerts(campaign.Id)
+	if err != nil {
+		return nil, err
+	}
+	updated := []*CampaignCert{}
+	for _, c := range certs {
+		if c.Status != CampaignStatusPending && c.Status != CampaignStatusInProgress {
+			continue
+		}
+		renewedBy, err := findCampaignRenewal(campaign, c, config, now)
+		if err == ErrNotFound {
+			c.Status, c.Note = CampaignStatusRetired, "Deleted"
+		} else if err != nil {
+			return nil, err
+		} else if renewedBy != "" {
+			c.Status, c.RenewedBy = CampaignStatusRenewed, renewedBy
+		} else {
+			continue
+		}
+		c.Updated = NewUTCTime(now)
+		updated = append(updated, c)
+	}
+	err = DatabaseUpdateCampaignCerts(context.Background(), updated, "refresh", reason)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Find the certificate renewing one in a campaign: an active certificate of the same user, for one of the same names,
+// expiring later, that the campaign doesn't select. ErrNotFound is returned if the certificate has been deleted.
+func findCampaignRenewal(campaign *Campaign, c *CampaignCert, config *RuntimeConfig, now time.Time) (string, error) {
+	_, err := DatabaseReadCert(c.UserId, c.CertId)
+	if err != nil {
+		return "", err
+	}
+	successors, err := DatabaseListCertSuccessors(c.UserId, c.CertId)
+	if err != nil {
+		return "", err
+	}
+	for _, successor := range successors {
+		cert, err := ParseCertificatePEM(string(successor.Cert))
+		if err != nil {
+			return "", err
+		}
+		if cert.NotAfter.After(c.NotAfter.Time) && !campaign.Selector.Matches(successor, cert, config, now) {
+			return successor.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// Get the campaign-id from a request
+func GetCampaignID(r *http.Request) (string, error) {
+	campaignid := mux.Vars(r)["campaign-id"]
+	if checkid, err := strconv.ParseInt(campaignid, 10, 64); err != nil || checkid <= 0 {
+		return "", ErrNotFound
+	}
+	return campaignid, nil
+}
+
+// List the campaigns, with their progress
+func ListCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaigns, err := DatabaseListCampaigns()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, campaigns)
+}
+
+// Create a campaign, selecting its certificates. A dry run gives the campaign it would create, without creating it.
+func CreateCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaign := new(Campaign)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(campaign)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	config := Config()
+	err = ValidateCampaign(campaign, config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	dryRun, err := IsDryRun(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	now := Now()
+	campaign.Certs, err = SelectCampaignCerts(&campaign.Selector, config, now)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	campaign.CreatedBy, campaign.Created = RequestPrincipal(r), NewUTCTime(now)
+	campaign.Progress = NewCampaignProgress(map[string]int{CampaignStatusPending: len(campaign.Certs)})
+	if !dryRun {
+		err = DatabaseCreateCampaign(r.Context(), campaign, reason)
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
+	}
+
+	// Send the result
+	SendResult(w, r, campaign)
+}
+
+// Get a campaign, with its certificates. ?status= lists only the certificates in that state.
+func ReadCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaignid, err := GetCampaignID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", CampaignStatusPending, CampaignStatusInProgress, CampaignStatusRenewed, CampaignStatusRetired:
+	default:
+		HandleError(w, r, ErrInvalidCampaignStatus, 0)
+		return
+	}
+
+	campaign, err := DatabaseReadCampaign(campaignid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certs, err := DatabaseListCampaignCerts(campaignid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	campaign.Certs = []*CampaignCert{}
+	for _, c := range certs {
+		if status == "" || c.Status == status {
+			campaign.Certs = append(campaign.Certs, c)
+		}
+	}
+
+	// Send the result
+	SendResult(w, r, campaign)
+}
+
+// Refresh a campaign, finding the certificates renewed or deleted since. The updated certificates are returned.
+func RefreshCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaignid, err := GetCampaignID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	campaign, err := DatabaseReadCampaign(campaignid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	updated, err := RefreshCampaign(campaign, reason, Config(), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, updated)
+}
+
+// Update the owner, status or note of a certificate in a campaign
+func UpdateCampaignCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaignid, err := GetCampaignID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	update := new(CampaignCertUpdate)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(update)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	c, err := DatabaseReadCampaignCert(campaignid, userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = c.apply(update, Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	c.Updated = NewUTCTime(Now())
+	err = DatabaseUpdateCampaignCerts(r.Context(), []*CampaignCert{c}, RequestPrincipal(r), reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, c)
+}
+
+// Delete a campaign. The certificates in it are left alone.
+func DeleteCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	campaignid, err := GetCampaignID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	campaign, err := DatabaseDeleteCampaign(r.Context(), campaignid, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, campaign)
+}
@@ -8,18 +8,22 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
-	"errors"
+	"golang.org/x/text/unicode/norm"
+	"net/http"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
-	ErrDSANotSupported       = errors.New("DSA Is not supported. Please use RSA or ECDSA.")
-	ErrInvalidPEMBlock       = errors.New("Invalid PEM Block. Please only include a single PEM Block per field.")
-	ErrInvalidCertificatePEM = errors.New("Invalid Certificate")
-	ErrInvalidCertificateId  = errors.New("Invaid Certificate ID. The Certificate ID is the SHA256 hash (hex-encoded) of the Certificate data (DER-encoded)")
-	ErrInvalidPrivateKey     = errors.New("Invalid Private Key. The provided key does not match the certificate.")
-	ErrMissingPrivateKey     = errors.New("No Private Key provided.")
-	ErrKeyTooSmall           = errors.New("The key is of insufficient length to provide good security. A minimum key size of 1024 for RSA or 168 for EC must be used.")
+	ErrDSANotSupported       = NewError("dsa-not-supported", http.StatusBadRequest, "DSA Is not supported. Please use RSA or ECDSA.")
+	ErrInvalidPEMBlock       = NewError("invalid-pem-block", http.StatusBadRequest, "Invalid PEM Block. Please only include a single PEM Block per field.")
+	ErrInvalidCertificatePEM = NewError("invalid-certificate", http.StatusBadRequest, "Invalid Certificate")
+	ErrInvalidCertificateId  = NewError("invalid-certificate-id", http.StatusBadRequest, "Invaid Certificate ID. The Certificate ID is the SHA256 hash (hex-encoded) of the Certificate data (DER-encoded)")
+	ErrInvalidPrivateKey     = NewError("invalid-private-key", http.StatusBadRequest, "Invalid Private Key. The provided key does not match the certificate.")
+	ErrMissingPrivateKey     = NewError("missing-private-key", http.StatusBadRequest, "No Private Key provided.")
+	ErrNotesTooLong          = NewError("notes-too-long", http.StatusBadRequest, "The certificate notes are too long.")
+	ErrEmptyCertPatch        = NewError("empty-cert-patch", http.StatusBadRequest, "Nothing to update. Set active, notes, activateAt or deactivateAt.")
+	ErrKeyTooSmall           = NewError("key-too-small", http.StatusBadRequest, "The key is of insufficient length to provide good security. A minimum key size of 1024 for RSA or 168 for EC must be used.")
 )
 
 type Certificate struct {
@@ -28,6 +32,19 @@ type Certificate struct {
 	Active bool
 	Cert   *x509.Certificate
 	Key    interface{} // Could be RSA or DSA Private Key
+	Notes  string
+
+	// Scheduled changes (see schedule.go). Zero if there are none.
+	ActivateAt   UTCTime
+	DeactivateAt UTCTime
+
+	Chain []*x509.Certificate // The intermediates, and optionally the root, in order from its issuer (see chain.go)
+
+	// The OCSP status found when the certificate was uploaded (see ocsp.go). Empty and zero if it wasn't checked.
+	OCSPStatus  string
+	OCSPChecked UTCTime
+
+	Warnings ValidationErrors // About the upload: what lenient parsing repaired (see parsing.go), and policy it breaks
 }
 
 // CertificateData is an intermediary representation of a Certificate
@@ -36,11 +53,106 @@ type Certificate struct {
 // 1. Easy JSON marshalling / unmarshalling
 // 2. Retreival from the database and delivery to the client (no parsing overhead)
 type CertificateData struct {
-	Id     string `json:"id"`
-	UserId string `json:"user"`
-	Active bool   `json:"active"`
-	Cert   string `json:"cert"`
-	Key    string `json:"key"`
+	Id        string    `json:"id"`
+	UserId    string    `json:"user"`
+	Active    bool      `json:"active"`
+	Cert      StoredPEM `json:"cert"`
+	Key       StoredPEM `json:"key,omitempty"` // Only read from the database, and sent to clients, when the key is exported
+	NotBefore UTCTime   `json:"notBefore"`     // Derived from Cert. Ignored on input.
+	NotAfter  UTCTime   `json:"notAfter"`      // Derived from Cert. Ignored on input.
+	Notes     string    `json:"notes"`         // Free text about the certificate, for the user's own reference
+
+	// Scheduled changes (see schedule.go), cleared once they have run. Null if there are none.
+	ActivateAt   UTCTime `json:"activateAt"`
+	DeactivateAt UTCTime `json:"deactivateAt"`
+
+	// SHA256 hash (hex-encoded) of the public key, to find keys reused across certificates (see keyreuse.go).
+	// Derived from Cert. Ignored on input. Empty until certificates stored before it was added are backfilled.
+	KeyFingerprint string `json:"keyFingerprint" db:"spki"`
+
+	// The chain (see chain.go), as PEM: the intermediates, and optionally the root, in order from the issuer. Empty if
+	// there is none. On input it may instead come with the certificate in a bundle, or a PKCS#12 or PKCS#7 bundle.
+	Chain StoredChain `json:"chain,omitempty" db:"chain"`
+
+	// The OCSP status found when the certificate was last uploaded (see ocsp.go), and when. Ignored on input. Empty
+	// and null if it has never been checked.
+	OCSPStatus  string  `json:"ocspStatus,omitempty" db:"ocspstatus"`
+	OCSPChecked UTCTime `json:"ocspChecked" db:"ocspchecked"`
+
+	// When the certificate was revoked, as found on its CRL (see crl.go) or by OCSP, and why, as an RFC 5280 reason
+	// such as "keyCompromise". Ignored on input. Null and empty if it hasn't been.
+	Revoked          UTCTime `json:"revoked" db:"revoked"`
+	RevocationReason string  `json:"revocationReason,omitempty" db:"revocationreason"`
+
+	// When the revocation status was last checked again (see revocation.go). Ignored on input. Null if it hasn't been.
+	RevocationChecked UTCTime `json:"revocationChecked" db:"revocationchecked"`
+
+	// Only filled in when a single certificate is read. The attachments' data is fetched separately.
+	Attachments []*Attachment `json:"attachments,omitempty" db:"-"`
+
+	// Only filled in when a single certificate is read: its embedded SCTs, verified against the CT log list (see ct.go)
+	CT *CTStatus `json:"ct,omitempty" db:"-"`
+
+	// Only filled in when a user's certificates are listed (see SummarizeCerts)
+	Summary *CertificateSummary `json:"summary,omitempty" db:"-"`
+
+	// Only on input: how Cert and Key are encoded, CertFormatPEM (the default) or CertFormatDER (see parsing.go)
+	Format string `json:"format,omitempty" db:"-"`
+
+	// Only on input: the certificate and its key in one field, in place of Cert and Key (see SplitBundle)
+	Bundle string `json:"bundle,omitempty" db:"-"`
+
+	// Only on input: the certificate, its key and its chain as a base64-encoded PKCS#12 bundle, in place of Cert and
+	// Key (see pkcs12.go), and the passphrase of the bundle or of an encrypted key (see encryptedkey.go). Never stored.
+	PKCS12     string `json:"pkcs12,omitempty" db:"-"`
+	Passphrase string `json:"passphrase,omitempty" db:"-"`
+
+	// Only on input: the certificate and its chain as a PKCS#7 bundle, PEM or base64-encoded DER, in place of Cert
+	// (see pkcs7.go). The key is given in Key.
+	PKCS7 string `json:"pkcs7,omitempty" db:"-"`
+}
+
+// CertificatePatch is an update to a certificate. Fields that are nil are left alone.
+type CertificatePatch struct {
+	Active       *bool    `json:"active"`
+	Notes        *string  `json:"notes"`
+	ActivateAt   *UTCTime `json:"activateAt"`   // An empty string cancels the scheduled activation
+	DeactivateAt *UTCTime `json:"deactivateAt"` // An empty string cancels the scheduled deactivation
+}
+
+// Validate that the patch changes something, and normalize the notes
+func (patch *CertificatePatch) ValidateNormalize() error {
+	if patch.Active == nil && patch.Notes == nil && patch.ActivateAt == nil && patch.DeactivateAt == nil {
+		return ErrEmptyCertPatch
+	}
+	var activateAt, deactivateAt UTCTime
+	if patch.ActivateAt != nil {
+		activateAt = *patch.ActivateAt
+	}
+	if patch.DeactivateAt != nil {
+		deactivateAt = *patch.DeactivateAt
+	}
+	err := ValidateSchedule(activateAt, deactivateAt)
+	if err != nil {
+		return err
+	}
+	if patch.Notes != nil {
+		notes, err := NormalizeNotes(*patch.Notes)
+		if err != nil {
+			return &FieldError{"notes", err}
+		}
+		patch.Notes = &notes
+	}
+	return nil
+}
+
+// Normalize certificate notes (trimmed, Unicode NFC) and check their length in characters
+func NormalizeNotes(notes string) (string, error) {
+	notes = norm.NFC.String(strings.TrimSpace(notes))
+	if utf8.RuneCountInString(notes) > Config().MaxNotesLength {
+		return "", ErrNotesTooLong
+	}
+	return notes, nil
 }
 
 func NewCertificateFromData(certData *CertificateData) (*Certificate, error) {
@@ -50,77 +162,78 @@ func NewCertificateFromData(certData *CertificateData) (*Certificate, error) {
 		Active: certData.Active,
 	}
 
-	// Parse the certificate
-	certPEMBlockBytes, err := PEMBlockNormalize(certData.Cert)
+	// Normalize the notes
+	var err error
+	cert.Notes, err = NormalizeNotes(certData.Notes)
 	if err != nil {
 		return nil, err
 	}
-	certPEMBlock, _ := pem.Decode(certPEMBlockBytes)
-	if certPEMBlock == nil {
-		return nil, ErrInvalidCertificatePEM
-	}
-	if certPEMBlock.Type != "CERTIFICATE" {
-		return nil, ErrInvalidCertificatePEM
-	}
-	cert.Cert, err = x509.ParseCertificate(certPEMBlock.Bytes)
+
+	// Check the scheduled changes
+	err = ValidateSchedule(certData.ActivateAt, certData.DeactivateAt)
 	if err != nil {
 		return nil, err
 	}
+	cert.ActivateAt, cert.DeactivateAt = certData.ActivateAt, certData.DeactivateAt
 
-	// Parse the private key
-	keyPEMBlockBytes, err := PEMBlockNormalize(certData.Key)
+	// Check, or repair, the PEM before parsing it
+	cert.Warnings, err = NormalizeUploadPEM(certData, Config().ParseMode)
 	if err != nil {
 		return nil, err
 	}
-	keyPEMBlock, _ := pem.Decode(keyPEMBlockBytes)
-	if keyPEMBlock == nil {
-		return nil, ErrMissingPrivateKey
-	}
-	if keyPEMBlock.Type == "DSA PRIVATE KEY" {
-		return nil, ErrDSANotSupported
-	}
-	if keyPEMBlock.Type != "RSA PRIVATE KEY" && keyPEMBlock.Type != "EC PRIVATE KEY" && keyPEMBlock.Type != "PRIVATE KEY" {
-		return nil, ErrMissingPrivateKey
-	}
-	if keyPEMBlock.Type == "RSA PRIVATE KEY" {
-		cert.Key, err = x509.ParsePKCS1PrivateKey(keyPEMBlock.Bytes)
-		if err != nil {
-			return nil, err
-		}
+
+	// Parse the certificate
+	cert.Cert, err = ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
 	}
-	if keyPEMBlock.Type == "EC PRIVATE KEY" {
-		cert.Key, err = x509.ParseECPrivateKey(keyPEMBlock.Bytes)
-		if err != nil {
-			return nil, err
-		}
+
+	// Parse the chain, and check its order
+	var chainWarnings ValidationErrors
+	cert.Chain, chainWarnings, err = NormalizeChain(cert.Cert, string(certData.Chain), Config().ParseMode == ParseModeLenient)
+	if err != nil {
+		return nil, &FieldError{"chain", err}
 	}
-	if keyPEMBlock.Type == "PRIVATE KEY" {
-		cert.Key, err = x509.ParsePKCS8PrivateKey(keyPEMBlock.Bytes)
-		if err != nil {
-			return nil, err
-		}
+	cert.Warnings = append(cert.Warnings, chainWarnings...)
+
+	// Parse the private key
+	cert.Key, err = ParsePrivateKeyPEM(string(certData.Key))
+	if err != nil {
+		return nil, err
 	}
 
 	// If the Id is empty, generate it
 	if certData.Id == "" {
-		hash := sha256.Sum256(certPEMBlock.Bytes)
+		hash := sha256.Sum256(cert.Cert.Raw)
 		cert.Id = hex.EncodeToString(hash[:])
 	}
 
-	// Verify the certificate
+	// Verify the certificate, and check it against the acceptance policy
 	err = cert.Verify()
 	if err != nil {
 		return nil, err
 	}
+	err = Acceptance.Check(cert, Config())
+	if err != nil {
+		return nil, err
+	}
+	switch CheckValidityPolicy(cert.Cert, Config()) {
+	case ErrPublicValidity:
+		cert.Warnings.Add("cert", WarnPublicValidity)
+	case ErrInternalValidity:
+		cert.Warnings.Add("cert", WarnInternalValidity)
+	}
 
 	// All is well
 	return cert, nil
 }
 
 func (cert *Certificate) Verify() error {
+	config := Config()
+
 	// Verify the entire certificate chain
-	if OptVerifyCertificate {
-		_, err := cert.Cert.Verify(x509.VerifyOptions{})
+	if config.VerifyCertificate {
+		_, err := cert.Cert.Verify(certVerifyOptions(cert.Chain))
 		if err != nil {
 			return err
 		}
@@ -132,7 +245,35 @@ func (cert *Certificate) Verify() error {
 		return ErrInvalidCertificateId
 	}
 
-	// Verify that the private key matches the public key in the certificate and the key lengths are sufficient
+	// Check the certificate's extensions against the extension policy, and its usages against the usage policy
+	err := CheckExtensionPolicy(cert.Cert, config)
+	if err != nil {
+		return err
+	}
+	err = CheckUsagePolicy(cert.Cert, config)
+	if err != nil {
+		return err
+	}
+
+	// Check the signature algorithms against the signature policy. A sandbox accepts weak signatures, with a warning.
+	err = CheckSignaturePolicy(cert.Cert, cert.Chain, config)
+	if fieldErr, ok := err.(*FieldError); ok && OptSandbox {
+		cert.Warnings.Add(fieldErr.Field, WarnSandboxSignature)
+	} else if err != nil {
+		return err
+	}
+
+	// Check how long the certificate is valid for, if certificates breaking the validity policy are rejected.
+	// Otherwise they are warned about (see NewCertificateFromData).
+	if config.ValidityPolicy == ValidityPolicyReject {
+		err = CheckValidityPolicy(cert.Cert, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Verify that the private key matches the public key in the certificate. Key lengths are checked by the
+	// acceptance policy (see acceptance.go).
 	switch priv := cert.Key.(type) {
 	case *rsa.PrivateKey:
 		pub, ok := cert.Cert.PublicKey.(*rsa.PublicKey)
@@ -142,9 +283,6 @@ func (cert *Certificate) Verify() error {
 		if priv.N.Cmp(pub.N) != 0 {
 			return ErrInvalidPrivateKey
 		}
-		if priv.N.BitLen() < OptMinimumRSABits {
-			return ErrKeyTooSmall
-		}
 	case *ecdsa.PrivateKey:
 		pub, ok := cert.Cert.PublicKey.(*ecdsa.PublicKey)
 		if !ok {
@@ -153,10 +291,6 @@ func (cert *Certificate) Verify() error {
 		if priv.X.Cmp(pub.X) != 0 || priv.Y.Cmp(pub.Y) != 0 {
 			return ErrInvalidPrivateKey
 		}
-		// TODO: Not 100% positive that this is the correct way to check key size on an eliptic curve. Needs review.
-		if priv.X.BitLen() < OptMinimumECBits || priv.Y.BitLen() < OptMinimumECBits {
-			return ErrKeyTooSmall
-		}
 	default:
 		return ErrInvalidPrivateKey
 	}
@@ -166,9 +300,17 @@ func (cert *Certificate) Verify() error {
 
 func (cert *Certificate) GetData() *CertificateData {
 	certData := &CertificateData{
-		Id:     cert.Id,
-		UserId: cert.UserId,
-		Active: cert.Active,
+		Id:             cert.Id,
+		UserId:         cert.UserId,
+		Active:         cert.Active,
+		Notes:          cert.Notes,
+		NotBefore:      NewUTCTime(cert.Cert.NotBefore),
+		NotAfter:       NewUTCTime(cert.Cert.NotAfter),
+		ActivateAt:     cert.ActivateAt,
+		DeactivateAt:   cert.DeactivateAt,
+		KeyFingerprint: SPKIFingerprint(cert.Cert),
+		OCSPStatus:     cert.OCSPStatus,
+		OCSPChecked:    cert.OCSPChecked,
 	}
 
 	// Encode the certificate
@@ -176,27 +318,52 @@ func (cert *Certificate) GetData() *CertificateData {
 		Type:  "CERTIFICATE",
 		Bytes: cert.Cert.Raw,
 	}
-	certData.Cert = string(pem.EncodeToMemory(certBlock))
+	certData.Cert = StoredPEM(pem.EncodeToMemory(certBlock))
 
 	// Encode the private key
-	keyBlock := &pem.Block{}
-	switch priv := cert.Key.(type) {
+	key, err := EncodePrivateKeyPEM(cert.Key, Config().KeyFormat)
+	if err != nil {
+		panic("Invalid Private Key")
+	}
+	certData.Key = StoredPEM(key)
+	certData.Chain = EncodeChain(cert.Chain)
+
+	return certData
+}
+
+// Private key PEM formats
+const (
+	KeyFormatTraditional = "traditional" // PKCS#1 ("RSA PRIVATE KEY") for RSA keys, SEC 1 ("EC PRIVATE KEY") for EC keys
+	KeyFormatPKCS8       = "pkcs8"       // PKCS#8 ("PRIVATE KEY") for every type of key
+)
+
+// PEM encode an RSA or EC private key in the given format. The output is what OpenSSL writes for the same key
+// (with "openssl pkey -traditional", or "openssl pkcs8 -topk8 -nocrypt"), so it can be read back by anything.
+func EncodePrivateKeyPEM(key interface{}, format string) ([]byte, error) {
+	block := &pem.Block{}
+	var err error
+	if format == KeyFormatPKCS8 {
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, ErrInvalidPrivateKey
+		}
+		return pem.EncodeToMemory(block), nil
+	}
+	switch priv := key.(type) {
 	case *rsa.PrivateKey:
-		keyBlock.Type = "RSA PRIVATE KEY"
-		keyBlock.Bytes = x509.MarshalPKCS1PrivateKey(priv)
+		block.Type = "RSA PRIVATE KEY"
+		block.Bytes = x509.MarshalPKCS1PrivateKey(priv)
 	case *ecdsa.PrivateKey:
-		keyBlock.Type = "DSA PRIVATE KEY"
-		var err error
-		keyBlock.Bytes, err = x509.MarshalECPrivateKey(priv)
+		block.Type = "EC PRIVATE KEY"
+		block.Bytes, err = x509.MarshalECPrivateKey(priv)
 		if err != nil {
-			panic("Invalid Private Key")
+			return nil, ErrInvalidPrivateKey
 		}
 	default:
-		panic("Invalid Private Key type")
+		return nil, ErrInvalidPrivateKey
 	}
-	certData.Key = string(pem.EncodeToMemory(keyBlock))
-
-	return certData
+	return pem.EncodeToMemory(block), nil
 }
 
 func (cert *Certificate) MarshalJSON() ([]byte, error) {
@@ -220,10 +387,78 @@ func (cert *Certificate) UnmarshalJSON(data []byte) error {
 	cert.Active = newCert.Active
 	cert.Cert = newCert.Cert
 	cert.Key = newCert.Key
+	cert.Notes = newCert.Notes
+	cert.Chain = newCert.Chain
+	cert.Warnings = newCert.Warnings
 
 	return nil
 }
 
+// Parse a single PEM encoded RSA or EC private key, in PKCS#1, SEC 1 or PKCS#8 form.
+// JSON compatible PEM Blocks are accepted (see PEMBlockNormalize).
+func ParsePrivateKeyPEM(jsonpem string) (interface{}, error) {
+	var key interface{}
+	jsonpem, err := StripECParameters(jsonpem)
+	if err != nil {
+		return nil, err
+	}
+	keyPEMBlockBytes, err := PEMBlockNormalize(jsonpem)
+	if err != nil {
+		return nil, err
+	}
+	keyPEMBlock, _ := pem.Decode(keyPEMBlockBytes)
+	if keyPEMBlock == nil {
+		return nil, ErrMissingPrivateKey
+	}
+	// Older versions stored EC keys mislabeled as "DSA PRIVATE KEY". Those are read as the EC keys they are, and
+	// relabeled when they are read from the database (see StoredPEM).
+	if keyPEMBlock.Type == "DSA PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(keyPEMBlock.Bytes)
+		if err != nil {
+			return nil, ErrDSANotSupported
+		}
+		return key, nil
+	}
+	if keyPEMBlock.Type != "RSA PRIVATE KEY" && keyPEMBlock.Type != "EC PRIVATE KEY" && keyPEMBlock.Type != "PRIVATE KEY" {
+		return nil, ErrMissingPrivateKey
+	}
+	if keyPEMBlock.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(keyPEMBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keyPEMBlock.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(keyPEMBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keyPEMBlock.Type == "PRIVATE KEY" {
+		key, err = x509.ParsePKCS8PrivateKey(keyPEMBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Parse a single PEM encoded certificate. JSON compatible PEM Blocks are accepted (see PEMBlockNormalize).
+func ParseCertificatePEM(jsonpem string) (*x509.Certificate, error) {
+	certPEMBlockBytes, err := PEMBlockNormalize(jsonpem)
+	if err != nil {
+		return nil, err
+	}
+	certPEMBlock, _ := pem.Decode(certPEMBlockBytes)
+	if certPEMBlock == nil {
+		return nil, ErrInvalidCertificatePEM
+	}
+	if certPEMBlock.Type != "CERTIFICATE" {
+		return nil, ErrInvalidCertificatePEM
+	}
+	return x509.ParseCertificate(certPEMBlock.Bytes)
+}
+
 // Convert a JSON compatible PEM Block (where " " is used in lieu of "\n") to a regular PEM Block
 // It also checks to make sure there is only one PEM Block defined per string
 func PEMBlockNormalize(jsonpem string) ([]byte, error) {
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// Schemes for referring to a certificate in a URL
+const (
+	CertRefSHA256 = "sha256" // The cert-id: SHA256 of the DER certificate, or at least MinCertIdPrefix characters of it
+	CertRefSHA1   = "sha1"   // SHA1 of the DER certificate, as shown by most tools as the "thumbprint"
+	CertRefSPKI   = "spki"   // SHA256 of the certificate's SubjectPublicKeyInfo, as used for key pinning
+	CertRefSerial = "serial" // The certificate's serial number in hex, with or without colons
+)
+
+// The shortest prefix of a cert-id that can be used in its place
+const MinCertIdPrefix = 8
+
+var (
+	ErrAmbiguousCertRef = NewError("ambiguous-cert-ref", http.StatusConflict, "More than one certificate matches. Use the full cert-id.")
+)
+
+// A CertRef refers to a certificate in a URL. A bare cert-id is the same as "sha256:<cert-id>".
+// References that aren't cert-ids are resolved among the certificates a user holds, or that are shared with them.
+type CertRef struct {
+	Scheme string
+	Value  string // Lower case hex, without colons
+}
+
+// Parse a reference to a certificate. Malformed references can't refer to anything, so they are ErrNotFound.
+func ParseCertRef(s string) (*CertRef, error) {
+	scheme, value := CertRefSHA256, s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		scheme, value = s[:i], s[i+1:]
+	}
+	value = strings.ToLower(value)
+	if scheme == CertRefSerial {
+		value = strings.Replace(value, ":", "", -1)
+		if trimmed := strings.TrimLeft(value, "0"); trimmed != "" {
+			value = trimmed
+		} else if value != "" {
+			value = "0"
+		}
+	}
+	if !isHex(value) {
+		return nil, ErrNotFound
+	}
+	switch {
+	case scheme == CertRefSHA256 && len(value) >= MinCertIdPrefix && len(value) <= 64:
+	case scheme == CertRefSHA1 && len(value) == 40:
+	case scheme == CertRefSPKI && len(value) == 64:
+	case scheme == CertRefSerial && len(value) <= 40: // RFC 5280 limits serials to 20 bytes
+	default:
+		return nil, ErrNotFound
+	}
+	return &CertRef{Scheme: scheme, Value: value}, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Is the reference a full cert-id, which needs no resolving?
+func (ref *CertRef) IsCertId() bool {
+	return ref.Scheme == CertRefSHA256 && len(ref.Value) == 64
+}
+
+// Is the reference a prefix of a cert-id?
+func (ref *CertRef) IsCertIdPrefix() bool {
+	return ref.Scheme == CertRefSHA256 && len(ref.Value) < 64
+}
+
+// Does a certificate match the reference?
+func (ref *CertRef) Matches(cert *x509.Certificate) bool {
+	switch ref.Scheme {
+	case CertRefSHA256:
+		hash := sha256.Sum256(cert.Raw)
+		return strings.HasPrefix(hex.EncodeToString(hash[:]), ref.Value)
+	case CertRefSHA1:
+		hash := sha1.Sum(cert.Raw)
+		return hex.EncodeToString(hash[:]) == ref.Value
+	case CertRefSPKI:
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return hex.EncodeToString(hash[:]) == ref.Value
+	case CertRefSerial:
+		serial, ok := new(big.Int).SetString(ref.Value, 16)
+		return ok && cert.SerialNumber != nil && cert.SerialNumber.Cmp(serial) == 0
+	}
+	return false
+}
+
+// Pick the one cert-id that matched a reference
+func resolvedCertId(ids []string) (string, error) {
+	switch len(ids) {
+	case 0:
+		return "", ErrNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return "", ErrAmbiguousCertRef
+	}
+}
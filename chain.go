@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"net/http"
+)
+
+var (
+	ErrInvalidChain    = NewError("invalid-chain", http.StatusBadRequest, "The chain must only hold certificates, as PEM blocks.")
+	ErrChainOrder      = NewError("chain-order", http.StatusBadRequest, "The chain isn't in order. Each certificate must be issued by the one after it, starting with the certificate's issuer.")
+	WarnReorderedChain = NewError("reordered-chain", 0, "The chain wasn't in order, and was reordered.")
+	WarnChainKept      = NewError("chain-kept", 0, "The certificate is already stored with a different chain, which was kept, since every user holding the certificate shares it.")
+)
+
+// A certificate is stored with its chain: the intermediate certificates between it and a root, and optionally the
+// root, so deployments that need the full bundle can get it from one place. The chain is given in the "chain" field,
+// or comes from the rest of a bundle, or a PKCS#12 or PKCS#7 bundle. It must be in order, starting with the
+// certificate's issuer, with each certificate issued by the one after it. In the lenient parsing mode, a chain that is
+// out of order is reordered, with a warning. In the strict mode it is an error. (PKCS#7 bundles are unordered sets,
+// so their chains are put in order without a warning, see pkcs7.go.)
+//
+// The chain is kept with the certificate data, so every user holding a certificate shares its chain. The first chain
+// the certificate is uploaded with is kept: uploading it again, by the same user or another, doesn't replace it, so
+// no user can change the chain the others are served. An upload with a different chain is stored with a warning, and
+// given back with the chain that was kept.
+
+// Parse the certificates of a chain. Text between the blocks, such as the "Bag Attributes" some tools write, is ignored.
+func ParseChainPEM(s string) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for _, b := range findPEMBlocks(s) {
+		if !isCertPEMType(b.Type) {
+			return nil, ErrInvalidChain
+		}
+		cert, err := ParseCertificatePEM(s[b.start:b.end] + "\n")
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 && s != "" {
+		return nil, ErrInvalidChain
+	}
+	return chain, nil
+}
+
+// Check that each certificate is issued by the next, starting with the certificate itself
+func chainInOrder(cert *x509.Certificate, chain []*x509.Certificate) bool {
+	for _, issuer := range chain {
+		if cert.CheckSignatureFrom(issuer) != nil {
+			return false
+		}
+		cert = issuer
+	}
+	return true
+}
+
+// Put a chain in order, starting with the certificate's issuer. ok is false if there is no such order.
+func orderChain(cert *x509.Certificate, chain []*x509.Certificate) (ordered []*x509.Certificate, ok bool) {
+	remaining := append([]*x509.Certificate{}, chain...)
+	for len(remaining) != 0 {
+		found := -1
+		for i, issuer := range remaining {
+			if cert.CheckSignatureFrom(issuer) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, false
+		}
+		cert = remaining[found]
+		ordered = append(ordered, cert)
+		remaining = append(remaining[:found], remaining[found+1:]...)
+	}
+	return ordered, true
+}
+
+// Parse a certificate's chain, and check that it is in order. In the lenient mode, a chain out of order is reordered,
+// and the reordering is returned as a warning.
+func NormalizeChain(cert *x509.Certificate, chainPEM string, lenient bool) ([]*x509.Certificate, ValidationErrors, error) {
+	chain, err := ParseChainPEM(chainPEM)
+	if err != nil || chainInOrder(cert, chain) {
+		return chain, nil, err
+	}
+	if !lenient {
+		return nil, nil, ErrChainOrder
+	}
+	ordered, ok := orderChain(cert, chain)
+	if !ok {
+		return nil, nil, ErrChainOrder
+	}
+	var warnings ValidationErrors
+	warnings.Add("chain", WarnReorderedChain)
+	return ordered, warnings, nil
+}
+
+// Warn if a certificate that has just been stored was uploaded with a different chain to the one it was already
+// stored with, and give it the chain that was kept
+func keptChainWarnings(certData *CertificateData, field string) ValidationErrors {
+	var warnings ValidationErrors
+	if certData.Chain == "" {
+		return nil
+	}
+	chain, err := DatabaseReadCertChain(certData.Id)
+	if err != nil {
+		log.Println("Unable to check the certificate's chain:", err)
+		return nil
+	}
+	if chain != certData.Chain {
+		certData.Chain = chain
+		warnings.Add(field, WarnChainKept)
+	}
+	return warnings
+}
+
+// Encode a chain as PEM
+func EncodeChain(chain []*x509.Certificate) StoredChain {
+	var encoded []byte
+	for _, cert := range chain {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return StoredChain(encoded)
+}
+
+// Get the options for verifying a certificate, with its chain added to the intermediates
+func certVerifyOptions(chain []*x509.Certificate) x509.VerifyOptions {
+	opts := chainVerifyOptions()
+	if len(chain) != 0 {
+		if opts.Intermediates == nil {
+			opts.Intermediates = x509.NewCertPool()
+		}
+		for _, cert := range chain {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	return opts
+}
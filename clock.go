@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClockBackwards  = NewError("clock-backwards", http.StatusBadRequest, "The clock can only be moved forwards.")
+	ErrTimeTravelOff   = NewError("time-travel-off", http.StatusNotFound, "Time travel is not enabled on this server.")
+	ErrInvalidAdvance  = NewError("invalid-advance", http.StatusBadRequest, "Invalid advance. It must be a positive duration, such as \"36h\".")
+	ErrEmptyClockPatch = NewError("empty-clock-patch", http.StatusBadRequest, "Give either a time to move the clock to, or a duration to advance it by.")
+)
+
+// A Clock tells the time. Everything that decides what time it is (validity checks and filters, expiry of
+// sessions, download links and lockouts, and the background jobs) asks the clock, so tests and sandboxes can
+// move time on instead of sleeping or making short-lived certificates.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time // Like time.After, in the clock's time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// The clock in use. Only set before serving, or in tests.
+var clock Clock = systemClock{}
+
+// The current time, according to the clock in use
+func Now() time.Time {
+	return clock.Now()
+}
+
+// A TestClock only moves when it is told to, or, if it is running, also moves with real time. Moving it on
+// fires any timers that are due, so background jobs run as if the time had really passed.
+type TestClock struct {
+	mu      sync.Mutex
+	now     time.Time // The clock's time at since
+	since   time.Time // When now was last set, in real time. Zero if the clock is stopped.
+	waiters []*clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// Make a test clock starting at the given time. A running clock also moves with real time (for a sandbox);
+// a stopped one only moves when told to (for tests).
+func NewTestClock(start time.Time, running bool) *TestClock {
+	c := &TestClock{now: start}
+	if running {
+		c.since = time.Now()
+	}
+	return c
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current()
+}
+
+// Called with the lock held
+func (c *TestClock) current() time.Time {
+	if c.since.IsZero() {
+		return c.now
+	}
+	return c.now.Add(time.Since(c.since))
+}
+
+func (c *TestClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &clockWaiter{at: c.current().Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.current()
+		return w.c
+	}
+	c.waiters = append(c.waiters, w)
+	if !c.since.IsZero() {
+		time.AfterFunc(d, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.fire()
+		})
+	}
+	return w.c
+}
+
+// Move the clock to a time, which must not be in its past
+func (c *TestClock) Set(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.Before(c.current()) {
+		return ErrClockBackwards
+	}
+	c.now = t
+	if !c.since.IsZero() {
+		c.since = time.Now()
+	}
+	c.fire()
+	return nil
+}
+
+// Move the clock on
+func (c *TestClock) Advance(d time.Duration) error {
+	c.mu.Lock()
+	now := c.current()
+	c.mu.Unlock()
+	return c.Set(now.Add(d))
+}
+
+// Fire the timers that are due, earliest first. Called with the lock held.
+func (c *TestClock) fire() {
+	now := c.current()
+	sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- now
+	}
+	c.waiters = pending
+}
+
+// The clock, as reported by the admin API
+type ClockState struct {
+	Time       UTCTime `json:"time"`
+	TimeTravel bool    `json:"timeTravel"` // Can the clock be moved on? Only with the TimeTravel option.
+}
+
+func clockState() *ClockState {
+	_, travel := clock.(*TestClock)
+	return &ClockState{Time: NewUTCTime(Now()), TimeTravel: travel}
+}
+
+func ReadClockHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, clockState())
+}
+
+// Move the clock on, if time travel is enabled
+func UpdateClockHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	testClock, ok := clock.(*TestClock)
+	if !ok {
+		HandleError(w, r, ErrTimeTravelOff, 0)
+		return
+	}
+
+	// Load the new time, or how far to move on, from the body
+	clockPatch := new(struct {
+		Time    UTCTime `json:"time"`
+		Advance string  `json:"advance"`
+	})
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(clockPatch)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case !clockPatch.Time.IsZero():
+		err = testClock.Set(clockPatch.Time.Time)
+	case clockPatch.Advance != "":
+		advance, perr := time.ParseDuration(clockPatch.Advance)
+		if perr != nil || advance <= 0 {
+			err = ErrInvalidAdvance
+		} else {
+			err = testClock.Advance(advance)
+		}
+	default:
+		err = ErrEmptyClockPatch
+	}
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, clockState())
+}
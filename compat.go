@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Field naming conventions for JSON responses
+const (
+	NamingCamel = "camel" // "notAfter", as documented in openapi.json
+	NamingSnake = "snake" // "not_after"
+)
+
+// Response envelopes for JSON responses
+const (
+	EnvelopeStandard = "standard" // HTTPResult
+	EnvelopeLegacy   = "legacy"   // The bare result, or a flat LegacyError
+)
+
+var (
+	ErrInvalidNaming   = NewError("invalid-naming", http.StatusBadRequest, "Unknown field naming. Use camel or snake.")
+	ErrInvalidEnvelope = NewError("invalid-envelope", http.StatusBadRequest, "Unknown envelope. Use standard or legacy.")
+)
+
+// Response profiles let clients built for the system certstore replaced keep working while they are ported. Each
+// API key (a bearer token, configured by its SHA256 hash as scope tokens are) may have a profile that renames the
+// fields of its JSON responses to snake_case, and replaces the envelope with the legacy one: a successful result is
+// sent bare, with its page cursors in the X-Next-Cursor and X-Prev-Cursor headers and its warnings dropped, and an
+// error is sent as a LegacyError. A profile can also ask for deprecated space-normalized PEM (see pemformat.go).
+// Requests without a profile get the documented responses.
+//
+// Profiles only change JSON responses sent through SendResult, SendPagedResult and HandleError, not CBOR or
+// protobuf ones, GraphQL, or the websocket. Every key is renamed, including the keys of maps. Request bodies are
+// never renamed: they always use the documented field names.
+
+// How JSON responses are shaped for an API key
+type ResponseProfile struct {
+	Naming    string `json:"naming"`    // NamingCamel or NamingSnake. Empty means camel.
+	Envelope  string `json:"envelope"`  // EnvelopeStandard or EnvelopeLegacy. Empty means standard.
+	PEMFormat string `json:"pemFormat"` // PEMFormatStandard or PEMFormatLegacy (see pemformat.go). Empty means standard.
+}
+
+// Response profiles, by the SHA256 hash (hex-encoded) of the API key they apply to
+type ResponseProfiles map[string]*ResponseProfile
+
+// The flat error shape of the legacy envelope
+type LegacyError struct {
+	Error  string            `json:"error"`
+	Code   string            `json:"code,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"` // Messages for every field that failed validation
+}
+
+// Get the response profile for the API key a request presents, as "Authorization: Bearer <token>", if it has one
+func RequestProfile(r *http.Request, config *RuntimeConfig) *ResponseProfile {
+	if len(config.ResponseProfiles) == 0 {
+		return nil
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(auth[7:])))
+	presented := hex.EncodeToString(hash[:])
+	for tokenHash, profile := range config.ResponseProfiles {
+		if strings.ToLower(tokenHash) == presented {
+			return profile
+		}
+	}
+	return nil
+}
+
+// Marshal a result as JSON, shaped by the request's response profile if it has one, with its PEM in the format the
+// request asked for (see pemformat.go)
+func marshalJSONResult(w http.ResponseWriter, r *http.Request, res *HTTPResult) ([]byte, error) {
+	var body []byte
+	var err error
+	profile := RequestProfile(r, Config())
+	if profile == nil {
+		body, err = json.Marshal(res)
+	} else {
+		body, err = profile.Marshal(w, res)
+	}
+	if transport := requestPEMTransport(r); err == nil && transport != nil && transport.format == PEMFormatLegacy {
+		return legacyPEMJSON(body)
+	}
+	return body, err
+}
+
+// Marshal a result as JSON in the profile's envelope and field naming
+func (profile *ResponseProfile) Marshal(w http.ResponseWriter, res *HTTPResult) ([]byte, error) {
+	var v interface{} = res
+	if profile.Envelope == EnvelopeLegacy {
+		v = legacyEnvelope(w, res)
+	}
+	body, err := json.Marshal(v)
+	if err != nil || profile.Naming != NamingSnake {
+		return body, err
+	}
+
+	// Rename the fields of the JSON, so every type is renamed the same way without knowing about profiles
+	var decoded interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err = d.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(renameKeys(decoded, snakeCase))
+}
+
+// Get what a result looks like in the legacy envelope
+func legacyEnvelope(w http.ResponseWriter, res *HTTPResult) interface{} {
+	if !res.Success {
+		legacy := &LegacyError{Error: res.Error, Code: res.Code}
+		if len(res.Errors) != 0 {
+			legacy.Fields = make(map[string]string, len(res.Errors))
+			for _, fieldErr := range res.Errors {
+				legacy.Fields[fieldErr.Field] = fieldErr.Message
+			}
+		}
+		return legacy
+	}
+	if res.Next != "" {
+		w.Header().Set("X-Next-Cursor", res.Next)
+	}
+	if res.Prev != "" {
+		w.Header().Set("X-Prev-Cursor", res.Prev)
+	}
+	return res.Result
+}
+
+// Rename every key of decoded JSON
+func renameKeys(v interface{}, rename func(string) string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			renamed[rename(key)] = renameKeys(value, rename)
+		}
+		return renamed
+	case []interface{}:
+		for i, value := range v {
+			v[i] = renameKeys(value, rename)
+		}
+		return v
+	}
+	return v
+}
+
+// Convert a camelCase name to snake_case. Runs of capitals are kept together, so "adminCSP" is "admin_csp".
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, c := range runes {
+		if unicode.IsUpper(c) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Validate the configured response profiles
+func validateResponseProfiles(profiles ResponseProfiles, errs *ValidationErrors) {
+	for hash, profile := range profiles {
+		field := "responseProfiles." + hash
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			errs.Add(field, ErrInvalidScopeToken)
+		}
+		if profile == nil {
+			errs.Add(field, ErrInvalidConfig)
+			continue
+		}
+		switch profile.Naming {
+		case "", NamingCamel, NamingSnake:
+		default:
+			errs.Add(field+".naming", ErrInvalidNaming)
+		}
+		switch profile.Envelope {
+		case "", EnvelopeStandard, EnvelopeLegacy:
+		default:
+			errs.Add(field+".envelope", ErrInvalidEnvelope)
+		}
+		switch profile.PEMFormat {
+		case "", PEMFormatStandard, PEMFormatLegacy:
+		default:
+			errs.Add(field+".pemFormat", ErrInvalidPEMFormat)
+		}
+	}
+}
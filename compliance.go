@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Compliance rules
+const (
+	RuleWeakSignature = "weak-signature" // Signed with SHA-1, or worse
+	RuleWeakKey       = "weak-key"       // A key shorter than the warning threshold (WarnRSABits or WarnECBits)
+	RuleExpired       = "expired"        // Past its NotAfter, allowing for clock skew
+	RuleLongValidity  = "long-validity"  // Valid for longer than the warning threshold (WarnValidity)
+
+	// Rules enforced on upload, that certificates stored before the policy was tightened may break
+	RuleKeyPolicy       = "key-policy"       // A key shorter than the minimum (MinimumRSABits or MinimumECBits)
+	RuleExtensionPolicy = "extension-policy" // Missing a required extension, or having a forbidden one
+	RuleValidityPolicy  = "validity-policy"  // Valid for longer than the validity policy allows
+)
+
+const (
+	MediaTypeCSV = "text/csv"
+
+	// Certificates are checked a batch at a time, so the report doesn't hold every certificate in memory at once
+	complianceBatchSize = 500
+
+	// Certificates expire whether or not the policy changes, so they are evaluated at least this often
+	complianceMaxAge = 24 * time.Hour
+)
+
+var (
+	ErrComplianceRunning = NewError("compliance-running", http.StatusConflict, "The certificates are already being evaluated. Please wait for the evaluation to finish.")
+	ErrInvalidViolations = NewError("invalid-violations", http.StatusInternalServerError, "Invalid compliance violations in the database.")
+)
+
+// The compliance report lists every stored certificate that breaks the current policy, with what to do about it.
+// The policy is the warning thresholds and upload policy in the configuration, so the report finds the
+// certificates that would be warned about or refused if they were uploaded today, and those that have expired since.
+//
+// Evaluating every certificate is slow, so the latest evaluation is saved and the report is read from it. Every
+// OptComplianceInterval the evaluation is run again if the policy has changed since (say MinimumRSABits was raised),
+// or if it is older than complianceMaxAge. Until then the report is marked stale. An administrator can also run it
+// straight away. Only one evaluation runs at a time, and a standby runs its own.
+
+// A way a certificate breaks the policy, and how to put it right
+type ComplianceViolation struct {
+	Rule        string `json:"rule"`
+	Detail      string `json:"detail"`
+	Remediation string `json:"remediation"`
+}
+
+// A certificate that breaks the policy
+type ComplianceFinding struct {
+	UserId     string               `json:"user"`
+	CertId     string               `json:"cert"`
+	CommonName string               `json:"commonName"`
+	Active     bool                 `json:"active"`
+	NotAfter   UTCTime              `json:"notAfter"`
+	Violations ComplianceViolations `json:"violations"`
+}
+
+type ComplianceReport struct {
+	Generated UTCTime              `json:"generated"`
+	Checked   int                  `json:"checked"` // The number of certificates checked
+	Policy    string               `json:"policy"`  // Fingerprint of the policy the certificates were checked against
+	Stale     bool                 `json:"stale"`   // The policy has changed since. The certificates will be checked again soon.
+	Findings  []*ComplianceFinding `json:"findings"`
+}
+
+// The violations of a finding, stored as JSON
+type ComplianceViolations []*ComplianceViolation
+
+// Value implements driver.Valuer for writing to the database.
+func (v ComplianceViolations) Value() (driver.Value, error) {
+	if v == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(v)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (v *ComplianceViolations) Scan(src interface{}) error {
+	var data []byte
+	switch s := src.(type) {
+	case []byte:
+		data = s
+	case string:
+		data = []byte(s)
+	default:
+		return ErrInvalidViolations
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Fingerprint the options a certificate is checked against, so a change to any of them can be noticed
+func CompliancePolicy(config *RuntimeConfig) string {
+	policy, _ := json.Marshal([]interface{}{
+		config.MinimumRSABits, config.MinimumECBits, config.WarnRSABits, config.WarnECBits, config.WarnValidity,
+		config.ClockSkew, config.RequiredExtensions, config.ForbiddenExtensions, config.ValidityPolicy,
+		config.PublicValidity, config.InternalValidity, config.InternalIssuers,
+	})
+	hash := sha256.Sum256(policy)
+	return hex.EncodeToString(hash[:])
+}
+
+// Check a certificate against the policy
+func CheckCompliance(cert *x509.Certificate, config *RuntimeConfig, now time.Time) []*ComplianceViolation {
+	var violations []*ComplianceViolation
+	details := NewCertificateDetails(cert)
+
+	switch cert.SignatureAlgorithm {
+	case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1, x509.MD5WithRSA, x509.MD2WithRSA:
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleWeakSignature,
+			Detail:      "Signed with " + details.SignatureAlgorithm,
+			Remediation: "Have the CA reissue the certificate with a SHA-256 signature. SHA-1 signatures can be forged, and browsers reject them.",
+		})
+	}
+
+	switch {
+	case details.KeyType == KeyTypeRSA && details.KeyBits < config.MinimumRSABits:
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleKeyPolicy,
+			Detail:      fmt.Sprintf("RSA key of %d bits, below the minimum of %d", details.KeyBits, config.MinimumRSABits),
+			Remediation: fmt.Sprintf("Generate a new RSA key of at least %d bits, have the certificate reissued for it, and revoke this one. It would be refused if it were uploaded today.", config.MinimumRSABits),
+		})
+	case details.KeyType == KeyTypeEC && details.KeyBits < config.MinimumECBits:
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleKeyPolicy,
+			Detail:      fmt.Sprintf("EC key of %d bits, below the minimum of %d", details.KeyBits, config.MinimumECBits),
+			Remediation: fmt.Sprintf("Generate a new EC key on a curve of at least %d bits, have the certificate reissued for it, and revoke this one. It would be refused if it were uploaded today.", config.MinimumECBits),
+		})
+	case details.KeyType == KeyTypeRSA && details.KeyBits < config.WarnRSABits:
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleWeakKey,
+			Detail:      fmt.Sprintf("RSA key of %d bits", details.KeyBits),
+			Remediation: fmt.Sprintf("Generate a new RSA key of at least %d bits, or an EC P-256 key, have the certificate reissued for it, and revoke this one.", config.WarnRSABits),
+		})
+	case details.KeyType == KeyTypeEC && details.KeyBits < config.WarnECBits:
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleWeakKey,
+			Detail:      fmt.Sprintf("EC key of %d bits", details.KeyBits),
+			Remediation: fmt.Sprintf("Generate a new EC key on a curve of at least %d bits, such as P-256, have the certificate reissued for it, and revoke this one.", config.WarnECBits),
+		})
+	}
+
+	if now.Add(-time.Duration(config.ClockSkew)).After(cert.NotAfter) {
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleExpired,
+			Detail:      "Expired " + cert.NotAfter.UTC().Format("2006-01-02"),
+			Remediation: "Renew the certificate and upload the new one. If it is no longer used, deactivate or delete it.",
+		})
+	}
+
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity > time.Duration(config.WarnValidity) {
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleLongValidity,
+			Detail:      fmt.Sprintf("Valid for %d days", int(validity.Hours()/24)),
+			Remediation: fmt.Sprintf("Have the certificate reissued with a validity of at most %d days. Browsers distrust public certificates valid for longer than 398 days.", int(time.Duration(config.WarnValidity).Hours()/24)),
+		})
+	}
+
+	if err := CheckExtensionPolicy(cert, config); err != nil {
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleExtensionPolicy,
+			Detail:      err.Error(),
+			Remediation: "Have the certificate reissued with the extensions this server requires, and without those it forbids.",
+		})
+	}
+
+	if err := CheckValidityPolicy(cert, config); err != nil {
+		violations = append(violations, &ComplianceViolation{
+			Rule:        RuleValidityPolicy,
+			Detail:      err.Error(),
+			Remediation: "Have the certificate reissued with a validity the policy allows.",
+		})
+	}
+
+	return violations
+}
+
+// Check every stored certificate against the policy
+func NewComplianceReport() (*ComplianceReport, error) {
+	config := Config()
+	now := Now()
+	report := &ComplianceReport{Generated: NewUTCTime(now), Policy: CompliancePolicy(config), Findings: []*ComplianceFinding{}}
+	err := DatabaseEachCert(complianceBatchSize, func(certData *CertificateData) error {
+		report.Checked++
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			return err
+		}
+		violations := CheckCompliance(cert, config, now)
+		if len(violations) == 0 {
+			return nil
+		}
+		report.Findings = append(report.Findings, &ComplianceFinding{
+			UserId:     certData.UserId,
+			CertId:     certData.Id,
+			CommonName: cert.Subject.CommonName,
+			Active:     certData.Active,
+			NotAfter:   certData.NotAfter,
+			Violations: violations,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Is an evaluation running?
+var complianceRunning int32
+
+// Check every stored certificate against the policy and save the report, replacing the one before
+func EvaluateCompliance() (*ComplianceReport, error) {
+	if !atomic.CompareAndSwapInt32(&complianceRunning, 0, 1) {
+		return nil, ErrComplianceRunning
+	}
+	defer atomic.StoreInt32(&complianceRunning, 0)
+
+	report, err := NewComplianceReport()
+	if err != nil {
+		return nil, err
+	}
+	err = DatabaseSaveCompliance(report)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Compliance evaluated: %d of %d certificates break the policy", len(report.Findings), report.Checked)
+	return report, nil
+}
+
+// Get the latest compliance report, evaluating the certificates if they never have been
+func LatestComplianceReport() (*ComplianceReport, error) {
+	report, err := DatabaseReadCompliance()
+	if err == ErrNotFound {
+		report, err = EvaluateCompliance()
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Stale = report.Policy != CompliancePolicy(Config())
+	return report, nil
+}
+
+// Should the certificates be evaluated again? They should if the policy has changed, or the evaluation is too old.
+func complianceDue(report *ComplianceReport, config *RuntimeConfig, now time.Time) bool {
+	return report == nil || report.Policy != CompliancePolicy(config) || now.Sub(report.Generated.Time) >= complianceMaxAge
+}
+
+// Evaluate the certificates every interval if they are due
+func RunComplianceEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if Replica.Standby() {
+			continue
+		}
+		report, err := DatabaseReadCompliance()
+		if err != nil && err != ErrNotFound {
+			log.Println("Unable to read the compliance evaluation:", err)
+			continue
+		}
+		if !complianceDue(report, Config(), Now()) {
+			continue
+		}
+		_, err = EvaluateCompliance()
+		if err != nil && err != ErrComplianceRunning {
+			log.Println("Unable to evaluate compliance:", err)
+		}
+	}
+}
+
+// Spreadsheets run cells that start with these as formulas. Common names are chosen by whoever made the certificate.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+// Write the report as CSV, with a row for each violation
+func (report *ComplianceReport) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"user", "cert", "commonName", "active", "notAfter", "rule", "detail", "remediation"})
+	for _, finding := range report.Findings {
+		for _, violation := range finding.Violations {
+			w.Write([]string{
+				finding.UserId,
+				finding.CertId,
+				csvSafe(finding.CommonName),
+				strconv.FormatBool(finding.Active),
+				finding.NotAfter.UTC().Format(time.RFC3339),
+				violation.Rule,
+				violation.Detail,
+				violation.Remediation,
+			})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Does the client want CSV rather than the usual encodings?
+func acceptsCSV(r *http.Request) bool {
+	for _, mediaType := range parseQualityList(r.Header.Get("Accept")) {
+		switch mediaType {
+		case MediaTypeCSV:
+			return true
+		case MediaTypeJSON, MediaTypeCBOR, MediaTypeProtobuf, "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// Get the compliance report, as JSON or, with "Accept: text/csv", as a CSV file
+func ReadComplianceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report, err := LatestComplianceReport()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	if acceptsCSV(r) {
+		body, err := report.CSV()
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
+		filename := "compliance-" + report.Generated.UTC().Format("2006-01-02") + ".csv"
+		w.Header().Set("Content-Type", mime.FormatMediaType(MediaTypeCSV, map[string]string{"charset": "utf-8"}))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		w.Write(body)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, report)
+}
+
+// Check every stored certificate against the policy now, rather than waiting for the compliance job
+func EvaluateComplianceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report, err := EvaluateCompliance()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, report)
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidConfig         = NewError("invalid-config", http.StatusBadRequest, "Invalid configuration. The configuration was not reloaded.")
+	ErrInvalidConfigDuration = NewError("invalid-config-duration", http.StatusBadRequest, "Invalid configuration. Durations must be strings such as \"5m\" or \"30s\".")
+)
+
+// RuntimeConfig holds the non-structural options, which can be changed while the server is running.
+// The Opt* variables in main.go are the defaults. The config file (OptConfigFile) only needs to contain the options
+// that differ from the defaults: removing an option from the file and reloading puts it back to its default.
+//
+// Options that need a restart to take effect (the database connection, request validation) are not included.
+type RuntimeConfig struct {
+	VerifyCertificate    bool                `json:"verifyCertificate"`
+	MinimumRSABits       int                 `json:"minimumRSABits"`
+	MinimumECBits        int                 `json:"minimumECBits"`
+	DefaultPageSize      int                 `json:"defaultPageSize"`
+	MaxPageSize          int                 `json:"maxPageSize"`
+	StorageCompression   bool                `json:"storageCompression"`
+	KeyFormat            string              `json:"keyFormat"`       // How private keys are PEM encoded: "traditional" or "pkcs8"
+	ParseMode            string              `json:"parseMode"`       // How uploaded PEM is parsed: "strict" or "lenient"
+	ExclusiveActive      bool                `json:"exclusiveActive"` // Only one active certificate per name, per user (see exclusive.go)
+	RejectExpired        bool                `json:"rejectExpired"`   // Refuse certificates that have already expired (see expired.go)
+	ClockSkew            Duration            `json:"clockSkew"`
+	MaxNameLength        int                 `json:"maxNameLength"`
+	MaxEmailLength       int                 `json:"maxEmailLength"`
+	MaxNotesLength       int                 `json:"maxNotesLength"`
+	MaxReasonLength      int                 `json:"maxReasonLength"`
+	RequireReason        bool                `json:"requireReason"`
+	VerifyEmailMX        bool                `json:"verifyEmailMX"`
+	WebSocketBuffer      int                 `json:"webSocketBuffer"`
+	WarnRSABits          int                 `json:"warnRSABits"`
+	WarnECBits           int                 `json:"warnECBits"`
+	WarnValidity         Duration            `json:"warnValidity"`
+	WarnSANConflicts     bool                `json:"warnSANConflicts"`
+	MaxAttachmentSize    int                 `json:"maxAttachmentSize"`
+	MaxRequestSize       int                 `json:"maxRequestSize"`
+	MaxAttachments       int                 `json:"maxAttachments"`
+	AttachmentTypes      []string            `json:"attachmentTypes"`
+	RequiredExtensions   []string            `json:"requiredExtensions"`   // OIDs of extensions every new certificate must have
+	ForbiddenExtensions  []string            `json:"forbiddenExtensions"`  // OIDs of extensions no new certificate may have
+	ForbiddenSignatures  []string            `json:"forbiddenSignatures"`  // Signature algorithms no new certificate may be signed with, such as "SHA1-RSA"
+	RequiredKeyUsages    []string            `json:"requiredKeyUsages"`    // Key usages every new certificate must allow, such as "digitalSignature"
+	RequiredExtKeyUsages []string            `json:"requiredExtKeyUsages"` // Extended key usages every new certificate must allow, such as "serverAuth"
+	RequireExtKeyUsage   bool                `json:"requireExtKeyUsage"`   // Whether new certificates must have the extended key usage extension for RequiredExtKeyUsages
+	AcceptanceRules      AcceptanceRules     `json:"acceptanceRules"`      // Key types, validity, issuers, domains and EKUs new certificates must meet (see acceptance.go)
+	ValidityPolicy       string              `json:"validityPolicy"`       // "off", "warn" or "reject" certificates valid for too long
+	PublicValidity       Duration            `json:"publicValidity"`       // The longest a publicly trusted server certificate may be valid for
+	InternalValidity     Duration            `json:"internalValidity"`     // The longest a certificate from an internal CA may be valid for. Zero for no limit.
+	InternalIssuers      []string            `json:"internalIssuers"`      // Distinguished names of internal CAs
+	DomainPolicy         string              `json:"domainPolicy"`         // "off", "warn" or "reject" certificates with names outside the user's domains
+	VerifiedDomainsOnly  bool                `json:"verifiedDomainsOnly"`  // Do only verified domains count for the domain policy?
+	CAAIdentities        []string            `json:"caaIdentities"`        // The issuer domain names CAA records name the built-in CA by (see caa.go). Empty turns CAA checking off.
+	CAAResolver          string              `json:"caaResolver"`          // The DNS server CAA records are looked up from, as host:port. Empty for the system's.
+	OCSPCheck            string              `json:"ocspCheck"`            // "off", "soft-fail" or "hard-fail" checking new certificates' OCSP status (see ocsp.go)
+	CTPolicy             string              `json:"ctPolicy"`             // "off", "warn" or "reject" publicly trusted certificates without enough valid SCTs (see ct.go)
+	CTMinSCTs            int                 `json:"ctMinSCTs"`            // The fewest valid SCTs a publicly trusted certificate must have
+	CRLCheck             bool                `json:"crlCheck"`             // Are stored certificates checked against their CRLs (see crl.go)?
+	RevocationInterval   Duration            `json:"revocationInterval"`   // How often active certificates' revocation status is checked again (see revocation.go). Zero for never.
+	TrustSystemRoots     bool                `json:"trustSystemRoots"`     // Are the system's roots trusted alongside custom roots (see trustroots.go)?
+	SlowQueryThreshold   Duration            `json:"slowQueryThreshold"`   // Statements slower than this are logged (see querystats.go). Zero for none.
+	ChangeFreezes        []*ChangeFreeze     `json:"changeFreezes"`        // When automated and bulk changes wait (see freeze.go)
+	ExportLinkTTL        Duration            `json:"exportLinkTTL"`
+	SessionTTL           Duration            `json:"sessionTTL"`
+	ImpersonationTTL     Duration            `json:"impersonationTTL"`
+	MaxMintValidity      Duration            `json:"maxMintValidity"`
+	MaxBatchDevices      int                 `json:"maxBatchDevices"`
+	AuthMaxFailures      int                 `json:"authMaxFailures"`   // Failed authentication attempts before a client or account is locked out
+	AuthFailureWindow    Duration            `json:"authFailureWindow"` // How long failed attempts are remembered for
+	AuthLockout          Duration            `json:"authLockout"`       // How long a locked out client or account must wait
+	AuthDelay            Duration            `json:"authDelay"`         // Delay after the first failed attempt, doubling with each failure after
+	StatusRateLimit      int                 `json:"statusRateLimit"`   // Requests per minute each client may make for the public status
+	CSRRateLimit         int                 `json:"csrRateLimit"`      // CSRs each client may submit for approval per hour
+	MaxPendingCSRs       int                 `json:"maxPendingCSRs"`    // The most CSRs waiting for approval at once
+	HSTSMaxAge           Duration            `json:"hstsMaxAge"`        // Zero turns HSTS off
+	HSTSSubdomains       bool                `json:"hstsSubdomains"`    // Should HSTS cover subdomains too?
+	FrameOptions         string              `json:"frameOptions"`      // DENY, SAMEORIGIN, or empty for no header
+	ReferrerPolicy       string              `json:"referrerPolicy"`    // Empty for no header
+	CSP                  string              `json:"csp"`               // Content-Security-Policy header
+	AdminCSP             string              `json:"adminCSP"`          // For /admin, where the admin UI is served
+	AnomalyExports       int                 `json:"anomalyExports"`    // Key exports by one principal within the anomaly window before it is an anomaly
+	AnomalyWindow        Duration            `json:"anomalyWindow"`     // Also how long before the same anomaly is reported again
+	AnomalySpike         int                 `json:"anomalySpike"`      // How many times its usual requests per minute a principal must make for a spike
+	AdminUsers           map[string]string   `json:"adminUsers"`        // Administrators' usernames and bcrypt password hashes
+	ScopeTokens          map[string][]string `json:"scopeTokens"`       // SHA256 hashes of the tokens granting each scope (see scopes.go)
+	ResponseProfiles     ResponseProfiles    `json:"responseProfiles"`  // How JSON responses are shaped for each API key (see compat.go)
+	TrustDomains         TrustDomains        `json:"trustDomains"`      // SPIFFE trust domains and their CA certificates (see spiffe.go)
+	CSRIssuer            *CSRIssuer          `json:"csrIssuer"`         // The CA certificate issuing approved CSRs (see csrqueue.go). Null turns CSR submission off.
+	CSRAutoApprove       []*CSRApprovalRule  `json:"csrAutoApprove"`    // Rules for approving CSRs without review (see autoapprove.go)
+	Flags                map[string]bool     `json:"flags"`             // Feature flags that differ from their defaults (see flags.go)
+}
+
+// A Duration is a time.Duration written in config files as a string ("5m", "30s")
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return ErrInvalidConfigDuration
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return ErrInvalidConfigDuration
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// The active configuration. It is only ever replaced as a whole, so readers always see a consistent config.
+var (
+	activeConfig atomic.Value
+	reloadMu     sync.Mutex
+)
+
+// Get the active configuration. Callers that read several options should call this once and keep the result,
+// so that they don't see a mix of two configurations if a reload happens part way through.
+// Until a configuration has been loaded, the Opt* defaults are used.
+func Config() *RuntimeConfig {
+	if config, ok := activeConfig.Load().(*RuntimeConfig); ok {
+		return config
+	}
+	return DefaultConfig()
+}
+
+// Get the default configuration, from the Opt* variables
+func DefaultConfig() *RuntimeConfig {
+	config := &RuntimeConfig{
+		VerifyCertificate:    OptVerifyCertificate,
+		MinimumRSABits:       OptMinimumRSABits,
+		MinimumECBits:        OptMinimumECBits,
+		DefaultPageSize:      OptDefaultPageSize,
+		MaxPageSize:          OptMaxPageSize,
+		StorageCompression:   OptStorageCompression,
+		KeyFormat:            OptKeyFormat,
+		ParseMode:            OptParseMode,
+		ExclusiveActive:      OptExclusiveActive,
+		RejectExpired:        OptRejectExpired,
+		ClockSkew:            Duration(OptClockSkew),
+		MaxNameLength:        OptMaxNameLength,
+		MaxEmailLength:       OptMaxEmailLength,
+		MaxNotesLength:       OptMaxNotesLength,
+		MaxReasonLength:      OptMaxReasonLength,
+		RequireReason:        OptRequireReason,
+		VerifyEmailMX:        OptVerifyEmailMX,
+		WebSocketBuffer:      OptWebSocketBuffer,
+		WarnRSABits:          OptWarnRSABits,
+		WarnECBits:           OptWarnECBits,
+		WarnValidity:         Duration(OptWarnValidity),
+		WarnSANConflicts:     OptWarnSANConflicts,
+		MaxAttachmentSize:    OptMaxAttachmentSize,
+		MaxRequestSize:       OptMaxRequestSize,
+		MaxAttachments:       OptMaxAttachments,
+		AttachmentTypes:      append([]string(nil), OptAttachmentTypes...),
+		RequiredExtensions:   append([]string(nil), OptRequiredExtensions...),
+		ForbiddenExtensions:  append([]string(nil), OptForbiddenExtensions...),
+		ForbiddenSignatures:  append([]string(nil), OptForbiddenSignatures...),
+		RequiredKeyUsages:    append([]string(nil), OptRequiredKeyUsages...),
+		RequiredExtKeyUsages: append([]string(nil), OptRequiredExtKeyUsages...),
+		RequireExtKeyUsage:   OptRequireExtKeyUsage,
+		AcceptanceRules:      OptAcceptanceRules.copy(),
+		ValidityPolicy:       OptValidityPolicy,
+		DomainPolicy:         OptDomainPolicy,
+		VerifiedDomainsOnly:  OptVerifiedDomainsOnly,
+		CAAIdentities:        append([]string(nil), OptCAAIdentities...),
+		CAAResolver:          OptCAAResolver,
+		OCSPCheck:            OptOCSPCheck,
+		CTPolicy:             OptCTPolicy,
+		CTMinSCTs:            OptCTMinSCTs,
+		CRLCheck:             OptCRLCheck,
+		RevocationInterval:   Duration(OptRevocationInterval),
+		TrustSystemRoots:     OptTrustSystemRoots,
+		SlowQueryThreshold:   Duration(OptSlowQueryThreshold),
+		PublicValidity:       Duration(OptPublicValidity),
+		InternalValidity:     Duration(OptInternalValidity),
+		InternalIssuers:      append([]string(nil), OptInternalIssuers...),
+		ChangeFreezes:        append([]*ChangeFreeze(nil), OptChangeFreezes...),
+		ExportLinkTTL:        Duration(OptExportLinkTTL),
+		SessionTTL:           Duration(OptSessionTTL),
+		ImpersonationTTL:     Duration(OptImpersonationTTL),
+		MaxMintValidity:      Duration(OptMaxMintValidity),
+		MaxBatchDevices:      OptMaxBatchDevices,
+		AuthMaxFailures:      OptAuthMaxFailures,
+		AuthFailureWindow:    Duration(OptAuthFailureWindow),
+		AuthLockout:          Duration(OptAuthLockout),
+		AuthDelay:            Duration(OptAuthDelay),
+		StatusRateLimit:      OptStatusRateLimit,
+		CSRRateLimit:         OptCSRRateLimit,
+		MaxPendingCSRs:       OptMaxPendingCSRs,
+		HSTSMaxAge:           Duration(OptHSTSMaxAge),
+		HSTSSubdomains:       OptHSTSSubdomains,
+		FrameOptions:         OptFrameOptions,
+		ReferrerPolicy:       OptReferrerPolicy,
+		CSP:                  OptCSP,
+		AdminCSP:             OptAdminCSP,
+		AnomalyExports:       OptAnomalyExports,
+		AnomalyWindow:        Duration(OptAnomalyWindow),
+		AnomalySpike:         OptAnomalySpike,
+		AdminUsers:           make(map[string]string, len(OptAdminUsers)),
+		ScopeTokens:          make(map[string][]string, len(OptScopeTokens)),
+		ResponseProfiles:     make(ResponseProfiles, len(OptResponseProfiles)),
+		TrustDomains:         make(TrustDomains, len(OptTrustDomains)),
+		CSRIssuer:            OptCSRIssuer,
+		CSRAutoApprove:       append([]*CSRApprovalRule(nil), OptCSRAutoApprove...),
+	}
+	for username, hash := range OptAdminUsers {
+		config.AdminUsers[username] = hash
+	}
+	for scope, hashes := range OptScopeTokens {
+		config.ScopeTokens[scope] = append([]string(nil), hashes...)
+	}
+	for hash, profile := range OptResponseProfiles {
+		config.ResponseProfiles[hash] = profile
+	}
+	for name, domain := range OptTrustDomains {
+		config.TrustDomains[name] = domain
+	}
+	return config
+}
+
+// Parse a JSON config file over the defaults. Unknown options are rejected, so typos and structural options
+// (which can't be reloaded) are noticed rather than silently ignored.
+func ParseConfig(data []byte) (*RuntimeConfig, error) {
+	config := DefaultConfig()
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err := d.Decode(config)
+	if err != nil {
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate that the options are usable. Every invalid option is reported.
+func (config *RuntimeConfig) Validate() error {
+	var errs ValidationErrors
+	if config.MinimumRSABits <= 0 {
+		errs.Add("minimumRSABits", ErrInvalidConfig)
+	}
+	if config.MinimumECBits <= 0 {
+		errs.Add("minimumECBits", ErrInvalidConfig)
+	}
+	if config.MaxPageSize <= 0 {
+		errs.Add("maxPageSize", ErrInvalidConfig)
+	}
+	if config.DefaultPageSize <= 0 || config.DefaultPageSize > config.MaxPageSize {
+		errs.Add("defaultPageSize", ErrInvalidConfig)
+	}
+	if config.KeyFormat != KeyFormatTraditional && config.KeyFormat != KeyFormatPKCS8 {
+		errs.Add("keyFormat", ErrInvalidConfig)
+	}
+	if config.ParseMode != ParseModeStrict && config.ParseMode != ParseModeLenient {
+		errs.Add("parseMode", ErrInvalidConfig)
+	}
+	if config.ClockSkew < 0 {
+		errs.Add("clockSkew", ErrInvalidConfig)
+	}
+	if config.MaxNameLength <= 0 {
+		errs.Add("maxNameLength", ErrInvalidConfig)
+	}
+	if config.MaxEmailLength <= 0 {
+		errs.Add("maxEmailLength", ErrInvalidConfig)
+	}
+	if config.MaxNotesLength <= 0 {
+		errs.Add("maxNotesLength", ErrInvalidConfig)
+	}
+	if config.MaxReasonLength <= 0 {
+		errs.Add("maxReasonLength", ErrInvalidConfig)
+	}
+	if config.WebSocketBuffer <= 0 {
+		errs.Add("webSocketBuffer", ErrInvalidConfig)
+	}
+	if config.WarnValidity <= 0 {
+		errs.Add("warnValidity", ErrInvalidConfig)
+	}
+	if config.MaxAttachmentSize <= 0 {
+		errs.Add("maxAttachmentSize", ErrInvalidConfig)
+	}
+	if config.MaxRequestSize <= 0 {
+		errs.Add("maxRequestSize", ErrInvalidConfig)
+	}
+	if config.MaxAttachments < 0 {
+		errs.Add("maxAttachments", ErrInvalidConfig)
+	}
+	for i, mediaType := range config.AttachmentTypes {
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+			errs.Add("attachmentTypes["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	for i, oid := range config.RequiredExtensions {
+		if _, err := ParseOID(oid); err != nil {
+			errs.Add("requiredExtensions["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	for i, oid := range config.ForbiddenExtensions {
+		if _, err := ParseOID(oid); err != nil {
+			errs.Add("forbiddenExtensions["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	for i, name := range config.ForbiddenSignatures {
+		if !isSignatureAlgorithm(name) {
+			errs.Add("forbiddenSignatures["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	for i, name := range config.RequiredKeyUsages {
+		if _, ok := keyUsageNames[name]; !ok {
+			errs.Add("requiredKeyUsages["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	for i, usage := range config.RequiredExtKeyUsages {
+		if !isExtKeyUsageRule(usage) {
+			errs.Add("requiredExtKeyUsages["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	config.AcceptanceRules.validate("acceptanceRules", &errs)
+	if config.ValidityPolicy != ValidityPolicyOff && config.ValidityPolicy != ValidityPolicyWarn && config.ValidityPolicy != ValidityPolicyReject {
+		errs.Add("validityPolicy", ErrInvalidConfig)
+	}
+	if config.PublicValidity <= 0 {
+		errs.Add("publicValidity", ErrInvalidConfig)
+	}
+	if config.InternalValidity < 0 {
+		errs.Add("internalValidity", ErrInvalidConfig)
+	}
+	if config.DomainPolicy != DomainPolicyOff && config.DomainPolicy != DomainPolicyWarn && config.DomainPolicy != DomainPolicyReject {
+		errs.Add("domainPolicy", ErrInvalidConfig)
+	}
+	for i, identity := range config.CAAIdentities {
+		if !isDNSName(identity) {
+			errs.Add("caaIdentities["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+	if config.CAAResolver != "" {
+		if _, _, err := net.SplitHostPort(config.CAAResolver); err != nil {
+			errs.Add("caaResolver", ErrInvalidConfig)
+		}
+	}
+	if config.OCSPCheck != OCSPCheckOff && config.OCSPCheck != OCSPCheckSoftFail && config.OCSPCheck != OCSPCheckHardFail {
+		errs.Add("ocspCheck", ErrInvalidConfig)
+	}
+	if config.CTPolicy != CTPolicyOff && config.CTPolicy != CTPolicyWarn && config.CTPolicy != CTPolicyReject {
+		errs.Add("ctPolicy", ErrInvalidConfig)
+	}
+	if config.CTMinSCTs < 1 {
+		errs.Add("ctMinSCTs", ErrInvalidConfig)
+	}
+	if config.RevocationInterval != 0 && time.Duration(config.RevocationInterval) < minRevocationInterval {
+		errs.Add("revocationInterval", ErrInvalidConfig)
+	}
+	if config.SlowQueryThreshold < 0 {
+		errs.Add("slowQueryThreshold", ErrInvalidConfig)
+	}
+	validateChangeFreezes(config.ChangeFreezes, &errs)
+	if config.ExportLinkTTL <= 0 {
+		errs.Add("exportLinkTTL", ErrInvalidConfig)
+	}
+	if config.SessionTTL <= 0 {
+		errs.Add("sessionTTL", ErrInvalidConfig)
+	}
+	if config.ImpersonationTTL <= 0 {
+		errs.Add("impersonationTTL", ErrInvalidConfig)
+	}
+	if config.MaxMintValidity <= 0 {
+		errs.Add("maxMintValidity", ErrInvalidConfig)
+	}
+	if config.MaxBatchDevices <= 0 {
+		errs.Add("maxBatchDevices", ErrInvalidConfig)
+	}
+	if config.AuthMaxFailures <= 0 {
+		errs.Add("authMaxFailures", ErrInvalidConfig)
+	}
+	if config.AuthFailureWindow <= 0 {
+		errs.Add("authFailureWindow", ErrInvalidConfig)
+	}
+	if config.AuthLockout <= 0 {
+		errs.Add("authLockout", ErrInvalidConfig)
+	}
+	if config.AuthDelay < 0 {
+		errs.Add("authDelay", ErrInvalidConfig)
+	}
+	if config.StatusRateLimit <= 0 {
+		errs.Add("statusRateLimit", ErrInvalidConfig)
+	}
+	if config.CSRRateLimit <= 0 {
+		errs.Add("csrRateLimit", ErrInvalidConfig)
+	}
+	if config.MaxPendingCSRs <= 0 {
+		errs.Add("maxPendingCSRs", ErrInvalidConfig)
+	}
+	validateSecurityHeaders(config, &errs)
+	if config.AnomalyExports <= 0 {
+		errs.Add("anomalyExports", ErrInvalidConfig)
+	}
+	if config.AnomalyWindow <= 0 {
+		errs.Add("anomalyWindow", ErrInvalidConfig)
+	}
+	if config.AnomalySpike <= 1 {
+		errs.Add("anomalySpike", ErrInvalidConfig)
+	}
+	validateAdminUsers(config.AdminUsers, &errs)
+	validateScopeTokens(config.ScopeTokens, &errs)
+	validateResponseProfiles(config.ResponseProfiles, &errs)
+	validateTrustDomains(config.TrustDomains, &errs)
+	validateCSRIssuer(config.CSRIssuer, &errs)
+	validateApprovalRules(config.CSRAutoApprove, &errs)
+	for name := range config.Flags {
+		if _, ok := FeatureFlags[name]; !ok {
+			errs.Add("flags."+name, ErrUnknownFlag)
+		}
+	}
+	return errs.Err()
+}
+
+// Reload the configuration from OptConfigFile, along with the error message catalogs and the trust roots.
+// If the new configuration is invalid the active configuration is left alone.
+func ReloadConfig() (*RuntimeConfig, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config := DefaultConfig()
+	if OptConfigFile != "" {
+		data, err := ioutil.ReadFile(OptConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		config, err = ParseConfig(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if OptMessageCatalogDir != "" {
+		err := LoadMessageCatalogs(OptMessageCatalogDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The trust roots are read again too, so changes made on other instances are picked up
+	err := LoadTrustRoots()
+	if err != nil {
+		return nil, err
+	}
+	err = CTLogs.Load(OptCTLogList)
+	if err != nil {
+		return nil, err
+	}
+
+	activeConfig.Store(config)
+	return config, nil
+}
+
+// Reload the configuration whenever the process receives SIGHUP
+func WatchConfigReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			_, err := ReloadConfig()
+			if err != nil {
+				log.Println("Configuration not reloaded:", err)
+				continue
+			}
+			log.Println("Configuration reloaded")
+		}
+	}()
+}
+
+func ReadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, Config())
+}
+
+func ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	config, err := ReloadConfig()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	log.Println("Configuration reloaded")
+
+	SendResult(w, r, config)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Certificates stored before their names were indexed are indexed this many at a time
+const nameIndexBatchSize = 500
+
+var (
+	WarnSANConflict = NewError("san-conflict", 0, "Another user holds an active certificate for some of the same names. Check that it wasn't issued for another team's domains by mistake.")
+)
+
+// The names each certificate covers (as in exclusive.go: its DNS names and wildcards, in lower case, and IP addresses)
+// are indexed, so certificates for the same names held by different users can be found. That usually means a
+// certificate was issued for another team's domains by mistake. Administrators can list every name covered by more
+// than one user's active certificates, and if the WarnSANConflicts option is on, uploading a certificate whose names
+// are covered by another user's active certificate is allowed with a warning.
+
+// An active certificate covering a name
+type SANHolder struct {
+	UserId string `json:"user"`
+	CertId string `json:"cert"`
+	Name   string `json:"name"` // The name as the certificate has it, which may be a wildcard covering the conflicting name
+}
+
+// A name covered by more than one user's active certificates
+type SANConflict struct {
+	Name    string       `json:"name"`
+	Users   int          `json:"users"`
+	Holders []*SANHolder `json:"holders"`
+}
+
+// Escape a name for a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Get the indexed names that may overlap names: the names themselves, the wildcards covering them, and LIKE patterns
+// for the names the wildcards among them cover. The candidates are checked with namesOverlap.
+func sanCandidates(names []string) (exact, patterns []string) {
+	for _, name := range names {
+		exact = append(exact, name)
+		if strings.HasPrefix(name, "*.") {
+			patterns = append(patterns, "%"+escapeLike(name[1:]))
+		} else if i := strings.IndexByte(name, '.'); i > 0 {
+			exact = append(exact, "*"+name[i:])
+		}
+	}
+	return exact, patterns
+}
+
+// Group the holders of names, ordered by name, into conflicts. A name's holders include the certificates for a
+// wildcard covering it. A conflict between a wildcard and a name it covers is only reported for the name.
+func sanConflicts(holders []*SANHolder) []*SANConflict {
+	var names []string
+	byName := make(map[string][]*SANHolder)
+	for _, holder := range holders {
+		if _, ok := byName[holder.Name]; !ok {
+			names = append(names, holder.Name)
+		}
+		byName[holder.Name] = append(byName[holder.Name], holder)
+	}
+
+	conflicts := []*SANConflict{}
+	for _, name := range names {
+		group := byName[name]
+		if i := strings.IndexByte(name, '.'); i > 0 && !strings.HasPrefix(name, "*.") {
+			group = append(append([]*SANHolder{}, group...), byName["*"+name[i:]]...)
+		}
+		users := make(map[string]bool)
+		for _, holder := range group {
+			users[holder.UserId] = true
+		}
+		if len(users) > 1 {
+			conflicts = append(conflicts, &SANConflict{Name: name, Users: len(users), Holders: group})
+		}
+	}
+	return conflicts
+}
+
+// Warn about a new certificate if another user holds an active certificate for the same names, if the
+// WarnSANConflicts option is on. Failing to check isn't an error.
+func sanConflictWarnings(certData *CertificateData, field string) ValidationErrors {
+	if !Config().WarnSANConflicts {
+		return nil
+	}
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil
+	}
+	names := certNames(cert)
+	holders, err := DatabaseListNameConflicts(certData.UserId, names)
+	if err != nil {
+		log.Println("Unable to check for name conflicts:", err)
+		return nil
+	}
+	var warnings ValidationErrors
+	for _, holder := range holders {
+		if namesOverlap([]string{holder.Name}, names) {
+			warnings.Add(field, WarnSANConflict)
+			break
+		}
+	}
+	return warnings
+}
+
+// Index the names of certificates stored before names were indexed
+func BackfillNames() {
+	// A standby's certificates are the primary's, and are indexed there
+	if Replica.Standby() {
+		return
+	}
+	total := 0
+	for {
+		count, err := DatabaseBackfillNames(nameIndexBatchSize)
+		total += count
+		if err != nil {
+			log.Println("Unable to index certificates' names:", err)
+			return
+		}
+		if count < nameIndexBatchSize {
+			break
+		}
+	}
+	if total != 0 {
+		log.Printf("Indexed the names of %d certificates", total)
+	}
+}
+
+// List every name covered by more than one user's active certificates
+func ListSANConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	holders, err := DatabaseListActiveNames()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, sanConflicts(holders))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Certificates are read a batch at a time, as for the compliance report
+	crlBatchSize = 500
+
+	// How long a CRL is used for without a next update time, or past a next update that is too far off
+	crlMaxAge = 24 * time.Hour
+
+	// How long fetching a CRL may take, and the largest one read
+	crlTimeout = 30 * time.Second
+	maxCRLSize = 32 << 20
+)
+
+var (
+	ErrCRLRunning = NewError("crl-running", http.StatusConflict, "The CRLs are already being refreshed. Please wait for the refresh to finish.")
+	ErrCRLIssuer  = errors.New("the CRL's issuer isn't in any of its certificates' chains, so it can't be verified")
+)
+
+// Some internal CAs only publish CRLs, so stored certificates are checked against the CRLs named in their CRL
+// distribution points extension. Every OptCRLInterval, if the CRLCheck option is on, each http(s) CRL is fetched
+// again if it is due (past its next update, or older than crlMaxAge), verified against the certificate's issuer
+// from its chain, and cached in the database, so a restart or an unreachable CA doesn't lose it. Certificates on a
+// CRL are marked revoked, for every user holding them, with an audit entry and an update event for each. A certificate
+// stays revoked once marked, even after it drops off the CRL when it expires. Marking doesn't deactivate it: the
+// revocation check does, if it is on (see revocation.go). An administrator can refresh straight
+// away, and list the cached CRLs with when they were fetched and any error. A standby doesn't refresh.
+
+// A cached CRL, and how its last refresh went
+type CachedCRL struct {
+	URL        string  `json:"url"`
+	Issuer     string  `json:"issuer"` // Empty if it has never been fetched
+	ThisUpdate UTCTime `json:"thisUpdate"`
+	NextUpdate UTCTime `json:"nextUpdate"` // Null if the CRL doesn't say
+	Fetched    UTCTime `json:"fetched"`    // When the cached CRL was fetched. Null if it never has been.
+	Checked    UTCTime `json:"checked"`    // When it was last refreshed, or tried to be
+	Entries    int     `json:"entries"`    // Revoked certificates on the CRL
+	Error      string  `json:"error,omitempty"`
+	Data       []byte  `json:"-"` // DER
+}
+
+// What a refresh did
+type CRLRefresh struct {
+	Checked int      `json:"checked"` // Certificates naming a CRL
+	CRLs    int      `json:"crls"`
+	Fetched int      `json:"fetched"` // CRLs fetched, rather than used from the cache
+	Failed  int      `json:"failed"`  // CRLs that couldn't be fetched or verified
+	Revoked []string `json:"revoked"` // Certificates newly marked revoked
+}
+
+// A stored certificate naming a CRL, with the users holding it
+type crlCert struct {
+	id      string
+	cert    *x509.Certificate
+	issuer  *x509.Certificate // From its chain. Nil if it isn't there.
+	holders []string
+	revoked bool // Already marked
+}
+
+// Fetches a CRL. Replaced in tests.
+var fetchCRL = httpFetchCRL
+
+// Get a CRL, as DER
+func httpFetchCRL(rawurl string) ([]byte, error) {
+	client := &http.Client{Timeout: crlTimeout}
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("CRL " + rawurl + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCRLSize {
+		return nil, errors.New("CRL " + rawurl + " is too large")
+	}
+	// Some CAs publish PEM, though RFC 5280 says DER
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	return data, nil
+}
+
+// The CRLs a certificate names that can be fetched
+func crlURLs(cert *x509.Certificate) []string {
+	var urls []string
+	for _, point := range cert.CRLDistributionPoints {
+		if u, err := url.Parse(point); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			urls = append(urls, point)
+		}
+	}
+	return urls
+}
+
+// Is a cached CRL due to be fetched again?
+func crlDue(cached *CachedCRL, now time.Time) bool {
+	if cached == nil || cached.Fetched.IsZero() || now.Sub(cached.Fetched.Time) >= crlMaxAge {
+		return true
+	}
+	return !cached.NextUpdate.IsZero() && !now.Before(cached.NextUpdate.Time)
+}
+
+// Verify a CRL against the issuer of any of the certificates naming it
+func verifyCRL(crl *x509.RevocationList, certs []*crlCert) error {
+	for _, c := range certs {
+		if c.issuer != nil && bytes.Equal(c.issuer.RawSubject, crl.RawIssuer) {
+			return crl.CheckSignatureFrom(c.issuer)
+		}
+	}
+	return ErrCRLIssuer
+}
+
+// Get a CRL, from the cache if it isn't due, or else fetched and verified. A CRL that can't be fetched is used from
+// the cache meanwhile, if it is there. fetched is whether it was fetched.
+func refreshCRL(rawurl string, certs []*crlCert, now time.Time) (crl *x509.RevocationList, fetched bool, err error) {
+	cached, err := DatabaseReadCRL(rawurl)
+	if err != nil && err != ErrNotFound {
+		return nil, false, err
+	}
+	if cached != nil && !crlDue(cached, now) {
+		crl, err = x509.ParseRevocationList(cached.Data)
+		if err == nil {
+			return crl, false, nil
+		}
+	}
+	if cached == nil {
+		cached = &CachedCRL{URL: rawurl}
+	}
+	cached.Checked = NewUTCTime(now)
+
+	data, err := fetchCRL(rawurl)
+	if err == nil {
+		crl, err = x509.ParseRevocationList(data)
+	}
+	if err == nil {
+		err = verifyCRL(crl, certs)
+	}
+	if err != nil {
+		cached.Error = err.Error()
+		saveErr := DatabaseSaveCRL(cached)
+		if saveErr != nil {
+			return nil, false, saveErr
+		}
+		if cached.Data != nil {
+			if crl, parseErr := x509.ParseRevocationList(cached.Data); parseErr == nil {
+				return crl, false, err
+			}
+		}
+		return nil, false, err
+	}
+
+	cached.Issuer, cached.Data, cached.Error, cached.Entries = crl.Issuer.String(), data, "", len(crl.RevokedCertificateEntries)
+	cached.ThisUpdate, cached.NextUpdate, cached.Fetched = NewUTCTime(crl.ThisUpdate), NewUTCTime(crl.NextUpdate), NewUTCTime(now)
+	err = DatabaseSaveCRL(cached)
+	if err != nil {
+		return nil, false, err
+	}
+	return crl, true, nil
+}
+
+// A CRL, with its entries by serial number
+type crlIndex struct {
+	crl     *x509.RevocationList
+	entries map[string]*x509.RevocationListEntry
+}
+
+func newCRLIndex(crl *x509.RevocationList) *crlIndex {
+	index := &crlIndex{crl: crl, entries: make(map[string]*x509.RevocationListEntry, len(crl.RevokedCertificateEntries))}
+	for i := range crl.RevokedCertificateEntries {
+		entry := &crl.RevokedCertificateEntries[i]
+		index.entries[string(entry.SerialNumber.Bytes())] = entry
+	}
+	return index
+}
+
+// The entry revoking a certificate, or nil if the CRL doesn't
+func (index *crlIndex) lookup(cert *x509.Certificate) *x509.RevocationListEntry {
+	if !bytes.Equal(cert.RawIssuer, index.crl.RawIssuer) {
+		return nil
+	}
+	return index.entries[string(cert.SerialNumber.Bytes())]
+}
+
+// Is a refresh running?
+var crlRunning int32
+
+// Refresh the CRLs the stored certificates name, and mark the certificates on them revoked
+func RefreshCRLs(now time.Time) (*CRLRefresh, error) {
+	if !atomic.CompareAndSwapInt32(&crlRunning, 0, 1) {
+		return nil, ErrCRLRunning
+	}
+	defer atomic.StoreInt32(&crlRunning, 0)
+
+	// Gather the certificates by the CRLs they name. Certificates held by more than one user are gathered once.
+	refresh := &CRLRefresh{Revoked: []string{}}
+	certs := make(map[string]*crlCert)
+	byURL := make(map[string][]*crlCert)
+	err := DatabaseEachCert(crlBatchSize, func(certData *CertificateData) error {
+		if c, ok := certs[certData.Id]; ok {
+			c.holders = append(c.holders, certData.UserId)
+			return nil
+		}
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			return err
+		}
+		urls := crlURLs(cert)
+		if len(urls) == 0 {
+			return nil
+		}
+		chain, err := ParseChainPEM(string(certData.Chain))
+		if err != nil {
+			return err
+		}
+		c := &crlCert{id: certData.Id, cert: cert, issuer: chainIssuer(cert, chain), holders: []string{certData.UserId}, revoked: !certData.Revoked.IsZero()}
+		certs[certData.Id] = c
+		refresh.Checked++
+		for _, u := range urls {
+			byURL[u] = append(byURL[u], c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, 0, len(byURL))
+	for u := range byURL {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	refresh.CRLs = len(urls)
+	for _, u := range urls {
+		crl, fetched, err := refreshCRL(u, byURL[u], now)
+		if fetched {
+			refresh.Fetched++
+		}
+		if err != nil {
+			refresh.Failed++
+			log.Println("Unable to refresh CRL", u+":", err)
+		}
+		if crl == nil {
+			continue
+		}
+		index := newCRLIndex(crl)
+		for _, c := range byURL[u] {
+			entry := index.lookup(c.cert)
+			if c.revoked || entry == nil {
+				continue
+			}
+			err = DatabaseMarkRevoked(c.id, c.holders, crlRevocation(entry, u))
+			if err != nil {
+				return nil, err
+			}
+			c.revoked = true
+			refresh.Revoked = append(refresh.Revoked, c.id)
+			for _, userid := range c.holders {
+				Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: c.id})
+			}
+		}
+	}
+	log.Printf("CRLs refreshed: %d of %d fetched, %d failed, %d certificates newly revoked", refresh.Fetched, refresh.CRLs, refresh.Failed, len(refresh.Revoked))
+	return refresh, nil
+}
+
+// Refresh the CRLs every interval, if the CRLCheck option is on
+func RefreshCRLsEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if !Config().CRLCheck || Replica.Standby() {
+			continue
+		}
+		_, err := RefreshCRLs(Now())
+		if err != nil && err != ErrCRLRunning {
+			log.Println("Unable to refresh CRLs:", err)
+		}
+	}
+}
+
+// List the cached CRLs
+func ListCRLsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	crls, err := DatabaseListCRLs()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, crls)
+}
+
+// Refresh the CRLs now, rather than waiting for the refresh job. This works even if the CRLCheck option is off.
+func RefreshCRLsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	refresh, err := RefreshCRLs(Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, refresh)
+}
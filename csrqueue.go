@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The states of a queued CSR
+const (
+	CSRStatusPending  = "pending"
+	CSRStatusApproved = "approved"
+	CSRStatusDenied   = "denied"
+)
+
+var (
+	ErrCSRQueueClosed     = NewError("csr-queue-closed", http.StatusNotFound, "CSRs aren't accepted for approval here.")
+	ErrCSRQueueFull       = NewError("csr-queue-full", http.StatusServiceUnavailable, "Too many CSRs are waiting for approval. Please try again later.")
+	ErrCSRNotFound        = NewError("csr-not-found", http.StatusNotFound, "CSR not found.")
+	ErrCSRDecided         = NewError("csr-decided", http.StatusConflict, "The CSR has already been approved or denied.")
+	ErrCSRNoNames         = NewError("csr-no-names", http.StatusBadRequest, "The CSR names nothing. Give a common name or subject alternative names.")
+	ErrInvalidCSRName     = NewError("invalid-csr-name", http.StatusBadRequest, "The CSR has an invalid name. DNS names may be wildcards only in their first label.")
+	ErrInvalidCSRContact  = NewError("invalid-csr-contact", http.StatusBadRequest, "Invalid contact. Give an email address, or leave it out.")
+	ErrCSRCommentTooLong  = NewError("csr-comment-too-long", http.StatusBadRequest, "The comment is too long.")
+	ErrInvalidCSRStatus   = NewError("invalid-csr-status", http.StatusBadRequest, "Invalid status. Use pending, approved or denied.")
+	ErrInvalidCSRValidity = NewError("invalid-csr-validity", http.StatusBadRequest, "Invalid validity. Give a duration such as \"2160h\", no longer than the CA certificate has left.")
+)
+
+// Clients without an account, such as a new server or a contractor's laptop, can submit a CSR to be reviewed by an
+// administrator: the classic registration authority flow. Submitting needs no authentication, unless tokens are
+// configured for the csr-submit scope, and is rate limited per client by the CSRRateLimit option. No more than
+// MaxPendingCSRs wait at once, so a flood from many addresses can't fill the database. The submitter is given the
+// CSR's id, which is random and is the only way to read it, and polls GET /csr/{csr-id} for the decision. Routine
+// CSRs are approved as soon as they are submitted, by rules (see autoapprove.go).
+//
+// Administrators list the queue at /admin/csr, and approve or deny each CSR. A CSR is issued when it is approved,
+// by the CA certificate in the CSRIssuer option, with the CSR's subject and names and the CA certificate's chain,
+// unless its names' CAA records don't allow it (see caa.go).
+// The certificate is kept with the CSR for the submitter to collect: it isn't stored as a user's certificate, since
+// the submitter has no account and its key is theirs. A denial must give a reason, which the submitter is shown.
+// Decisions are audited under the CA certificate's user.
+//
+// The issuer is configured server-wide. CSRs aren't replicated to a standby.
+
+// The CA certificate that issues approved CSRs
+type CSRIssuer struct {
+	UserId   string   `json:"user"`     // The user holding the CA certificate
+	CA       string   `json:"ca"`       // Its cert-id
+	Validity Duration `json:"validity"` // How long certificates are valid for, unless the approval says. Zero means as long as the CA certificate.
+}
+
+// A CSR submitted for approval
+type CSRSubmission struct {
+	CSR     string `json:"csr"`     // PEM
+	Contact string `json:"contact"` // An email address the administrators can reach the submitter at. Optional.
+	Comment string `json:"comment"` // What the certificate is for. Optional.
+}
+
+// An administrator's approval of a CSR
+type CSRApproval struct {
+	Validity string `json:"validity"` // Such as "2160h". Empty for the CSRIssuer option's validity.
+}
+
+// A CSR in the queue, with its decision once it is made
+type QueuedCSR struct {
+	Id        string       `json:"id"`
+	Status    string       `json:"status"`
+	CSR       StoredBlob   `json:"-"`       // DER
+	Subject   string       `json:"subject"` // From the CSR
+	Names     []string     `json:"names"`   // From the CSR: its DNS names, IP addresses, email addresses and URIs
+	Contact   string       `json:"contact,omitempty"`
+	Comment   string       `json:"comment,omitempty"`
+	Client    string       `json:"client,omitempty"` // The address it was submitted from. Only shown to administrators.
+	Submitted UTCTime      `json:"submitted"`
+	Decided   UTCTime      `json:"decided"`
+	DecidedBy string       `json:"decidedBy,omitempty"` // The administrator or admin token that decided it (see RequestPrincipal)
+	Reason    string       `json:"reason,omitempty"`    // Why it was denied, or a note on its approval
+	Cert      StoredPEM    `json:"cert,omitempty"`      // Once approved
+	Chain     StoredChain  `json:"chain,omitempty"`
+	CAA       []*CAAResult `json:"caa,omitempty"` // The CAA check on approval (see caa.go). Not stored, but audited.
+}
+
+var csrIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// CSRLimiter limits CSR submissions, by client
+var CSRLimiter = NewRateLimiter()
+
+// Parse a queued CSR, filling in its subject and names
+func (q *QueuedCSR) parse() (*x509.CertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(q.CSR)
+	if err != nil {
+		return nil, ErrInvalidCSR
+	}
+	q.Subject = csr.Subject.String()
+	q.Names = append([]string(nil), csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		q.Names = append(q.Names, ip.String())
+	}
+	q.Names = append(q.Names, csr.EmailAddresses...)
+	for _, uri := range csr.URIs {
+		q.Names = append(q.Names, uri.String())
+	}
+	return csr, nil
+}
+
+// Check that a submitted CSR's key is strong enough, like an uploaded certificate's
+func checkCSRKey(pub interface{}, config *RuntimeConfig) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < config.MinimumRSABits && !OptSandbox {
+			return ErrKeyTooSmall
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < config.MinimumECBits && !OptSandbox {
+			return ErrKeyTooSmall
+		}
+	}
+	return nil
+}
+
+// Check that a CSR's DNS names are names, with wildcards only in their first label
+func checkCSRNames(csr *x509.CertificateRequest) error {
+	if csr.Subject.CommonName == "" && len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.EmailAddresses)+len(csr.URIs) == 0 {
+		return ErrCSRNoNames
+	}
+	for _, name := range csr.DNSNames {
+		if !isDNSName(strings.TrimPrefix(strings.ToLower(name), "*.")) {
+			return ErrInvalidCSRName
+		}
+	}
+	return nil
+}
+
+// Validate a submission, and get it as it is queued
+func NewQueuedCSR(sub *CSRSubmission, client string, config *RuntimeConfig) (*QueuedCSR, error) {
+	var errs ValidationErrors
+	csr, err := ParseCSRPEM(sub.CSR)
+	if err == nil {
+		err = checkCSRKey(csr.PublicKey, config)
+	}
+	if err == nil {
+		err = checkCSRNames(csr)
+	}
+	if err != nil {
+		errs.Add("csr", err)
+	}
+	contact := strings.TrimSpace(sub.Contact)
+	if contact != "" {
+		contact, err = NormalizeEmail(contact)
+		if err != nil {
+			errs.Add("contact", ErrInvalidCSRContact)
+		}
+	}
+	comment := strings.TrimSpace(sub.Comment)
+	if utf8.RuneCountInString(comment) > config.MaxNotesLength {
+		errs.Add("comment", ErrCSRCommentTooLong)
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	q := &QueuedCSR{
+		Id:      hex.EncodeToString(id),
+		Status:  CSRStatusPending,
+		CSR:     csr.Raw,
+		Contact: contact,
+		Comment: comment,
+		Client:  client,
+	}
+	_, err = q.parse()
+	return q, err
+}
+
+// Issue an approved CSR from the issuer's CA certificate. The certificate and its chain are filled in.
+func IssueQueuedCSR(q *QueuedCSR, parent *CertificateData, approval *CSRApproval, issuer *CSRIssuer, now time.Time) error {
+	signer, err := parseMintParent(parent, now)
+	if err != nil {
+		return err
+	}
+	csr, err := q.parse()
+	if err != nil {
+		return err
+	}
+
+	notAfter := signer.Cert.NotAfter
+	validity := time.Duration(issuer.Validity)
+	if approval.Validity != "" {
+		validity, err = time.ParseDuration(approval.Validity)
+		if err != nil || validity <= 0 {
+			return &FieldError{"validity", ErrInvalidCSRValidity}
+		}
+	}
+	if validity != 0 {
+		if now.Add(validity).After(notAfter) {
+			return &FieldError{"validity", ErrInvalidCSRValidity}
+		}
+		notAfter = now.Add(validity)
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             now,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		EmailAddresses:        csr.EmailAddresses,
+		URIs:                  csr.URIs,
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.Cert, csr.PublicKey, signer.Key)
+	if err != nil {
+		return err
+	}
+	q.Cert = StoredPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	q.Chain = EncodeChain(append([]*x509.Certificate{signer.Cert}, signer.Chain...))
+	q.Status = CSRStatusApproved
+	q.Decided = NewUTCTime(now)
+	return nil
+}
+
+// Check an approved CSR's certificate against the issuer's domains (see domains.go)
+func checkQueuedCSRDomains(q *QueuedCSR, issuer *CSRIssuer, config *RuntimeConfig) (ValidationErrors, error) {
+	cert, err := ParseCertificatePEM(string(q.Cert))
+	if err != nil {
+		return nil, err
+	}
+	return CheckDomainPolicy(issuer.UserId, certNames(cert), "csr", config)
+}
+
+// Check a queued CSR's CAA records before it is issued (see caa.go), keeping the result with it
+func checkQueuedCSRCAA(q *QueuedCSR, config *RuntimeConfig) error {
+	csr, err := q.parse()
+	if err != nil {
+		return err
+	}
+	q.CAA, err = CheckCAA(csr.DNSNames, "csr", config)
+	return err
+}
+
+// Validate the CSR issuer, if there is one
+func validateCSRIssuer(issuer *CSRIssuer, errs *ValidationErrors) {
+	if issuer == nil {
+		return
+	}
+	if issuer.UserId == "" || issuer.Validity < 0 {
+		errs.Add("csrIssuer", ErrInvalidConfig)
+	}
+	ref, err := ParseCertRef(issuer.CA)
+	if err != nil || !ref.IsCertId() {
+		errs.Add("csrIssuer.ca", ErrInvalidCertificateId)
+	}
+}
+
+// Get the csr-id from a request
+func GetCSRID(r *http.Request) (string, error) {
+	csrid := mux.Vars(r)["csr-id"]
+	if !csrIdPattern.MatchString(csrid) {
+		return "", ErrCSRNotFound
+	}
+	return csrid, nil
+}
+
+// Submit a CSR for approval
+func SubmitCSRHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	config := Config()
+	if config.CSRIssuer == nil {
+		HandleError(w, r, ErrCSRQueueClosed, 0)
+		return
+	}
+
+	// Submitters need a token only if some are configured
+	if len(config.ScopeTokens[ScopeCSRSubmit]) != 0 {
+		if !allowAttempt(w, r, ClientIPKey(r)) {
+			return
+		}
+		if !HasScope(r, ScopeCSRSubmit, config) {
+			if r.Header.Get("Authorization") != "" {
+				failedAttempt(r, "scope-token", ClientIPKey(r))
+			}
+			HandleError(w, r, ErrMissingScope, 0)
+			return
+		}
+	}
+	if wait := CSRLimiter.Allow(ClientIPKey(r), config.CSRRateLimit, time.Hour); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		HandleError(w, r, ErrRateLimited, 0)
+		return
+	}
+
+	sub := new(CSRSubmission)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(sub)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	q, err := NewQueuedCSR(sub, ClientIPKey(r), config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = DatabaseCreateCSR(q, config.MaxPendingCSRs)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// CSRs meeting an auto-approval rule are issued at once (see autoapprove.go)
+	err = AutoApproveCSR(q, config, Now())
+	if err != nil {
+		log.Printf("Unable to auto-approve CSR %s: %v", q.Id, err)
+	}
+
+	// Send the result. Its id is the only way to read it again.
+	q.Client = ""
+	SendResult(w, r, q)
+}
+
+// Get a submitted CSR, with its certificate once it is approved
+func ReadCSRHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	csrid, err := GetCSRID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := DatabaseReadCSR(csrid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result. Who decided it, and where it was sent from, is for administrators.
+	q.Client, q.DecidedBy = "", ""
+	SendResult(w, r, q)
+}
+
+// List the queued CSRs with a status, pending by default, oldest first
+func ListQueuedCSRsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	if status == "" {
+		status = CSRStatusPending
+	}
+	if status != CSRStatusPending && status != CSRStatusApproved && status != CSRStatusDenied {
+		HandleError(w, r, ErrInvalidCSRStatus, 0)
+		return
+	}
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	csrs, page, err := DatabaseListCSRs(status, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, csrs, page)
+}
+
+// Get a queued CSR, for an administrator
+func ReadQueuedCSRHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	csrid, err := GetCSRID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := DatabaseReadCSR(csrid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, q)
+}
+
+// Approve a queued CSR, issuing its certificate
+func ApproveCSRHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	csrid, err := GetCSRID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// The approval is optional
+	approval := new(CSRApproval)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(approval)
+	if err != nil && err != io.EOF {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	config := Config()
+	if config.CSRIssuer == nil {
+		HandleError(w, r, ErrCSRQueueClosed, 0)
+		return
+	}
+	q, err := DatabaseReadCSR(csrid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if q.Status != CSRStatusPending {
+		HandleError(w, r, ErrCSRDecided, 0)
+		return
+	}
+	parent, err := DatabaseReadKey(config.CSRIssuer.UserId, config.CSRIssuer.CA)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = checkQueuedCSRCAA(q, config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = IssueQueuedCSR(q, parent, approval, config.CSRIssuer, Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	warnings, err := checkQueuedCSRDomains(q, config.CSRIssuer, config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	q.DecidedBy, q.Reason = RequestPrincipal(r), reason
+
+	err = DatabaseDecideCSR(r.Context(), q, parent)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Usage.Record(parent.UserId, UsageCertsCreated, 1)
+
+	// Send the result
+	SendResult(w, r, q, warnings...)
+}
+
+// Deny a queued CSR. The reason is required, and is shown to the submitter.
+func DenyCSRHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	csrid, err := GetCSRID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrMissingReason, 0)
+		return
+	}
+
+	q, err := DatabaseReadCSR(csrid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if q.Status != CSRStatusPending {
+		HandleError(w, r, ErrCSRDecided, 0)
+		return
+	}
+	q.Status, q.Decided, q.DecidedBy, q.Reason = CSRStatusDenied, NewUTCTime(Now()), RequestPrincipal(r), reason
+
+	err = DatabaseDecideCSR(r.Context(), q, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, q)
+}
+
+// The cert-id of a queued CSR's certificate, for the audit log
+func queuedCertId(q *QueuedCSR) string {
+	block, _ := pem.Decode([]byte(q.Cert))
+	if block == nil {
+		return ""
+	}
+	hash := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How certificates without enough CT evidence are handled (see the CTPolicy option)
+const (
+	CTPolicyOff    = "off"
+	CTPolicyWarn   = "warn"   // Accept publicly trusted certificates without enough valid SCTs, with a warning
+	CTPolicyReject = "reject" // Reject publicly trusted certificates without enough valid SCTs
+)
+
+// The states a log list gives a log (see https://www.gstatic.com/ct/log_list/v3/log_list_schema.json)
+const (
+	ctLogPending   = "pending"
+	ctLogQualified = "qualified"
+	ctLogUsable    = "usable"
+	ctLogReadOnly  = "readonly"
+	ctLogRetired   = "retired"
+	ctLogRejected  = "rejected"
+)
+
+// The X.509 extension holding embedded SCTs (RFC 6962, section 3.3)
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+var (
+	ErrInvalidCTLogList = NewError("invalid-ct-log-list", http.StatusBadRequest, "Invalid CT log list. It must be a log list in the v3 JSON format.")
+	ErrInvalidSCTList   = NewError("invalid-sct-list", http.StatusBadRequest, "The certificate's signed certificate timestamp list extension is invalid.")
+	ErrMissingSCTs      = NewError("missing-scts", http.StatusBadRequest, "The certificate is publicly trusted, but doesn't have enough valid signed certificate timestamps from known CT logs.")
+
+	WarnMissingSCTs = NewError("missing-scts", 0, "The certificate is publicly trusted, but doesn't have enough valid signed certificate timestamps from known CT logs. Browsers will reject it.")
+
+	errSCTUnknownLog  = errors.New("the SCT is from a log that isn't in the log list")
+	errSCTLogState    = errors.New("the SCT is from a log that isn't trusted at the SCT's time")
+	errSCTInterval    = errors.New("the certificate expires outside the log's temporal interval")
+	errSCTFuture      = errors.New("the SCT's timestamp is in the future")
+	errSCTNoIssuer    = errors.New("the certificate's issuer is needed to verify the SCT, and isn't in the chain")
+	errSCTAlgorithm   = errors.New("the SCT's signature algorithm isn't supported")
+	errSCTSignature   = errors.New("the SCT's signature doesn't verify")
+	errSCTUnsupported = errors.New("the SCT's version isn't supported")
+)
+
+// Publicly trusted certificates must be logged to Certificate Transparency logs for browsers to accept them, with
+// signed certificate timestamps (SCTs) from the logs as evidence, usually embedded in the certificate itself. The
+// embedded SCTs of a certificate are verified against the logs in a log list, OptCTLogList, in the v3 JSON format
+// that Google and Apple publish, read again whenever the configuration is reloaded. An SCT is valid if it is signed
+// by a log in the list that was trusted at the SCT's time, and the certificate expires within the log's temporal
+// interval. SCTs delivered by TLS or OCSP stapling aren't seen, so aren't counted.
+//
+// When a certificate is uploaded, if it is publicly trusted (it chains to one of the system's roots, whatever custom
+// roots there are), the CTPolicy option says what happens if it has fewer than CTMinSCTs valid SCTs: "off" accepts
+// it, "warn" accepts it with a warning, and "reject" rejects it. Certificates from private CAs aren't expected to be
+// logged. A certificate's SCTs, and whether each is valid, are shown when it is read, whatever the policy.
+
+// A signed certificate timestamp embedded in a certificate
+type SCT struct {
+	LogId     string  `json:"logId"`    // The SHA256 hash of the log's key (base64-encoded), as in log lists
+	Log       string  `json:"log"`      // The log's description. Empty if it isn't in the log list.
+	Operator  string  `json:"operator"` // Empty if the log isn't in the log list
+	Timestamp UTCTime `json:"timestamp"`
+	Valid     bool    `json:"valid"`
+	Error     string  `json:"error,omitempty"` // Why it isn't valid
+
+	version   uint8
+	logID     []byte
+	timestamp uint64
+	ext       []byte
+	hashAlg   uint8
+	sigAlg    uint8
+	signature []byte
+}
+
+// The Certificate Transparency evidence of a certificate
+type CTStatus struct {
+	SCTs            []*SCT `json:"scts"`
+	Valid           int    `json:"valid"`           // SCTs that are valid
+	PubliclyTrusted bool   `json:"publiclyTrusted"` // Does it chain to one of the system's roots?
+}
+
+// A log from the log list
+type CTLog struct {
+	Id          string // The SHA256 hash of the log's key (base64-encoded)
+	Description string
+	Operator    string
+	Key         crypto.PublicKey
+	State       string // One of the ctLog states. Empty if the list doesn't say.
+	StateTime   time.Time
+	Start, End  time.Time // The temporal interval: the log only takes certificates expiring within it. Zero if it is open.
+}
+
+// A log in the v3 log list JSON format
+type ctLogListEntry struct {
+	Description string `json:"description"`
+	LogId       string `json:"log_id"`
+	Key         string `json:"key"`
+	State       map[string]struct {
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"state"`
+	TemporalInterval *struct {
+		StartInclusive time.Time `json:"start_inclusive"`
+		EndExclusive   time.Time `json:"end_exclusive"`
+	} `json:"temporal_interval"`
+}
+
+// Parse a log list in the v3 JSON format
+func parseCTLogList(data []byte) ([]*CTLog, error) {
+	var list struct {
+		Operators []struct {
+			Name      string            `json:"name"`
+			Logs      []*ctLogListEntry `json:"logs"`
+			TiledLogs []*ctLogListEntry `json:"tiled_logs"`
+		} `json:"operators"`
+	}
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, ErrInvalidCTLogList
+	}
+	var logs []*CTLog
+	for _, operator := range list.Operators {
+		for _, entry := range append(operator.Logs, operator.TiledLogs...) {
+			der, err := base64.StdEncoding.DecodeString(entry.Key)
+			if err != nil {
+				return nil, ErrInvalidCTLogList
+			}
+			key, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				return nil, ErrInvalidCTLogList
+			}
+			hash := sha256.Sum256(der)
+			ctlog := &CTLog{Id: base64.StdEncoding.EncodeToString(hash[:]), Description: entry.Description, Operator: operator.Name, Key: key}
+			if entry.LogId != "" && entry.LogId != ctlog.Id {
+				return nil, ErrInvalidCTLogList
+			}
+			for state, detail := range entry.State {
+				ctlog.State, ctlog.StateTime = state, detail.Timestamp
+			}
+			if entry.TemporalInterval != nil {
+				ctlog.Start, ctlog.End = entry.TemporalInterval.StartInclusive, entry.TemporalInterval.EndExclusive
+			}
+			logs = append(logs, ctlog)
+		}
+	}
+	return logs, nil
+}
+
+// CTLogStore holds the logs SCTs are verified against
+type CTLogStore struct {
+	mu   sync.RWMutex
+	logs map[string]*CTLog
+}
+
+// The logs from OptCTLogList
+var CTLogs = new(CTLogStore)
+
+// Read the log list again. Nothing changes if it can't be read.
+func (store *CTLogStore) Load(filename string) error {
+	logs := make(map[string]*CTLog)
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		list, err := parseCTLogList(data)
+		if err != nil {
+			return err
+		}
+		for _, ctlog := range list {
+			logs[ctlog.Id] = ctlog
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.logs = logs
+	return nil
+}
+
+// Find a log by its id. Nil if it isn't in the log list.
+func (store *CTLogStore) Find(id string) *CTLog {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.logs[id]
+}
+
+// Parse the SCTs embedded in a certificate. Nil if it has none.
+func parseEmbeddedSCTs(cert *x509.Certificate) ([]*SCT, error) {
+	var value []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSCTList) {
+			value = ext.Value
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	// The extension holds a TLS-encoded SignedCertificateTimestampList in an OCTET STRING
+	var data []byte
+	rest, err := asn1.Unmarshal(value, &data)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrInvalidSCTList
+	}
+	var list cryptobyte.String
+	input := cryptobyte.String(data)
+	if !input.ReadUint16LengthPrefixed(&list) || !input.Empty() {
+		return nil, ErrInvalidSCTList
+	}
+	var scts []*SCT
+	for !list.Empty() {
+		var raw cryptobyte.String
+		sct := new(SCT)
+		var ext, signature cryptobyte.String
+		if !list.ReadUint16LengthPrefixed(&raw) || !raw.ReadUint8(&sct.version) {
+			return nil, ErrInvalidSCTList
+		}
+		if sct.version != 0 {
+			// Later versions may be laid out differently, so only the version is known
+			sct.Error = errSCTUnsupported.Error()
+			scts = append(scts, sct)
+			continue
+		}
+		if !raw.ReadBytes(&sct.logID, sha256.Size) || !raw.ReadUint64(&sct.timestamp) || !raw.ReadUint16LengthPrefixed(&ext) ||
+			!raw.ReadUint8(&sct.hashAlg) || !raw.ReadUint8(&sct.sigAlg) || !raw.ReadUint16LengthPrefixed(&signature) || !raw.Empty() {
+			return nil, ErrInvalidSCTList
+		}
+		sct.ext, sct.signature = ext, signature
+		sct.LogId = base64.StdEncoding.EncodeToString(sct.logID)
+		sct.Timestamp = NewUTCTime(time.UnixMilli(int64(sct.timestamp)))
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// The TBSCertificate a log signed for a certificate with embedded SCTs: the certificate's, without the SCT list
+// extension (RFC 6962, section 3.2)
+func precertTBS(tbs []byte) ([]byte, error) {
+	input := cryptobyte.String(tbs)
+	var fields cryptobyte.String
+	if !input.ReadASN1(&fields, cbasn1.SEQUENCE) || !input.Empty() {
+		return nil, errors.New("invalid TBSCertificate")
+	}
+	extensionsTag := cbasn1.Tag(3).Constructed().ContextSpecific()
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !fields.Empty() {
+			var field cryptobyte.String
+			var tag cbasn1.Tag
+			if !fields.ReadAnyASN1Element(&field, &tag) {
+				b.SetError(errors.New("invalid TBSCertificate"))
+				return
+			}
+			if tag != extensionsTag {
+				b.AddBytes(field)
+				continue
+			}
+			var extensions cryptobyte.String
+			if !field.ReadASN1(&extensions, extensionsTag) || !extensions.ReadASN1(&extensions, cbasn1.SEQUENCE) {
+				b.SetError(errors.New("invalid extensions"))
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var extension, body cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !extensions.ReadASN1Element(&extension, cbasn1.SEQUENCE) {
+							b.SetError(errors.New("invalid extension"))
+							return
+						}
+						body = extension
+						if !body.ReadASN1(&body, cbasn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&oid) {
+							b.SetError(errors.New("invalid extension"))
+							return
+						}
+						if !oid.Equal(oidSCTList) {
+							b.AddBytes(extension)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+// Verify an SCT's signature over a certificate, as a log's precertificate entry
+func (sct *SCT) verifySignature(ctlog *CTLog, tbs []byte, issuer *x509.Certificate) error {
+	if sct.hashAlg != 4 { // SHA256
+		return errSCTAlgorithm
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	var b cryptobyte.Builder
+	b.AddUint8(sct.version)
+	b.AddUint8(0) // certificate_timestamp
+	b.AddUint64(sct.timestamp)
+	b.AddUint16(1) // precert_entry
+	b.AddBytes(issuerKeyHash[:])
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sct.ext) })
+	signed, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(signed)
+
+	switch key := ctlog.Key.(type) {
+	case *ecdsa.PublicKey:
+		if sct.sigAlg != 3 || !ecdsa.VerifyASN1(key, digest[:], sct.signature) {
+			return errSCTSignature
+		}
+	case *rsa.PublicKey:
+		if sct.sigAlg != 1 || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.signature) != nil {
+			return errSCTSignature
+		}
+	default:
+		return errSCTAlgorithm
+	}
+	return nil
+}
+
+// Check an SCT against the log list, and verify its signature
+func (sct *SCT) verify(cert *x509.Certificate, tbs []byte, issuer *x509.Certificate, now time.Time) error {
+	if sct.version != 0 {
+		return errSCTUnsupported
+	}
+	ctlog := CTLogs.Find(sct.LogId)
+	if ctlog == nil {
+		return errSCTUnknownLog
+	}
+	sct.Log, sct.Operator = ctlog.Description, ctlog.Operator
+	switch ctlog.State {
+	case ctLogPending, ctLogRejected:
+		return errSCTLogState
+	case ctLogRetired:
+		if !sct.Timestamp.Before(ctlog.StateTime) {
+			return errSCTLogState
+		}
+	}
+	if (!ctlog.Start.IsZero() && cert.NotAfter.Before(ctlog.Start)) || (!ctlog.End.IsZero() && !cert.NotAfter.Before(ctlog.End)) {
+		return errSCTInterval
+	}
+	if sct.Timestamp.After(now) {
+		return errSCTFuture
+	}
+	if issuer == nil {
+		return errSCTNoIssuer
+	}
+	return sct.verifySignature(ctlog, tbs, issuer)
+}
+
+// The roots a certificate is publicly trusted by. Replaced in tests.
+var ctPublicRoots = x509.SystemCertPool
+
+// Find a certificate's chain to one of the system's roots, if it is publicly trusted. Nil if it isn't.
+func publicChain(cert *x509.Certificate, chain []*x509.Certificate, now time.Time) []*x509.Certificate {
+	roots, err := ctPublicRoots()
+	if err != nil {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain {
+		intermediates.AddCert(c)
+	}
+	verified, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil || len(verified) == 0 {
+		return nil
+	}
+	return verified[0]
+}
+
+// Get a certificate's CT evidence, verifying its embedded SCTs against the log list
+func CheckCT(cert *x509.Certificate, chain []*x509.Certificate, now time.Time) (*CTStatus, error) {
+	status := &CTStatus{SCTs: []*SCT{}}
+	public := publicChain(cert, chain, now)
+	status.PubliclyTrusted = public != nil
+	scts, err := parseEmbeddedSCTs(cert)
+	if err != nil {
+		return nil, err
+	}
+	if len(scts) == 0 {
+		return status, nil
+	}
+
+	// The issuer is in the chain, or else in the chain found to a public root
+	issuer := chainIssuer(cert, chain)
+	if issuer == nil && len(public) > 1 {
+		issuer = public[1]
+	}
+	tbs, err := precertTBS(cert.RawTBSCertificate)
+	if err != nil {
+		return nil, ErrInvalidSCTList
+	}
+	for _, sct := range scts {
+		err = sct.verify(cert, tbs, issuer, now)
+		if err != nil {
+			sct.Error = err.Error()
+			continue
+		}
+		sct.Valid = true
+		status.Valid++
+	}
+	status.SCTs = scts
+	return status, nil
+}
+
+// Check an uploaded certificate's CT evidence against the CT policy
+func (cert *Certificate) CheckCT(config *RuntimeConfig, now time.Time) error {
+	if config.CTPolicy == CTPolicyOff {
+		return nil
+	}
+	status, err := CheckCT(cert.Cert, cert.Chain, now)
+	if err != nil {
+		return &FieldError{"cert", err}
+	}
+	if !status.PubliclyTrusted || status.Valid >= config.CTMinSCTs {
+		return nil
+	}
+	if config.CTPolicy == CTPolicyReject {
+		return &FieldError{"cert", ErrMissingSCTs}
+	}
+	cert.Warnings.Add("cert", WarnMissingSCTs)
+	return nil
+}
+
+// Get a stored certificate's CT evidence
+func (certData *CertificateData) CTStatus(now time.Time) (*CTStatus, error) {
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ParseChainPEM(string(certData.Chain))
+	if err != nil {
+		return nil, err
+	}
+	return CheckCT(cert, chain, now)
+}
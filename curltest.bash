@@ -8,6 +8,8 @@ if ! hash jsonlint 2>/dev/null; then
   exit 1
 fi
 
+# The test certificate is signed with SHA-1, which the server rejects by default. Run it with a config file
+# (OptConfigFile) setting "forbiddenSignatures" to [].
 
 echo "POSTing new user"
 echo "POST http://localhost:8080/user"
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -12,36 +18,531 @@ var (
 	db *sqlx.DB
 
 	// CRUD for User
-	QueryCreateUser *sqlx.NamedStmt // QueryRow() (because we are using RETURNING)
-	QueryReadUser   *sqlx.Stmt      // Get()
-	QueryUpdateUser *sqlx.NamedStmt // Exec()
-	QueryDeleteUser *sqlx.Stmt      // Exec()
+	QueryCreateUser = Statements.RegisterNamed(SQLCreateUser) // QueryRowx() (because we are using RETURNING)
+	QueryReadUser   = Statements.Register(SQLReadUser)        // Get()
+	QueryUpdateUser = Statements.RegisterNamed(SQLUpdateUser) // Exec()
+	QueryDeleteUser = Statements.Register(SQLDeleteUser)      // Exec()
+
+	QueryListUsersByEmail = Statements.Register(SQLListUsersByEmail) // Select()
+
+	// Optional attributes of users and certificates
+	QueryReadUserExtra   = Statements.Register(SQLReadUserExtra)   // Get()
+	QueryLockUserExtra   = Statements.Register(SQLLockUserExtra)   // Get()
+	QueryUpdateUserExtra = Statements.Register(SQLUpdateUserExtra) // Exec()
+	QueryReadCertExtra   = Statements.Register(SQLReadCertExtra)   // Get()
+	QueryLockCertExtra   = Statements.Register(SQLLockCertExtra)   // Get()
+	QueryUpdateCertExtra = Statements.Register(SQLUpdateCertExtra) // Exec()
 
 	// CRUD for Cert
-	QueryCreateCert *sqlx.NamedStmt // Exec()
-	QueryReadCert   *sqlx.Stmt      // Get()
-	QueryDeleteCert *sqlx.Stmt      // Exec()
+	QueryCreateCert = Statements.RegisterNamed(SQLCreateCert) // Exec()
+	QueryReadCert   = Statements.Register(SQLReadCert)        // Get()
+	QueryReadKey    = Statements.Register(SQLReadKey)         // Get()
+
+	// Private key exports
+	QueryCreateKeyExport = Statements.RegisterNamed(SQLCreateKeyExport) // Exec()
+	QueryUseKeyExport    = Statements.Register(SQLUseKeyExport)         // Get() (because we are using RETURNING)
+	QueryPurgeKeyExports = Statements.Register(SQLPurgeKeyExports)      // Exec()
+	QueryDeleteCert      = Statements.Register(SQLDeleteCert)           // Exec()
 
 	// Other miscellaneous queries
-	QueryFetchUserCerts   *sqlx.Stmt // Select()
-	QueryCertUpdateActive *sqlx.Stmt // Exec()
-	QueryCertDeleteUsers  *sqlx.Stmt // Exec()
+	QueryFetchUserCerts  = Statements.Register(SQLFetchUserCerts)  // Select()
+	QueryCertUpdate      = Statements.Register(SQLCertUpdate)      // Exec()
+	QueryCertDeleteUsers = Statements.Register(SQLCertDeleteUsers) // Select() (because we are using RETURNING)
+	QueryUserExists      = Statements.Register(SQLUserExists)      // Get()
+	QueryListCertsAfter  = Statements.Register(SQLListCertsAfter)  // Select()
+	QueryListCertsBefore = Statements.Register(SQLListCertsBefore) // Select()
+	QueryCountUserCerts  = Statements.Register(SQLCountUserCerts)  // Get()
+	QueryCertHolders     = Statements.Register(SQLCertHolders)     // Select()
+	QueryReadCertChain   = Statements.Register(SQLReadCertChain)   // Get()
+
+	// Certificate sharing grants
+	QueryCreateGrant          = Statements.RegisterNamed(SQLCreateGrant)     // Exec()
+	QueryReadGrant            = Statements.Register(SQLReadGrant)            // Get()
+	QueryDeleteGrant          = Statements.Register(SQLDeleteGrant)          // Exec()
+	QueryDeleteCertGrants     = Statements.Register(SQLDeleteCertGrants)     // Exec()
+	QueryDeleteUserGrants     = Statements.Register(SQLDeleteUserGrants)     // Exec()
+	QueryListCertGrants       = Statements.Register(SQLListCertGrants)       // Select()
+	QueryListCertGrantsBefore = Statements.Register(SQLListCertGrantsBefore) // Select()
+	QueryListUserGrants       = Statements.Register(SQLListUserGrants)       // Select()
+	QueryListUserGrantsBefore = Statements.Register(SQLListUserGrantsBefore) // Select()
+
+	// Certificate attachments
+	QueryLockCert              = Statements.Register(SQLLockCert)              // Get()
+	QueryCountAttachments      = Statements.Register(SQLCountAttachments)      // Get()
+	QueryCreateAttachment      = Statements.RegisterNamed(SQLCreateAttachment) // QueryRowx() (because we are using RETURNING)
+	QueryReadAttachment        = Statements.Register(SQLReadAttachment)        // Get()
+	QueryListAttachments       = Statements.Register(SQLListAttachments)       // Select()
+	QueryListAttachmentsBefore = Statements.Register(SQLListAttachmentsBefore) // Select()
+	QueryDeleteAttachment      = Statements.Register(SQLDeleteAttachment)      // Get() (because we are using RETURNING)
+
+	// Transfering certificates and merging users
+	QueryTransferDuplicateCerts = Statements.Register(SQLTransferDuplicateCerts) // Select()
+	QueryTransferCerts          = Statements.Register(SQLTransferCerts)          // Select()
+	QueryCountTransferGrants    = Statements.Register(SQLCountTransferGrants)    // Get()
+	QueryDeleteSelfGrants       = Statements.Register(SQLDeleteSelfGrants)       // Exec()
+	QueryMergeDuplicateGrants   = Statements.Register(SQLMergeDuplicateGrants)   // Exec()
+	QueryMergeGrants            = Statements.Register(SQLMergeGrants)            // Exec()
+
+	// Audit log
+	QueryCreateAudit         = Statements.RegisterNamed(SQLCreateAudit)    // Exec()
+	QueryListUserAudit       = Statements.Register(SQLListUserAudit)       // Select()
+	QueryListUserAuditBefore = Statements.Register(SQLListUserAuditBefore) // Select()
+	QueryLockAudit           = Statements.Register(SQLLockAudit)           // Exec()
+	QueryReadLastAudit       = Statements.Register(SQLReadLastAudit)       // Get()
+	QueryListAudit           = Statements.Register(SQLListAudit)           // Queryx()
+
+	// Audit log anchors
+	QueryCreateAuditAnchor   = Statements.RegisterNamed(SQLCreateAuditAnchor) // Exec()
+	QueryReadLastAuditAnchor = Statements.Register(SQLReadLastAuditAnchor)    // Get()
+	QueryListAuditAnchors    = Statements.Register(SQLListAuditAnchors)       // Select()
+
+	// Forwarding the audit log to the SIEM
+	QueryListAuditAfter   = Statements.Register(SQLListAuditAfter)   // Select()
+	QueryCreateSIEMCursor = Statements.Register(SQLCreateSIEMCursor) // Exec()
+	QueryReadSIEMCursor   = Statements.Register(SQLReadSIEMCursor)   // Get()
+	QueryUpdateSIEMCursor = Statements.Register(SQLUpdateSIEMCursor) // Exec()
+
+	// The event log, and replication to a standby
+	QueryLockEvents             = Statements.Register(SQLLockEvents)             // Exec()
+	QueryCreateEvent            = Statements.RegisterNamed(SQLCreateEvent)       // QueryRowx() (because we are using RETURNING)
+	QueryListEventsAfter        = Statements.Register(SQLListEventsAfter)        // Select()
+	QueryReadLastEvent          = Statements.Register(SQLReadLastEvent)          // Get()
+	QueryListReplicaUsers       = Statements.Register(SQLListReplicaUsers)       // Select()
+	QueryReadReplicaUser        = Statements.Register(SQLReadReplicaUser)        // Get()
+	QueryListReplicaCerts       = Statements.Register(SQLListReplicaCerts)       // Select()
+	QueryListReplicaGrants      = Statements.Register(SQLListReplicaGrants)      // Select()
+	QueryListReplicaAttachments = Statements.Register(SQLListReplicaAttachments) // Select()
+	QueryReplicateUser          = Statements.Register(SQLReplicateUser)          // Exec()
+	QueryReplicateCert          = Statements.Register(SQLReplicateCert)          // Exec()
+	QueryReplicateGrant         = Statements.Register(SQLReplicateGrant)         // Exec()
+	QueryReplicateAttachment    = Statements.Register(SQLReplicateAttachment)    // Exec()
+	QueryReplicateAudit         = Statements.RegisterNamed(SQLReplicateAudit)    // Exec()
+	QueryDeleteReceivedGrants   = Statements.Register(SQLDeleteReceivedGrants)   // Exec()
+	QueryCreateReplicaState     = Statements.Register(SQLCreateReplicaState)     // Exec()
+	QueryReadReplicaState       = Statements.Register(SQLReadReplicaState)       // Get()
+	QueryUpdateReplicaState     = Statements.Register(SQLUpdateReplicaState)     // Exec()
+	QueryPromoteReplica         = Statements.Register(SQLPromoteReplica)         // Exec()
+	QueryResetSequences         = Statements.Register(SQLResetSequences)         // Exec()
+
+	// Resolving references to certificates
+	QueryResolveCertIdPrefix = Statements.Register(SQLResolveCertIdPrefix) // Select()
+	QueryListHeldCerts       = Statements.Register(SQLListHeldCerts)       // Select()
+
+	// Usage metering
+	QueryAddUsage         = Statements.Register(SQLAddUsage)         // Exec()
+	QueryListUsage        = Statements.Register(SQLListUsage)        // Select()
+	QueryCountStoredCerts = Statements.Register(SQLCountStoredCerts) // Get()
+
+	// Compliance reporting
+	QueryListAllCerts            = Statements.Register(SQLListAllCerts)            // Select()
+	QueryReadCompliance          = Statements.Register(SQLReadCompliance)          // Get()
+	QueryListComplianceFindings  = Statements.Register(SQLListComplianceFindings)  // Select()
+	QuerySaveCompliance          = Statements.Register(SQLSaveCompliance)          // Exec()
+	QueryClearComplianceFindings = Statements.Register(SQLClearComplianceFindings) // Exec()
+	QueryCreateComplianceFinding = Statements.Register(SQLCreateComplianceFinding) // Exec()
+
+	// Public key reuse
+	QueryListUnfingerprinted = Statements.Register(SQLListUnfingerprinted) // Select()
+	QuerySetFingerprint      = Statements.Register(SQLSetFingerprint)      // Exec()
+	QueryCountKeyReuse       = Statements.Register(SQLCountKeyReuse)       // Get()
+	QueryListReusedKeys      = Statements.Register(SQLListReusedKeys)      // Select()
+
+	// Name conflicts between users
+	QueryIndexCertName      = Statements.Register(SQLIndexCertName)      // Exec()
+	QuerySetNamesIndexed    = Statements.Register(SQLSetNamesIndexed)    // Exec()
+	QueryListUnindexedNames = Statements.Register(SQLListUnindexedNames) // Select()
+	QueryListNameConflicts  = Statements.Register(SQLListNameConflicts)  // Select()
+	QueryListActiveNames    = Statements.Register(SQLListActiveNames)    // Select()
+
+	// Wildcard report
+	QueryListWildcardCerts = Statements.Register(SQLListWildcardCerts) // Select()
+
+	// Short-lived certificates
+	QueryCreateMinted      = Statements.Register(SQLCreateMinted)      // Exec()
+	QueryListExpiredMinted = Statements.Register(SQLListExpiredMinted) // Select()
+
+	// Provisioning batches
+	QueryCreateProvisionBatch       = Statements.Register(SQLCreateProvisionBatch)       // Get()
+	QueryCreateProvisionDevice      = Statements.Register(SQLCreateProvisionDevice)      // Exec()
+	QueryReadProvisionBatch         = Statements.Register(SQLReadProvisionBatch)         // Get()
+	QueryListProvisionBatches       = Statements.Register(SQLListProvisionBatches)       // Select()
+	QueryListProvisionBatchesBefore = Statements.Register(SQLListProvisionBatchesBefore) // Select()
+	QueryListPendingBatches         = Statements.Register(SQLListPendingBatches)         // Select()
+	QueryListPendingDevices         = Statements.Register(SQLListPendingDevices)         // Select()
+	QuerySetDeviceCert              = Statements.Register(SQLSetDeviceCert)              // Exec()
+	QueryListProvisionedDevices     = Statements.Register(SQLListProvisionedDevices)     // Select()
+	QueryRetryProvisionBatch        = Statements.Register(SQLRetryProvisionBatch)        // Exec()
+	QueryDeleteProvisionBatch       = Statements.Register(SQLDeleteProvisionBatch)       // Exec()
+	QueryCreateCSR                  = Statements.Register(SQLCreateCSR)                  // QueryRowx()
+	QueryReadCSR                    = Statements.Register(SQLReadCSR)                    // Get()
+	QueryListCSRs                   = Statements.Register(SQLListCSRs)                   // Select()
+	QueryListCSRsBefore             = Statements.Register(SQLListCSRsBefore)             // Select()
+	QueryDecideCSR                  = Statements.Register(SQLDecideCSR)                  // Exec()
+
+	// Domains
+	QueryCreateDomain      = Statements.Register(SQLCreateDomain)      // Get() (because we are using RETURNING)
+	QueryReadDomain        = Statements.Register(SQLReadDomain)        // Get()
+	QueryListDomains       = Statements.Register(SQLListDomains)       // Select()
+	QueryListDomainsBefore = Statements.Register(SQLListDomainsBefore) // Select()
+	QueryVerifyDomain      = Statements.Register(SQLVerifyDomain)      // Exec()
+	QueryDeleteDomain      = Statements.Register(SQLDeleteDomain)      // Get() (because we are using RETURNING)
+	QueryMergeDomains      = Statements.Register(SQLMergeDomains)      // Exec()
+
+	// Request templates
+	QuerySaveTemplate        = Statements.Register(SQLSaveTemplate)        // Exec()
+	QueryReadTemplate        = Statements.Register(SQLReadTemplate)        // Get()
+	QueryListTemplates       = Statements.Register(SQLListTemplates)       // Select()
+	QueryListTemplatesBefore = Statements.Register(SQLListTemplatesBefore) // Select()
+	QueryDeleteTemplate      = Statements.Register(SQLDeleteTemplate)      // Get() (because we are using RETURNING)
+	QueryMergeTemplates      = Statements.Register(SQLMergeTemplates)      // Exec()
+
+	// Renewal campaigns
+	QueryCreateCampaign     = Statements.Register(SQLCreateCampaign)     // Get() (because we are using RETURNING)
+	QueryReadCampaign       = Statements.Register(SQLReadCampaign)       // Get()
+	QueryListCampaigns      = Statements.Register(SQLListCampaigns)      // Select()
+	QueryDeleteCampaign     = Statements.Register(SQLDeleteCampaign)     // Get() (because we are using RETURNING)
+	QueryCampaignProgress   = Statements.Register(SQLCampaignProgress)   // Select()
+	QueryCreateCampaignCert = Statements.Register(SQLCreateCampaignCert) // Exec()
+	QueryReadCampaignCert   = Statements.Register(SQLReadCampaignCert)   // Get()
+	QueryListCampaignCerts  = Statements.Register(SQLListCampaignCerts)  // Select()
+	QueryUpdateCampaignCert = Statements.Register(SQLUpdateCampaignCert) // Exec()
+	QueryListCertSuccessors = Statements.Register(SQLListCertSuccessors) // Select()
+
+	// The CRL cache
+	QueryReadCRL         = Statements.Register(SQLReadCRL)         // Get()
+	QueryListCRLs        = Statements.Register(SQLListCRLs)        // Select()
+	QuerySaveCRL         = Statements.Register(SQLSaveCRL)         // Exec()
+	QueryMarkCertRevoked = Statements.Register(SQLMarkCertRevoked) // Exec()
+
+	// Re-checking revocation
+	QueryListRevocationDue      = Statements.Register(SQLListRevocationDue)      // Select()
+	QuerySetRevocationChecked   = Statements.Register(SQLSetRevocationChecked)   // Exec()
+	QueryListAllCertHolders     = Statements.Register(SQLListAllCertHolders)     // Select()
+	QueryDeactivateRevokedCerts = Statements.Register(SQLDeactivateRevokedCerts) // Select() (because we are using RETURNING)
+
+	// Choosing the parameters of query paths to explain
+	QueryBusiestUser   = Statements.Register(SQLBusiestUser)   // Get()
+	QueryCommonestName = Statements.Register(SQLCommonestName) // Get()
+
+	// Trusted roots and intermediates
+	QueryCreateTrustRoot = Statements.Register(SQLCreateTrustRoot) // Exec()
+	QueryListTrustRoots  = Statements.Register(SQLListTrustRoots)  // Select()
+	QueryDeleteTrustRoot = Statements.Register(SQLDeleteTrustRoot) // Get() (because we are using RETURNING)
+
+	// One active certificate per name
+	QueryListActiveCerts = Statements.Register(SQLListActiveCerts) // Select()
+
+	// Scheduled changes
+	QueryCertSchedule       = Statements.Register(SQLCertSchedule)       // Exec()
+	QueryListScheduledCerts = Statements.Register(SQLListScheduledCerts) // Select()
+	QueryListDueCerts       = Statements.Register(SQLListDueCerts)       // Select()
+	QueryRunSchedule        = Statements.Register(SQLRunSchedule)        // Exec()
+
+	// Public status
+	QueryStatusCounts = Statements.Register(SQLStatusCounts) // Get()
+
+	// Reference counting for content-addressed certificate data
+	QueryCreateCertContent      = Statements.RegisterNamed(SQLCreateCertContent) // Exec()
+	QueryReleaseCertContent     = Statements.Register(SQLReleaseCertContent)     // Exec()
+	QueryReleaseUserCertContent = Statements.Register(SQLReleaseUserCertContent) // Exec()
+	QueryPurgeCertContent       = Statements.Register(SQLPurgeCertContent)       // Exec()
 
 	// SQL for User CRUD
-	SQLCreateUser = "INSERT INTO certstore_user(name,email) VALUES(:name, :email) RETURNING id"
-	SQLReadUser   = "SELECT * from certstore_user WHERE id = $1"
-	SQLUpdateUser = "UPDATE certstore_user SET name = :name, email = :email WHERE id = :id"
-	SQLDeleteUser = "DELETE FROM certstore_user WHERE id = $1"
+	// Names and email addresses may be encrypted (see pii.go), so users are looked up by email with its blind index
+	SQLCreateUser       = "INSERT INTO certstore_user(name,email,emailindex) VALUES(:name, :email, :emailindex) RETURNING id"
+	SQLReadUser         = "SELECT id, name, email from certstore_user WHERE id = $1"
+	SQLUpdateUser       = "UPDATE certstore_user SET name = :name, email = :email, emailindex = :emailindex WHERE id = :id"
+	SQLListUsersByEmail = "SELECT id, name, email from certstore_user WHERE emailindex = $1 OR (emailindex IS NULL AND lower(email) = lower($2)) ORDER BY id"
+	SQLDeleteUser       = "DELETE FROM certstore_user WHERE id = $1"
+
+	// SQL for optional attributes (see extra.go). They are only read and written on their own, and locked while
+	// they are updated, so updates of different attributes don't overwrite each other.
+	SQLReadUserExtra   = "SELECT extra from certstore_user WHERE id = $1"
+	SQLLockUserExtra   = "SELECT extra from certstore_user WHERE id = $1 FOR UPDATE"
+	SQLUpdateUserExtra = "UPDATE certstore_user SET extra = $2 WHERE id = $1"
+	SQLReadCertExtra   = "SELECT extra from certstore_cert WHERE userid = $1 AND id = $2"
+	SQLLockCertExtra   = "SELECT extra from certstore_cert WHERE userid = $1 AND id = $2 FOR UPDATE"
+	SQLUpdateCertExtra = "UPDATE certstore_cert SET extra = $3 WHERE userid = $1 AND id = $2"
+
+	// Certificate data is content-addressed: it is stored once in certstore_cert_content (keyed by the certificate-id,
+	// which is the hash of the certificate) and referenced by each user's row in certstore_cert.
+	// Private keys are never read with the rest of a certificate. Only SQLReadKey reads them.
+	SQLCertColumns = "c.id, c.userid, c.active, b.cert, b.notbefore, b.notafter, COALESCE(b.spki, '') AS spki, b.chain, COALESCE(b.ocspstatus, '') AS ocspstatus, b.ocspchecked, b.revoked, COALESCE(b.revocationreason, '') AS revocationreason, b.revocationchecked, c.notes, c.activateat, c.deactivateat"
+	SQLCertFrom    = "certstore_cert c JOIN certstore_cert_content b ON b.id = c.id"
 
 	// SQL for Cert CRUD
-	SQLCreateCert = "INSERT INTO certstore_cert(id, userid, active, cert, key) VALUES(:id, :userid, :active, :cert, :key)"
-	SQLReadCert   = "SELECT * from certstore_cert WHERE userid = $1 AND id = $2"
-	SQLDeleteCert = "DELETE FROM certstore_cert WHERE userid = $1 AND id = $2"
+	SQLCreateCert = "INSERT INTO certstore_cert(id, userid, active, key, notes, activateat, deactivateat) VALUES(:id, :userid, :active, :key, :notes, :activateat, :deactivateat)"
+	SQLReadCert   = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.userid = $1 AND c.id = $2"
+	SQLReadKey    = "SELECT " + SQLCertColumns + ", c.key from " + SQLCertFrom + " WHERE c.userid = $1 AND c.id = $2"
+
+	// SQL for private key exports. Using an export marks it used, so it can only be used once.
+	// The current time is passed in from the clock (see clock.go), rather than being the database's now().
+	SQLCreateKeyExport = "INSERT INTO certstore_export(id, ownerid, certid, userid, expires) VALUES(:id, :ownerid, :certid, :userid, :expires)"
+	SQLUseKeyExport    = "UPDATE certstore_export SET used = true WHERE id = $1 AND NOT used AND expires > $2 RETURNING *"
+	SQLPurgeKeyExports = "DELETE FROM certstore_export WHERE expires <= $1"
+	SQLDeleteCert      = "DELETE FROM certstore_cert WHERE userid = $1 AND id = $2"
+
+	// SQL for content-addressed certificate data
+	SQLCreateCertContent      = "INSERT INTO certstore_cert_content(id, cert, notbefore, notafter, refcount, spki, chain, ocspstatus, ocspchecked, revoked, revocationreason, revocationchecked) VALUES(:id, :cert, :notbefore, :notafter, 1, NULLIF(:spki, ''), :chain, NULLIF(:ocspstatus, ''), :ocspchecked, :revoked, NULLIF(:revocationreason, ''), :revocationchecked) ON CONFLICT (id) DO UPDATE SET refcount = certstore_cert_content.refcount + 1, spki = COALESCE(certstore_cert_content.spki, EXCLUDED.spki), chain = COALESCE(certstore_cert_content.chain, EXCLUDED.chain), ocspstatus = COALESCE(EXCLUDED.ocspstatus, certstore_cert_content.ocspstatus), ocspchecked = COALESCE(EXCLUDED.ocspchecked, certstore_cert_content.ocspchecked), revoked = COALESCE(certstore_cert_content.revoked, EXCLUDED.revoked), revocationreason = COALESCE(certstore_cert_content.revocationreason, EXCLUDED.revocationreason), revocationchecked = COALESCE(EXCLUDED.revocationchecked, certstore_cert_content.revocationchecked)"
+	SQLReleaseCertContent     = "UPDATE certstore_cert_content SET refcount = refcount - 1 WHERE id = $1"
+	SQLReleaseUserCertContent = "UPDATE certstore_cert_content SET refcount = refcount - 1 WHERE id IN (SELECT id from certstore_cert WHERE userid = $1)"
+	SQLPurgeCertContent       = "DELETE FROM certstore_cert_content WHERE refcount <= 0"
 
 	// SQL for miscallaneous queries
-	SQLFetchUserCerts   = "SELECT * from certstore_cert WHERE userid = $1"
-	SQLCertUpdateActive = "UPDATE certstore_cert SET active = $1 WHERE userid = $2 AND id = $3"
-	SQLCertDeleteUsers  = "DELETE from certstore_cert WHERE userid = $1"
+	SQLFetchUserCerts  = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.userid = $1"
+	SQLCertUpdate      = "UPDATE certstore_cert SET active = COALESCE($3, active), notes = COALESCE($4, notes) WHERE userid = $1 AND id = $2"
+	SQLCertDeleteUsers = "DELETE from certstore_cert WHERE userid = $1 RETURNING id"
+	SQLUserExists      = "SELECT EXISTS(SELECT 1 from certstore_user WHERE id = $1)"
+
+	// SQL for keyset pagination of certificates. Passing NULL for a filter parameter disables that filter.
+	// $5 and $6 are the current time adjusted forwards and backwards by the clock-skew tolerance.
+	SQLListCertsFilter = "($3::BOOLEAN IS NULL OR c.active = $3) AND ($4::BOOLEAN IS NULL OR (b.notbefore <= $5 AND b.notafter >= $6) = $4)"
+	SQLListCertsAfter  = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.userid = $1 AND c.id > $2 AND " + SQLListCertsFilter + " ORDER BY c.id ASC LIMIT $7"
+	SQLListCertsBefore = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.userid = $1 AND c.id < $2 AND " + SQLListCertsFilter + " ORDER BY c.id DESC LIMIT $7"
+
+	// $2 is always the empty string, so that the filter's parameters keep their numbers
+	SQLCountUserCerts = "SELECT COUNT(*) from " + SQLCertFrom + " WHERE c.userid = $1 AND c.id > $2 AND " + SQLListCertsFilter
+
+	// SQL for certificate sharing grants. If a certificate is shared with a user by more than one owner, the
+	// grant with the most access wins.
+	SQLCreateGrant      = "INSERT INTO certstore_cert_grant(certid, ownerid, userid, access) VALUES(:certid, :ownerid, :userid, :access) ON CONFLICT (certid, ownerid, userid) DO UPDATE SET access = EXCLUDED.access"
+	SQLReadGrant        = "SELECT * from certstore_cert_grant WHERE certid = $1 AND userid = $2 ORDER BY access = 'deploy' DESC LIMIT 1"
+	SQLDeleteGrant      = "DELETE FROM certstore_cert_grant WHERE certid = $1 AND ownerid = $2 AND userid = $3"
+	SQLDeleteCertGrants = "DELETE FROM certstore_cert_grant WHERE certid = $1 AND ownerid = $2"
+	SQLDeleteUserGrants = "DELETE FROM certstore_cert_grant WHERE ownerid = $1 OR userid = $1"
+	SQLListCertGrants   = "SELECT * from certstore_cert_grant WHERE certid = $1 AND ownerid = $2 AND userid > $3 ORDER BY userid LIMIT $4"
+	SQLListUserGrants   = "SELECT * from certstore_cert_grant WHERE userid = $1 AND (certid, ownerid) > ($2, $3) ORDER BY certid, ownerid LIMIT $4"
+
+	// SQL for the pages before a cursor, read backwards, and given back in order (see pagination.go)
+	SQLListCertGrantsBefore = "SELECT * from (SELECT * from certstore_cert_grant WHERE certid = $1 AND ownerid = $2 AND userid < $3 ORDER BY userid DESC LIMIT $4) g ORDER BY userid"
+	SQLListUserGrantsBefore = "SELECT * from (SELECT * from certstore_cert_grant WHERE userid = $1 AND (certid, ownerid) < ($2, $3) ORDER BY certid DESC, ownerid DESC LIMIT $4) g ORDER BY certid, ownerid"
+
+	// SQL for certificate attachments. Listing an attachment never reads its data.
+	// A certificate is locked while attaching to it, so that concurrent uploads can't exceed the MaxAttachments option.
+	SQLAttachmentColumns     = "certid, userid, name, type, size, created"
+	SQLLockCert              = "SELECT id from certstore_cert WHERE userid = $1 AND id = $2 FOR UPDATE"
+	SQLCountAttachments      = "SELECT count(*) from certstore_attachment WHERE certid = $1 AND userid = $2 AND name <> $3"
+	SQLCreateAttachment      = "INSERT INTO certstore_attachment(certid, userid, name, type, size, created, data) VALUES(:certid, :userid, :name, :type, :size, :created, :data) ON CONFLICT (certid, userid, name) DO UPDATE SET type = EXCLUDED.type, size = EXCLUDED.size, data = EXCLUDED.data, created = EXCLUDED.created RETURNING created"
+	SQLReadAttachment        = "SELECT " + SQLAttachmentColumns + ", data from certstore_attachment WHERE certid = $1 AND userid = $2 AND name = $3"
+	SQLListAttachments       = "SELECT " + SQLAttachmentColumns + " from certstore_attachment WHERE certid = $1 AND userid = $2 AND name > $3 ORDER BY name LIMIT $4"
+	SQLListAttachmentsBefore = "SELECT * from (SELECT " + SQLAttachmentColumns + " from certstore_attachment WHERE certid = $1 AND userid = $2 AND name < $3 ORDER BY name DESC LIMIT $4) a ORDER BY name"
+	SQLDeleteAttachment      = "DELETE FROM certstore_attachment WHERE certid = $1 AND userid = $2 AND name = $3 RETURNING " + SQLAttachmentColumns
+
+	// SQL for transfering certificates between users. $3 is an optional array of cert-ids (NULL means all certs).
+	// If the receiving user already holds a certificate, the sender's copy is deleted instead of being moved.
+	SQLTransferCertsSelection = "($3::TEXT[] IS NULL OR id = ANY($3::TEXT[]))"
+	SQLTransferDuplicateCerts = "WITH dup AS (DELETE FROM certstore_cert s WHERE s.userid = $1 AND " + SQLTransferCertsSelection + " AND EXISTS(SELECT 1 from certstore_cert t WHERE t.userid = $2 AND t.id = s.id) RETURNING s.id) UPDATE certstore_cert_content SET refcount = refcount - 1 WHERE id IN (SELECT id from dup) RETURNING id"
+	SQLTransferCerts          = "UPDATE certstore_cert SET userid = $2 WHERE userid = $1 AND " + SQLTransferCertsSelection + " RETURNING id"
+	SQLCountTransferGrants    = "SELECT count(*) from certstore_cert_grant WHERE ownerid = $1 AND ($2::TEXT[] IS NULL OR certid = ANY($2::TEXT[]))"
+	SQLDeleteSelfGrants       = "DELETE FROM certstore_cert_grant WHERE ownerid = userid"
+	SQLMergeDuplicateGrants   = "DELETE FROM certstore_cert_grant g WHERE g.userid = $2 AND EXISTS(SELECT 1 from certstore_cert_grant h WHERE h.userid = $1 AND h.certid = g.certid AND h.ownerid = g.ownerid)"
+	SQLMergeGrants            = "UPDATE certstore_cert_grant SET userid = $1 WHERE userid = $2"
+
+	// SQL for the audit log
+	SQLCreateAudit         = "INSERT INTO certstore_audit(time, action, userid, targetid, certid, detail, reason, prevhash, hash) VALUES(:time, :action, :userid, :targetid, :certid, :detail, :reason, :prevhash, :hash)"
+	SQLListUserAudit       = "SELECT * from certstore_audit WHERE (userid = $1 OR targetid = $1) AND id < $2 ORDER BY id DESC LIMIT $3" // Newest first
+	SQLListUserAuditBefore = "SELECT * from (SELECT * from certstore_audit WHERE (userid = $1 OR targetid = $1) AND id > $2 ORDER BY id LIMIT $3) a ORDER BY id DESC"
+	SQLLockAudit           = "SELECT pg_advisory_xact_lock(" + auditLockKey + ")" // Held until the transaction ends, so entries are chained one at a time
+	SQLReadLastAudit       = "SELECT * from certstore_audit ORDER BY id DESC LIMIT 1"
+	SQLListAudit           = "SELECT * from certstore_audit ORDER BY id"
+
+	// Audit log anchors
+	SQLCreateAuditAnchor   = "INSERT INTO certstore_audit_anchor(auditid, hash, token) VALUES(:auditid, :hash, :token)"
+	SQLReadLastAuditAnchor = "SELECT * from certstore_audit_anchor ORDER BY id DESC LIMIT 1"
+	SQLListAuditAnchors    = "SELECT * from certstore_audit_anchor ORDER BY id"
+
+	// Forwarding the audit log to the SIEM
+	SQLListAuditAfter   = "SELECT * from certstore_audit WHERE id > $1 ORDER BY id LIMIT $2"
+	SQLCreateSIEMCursor = "INSERT INTO certstore_siem(id, auditid) SELECT 1, COALESCE(max(id), 0) from certstore_audit ON CONFLICT (id) DO NOTHING"
+	SQLReadSIEMCursor   = "SELECT auditid from certstore_siem WHERE id = 1"
+	SQLUpdateSIEMCursor = "UPDATE certstore_siem SET auditid = $1 WHERE id = 1"
+
+	// SQL for the event log. Like the audit log, events are written one at a time, so they are committed in the
+	// order of their ids and a standby reading after an id never misses one.
+	SQLLockEvents      = "SELECT pg_advisory_xact_lock(" + eventLockKey + ")"
+	SQLCreateEvent     = "INSERT INTO certstore_event(time, type, userid, targetid, certid) VALUES(:time, :type, :userid, :targetid, :certid) RETURNING id"
+	SQLListEventsAfter = "SELECT * from certstore_event WHERE id > $1 ORDER BY id LIMIT $2"
+	SQLReadLastEvent   = "SELECT COALESCE(max(id), 0) from certstore_event"
+
+	// SQL for reading users for a standby. Keys, certificates and attachments are read as they are stored.
+	SQLListReplicaUsers       = "SELECT * from certstore_user WHERE id > $1 ORDER BY id LIMIT $2"
+	SQLReadReplicaUser        = "SELECT * from certstore_user WHERE id = $1"
+	SQLListReplicaCerts       = "SELECT c.id, c.active, c.key, c.notes, c.activateat, c.deactivateat, c.extra, b.cert, b.notbefore, b.notafter, COALESCE(b.spki, '') AS spki, b.chain from " + SQLCertFrom + " WHERE c.userid = $1 ORDER BY c.id"
+	SQLListReplicaGrants      = "SELECT * from certstore_cert_grant WHERE ownerid = $1 OR userid = $1 ORDER BY certid, ownerid, userid"
+	SQLListReplicaAttachments = "SELECT certid, name, type, size, created, data from certstore_attachment WHERE userid = $1 ORDER BY certid, name"
+
+	// SQL for applying users on a standby. A grant is only copied once both the certificate and the grantee
+	// have been, so users can be copied in any order.
+	SQLReplicateUser        = "INSERT INTO certstore_user(id, name, email, emailindex, extra) VALUES($1, $2, $3, $4, $5) ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email, emailindex = EXCLUDED.emailindex, extra = EXCLUDED.extra"
+	SQLReplicateCert        = "INSERT INTO certstore_cert(id, userid, active, key, notes, activateat, deactivateat, extra) VALUES($1, $2, $3, $4, $5, $6, $7, $8)"
+	SQLReplicateGrant       = "INSERT INTO certstore_cert_grant(certid, ownerid, userid, access) SELECT $1::CHAR(64), $2::INT, $3::INT, $4::TEXT WHERE EXISTS(SELECT 1 from certstore_cert WHERE id = $1 AND userid = $2) AND EXISTS(SELECT 1 from certstore_user WHERE id = $3) ON CONFLICT (certid, ownerid, userid) DO UPDATE SET access = EXCLUDED.access"
+	SQLReplicateAttachment  = "INSERT INTO certstore_attachment(certid, userid, name, type, size, created, data) VALUES($1, $2, $3, $4, $5, $6, $7)"
+	SQLReplicateAudit       = "INSERT INTO certstore_audit(id, time, action, userid, targetid, certid, detail, reason, prevhash, hash) VALUES(:id, :time, :action, :userid, :targetid, :certid, :detail, :reason, :prevhash, :hash) ON CONFLICT (id) DO NOTHING"
+	SQLDeleteReceivedGrants = "DELETE FROM certstore_cert_grant WHERE userid = $1"
+	SQLCreateReplicaState   = "INSERT INTO certstore_replica(id) VALUES(1) ON CONFLICT (id) DO NOTHING"
+	SQLReadReplicaState     = "SELECT eventid, auditid, copyuser, copied, promoted from certstore_replica WHERE id = 1"
+	SQLUpdateReplicaState   = "UPDATE certstore_replica SET eventid = $1, auditid = $2, copyuser = $3, copied = $4 WHERE id = 1"
+	SQLPromoteReplica       = "UPDATE certstore_replica SET promoted = true WHERE id = 1"
+
+	// Rows copied from the primary keep their ids, so the sequences have to catch up before this instance
+	// creates rows of its own
+	SQLResetSequences = "SELECT " +
+		"setval(pg_get_serial_sequence('certstore_user', 'id'), COALESCE((SELECT max(id) from certstore_user), 0) + 1, false), " +
+		"setval(pg_get_serial_sequence('certstore_audit', 'id'), COALESCE((SELECT max(id) from certstore_audit), 0) + 1, false), " +
+		"setval(pg_get_serial_sequence('certstore_event', 'id'), COALESCE((SELECT max(id) from certstore_event), 0) + 1, false)"
+
+	// SQL for resolving references to certificates (see certref.go), among the certificates a user holds or that
+	// are shared with them. Resolving a prefix only needs to know if there is more than one match.
+	SQLHeldCertIds         = "(SELECT id from certstore_cert WHERE userid = $1 UNION SELECT certid from certstore_cert_grant WHERE userid = $1)"
+	SQLResolveCertIdPrefix = "SELECT id from certstore_cert_content WHERE id IN " + SQLHeldCertIds + " AND id LIKE $2 ORDER BY id LIMIT 2"
+	SQLListHeldCerts       = "SELECT id, cert from certstore_cert_content WHERE id IN " + SQLHeldCertIds + " ORDER BY id"
+
+	// SQL for usage metering. Passing NULL for the user-id gives usage for the whole server.
+	SQLAddUsage         = "INSERT INTO certstore_usage(month, userid, metric, count) VALUES($1, $2, $3, $4) ON CONFLICT (month, userid, metric) DO UPDATE SET count = certstore_usage.count + EXCLUDED.count"
+	SQLListUsage        = "SELECT month, metric, sum(count) AS count from certstore_usage WHERE ($1::TEXT IS NULL OR userid = $1) AND month >= $2 AND month <= $3 GROUP BY month, metric ORDER BY month, metric"
+	SQLCountStoredCerts = "SELECT count(*) from certstore_cert WHERE $1::INT IS NULL OR userid = $1"
+
+	// SQL for going through every user's certificates, in keyset pages ordered by user and cert-id
+	SQLListAllCerts = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE (c.userid, c.id) > ($1::INT, $2) ORDER BY c.userid, c.id LIMIT $3"
+
+	// SQL for a user's active certificates, locked so they can be deactivated (see exclusive.go)
+	SQLListActiveCerts = "SELECT c.id, b.cert from " + SQLCertFrom + " WHERE c.userid = $1 AND c.active ORDER BY c.id FOR UPDATE OF c"
+
+	// SQL for scheduled changes (see schedule.go). Certificates locked by another instance running the schedule are
+	// skipped. Passing false for a time leaves it alone; passing true and NULL cancels it.
+	SQLCertSchedule       = "UPDATE certstore_cert SET activateat = CASE WHEN $3 THEN $4::TIMESTAMPTZ ELSE activateat END, deactivateat = CASE WHEN $5 THEN $6::TIMESTAMPTZ ELSE deactivateat END WHERE userid = $1 AND id = $2"
+	SQLListScheduledCerts = "SELECT userid, id, activateat, deactivateat from certstore_cert WHERE activateat <= $1 OR deactivateat <= $1 ORDER BY userid, id LIMIT $2 FOR UPDATE SKIP LOCKED"
+	SQLListDueCerts       = "SELECT userid, id, activateat, deactivateat from certstore_cert WHERE activateat <= $1 OR deactivateat <= $1 ORDER BY userid, id"
+	SQLRunSchedule        = "UPDATE certstore_cert SET active = $3, activateat = CASE WHEN activateat <= $4 THEN NULL ELSE activateat END, deactivateat = CASE WHEN deactivateat <= $4 THEN NULL ELSE deactivateat END WHERE userid = $1 AND id = $2"
+
+	// SQL for the public status (see status.go): active certificates by expiry, given now and now plus 7 and 30 days
+	SQLStatusCounts = "SELECT count(*) AS active, " +
+		"count(*) FILTER (WHERE b.notafter < $1) AS expired, " +
+		"count(*) FILTER (WHERE b.notafter >= $1 AND b.notafter < $2) AS expiring7d, " +
+		"count(*) FILTER (WHERE b.notafter >= $1 AND b.notafter < $3) AS expiring30d " +
+		"from " + SQLCertFrom + " WHERE c.active"
+
+	// SQL for the latest compliance evaluation (see compliance.go). Findings for certificates deleted since are left out.
+	SQLReadCompliance          = "SELECT generated, policy, checked from certstore_compliance WHERE id = 1"
+	SQLListComplianceFindings  = "SELECT f.userid, f.certid, f.commonname, c.active, f.notafter, f.violations from certstore_compliance_finding f JOIN certstore_cert c ON c.userid = f.userid AND c.id = f.certid ORDER BY f.userid, f.certid"
+	SQLSaveCompliance          = "INSERT INTO certstore_compliance(id, generated, policy, checked) VALUES(1, $1, $2, $3) ON CONFLICT (id) DO UPDATE SET generated = $1, policy = $2, checked = $3"
+	SQLClearComplianceFindings = "DELETE FROM certstore_compliance_finding"
+	SQLCreateComplianceFinding = "INSERT INTO certstore_compliance_finding(userid, certid, commonname, notafter, violations) VALUES($1, $2, $3, $4, $5)"
+
+	// SQL for public key reuse (see keyreuse.go). Certificates are only counted once, however many users hold them.
+	SQLListUnfingerprinted = "SELECT id, cert from certstore_cert_content WHERE spki IS NULL ORDER BY id LIMIT $1"
+	SQLSetFingerprint      = "UPDATE certstore_cert_content SET spki = $2 WHERE id = $1"
+	SQLCountKeyReuse       = "SELECT count(*) from certstore_cert_content WHERE spki = $1 AND id <> $2"
+	SQLListReusedKeys      = "SELECT b.spki, c.userid, c.id, c.active, b.notafter from " + SQLCertFrom + " WHERE b.spki IN (SELECT spki from certstore_cert_content WHERE spki IS NOT NULL GROUP BY spki HAVING count(*) > 1) ORDER BY b.spki, c.userid, c.id"
+
+	// SQL for name conflicts between users (see conflicts.go)
+	SQLIndexCertName      = "INSERT INTO certstore_cert_name(id, name) VALUES($1, $2) ON CONFLICT DO NOTHING"
+	SQLSetNamesIndexed    = "UPDATE certstore_cert_content SET namesindexed = true WHERE id = $1"
+	SQLListUnindexedNames = "SELECT id, cert from certstore_cert_content WHERE NOT namesindexed ORDER BY id LIMIT $1"
+	SQLListNameConflicts  = "SELECT DISTINCT c.userid, c.id AS certid, n.name from certstore_cert_name n JOIN certstore_cert c ON c.id = n.id WHERE c.active AND c.userid <> $1::INT AND (n.name = ANY($2) OR n.name LIKE ANY($3)) ORDER BY c.userid, certid, n.name"
+	SQLListActiveNames    = "SELECT DISTINCT c.userid, c.id AS certid, n.name from certstore_cert_name n JOIN certstore_cert c ON c.id = n.id WHERE c.active ORDER BY n.name, c.userid, certid"
+
+	// SQL for the wildcard report (see wildcards.go): active wildcard certificates, with the users they are shared with for deployment
+	SQLListWildcardCerts = "SELECT c.userid, c.id AS certid, b.notafter, array_agg(n.name ORDER BY n.name) AS wildcards, " +
+		"ARRAY(SELECT g.userid::TEXT from certstore_cert_grant g WHERE g.certid = c.id AND g.ownerid = c.userid AND g.access = 'deploy' ORDER BY g.userid) AS deployedby " +
+		"from " + SQLCertFrom + " JOIN certstore_cert_name n ON n.id = c.id WHERE c.active AND n.name LIKE '*.%' GROUP BY c.userid, c.id, b.notafter ORDER BY c.userid, c.id"
+
+	// SQL for short-lived certificates (see mint.go)
+	SQLCreateMinted      = "INSERT INTO certstore_minted(certid, userid, parentid, notafter) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	SQLListExpiredMinted = "SELECT userid, certid from certstore_minted WHERE notafter < $1 ORDER BY notafter LIMIT $2"
+
+	// SQL for provisioning batches (see provision.go). A device is pending until it has a certificate or an error.
+	SQLProvisionBatchColumns = "p.id, p.userid, p.parentid, p.notafter, p.vendorid, p.productid, p.created, count(d.deviceid) AS devices, " +
+		"count(d.deviceid) FILTER (WHERE d.cert <> '') AS issued, count(d.deviceid) FILTER (WHERE d.error <> '') AS failed, " +
+		"count(d.deviceid) FILTER (WHERE d.cert = '' AND d.error = '') AS pending"
+	SQLProvisionBatchFrom         = "certstore_provision_batch p LEFT JOIN certstore_provision_device d ON d.batchid = p.id"
+	SQLCreateProvisionBatch       = "INSERT INTO certstore_provision_batch(userid, parentid, notafter, vendorid, productid) VALUES($1, $2, $3, $4, $5) RETURNING id, created"
+	SQLCreateProvisionDevice      = "INSERT INTO certstore_provision_device(batchid, deviceid, csr) VALUES($1, $2, $3)"
+	SQLReadProvisionBatch         = "SELECT " + SQLProvisionBatchColumns + " from " + SQLProvisionBatchFrom + " WHERE p.userid = $1 AND p.id = $2 GROUP BY p.id"
+	SQLListProvisionBatches       = "SELECT " + SQLProvisionBatchColumns + " from " + SQLProvisionBatchFrom + " WHERE p.userid = $1 AND p.id > $2 GROUP BY p.id ORDER BY p.id LIMIT $3"
+	SQLListProvisionBatchesBefore = "SELECT * from (SELECT " + SQLProvisionBatchColumns + " from " + SQLProvisionBatchFrom + " WHERE p.userid = $1 AND p.id < $2 GROUP BY p.id ORDER BY p.id DESC LIMIT $3) b ORDER BY id"
+	SQLListPendingBatches         = "SELECT " + SQLProvisionBatchColumns + " from " + SQLProvisionBatchFrom + " WHERE p.id IN (SELECT batchid from certstore_provision_device WHERE cert = '' AND error = '') GROUP BY p.id ORDER BY p.id"
+	SQLListPendingDevices         = "SELECT deviceid, csr from certstore_provision_device WHERE batchid = $1 AND cert = '' AND error = '' ORDER BY deviceid LIMIT $2"
+	SQLSetDeviceCert              = "UPDATE certstore_provision_device SET cert = $3, key = $4, error = $5 WHERE batchid = $1 AND deviceid = $2 AND cert = '' AND error = ''"
+	SQLListProvisionedDevices     = "SELECT deviceid, cert, key, error from certstore_provision_device WHERE batchid = $1 AND deviceid > $2 AND (cert <> '' OR error <> '') ORDER BY deviceid LIMIT $3"
+	SQLRetryProvisionBatch        = "UPDATE certstore_provision_device SET error = '' WHERE batchid = $1 AND error <> ''"
+	SQLDeleteProvisionBatch       = "DELETE FROM certstore_provision_batch WHERE userid = $1 AND id = $2"
+
+	// SQL for CSRs submitted for approval (see csrqueue.go). A CSR is only queued while there is room, and only decided once.
+	SQLCSRColumns     = "id, status, csr, contact, comment, client, submitted, decided, decidedby, reason, cert, chain"
+	SQLCreateCSR      = "INSERT INTO certstore_csr(id, csr, contact, comment, client) SELECT $1, $2, $3, $4, $5 WHERE (SELECT count(*) from certstore_csr WHERE status = 'pending') < $6 RETURNING submitted"
+	SQLReadCSR        = "SELECT " + SQLCSRColumns + " from certstore_csr WHERE id = $1"
+	SQLListCSRs       = "SELECT " + SQLCSRColumns + " from certstore_csr WHERE status = $1 AND (submitted, id) > ($2, $3) ORDER BY submitted, id LIMIT $4"
+	SQLListCSRsBefore = "SELECT * from (SELECT " + SQLCSRColumns + " from certstore_csr WHERE status = $1 AND (submitted, id) < ($2, $3) ORDER BY submitted DESC, id DESC LIMIT $4) q ORDER BY submitted, id"
+	SQLDecideCSR      = "UPDATE certstore_csr SET status = $2, decided = $3, decidedby = $4, reason = $5, cert = $6, chain = $7 WHERE id = $1 AND status = 'pending'"
+
+	// SQL for domains (see domains.go). Registering a domain again leaves it alone. Merging users keeps a domain
+	// verified if either user had verified it.
+	SQLDomainColumns     = "userid, name, token, created, verified"
+	SQLCreateDomain      = "INSERT INTO certstore_domain(userid, name, token, created) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING RETURNING " + SQLDomainColumns
+	SQLReadDomain        = "SELECT " + SQLDomainColumns + " from certstore_domain WHERE userid = $1 AND name = $2"
+	SQLListDomains       = "SELECT " + SQLDomainColumns + " from certstore_domain WHERE userid = $1 AND name > $2 ORDER BY name LIMIT $3"
+	SQLListDomainsBefore = "SELECT * from (SELECT " + SQLDomainColumns + " from certstore_domain WHERE userid = $1 AND name < $2 ORDER BY name DESC LIMIT $3) d ORDER BY name"
+	SQLVerifyDomain      = "UPDATE certstore_domain SET verified = $3 WHERE userid = $1 AND name = $2"
+	SQLDeleteDomain      = "DELETE FROM certstore_domain WHERE userid = $1 AND name = $2 RETURNING " + SQLDomainColumns
+	SQLMergeDomains      = "INSERT INTO certstore_domain(userid, name, token, created, verified) SELECT $1, name, token, created, verified from certstore_domain WHERE userid = $2 " +
+		"ON CONFLICT (userid, name) DO UPDATE SET verified = COALESCE(certstore_domain.verified, EXCLUDED.verified)"
+
+	// SQL for request templates (see templates.go). Merging users keeps the merged-into user's template of a name.
+	SQLTemplateColumns     = "userid, name, spec, updated"
+	SQLSaveTemplate        = "INSERT INTO certstore_template(userid, name, spec, updated) VALUES($1, $2, $3, $4) ON CONFLICT (userid, name) DO UPDATE SET spec = EXCLUDED.spec, updated = EXCLUDED.updated"
+	SQLReadTemplate        = "SELECT " + SQLTemplateColumns + " from certstore_template WHERE userid = $1 AND name = $2"
+	SQLListTemplates       = "SELECT " + SQLTemplateColumns + " from certstore_template WHERE userid = $1 AND name > $2 ORDER BY name LIMIT $3"
+	SQLListTemplatesBefore = "SELECT * from (SELECT " + SQLTemplateColumns + " from certstore_template WHERE userid = $1 AND name < $2 ORDER BY name DESC LIMIT $3) t ORDER BY name"
+	SQLDeleteTemplate      = "DELETE FROM certstore_template WHERE userid = $1 AND name = $2 RETURNING " + SQLTemplateColumns
+	SQLMergeTemplates      = "INSERT INTO certstore_template(userid, name, spec, updated) SELECT $1, name, spec, updated from certstore_template WHERE userid = $2 ON CONFLICT DO NOTHING"
+
+	// SQL for renewal campaigns (see campaign.go). Progress is counted by status, for one campaign or ($1 NULL) all.
+	SQLCampaignColumns     = "id, name, description, selector, due, created, createdby"
+	SQLCampaignCertColumns = "campaignid, userid, certid, commonname, notafter, owner, status, note, renewedby, updated"
+	SQLCreateCampaign      = "INSERT INTO certstore_campaign(name, description, selector, due, created, createdby) VALUES($1, $2, $3, $4, $5, $6) RETURNING id"
+	SQLReadCampaign        = "SELECT " + SQLCampaignColumns + " from certstore_campaign WHERE id = $1"
+	SQLListCampaigns       = "SELECT " + SQLCampaignColumns + " from certstore_campaign ORDER BY id"
+	SQLDeleteCampaign      = "DELETE FROM certstore_campaign WHERE id = $1 RETURNING " + SQLCampaignColumns
+	SQLCampaignProgress    = "SELECT campaignid, status, count(*) from certstore_campaign_cert WHERE $1::BIGINT IS NULL OR campaignid = $1 GROUP BY campaignid, status"
+	SQLCreateCampaignCert  = "INSERT INTO certstore_campaign_cert(" + SQLCampaignCertColumns + ") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	SQLReadCampaignCert    = "SELECT " + SQLCampaignCertColumns + " from certstore_campaign_cert WHERE campaignid = $1 AND userid = $2 AND certid = $3"
+	SQLListCampaignCerts   = "SELECT " + SQLCampaignCertColumns + " from certstore_campaign_cert WHERE campaignid = $1 ORDER BY notafter, userid, certid"
+	SQLUpdateCampaignCert  = "UPDATE certstore_campaign_cert SET owner = $4, status = $5, note = $6, renewedby = $7, updated = $8 WHERE campaignid = $1 AND userid = $2 AND certid = $3"
+
+	// A user's other active certificates for any of the names of one of theirs (see certstore_cert_name), latest expiring first
+	SQLListCertSuccessors = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.userid = $1 AND c.active AND c.id <> $2 AND " +
+		"EXISTS(SELECT 1 from certstore_cert_name n JOIN certstore_cert_name m ON m.name = n.name WHERE n.id = c.id AND m.id = $2) ORDER BY b.notafter DESC, c.id"
+
+	// SQL for the CRL cache (see crl.go). Listing leaves out the CRLs themselves.
+	SQLCRLColumns      = "url, issuer, thisupdate, nextupdate, fetched, checked, entries, error"
+	SQLReadCRL         = "SELECT " + SQLCRLColumns + ", data from certstore_crl WHERE url = $1"
+	SQLListCRLs        = "SELECT " + SQLCRLColumns + " from certstore_crl ORDER BY url"
+	SQLSaveCRL         = "INSERT INTO certstore_crl(" + SQLCRLColumns + ", data) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (url) DO UPDATE SET issuer = EXCLUDED.issuer, thisupdate = EXCLUDED.thisupdate, nextupdate = EXCLUDED.nextupdate, fetched = EXCLUDED.fetched, checked = EXCLUDED.checked, entries = EXCLUDED.entries, error = EXCLUDED.error, data = EXCLUDED.data"
+	SQLMarkCertRevoked = "UPDATE certstore_cert_content SET revoked = $2, revocationreason = NULLIF($3, '') WHERE id = $1 AND revoked IS NULL"
+
+	// SQL for re-checking active certificates' revocation status (see revocation.go). Certificates already known to be
+	// revoked are always due, so their active copies are deactivated.
+	SQLListRevocationDue      = "SELECT " + SQLCertColumns + " from " + SQLCertFrom + " WHERE c.active AND (b.revoked IS NOT NULL OR b.revocationchecked IS NULL OR b.revocationchecked < $1) ORDER BY b.revocationchecked NULLS FIRST, c.id, c.userid LIMIT $2"
+	SQLSetRevocationChecked   = "UPDATE certstore_cert_content SET revocationchecked = $2 WHERE id = $1"
+	SQLListAllCertHolders     = "SELECT userid from certstore_cert WHERE id = $1 ORDER BY userid"
+	SQLDeactivateRevokedCerts = "UPDATE certstore_cert SET active = false WHERE id = $1 AND active RETURNING userid"
+
+	// SQL for choosing the parameters of query paths to explain (see explain.go), for the worst case
+	SQLBusiestUser   = "SELECT userid from certstore_cert GROUP BY userid ORDER BY count(*) DESC, userid LIMIT 1"
+	SQLCommonestName = "SELECT name from certstore_cert_name GROUP BY name ORDER BY count(*) DESC, name LIMIT 1"
+
+	// SQL for the roots and intermediates trusted for verifying chains (see trustroots.go)
+	SQLTrustRootColumns = "id, kind, cert, subject, notafter, added, addedby"
+	SQLCreateTrustRoot  = "INSERT INTO certstore_trust_root(" + SQLTrustRootColumns + ") VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING"
+	SQLListTrustRoots   = "SELECT " + SQLTrustRootColumns + " from certstore_trust_root ORDER BY id"
+	SQLDeleteTrustRoot  = "DELETE FROM certstore_trust_root WHERE id = $1 RETURNING " + SQLTrustRootColumns
+
+	// Every user holding a certificate, but only if the given user holds it too
+	SQLCertHolders = "SELECT userid from certstore_cert WHERE id = $1 AND EXISTS(SELECT 1 from certstore_cert WHERE userid = $2 AND id = $1) ORDER BY userid"
+
+	// The chain every holder of a certificate shares (see chain.go)
+	SQLReadCertChain = "SELECT chain from certstore_cert_content WHERE id = $1"
 )
 
 // Set-up the connection to the database on the global `db` connection.
@@ -49,12 +550,19 @@ var (
 func DatabaseSetup() error {
 	var err error
 
-	db, err = sqlx.Connect("postgres", OptDatabaseConnection)
+	// Connect through a connector that times each statement (see querystats.go)
+	connector, err := pq.NewConnector(OptDatabaseConnection)
+	if err != nil {
+		return err
+	}
+	db = sqlx.NewDb(sql.OpenDB(&instrumentedConnector{connector}), "postgres")
+	err = db.Ping()
 	if err != nil {
 		return err
 	}
 
-	err = DatabasePrepareQueries()
+	// The statements are prepared as they are first used (see statements.go)
+	err = Statements.Open(db)
 	if err != nil {
 		return err
 	}
@@ -70,101 +578,37 @@ func DatabaseShutdown() {
 	}
 }
 
-// Prepare the database queries in the database upon startup
-// By exclusively using prepared queries, we can gain some
-// speedups in the database.
-func DatabasePrepareQueries() error {
-	var err error
-
-	// CRUD for User
-	QueryCreateUser, err = db.PrepareNamed(SQLCreateUser)
-	if err != nil {
-		return err
-	}
-	QueryReadUser, err = db.Preparex(SQLReadUser)
-	if err != nil {
-		return err
-	}
-	QueryUpdateUser, err = db.PrepareNamed(SQLUpdateUser)
-	if err != nil {
-		return err
-	}
-	QueryDeleteUser, err = db.Preparex(SQLDeleteUser)
-	if err != nil {
-		return err
-	}
-
-	// CRUD for Cert
-	QueryCreateCert, err = db.PrepareNamed(SQLCreateCert)
-	if err != nil {
-		return err
-	}
-	QueryReadCert, err = db.Preparex(SQLReadCert)
-	if err != nil {
-		return err
-	}
-	QueryDeleteCert, err = db.Preparex(SQLDeleteCert)
-	if err != nil {
-		return err
-	}
-
-	// Other miscellaneous queries
-	QueryFetchUserCerts, err = db.Preparex(SQLFetchUserCerts)
-	if err != nil {
-		return err
-	}
-	QueryCertUpdateActive, err = db.Preparex(SQLCertUpdateActive)
-	if err != nil {
-		return err
-	}
-	QueryCertDeleteUsers, err = db.Preparex(SQLCertDeleteUsers)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 // Given a User, insert a row into the database
 // If the user struct contains certificates, insert
 // the certificates in a transaction safe manner.
 func DatabaseCreateUser(user *User) error {
 	// Use a transaction as to avoid a situation where a client could
 	// read a new user with only a partial list of certificates
-	tx, err := db.Beginx()
+	stored, err := newStoredUser(user)
 	if err != nil {
 		return err
 	}
-	createUserStmt := tx.NamedStmt(QueryCreateUser)
-	createCertStmt := tx.NamedStmt(QueryCreateCert)
+	err = WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		createUserStmt := QueryCreateUser.Tx(tx)
 
-	// Insert the user
-	err = createUserStmt.Get(&user.Id, user)
-	if err != nil {
-		rollerr := tx.Rollback()
-		if rollerr != nil {
-			log.Println(rollerr)
+		// Insert the user
+		err := createUserStmt.Get(&user.Id, stored)
+		if err != nil {
+			return err
 		}
-		return err
-	}
 
-	// If the User contains certificates, insert them as well
-	if len(user.Certs) != 0 {
-		for _, certData := range user.Certs {
-			certData.UserId = user.Id
-			_, err := createCertStmt.Exec(*certData)
-			if err != nil {
-				rollerr := tx.Rollback()
-				if rollerr != nil {
-					log.Println(rollerr)
+		// If the User contains certificates, insert them as well
+		if len(user.Certs) != 0 {
+			for _, certData := range user.Certs {
+				certData.UserId = user.Id
+				err := databaseCreateCertTx(tx, certData)
+				if err != nil {
+					return err
 				}
-				return err
 			}
 		}
-	}
-
-	// Commit the transaction
-	err = tx.Commit()
+		return nil
+	})
 	if err != nil {
 		return err
 	}
@@ -172,31 +616,75 @@ func DatabaseCreateUser(user *User) error {
 	return nil
 }
 
-// Given a userID, get a User
-func DatabaseReadUser(userid string) (*User, error) {
+// Given a userID, get a User, with the certificates certs asks for, and the cursors for their neighbouring pages
+func DatabaseReadUser(userid string, certs *UserCertsQuery) (*User, *Page, error) {
 	// Build the User struct
-	user := new(User)
-	err := QueryReadUser.Get(user, userid)
+	stored := new(storedUser)
+	err := QueryReadUser.Get(stored, userid)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrNotFound
+			return nil, nil, ErrNotFound
 		} else {
-			return nil, err
+			return nil, nil, err
+		}
+	}
+	user := stored.user()
+
+	// Attach every cert, for internal use
+	page := new(Page)
+	if certs == nil {
+		err = QueryFetchUserCerts.Select(&user.Certs, userid)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
 		}
+		user.CertCount = len(user.Certs)
+		return user, page, nil
+	}
+
+	// Count the certs, and attach a page of them unless only the count is wanted
+	now := Now()
+	skew := time.Duration(Config().ClockSkew)
+	err = QueryCountUserCerts.Get(&user.CertCount, userid, "", certs.Filter.Active, certs.Filter.Valid, now.Add(skew), now.Add(-skew))
+	if err != nil {
+		return nil, nil, err
+	}
+	user.Certs = []*CertificateData{}
+	if certs.CountOnly || user.CertCount == 0 {
+		return user, page, nil
+	}
+	user.Certs, page, err = listCertsPage(userid, certs.Cursor, certs.Limit, certs.Filter)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Attach the certs
-	err = QueryFetchUserCerts.Select(&user.Certs, userid)
+	return user, page, nil
+}
+
+// Given an email address, get the users with it, whatever its case
+func DatabaseListUsersByEmail(email string) ([]*User, error) {
+	index, err := EmailIndex(email)
+	if err != nil {
+		return nil, err
+	}
+	stored := []*storedUser{}
+	err = QueryListUsersByEmail.Select(&stored, index, email)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
-
-	return user, nil
+	users := make([]*User, len(stored))
+	for i, s := range stored {
+		users[i] = s.user()
+	}
+	return users, nil
 }
 
 // Given a partial User object, update the database record
 func DatabaseUpdateUser(user *User) error {
-	result, err := QueryUpdateUser.Exec(user)
+	stored, err := newStoredUser(user)
+	if err != nil {
+		return err
+	}
+	result, err := QueryUpdateUser.Exec(stored)
 	if err != nil {
 		return err
 	}
@@ -206,61 +694,218 @@ func DatabaseUpdateUser(user *User) error {
 	return nil
 }
 
+// Given a user-id, get the user's optional attributes (see extra.go)
+func DatabaseReadUserExtra(userid string) (Extra, error) {
+	var extra Extra
+	err := QueryReadUserExtra.Get(&extra, userid)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return extra, nil
+}
+
+// Given a user-id, update the user's optional attributes with update, which sets them with their ExtraAttr
+func DatabaseUpdateUserExtra(userid string, update func(extra *Extra) error) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		var extra Extra
+		err := QueryLockUserExtra.Tx(tx).Get(&extra, userid)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = update(&extra)
+		if err != nil {
+			return err
+		}
+		_, err = QueryUpdateUserExtra.Tx(tx).Exec(userid, extra)
+		return err
+	})
+}
+
 // Given a user-id, delete a user. This will also delete the user's
-// certificates in a transaction safe manner.
-func DatabaseDeleteUser(userid string) error {
+// certificates and grants in a transaction safe manner.
+// In a dry run nothing is deleted, but the report says what would have been.
+func DatabaseDeleteUser(ctx context.Context, userid, reason string, dryRun bool) (*ChangeReport, error) {
+	report := &ChangeReport{DryRun: dryRun, Users: []string{userid}}
+
 	// Use a transaction so as to avoid foreign key errors
-	tx, err := db.Beginx()
-	if err != nil {
+	err := withDryRunTx(dryRun, func(tx *sqlx.Tx) error {
+		deleteUserStmt := QueryDeleteUser.Tx(tx)
+		deleteCertStmt := QueryCertDeleteUsers.Tx(tx)
+		deleteGrantsStmt := QueryDeleteUserGrants.Tx(tx)
+		releaseContentStmt := QueryReleaseUserCertContent.Tx(tx)
+		purgeContentStmt := QueryPurgeCertContent.Tx(tx)
+
+		// Delete the grants of and to the user. These would go anyway, but deleting them here lets us count them.
+		res, err := deleteGrantsStmt.Exec(userid)
+		if err != nil {
+			return err
+		}
+		report.Grants, _ = res.RowsAffected()
+
+		// Release the user's references to certificate data.
+		// This has to happen before the certs are deleted, since it uses them to find the data.
+		_, err = releaseContentStmt.Exec(userid)
+		if err != nil {
+			return err
+		}
+
+		// Delete the certs
+		err = deleteCertStmt.Select(&report.Certs, userid)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		// Delete any certificate data that is no longer referenced by anyone
+		res, err = purgeContentStmt.Exec()
+		if err != nil {
+			return err
+		}
+		report.CertContent, _ = res.RowsAffected()
+
+		// Delete the user
+		res, err = deleteUserStmt.Exec(userid)
+		if err != nil {
+			return err
+		}
+
+		// Check if we acutally deleted anything
+		if affected, err := res.RowsAffected(); affected == 0 || err != nil {
+			return ErrNotFound
+		}
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDeleteUser,
+			UserId: userid,
+			Detail: AuditDetail{"certs": report.Certs},
+			Reason: reason,
+		})
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	deleteUserStmt := tx.Stmtx(QueryDeleteUser)
-	deleteCertStmt := tx.Stmtx(QueryCertDeleteUsers)
 
-	// Delete the certs
-	_, err = deleteCertStmt.Exec(userid)
+	// Sucessully deleted the user and their certificates
+	return report, nil
+}
+
+// Given CertificateData, insert a row into the database
+// If exclusive, the user's other active certificates for the same names are deactivated, and their cert-ids returned.
+func DatabaseCreateCert(ctx context.Context, cert *CertificateData, reason string, exclusive bool) ([]string, error) {
+	// Use a transaction so the certificate data, its reference and the audit entry are created together
+	var deactivated []string
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := databaseCreateCertTx(tx, cert)
+		if err != nil {
+			return err
+		}
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionCreateCert,
+			UserId: cert.UserId,
+			CertId: cert.Id,
+			Reason: reason,
+		})
+		if err != nil {
+			return err
+		}
+
+		if exclusive {
+			deactivated, err = databaseDeactivateOthersTx(ctx, tx, cert.UserId, cert.Id, reason)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		rollerr := tx.Rollback()
-		if rollerr != nil {
-			log.Println(rollerr)
+		return nil, err
+	}
+	return deactivated, nil
+}
+
+// Store a certificate minted from one of the user's CA certificates (see mint.go), so it is deleted once it expires.
+// Its CAA check (see caa.go), if there was one, is audited with it.
+func DatabaseCreateMintedCert(ctx context.Context, cert *CertificateData, parentid, reason string, exclusive bool, caa []*CAAResult) ([]string, error) {
+	var deactivated []string
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := databaseCreateCertTx(tx, cert)
+		if err != nil {
+			return err
 		}
-		return err
+
+		_, err = QueryCreateMinted.Tx(tx).Exec(cert.Id, cert.UserId, parentid, cert.NotAfter)
+		if err != nil {
+			return err
+		}
+
+		entry := &AuditEntry{
+			Action: AuditActionMintCert,
+			UserId: cert.UserId,
+			CertId: cert.Id,
+			Detail: AuditDetail{"parent": parentid, "notAfter": cert.NotAfter},
+			Reason: reason,
+		}
+		if caa != nil {
+			entry.Detail["caa"] = caa
+		}
+		err = databaseCreateAuditTx(ctx, tx, entry)
+		if err != nil {
+			return err
+		}
+
+		if exclusive {
+			deactivated, err = databaseDeactivateOthersTx(ctx, tx, cert.UserId, cert.Id, reason)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return deactivated, nil
+}
 
-	// Delete the user
-	res, err := deleteUserStmt.Exec(userid)
+// Insert a certificate within a transaction. The certificate data is stored once no matter how many users hold
+// the certificate, and its reference count is incremented for this user.
+func databaseCreateCertTx(tx *sqlx.Tx, cert *CertificateData) error {
+	_, err := QueryCreateCertContent.Tx(tx).Exec(cert)
 	if err != nil {
-		rollerr := tx.Rollback()
-		if rollerr != nil {
-			log.Println(rollerr)
-		}
 		return err
 	}
-
-	// Commit the transaction
-	err = tx.Commit()
+	err = databaseIndexNamesTx(tx, cert.Id, cert.Cert)
 	if err != nil {
 		return err
 	}
-
-	// Check if we acutally deleted anything
-	if affected, err := res.RowsAffected(); affected == 0 || err != nil {
-		return ErrNotFound
+	_, err = QueryCreateCert.Tx(tx).Exec(cert)
+	if err != nil {
+		return err
 	}
-
-	// Sucessully deleted the user and their certificates
 	return nil
 }
 
-// Given CertificateData, insert a row into the database
-func DatabaseCreateCert(cert *CertificateData) error {
-	// Insert the user
-	_, err := QueryCreateCert.Exec(cert)
+// Index the names a certificate covers within a transaction (see conflicts.go)
+func databaseIndexNamesTx(tx *sqlx.Tx, certid string, certPEM StoredPEM) error {
+	cert, err := ParseCertificatePEM(string(certPEM))
 	if err != nil {
 		return err
 	}
-
-	return nil
+	for _, name := range certNames(cert) {
+		_, err = QueryIndexCertName.Tx(tx).Exec(certid, name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = QuerySetNamesIndexed.Tx(tx).Exec(certid)
+	return err
 }
 
 // Given a userID, get a User
@@ -279,26 +924,2523 @@ func DatabaseReadCert(userid, certid string) (*CertificateData, error) {
 	return cert, nil
 }
 
-// Update the certificate to mark it as active or inactive
-func DatabaseUpdateCertActive(userid, certid string, active bool) error {
-	result, err := QueryCertUpdateActive.Exec(userid, certid, active)
+// Given a user-id and a cert-id, get the certificate's optional attributes (see extra.go)
+func DatabaseReadCertExtra(userid, certid string) (Extra, error) {
+	var extra Extra
+	err := QueryReadCertExtra.Get(&extra, userid, certid)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if affected, err := result.RowsAffected(); affected == 0 || err != nil {
-		return ErrNotFound
+	return extra, nil
+}
+
+// Given a user-id and a cert-id, update the certificate's optional attributes with update (see
+// DatabaseUpdateUserExtra)
+func DatabaseUpdateCertExtra(userid, certid string, update func(extra *Extra) error) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		var extra Extra
+		err := QueryLockCertExtra.Tx(tx).Get(&extra, userid, certid)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		err = update(&extra)
+		if err != nil {
+			return err
+		}
+		_, err = QueryUpdateCertExtra.Tx(tx).Exec(userid, certid, extra)
+		return err
+	})
+}
+
+// Given a user-id and a cert-id, get a certificate along with its private key.
+// This is for uses of the key that don't reveal it, such as describing it. Use DatabaseExportKey to give a key to a client.
+func DatabaseReadKey(userid, certid string) (*CertificateData, error) {
+	cert := new(CertificateData)
+	err := QueryReadKey.Get(cert, userid, certid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
 	}
-	return nil
+	return cert, nil
 }
 
-// Given a user-id, and a cert-id delete a certificate.
-func DatabaseDeleteCert(userid, certid string) error {
-	result, err := QueryDeleteCert.Exec(userid, certid)
+// Get a certificate with its private key for exporting it (see ExportCertHandler), recording the export in the audit
+// log in the same transaction, as for a key export.
+func DatabaseExportCert(ctx context.Context, userid, certid, format, reason string) (*CertificateData, error) {
+	cert := new(CertificateData)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryReadKey.Tx(tx).Get(cert, userid, certid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionExportKey,
+			UserId: userid,
+			CertId: certid,
+			Detail: AuditDetail{"format": format},
+			Reason: reason,
+		})
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if affected, err := result.RowsAffected(); affected == 0 || err != nil {
-		return ErrNotFound
+	return cert, nil
+}
+
+// Export a certificate's private key to a user: either the owner, or a user the certificate is shared with for deployment.
+// The key itself isn't returned, only a single-use link to download it (see KeyExport). Making the export is recorded
+// in the audit log in the same transaction, so there is always a record of who a key was exported to and why.
+func DatabaseExportKey(ctx context.Context, ownerid, certid, userid, reason string) (*ExportLink, error) {
+	export, link, err := NewKeyExport(ownerid, certid, userid, time.Duration(Config().ExportLinkTTL))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	err = WithTx(ctx, func(tx *sqlx.Tx) error {
+		cert := new(CertificateData)
+		err = QueryReadCert.Tx(tx).Get(cert, ownerid, certid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		// Tidy up old exports while we are here
+		_, err = QueryPurgeKeyExports.Tx(tx).Exec(NewUTCTime(Now()))
+		if err != nil {
+			return err
+		}
+
+		_, err = QueryCreateKeyExport.Tx(tx).Exec(export)
+		if err != nil {
+			return err
+		}
+
+		entry := &AuditEntry{
+			Action: AuditActionExportKey,
+			UserId: ownerid,
+			CertId: certid,
+			Detail: AuditDetail{"expires": export.Expires},
+			Reason: reason,
+		}
+		if userid != ownerid {
+			entry.TargetId = userid
+		}
+		return databaseCreateAuditTx(ctx, tx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// Given the hashed id of a KeyExport, mark it used and get the certificate along with its private key.
+// An export can only be downloaded once, before it expires, and only while the user it was made for still has
+// access to the key. Each download is recorded in the audit log.
+func DatabaseDownloadKeyExport(ctx context.Context, id string) (*CertificateData, error) {
+	cert := new(CertificateData)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		export := new(KeyExport)
+		err := QueryUseKeyExport.Tx(tx).Get(export, id, NewUTCTime(Now()))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidExportLink
+			}
+			return err
+		}
+
+		// Exports to other users need the certificate to still be shared for deployment
+		if export.UserId != export.OwnerId {
+			grant := new(Grant)
+			err = QueryReadGrant.Tx(tx).Get(grant, export.CertId, export.UserId)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err == sql.ErrNoRows || grant.OwnerId != export.OwnerId || grant.Access != GrantAccessDeploy {
+				return ErrInvalidExportLink
+			}
+		}
+
+		// The certificate may have been deleted or transferred since the export was made
+		err = QueryReadKey.Tx(tx).Get(cert, export.OwnerId, export.CertId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidExportLink
+			}
+			return err
+		}
+
+		entry := &AuditEntry{
+			Action: AuditActionDownloadKey,
+			UserId: export.OwnerId,
+			CertId: export.CertId,
+		}
+		if export.UserId != export.OwnerId {
+			entry.TargetId = export.UserId
+		}
+		return databaseCreateAuditTx(ctx, tx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Update a certificate's active flag and notes, recording the change and the reason for it in the audit log
+// If exclusive, the user's other active certificates for the same names are deactivated, and their cert-ids returned.
+func DatabaseUpdateCert(ctx context.Context, userid, certid string, patch *CertificatePatch, reason string, exclusive bool) ([]string, error) {
+	var deactivated []string
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := QueryCertUpdate.Tx(tx).Exec(userid, certid, patch.Active, patch.Notes)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); affected == 0 || err != nil {
+			return ErrNotFound
+		}
+		if patch.ActivateAt != nil || patch.DeactivateAt != nil {
+			_, err = QueryCertSchedule.Tx(tx).Exec(userid, certid, patch.ActivateAt != nil, patch.ActivateAt, patch.DeactivateAt != nil, patch.DeactivateAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Record what was changed, and why
+		detail := AuditDetail{}
+		if patch.Active != nil {
+			detail["active"] = *patch.Active
+		}
+		if patch.Notes != nil {
+			detail["notes"] = *patch.Notes
+		}
+		if patch.ActivateAt != nil {
+			detail["activateAt"] = *patch.ActivateAt
+		}
+		if patch.DeactivateAt != nil {
+			detail["deactivateAt"] = *patch.DeactivateAt
+		}
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionUpdateCert,
+			UserId: userid,
+			CertId: certid,
+			Detail: detail,
+			Reason: reason,
+		})
+		if err != nil {
+			return err
+		}
+
+		if exclusive {
+			deactivated, err = databaseDeactivateOthersTx(ctx, tx, userid, certid, reason)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deactivated, nil
+}
+
+// Deactivate the user's other active certificates that cover any of the same names as an active certificate, within a
+// transaction (see exclusive.go). Each is audited as an update of its own. Returns the cert-ids deactivated.
+func databaseDeactivateOthersTx(ctx context.Context, tx *sqlx.Tx, userid, certid, reason string) ([]string, error) {
+	active := []*struct {
+		Id   string
+		Cert StoredPEM
+	}{}
+	err := QueryListActiveCerts.Tx(tx).Select(&active, userid)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	names := make(map[string][]string, len(active))
+	for _, c := range active {
+		cert, err := ParseCertificatePEM(string(c.Cert))
+		if err != nil {
+			return nil, err
+		}
+		names[c.Id] = certNames(cert)
+	}
+	activated, ok := names[certid]
+	if !ok {
+		return nil, nil
+	}
+
+	deactivated := []string{}
+	inactive := false
+	for _, c := range active {
+		if c.Id == certid || !namesOverlap(activated, names[c.Id]) {
+			continue
+		}
+		_, err = QueryCertUpdate.Tx(tx).Exec(userid, c.Id, &inactive, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionUpdateCert,
+			UserId: userid,
+			CertId: c.Id,
+			Detail: AuditDetail{"active": false, "supersededBy": certid},
+			Reason: reason,
+		})
+		if err != nil {
+			return nil, err
+		}
+		deactivated = append(deactivated, c.Id)
+	}
+	return deactivated, nil
+}
+
+// Count the active certificates by how soon they expire, for the public status
+func DatabaseStatusCounts(now time.Time) (*StatusCerts, error) {
+	certs := new(StatusCerts)
+	err := QueryStatusCounts.Get(certs, now, now.AddDate(0, 0, 7), now.AddDate(0, 0, 30))
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// List the scheduled changes that are due, without running them
+func DatabaseListDueCerts(now time.Time) ([]*ScheduledChange, error) {
+	due := []*struct {
+		UserId       string
+		Id           string
+		ActivateAt   UTCTime
+		DeactivateAt UTCTime
+	}{}
+	err := QueryListDueCerts.Select(&due, now)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	changes := make([]*ScheduledChange, len(due))
+	for i, c := range due {
+		active, _ := scheduledState(c.ActivateAt, c.DeactivateAt, now)
+		changes[i] = &ScheduledChange{UserId: c.UserId, CertId: c.Id, Active: active}
+	}
+	return changes, nil
+}
+
+// Run up to limit scheduled changes that are due, in one transaction (see schedule.go). Each is audited as an
+// update, and an activation deactivates other certificates for the same names if exclusive is set.
+func DatabaseRunSchedule(ctx context.Context, now time.Time, limit int, exclusive bool) ([]*ScheduledChange, error) {
+	changes := []*ScheduledChange{}
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		due := []*struct {
+			UserId       string
+			Id           string
+			ActivateAt   UTCTime
+			DeactivateAt UTCTime
+		}{}
+		err := QueryListScheduledCerts.Tx(tx).Select(&due, now, limit)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		for _, c := range due {
+			active, _ := scheduledState(c.ActivateAt, c.DeactivateAt, now)
+			change := &ScheduledChange{UserId: c.UserId, CertId: c.Id, Active: active}
+			reason := "Scheduled deactivation"
+			if active {
+				reason = "Scheduled activation"
+			}
+			_, err = QueryRunSchedule.Tx(tx).Exec(c.UserId, c.Id, active, now)
+			if err != nil {
+				return err
+			}
+			err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+				Action: AuditActionUpdateCert,
+				UserId: c.UserId,
+				CertId: c.Id,
+				Detail: AuditDetail{"active": active, "scheduled": true},
+				Reason: reason,
+			})
+			if err != nil {
+				return err
+			}
+			if active && exclusive {
+				change.Deactivated, err = databaseDeactivateOthersTx(ctx, tx, c.UserId, c.Id, reason)
+				if err != nil {
+					return err
+				}
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Given a user-id, and a cert-id delete a certificate, along with any grants sharing it.
+// The certificate data itself is only deleted once no other user holds the certificate.
+// In a dry run nothing is deleted, but the report says what would have been.
+func DatabaseDeleteCert(ctx context.Context, userid, certid, reason string, dryRun bool) (*ChangeReport, error) {
+	report := &ChangeReport{DryRun: dryRun, Certs: []string{certid}}
+
+	err := withDryRunTx(dryRun, func(tx *sqlx.Tx) error {
+		// Delete the grants first so we can count them
+		result, err := QueryDeleteCertGrants.Tx(tx).Exec(certid, userid)
+		if err != nil {
+			return err
+		}
+		report.Grants, _ = result.RowsAffected()
+
+		result, err = QueryDeleteCert.Tx(tx).Exec(userid, certid)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); affected == 0 || err != nil {
+			return ErrNotFound
+		}
+
+		// Release our reference to the certificate data, and delete it if nobody else references it
+		_, err = QueryReleaseCertContent.Tx(tx).Exec(certid)
+		if err != nil {
+			return err
+		}
+		result, err = QueryPurgeCertContent.Tx(tx).Exec()
+		if err != nil {
+			return err
+		}
+		report.CertContent, _ = result.RowsAffected()
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDeleteCert,
+			UserId: userid,
+			CertId: certid,
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Given a user-id and a cert-id, list the ids of every user that holds the same certificate.
+// The given user must hold the certificate themselves.
+func DatabaseReadCertHolders(userid, certid string) ([]string, error) {
+	holders := []string{}
+	err := QueryCertHolders.Select(&holders, certid, userid)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if len(holders) == 0 {
+		return nil, ErrNotFound
+	}
+	return holders, nil
+}
+
+// Given a cert-id, get the chain stored with the certificate, which every user holding it shares
+func DatabaseReadCertChain(certid string) (StoredChain, error) {
+	var chain StoredChain
+	err := QueryReadCertChain.Get(&chain, certid)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return chain, nil
+}
+
+// CertFilter limits which certificates are listed. Filters that are not Valid are not applied.
+type CertFilter struct {
+	Active sql.NullBool // Only list active (or inactive) certificates
+	Valid  sql.NullBool // Only list currently valid (or invalid) certificates
+}
+
+// Which of a user's certificates DatabaseReadUser attaches to the user. Nil attaches every certificate, unfiltered,
+// which is only for internal use: users may hold thousands.
+type UserCertsQuery struct {
+	Cursor    *Cursor // Nil for the first page
+	Limit     int
+	Filter    CertFilter
+	CountOnly bool // Only count the certificates, attaching none
+}
+
+// Given a user-id, get a single page of the user's certificates, ordered by certificate-id.
+// A nil cursor fetches the first page.
+func DatabaseListCerts(userid string, cursor *Cursor, limit int, filter CertFilter) ([]*CertificateData, *Page, error) {
+	// Make sure the user exists so that we can tell the difference between "no certs" and "no user"
+	var exists bool
+	err := QueryUserExists.Get(&exists, userid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, ErrNotFound
+	}
+	return listCertsPage(userid, cursor, limit, filter)
+}
+
+// Get a single page of a user's certificates, ordered by certificate-id, without checking that the user exists
+func listCertsPage(userid string, cursor *Cursor, limit int, filter CertFilter) ([]*CertificateData, *Page, error) {
+	// Fetch one more row than asked for so we know if there is another page
+	var err error
+	certs := []*CertificateData{}
+	now := Now()
+	skew := time.Duration(Config().ClockSkew)
+	args := []interface{}{filter.Active, filter.Valid, now.Add(skew), now.Add(-skew), limit + 1}
+	forward := cursor == nil || cursor.Direction == CursorForward
+	if cursor == nil {
+		err = QueryListCertsAfter.Select(&certs, append([]interface{}{userid, ""}, args...)...)
+	} else if forward {
+		err = QueryListCertsAfter.Select(&certs, append([]interface{}{userid, cursor.Key}, args...)...)
+	} else {
+		err = QueryListCertsBefore.Select(&certs, append([]interface{}{userid, cursor.Key}, args...)...)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	more := len(certs) > limit
+	if more {
+		certs = certs[:limit]
+	}
+
+	// Backwards pages are read in descending order, put them back in ascending order
+	if !forward {
+		for i, j := 0, len(certs)-1; i < j; i, j = i+1, j-1 {
+			certs[i], certs[j] = certs[j], certs[i]
+		}
+	}
+
+	// Work out the cursors for the neighbouring pages
+	page := new(Page)
+	if len(certs) != 0 {
+		first, last := certs[0].Id, certs[len(certs)-1].Id
+		if forward {
+			if more {
+				page.Next = &Cursor{CursorForward, last}
+			}
+			if cursor != nil {
+				page.Prev = &Cursor{CursorBackward, first}
+			}
+		} else {
+			page.Next = &Cursor{CursorForward, last}
+			if more {
+				page.Prev = &Cursor{CursorBackward, first}
+			}
+		}
+	}
+
+	return certs, page, nil
+}
+
+// Given a Grant, share the owner's certificate with the grantee. Granting again updates the access level.
+func DatabaseCreateGrant(grant *Grant) error {
+	// Make sure the owner holds the certificate and the grantee exists
+	_, err := DatabaseReadCert(grant.OwnerId, grant.CertId)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = QueryUserExists.Get(&exists, grant.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrInvalidGrantUser
+	}
+
+	_, err = QueryCreateGrant.Exec(grant)
+	return err
+}
+
+// Given an owner's user-id and a cert-id, list a page of who the certificate has been shared with, ordered by their
+// user-id. A nil query lists them all.
+func DatabaseListCertGrants(ownerid, certid string, q *ListQuery) ([]*Grant, *Page, error) {
+	_, err := DatabaseReadCert(ownerid, certid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	grants := []*Grant{}
+	forward, key, limit := q.read("0")
+	if err := numericCursorKey(key); err != nil {
+		return nil, nil, err
+	}
+	if forward {
+		err = QueryListCertGrants.Select(&grants, certid, ownerid, key, limit)
+	} else {
+		err = QueryListCertGrantsBefore.Select(&grants, certid, ownerid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(grants))
+	for i, grant := range grants {
+		keys[i] = grant.UserId
+	}
+	start, end, page := q.page(keys)
+	return grants[start:end], page, nil
+}
+
+// Given a user-id, list a page of the certificates that have been shared with the user, ordered by cert-id and
+// owner. A nil query lists them all.
+func DatabaseListUserGrants(userid string, q *ListQuery) ([]*Grant, *Page, error) {
+	// The key is the cert-id, which is always 64 characters, followed by the owner's user-id
+	forward, key, limit := q.read(":0")
+	certid, ownerid := "", key
+	if len(key) > 64 {
+		certid, ownerid = key[:64], key[64:]
+	}
+	if !strings.HasPrefix(ownerid, ":") || numericCursorKey(ownerid[1:]) != nil {
+		return nil, nil, ErrInvalidCursor
+	}
+	ownerid = ownerid[1:]
+
+	grants := []*Grant{}
+	var err error
+	if forward {
+		err = QueryListUserGrants.Select(&grants, userid, certid, ownerid, limit)
+	} else {
+		err = QueryListUserGrantsBefore.Select(&grants, userid, certid, ownerid, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(grants))
+	for i, grant := range grants {
+		keys[i] = grant.CertId + ":" + grant.OwnerId
+	}
+	start, end, page := q.page(keys)
+	return grants[start:end], page, nil
+}
+
+// Revoke a grant. In a dry run nothing is deleted, but the report says what would have been.
+func DatabaseDeleteGrant(ownerid, certid, userid string, dryRun bool) (*ChangeReport, error) {
+	err := withDryRunTx(dryRun, func(tx *sqlx.Tx) error {
+		result, err := QueryDeleteGrant.Tx(tx).Exec(certid, ownerid, userid)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); affected == 0 || err != nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeReport{DryRun: dryRun, Grants: 1}, nil
+}
+
+// Attach a file to a user's certificate, replacing any attachment with the same name.
+// The number of attachments per certificate is limited by the MaxAttachments option.
+func DatabaseCreateAttachment(ctx context.Context, attachment *Attachment, reason string) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		// Lock the certificate so that concurrent uploads are counted correctly
+		var certid string
+		err := QueryLockCert.Tx(tx).Get(&certid, attachment.UserId, attachment.CertId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		var count int
+		err = QueryCountAttachments.Tx(tx).Get(&count, attachment.CertId, attachment.UserId, attachment.Name)
+		if err != nil {
+			return err
+		}
+		if count >= Config().MaxAttachments {
+			return ErrTooManyAttachments
+		}
+
+		attachment.Created = NewUTCTime(Now())
+		err = QueryCreateAttachment.Tx(tx).QueryRowx(attachment).Scan(&attachment.Created)
+		if err != nil {
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionAttach,
+			UserId: attachment.UserId,
+			CertId: attachment.CertId,
+			Detail: AuditDetail{"name": attachment.Name, "type": attachment.Type, "size": attachment.Size},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Given a user-id, a cert-id and a name, get an attachment along with its data
+func DatabaseReadAttachment(userid, certid, name string) (*Attachment, error) {
+	attachment := new(Attachment)
+	err := QueryReadAttachment.Get(attachment, certid, userid, name)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// Given a user-id and a cert-id, list the certificate's attachments, without their data
+func DatabaseListAttachments(userid, certid string, q *ListQuery) ([]*Attachment, *Page, error) {
+	_, err := DatabaseReadCert(userid, certid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attachments := []*Attachment{}
+	forward, key, limit := q.read("")
+	if forward {
+		err = QueryListAttachments.Select(&attachments, certid, userid, key, limit)
+	} else {
+		err = QueryListAttachmentsBefore.Select(&attachments, certid, userid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		keys[i] = attachment.Name
+	}
+	start, end, page := q.page(keys)
+	return attachments[start:end], page, nil
+}
+
+// Given a user-id, a cert-id and a name, delete an attachment. The deleted attachment is returned, without its data.
+func DatabaseDeleteAttachment(ctx context.Context, userid, certid, name, reason string) (*Attachment, error) {
+	attachment := new(Attachment)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryDeleteAttachment.Tx(tx).Get(attachment, certid, userid, name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDetach,
+			UserId: userid,
+			CertId: certid,
+			Detail: AuditDetail{"name": attachment.Name, "type": attachment.Type, "size": attachment.Size},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// Given a user-id and a cert-id, get a certificate that has been shared with the user
+func DatabaseReadSharedCert(userid, certid string) (*CertificateData, *Grant, error) {
+	grant := new(Grant)
+	err := QueryReadGrant.Get(grant, certid, userid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, ErrNotFound
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	cert, err := DatabaseReadCert(grant.OwnerId, certid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, grant, nil
+}
+
+// Given a user-id and a cert-id, export the private key of a certificate that has been shared with the user.
+// The user must have been granted deploy access.
+func DatabaseExportSharedKey(ctx context.Context, userid, certid, reason string) (*ExportLink, error) {
+	grant := new(Grant)
+	err := QueryReadGrant.Get(grant, certid, userid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if grant.Access != GrantAccessDeploy {
+		return nil, ErrKeyExportNotGranted
+	}
+	return DatabaseExportKey(ctx, grant.OwnerId, certid, userid, reason)
+}
+
+// Given a Transfer, move certificates from one user to another in a single transaction, recording it in the audit log.
+// Returns the ids of the certificates that were transfered.
+func DatabaseTransferCerts(ctx context.Context, transfer *Transfer, reason string, dryRun bool) (*ChangeReport, error) {
+	var exists bool
+	err := QueryUserExists.Get(&exists, transfer.ToId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrInvalidTransferUser
+	}
+
+	report := &ChangeReport{DryRun: dryRun}
+	err = withDryRunTx(dryRun, func(tx *sqlx.Tx) error {
+		err = databaseTransferCertsTx(tx, transfer.FromId, transfer.ToId, transfer.Certs, report)
+		if err != nil {
+			return err
+		}
+
+		// If specific certificates were asked for, they must all have been transfered
+		if len(transfer.Certs) != 0 {
+			requested := make(map[string]bool)
+			for _, certid := range transfer.Certs {
+				requested[certid] = true
+			}
+			if len(report.Certs) != len(requested) {
+				return ErrNotFound
+			}
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action:   AuditActionTransferCerts,
+			UserId:   transfer.FromId,
+			TargetId: transfer.ToId,
+			Detail:   AuditDetail{"certs": report.Certs},
+			Reason:   reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Move certificates from one user to another within a transaction. A nil certids moves all certificates.
+// The certificates moved and the certificate data no longer needed are added to the report.
+func databaseTransferCertsTx(tx *sqlx.Tx, fromid, toid string, certids []string, report *ChangeReport) error {
+	var certArray interface{}
+	if len(certids) != 0 {
+		certArray = pq.Array(certids)
+	}
+
+	// Every grant of the certificates is either moved or deleted, so count them up front
+	var grants int64
+	err := QueryCountTransferGrants.Tx(tx).Get(&grants, fromid, certArray)
+	if err != nil {
+		return err
+	}
+	report.Grants += grants
+
+	// Certificates the receiving user already holds are deleted from the sender rather than moved
+	duplicates := []string{}
+	err = QueryTransferDuplicateCerts.Tx(tx).Select(&duplicates, fromid, toid, certArray)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	res, err := QueryPurgeCertContent.Tx(tx).Exec()
+	if err != nil {
+		return err
+	}
+	purged, _ := res.RowsAffected()
+	report.CertContent += purged
+
+	// Move everything else. Grants move along with the certificates, except grants to the receiving user.
+	moved := []string{}
+	err = QueryTransferCerts.Tx(tx).Select(&moved, fromid, toid, certArray)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err = QueryDeleteSelfGrants.Tx(tx).Exec()
+	if err != nil {
+		return err
+	}
+
+	report.Certs = append(report.Certs, duplicates...)
+	report.Certs = append(report.Certs, moved...)
+	return nil
+}
+
+// Given a Merge, move all certificates and grants from one user into another and delete the merged user,
+// all in a single transaction, recording it in the audit log.
+func DatabaseMergeUsers(ctx context.Context, merge *Merge, reason string, dryRun bool) (*ChangeReport, error) {
+	var exists bool
+	err := QueryUserExists.Get(&exists, merge.FromId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrInvalidTransferUser
+	}
+
+	report := &ChangeReport{DryRun: dryRun, Users: []string{merge.FromId}}
+	err = withDryRunTx(dryRun, func(tx *sqlx.Tx) error {
+		// Move the certificates
+		err = databaseTransferCertsTx(tx, merge.FromId, merge.IntoId, nil, report)
+		if err != nil {
+			return err
+		}
+
+		// Move the certificates shared with the merged user
+		res, err := QueryMergeDuplicateGrants.Tx(tx).Exec(merge.IntoId, merge.FromId)
+		if err != nil {
+			return err
+		}
+		duplicateGrants, _ := res.RowsAffected()
+		res, err = QueryMergeGrants.Tx(tx).Exec(merge.IntoId, merge.FromId)
+		if err != nil {
+			return err
+		}
+		movedGrants, _ := res.RowsAffected()
+		report.Grants += duplicateGrants + movedGrants
+		_, err = QueryDeleteSelfGrants.Tx(tx).Exec()
+		if err != nil {
+			return err
+		}
+
+		// Move the merged user's domains
+		_, err = QueryMergeDomains.Tx(tx).Exec(merge.IntoId, merge.FromId)
+		if err != nil {
+			return err
+		}
+
+		// Move the merged user's templates
+		_, err = QueryMergeTemplates.Tx(tx).Exec(merge.IntoId, merge.FromId)
+		if err != nil {
+			return err
+		}
+
+		// Delete the merged user
+		res, err = QueryDeleteUser.Tx(tx).Exec(merge.FromId)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); affected == 0 || err != nil {
+			return ErrInvalidTransferUser
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action:   AuditActionMergeUsers,
+			UserId:   merge.IntoId,
+			TargetId: merge.FromId,
+			Detail:   AuditDetail{"certs": report.Certs},
+			Reason:   reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Record an audit entry within a transaction, so the entry is only kept if the change it describes is committed.
+// An entry written while serving an impersonated request is attributed to the administrator too (see impersonation.go).
+func databaseCreateAuditTx(ctx context.Context, tx *sqlx.Tx, entry *AuditEntry) error {
+	stampImpersonation(ctx, entry)
+	entry.Redact()
+
+	// Chain the entry to the last one. The lock is held until the transaction ends, so no other entry can be
+	// chained to the same one, and entries are committed in the order of their ids.
+	_, err := QueryLockAudit.Tx(tx).Exec()
+	if err != nil {
+		return err
+	}
+	last := new(AuditEntry)
+	err = QueryReadLastAudit.Tx(tx).Get(last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	err = chainAuditEntry(entry, last.Hash, Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = QueryCreateAudit.Tx(tx).Exec(entry)
+	return err
+}
+
+// Record an audit entry for something that isn't a change to the store, such as a lockout
+func DatabaseCreateAudit(ctx context.Context, entry *AuditEntry) error {
+	// A standby's audit log is a copy of the primary's, and entries of its own would take ids the primary uses
+	if Replica.Standby() {
+		log.Println("Not audited on a standby:", entry.Action, entry.Reason)
+		return nil
+	}
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := databaseCreateAuditTx(ctx, tx, entry)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the newest audit entry, or nil if there are none
+func DatabaseReadLastAudit() (*AuditEntry, error) {
+	entry := new(AuditEntry)
+	err := QueryReadLastAudit.Get(entry)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Check the whole audit chain, and the anchors over it
+func DatabaseVerifyAudit() (*AuditVerification, error) {
+	anchors := []*AuditAnchor{}
+	err := QueryListAuditAnchors.Select(&anchors)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	verification := NewAuditVerification(anchors)
+
+	// The log may be large, so read it a row at a time
+	rows, err := QueryListAudit.Queryx()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := new(AuditEntry)
+		err = rows.StructScan(entry)
+		if err != nil {
+			return nil, err
+		}
+		verification.Add(entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	verification.Finish()
+	return verification, nil
+}
+
+// List the audit entries after an id, oldest first
+func DatabaseListAuditAfter(id int64, limit int) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+	err := QueryListAuditAfter.Select(&entries, id, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Get the id of the last audit entry forwarded to the SIEM. The first time, this is the newest entry.
+func DatabaseReadSIEMCursor() (int64, error) {
+	_, err := QueryCreateSIEMCursor.Exec()
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = QueryReadSIEMCursor.Get(&id)
+	return id, err
+}
+
+// Save the id of the last audit entry forwarded to the SIEM
+func DatabaseUpdateSIEMCursor(id int64) error {
+	_, err := QueryUpdateSIEMCursor.Exec(id)
+	return err
+}
+
+// Record a timestamp over an audit entry's hash
+func DatabaseCreateAuditAnchor(anchor *AuditAnchor) error {
+	_, err := QueryCreateAuditAnchor.Exec(anchor)
+	return err
+}
+
+// Get the newest audit anchor, or nil if there are none
+func DatabaseReadLastAuditAnchor() (*AuditAnchor, error) {
+	anchor := new(AuditAnchor)
+	err := QueryReadLastAuditAnchor.Get(anchor)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return anchor, nil
+}
+
+// Given a user-id, list the most recent audit entries involving the user, newest first
+func DatabaseListUserAudit(userid string, q *ListQuery) ([]*AuditEntry, *Page, error) {
+	// Newest first, so the first page is of the entries before the largest id there could be
+	forward, key, limit := q.read(strconv.FormatInt(math.MaxInt64, 10))
+	if err := numericCursorKey(key); err != nil {
+		return nil, nil, err
+	}
+	entries := []*AuditEntry{}
+	var err error
+	if forward {
+		err = QueryListUserAudit.Select(&entries, userid, key, limit)
+	} else {
+		err = QueryListUserAuditBefore.Select(&entries, userid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = strconv.FormatInt(entry.Id, 10)
+	}
+	start, end, page := q.page(keys)
+	return entries[start:end], page, nil
+}
+
+// Record an event in the event log
+func DatabaseCreateEvent(e *Event) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := QueryLockEvents.Tx(tx).Exec()
+		if err == nil {
+			err = QueryCreateEvent.Tx(tx).QueryRowx(e).Scan(&e.Id)
+		}
+		return err
+	})
+}
+
+// Read everything stored for a user, for a standby, within a transaction. A user that doesn't exist is deleted.
+func databaseReadUserSnapshotTx(tx *sqlx.Tx, userid string) (*UserSnapshot, error) {
+	snapshot := &UserSnapshot{}
+	err := QueryReadReplicaUser.Tx(tx).Get(snapshot, userid)
+	if err == sql.ErrNoRows {
+		return &UserSnapshot{Id: userid, Deleted: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, databaseReadUserSnapshotDataTx(tx, snapshot)
+}
+
+func databaseReadUserSnapshotDataTx(tx *sqlx.Tx, snapshot *UserSnapshot) error {
+	snapshot.Certs = []*ReplicaCert{}
+	err := QueryListReplicaCerts.Tx(tx).Select(&snapshot.Certs, snapshot.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	snapshot.Grants = []*Grant{}
+	err = QueryListReplicaGrants.Tx(tx).Select(&snapshot.Grants, snapshot.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	snapshot.Attachments = []*ReplicaAttachment{}
+	err = QueryListReplicaAttachments.Tx(tx).Select(&snapshot.Attachments, snapshot.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// Get the changes after a position in the event log and the audit log, with a snapshot of the users involved.
+// A position of -1 gets no changes, only the current positions.
+// The snapshot is read in a read-only transaction that sees the database as it was when it began, so a standby is
+// sent users as they were at one moment.
+func DatabaseReplicationChanges(event, audit int64, limit int) (*ReplicationBatch, error) {
+	batch := &ReplicationBatch{Events: []*Event{}, Audit: []*AuditEntry{}, Users: []*UserSnapshot{}, Event: event, AuditId: audit}
+	err := WithTxOptions(context.Background(), snapshotTxOptions, func(tx *sqlx.Tx) error {
+		var err error
+		if event < 0 {
+			err = QueryReadLastEvent.Tx(tx).Get(&batch.Event)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = QueryListEventsAfter.Tx(tx).Select(&batch.Events, event, limit)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if len(batch.Events) > 0 {
+				batch.Event = batch.Events[len(batch.Events)-1].Id
+			}
+		}
+		if audit < 0 {
+			last := new(AuditEntry)
+			err = QueryReadLastAudit.Tx(tx).Get(last)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			batch.AuditId = last.Id
+		} else {
+			err = QueryListAuditAfter.Tx(tx).Select(&batch.Audit, audit, limit)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if len(batch.Audit) > 0 {
+				batch.AuditId = batch.Audit[len(batch.Audit)-1].Id
+			}
+		}
+
+		for _, userid := range eventUserIds(batch.Events) {
+			snapshot, err := databaseReadUserSnapshotTx(tx, userid)
+			if err != nil {
+				return err
+			}
+			batch.Users = append(batch.Users, snapshot)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Get a page of users after a user-id, for a standby's first copy, in a snapshot (see DatabaseReplicationChanges)
+func DatabaseReplicationUsers(after int64, limit int) (*ReplicationUsers, error) {
+	page := &ReplicationUsers{Users: []*UserSnapshot{}, Last: after}
+	err := WithTxOptions(context.Background(), snapshotTxOptions, func(tx *sqlx.Tx) error {
+		err := QueryListReplicaUsers.Tx(tx).Select(&page.Users, after, limit)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		for _, snapshot := range page.Users {
+			err = databaseReadUserSnapshotDataTx(tx, snapshot)
+			if err != nil {
+				return err
+			}
+		}
+		if len(page.Users) > 0 {
+			page.Last, err = strconv.ParseInt(page.Users[len(page.Users)-1].Id, 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Get the replica state, creating it the first time
+func DatabaseReadReplicaState() (*replicaState, error) {
+	_, err := QueryCreateReplicaState.Exec()
+	if err != nil {
+		return nil, err
+	}
+	state := new(replicaState)
+	err = QueryReadReplicaState.Get(state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Apply users and audit entries from the primary on a standby, and save the position reached, all in one
+// transaction. Each user replaces the standby's copy of that user.
+func DatabaseApplyReplication(users []*UserSnapshot, audit []*AuditEntry, state *replicaState) error {
+	err := WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		err := databaseApplyReplicationTx(tx, users, audit, state)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func databaseApplyReplicationTx(tx *sqlx.Tx, users []*UserSnapshot, audit []*AuditEntry, state *replicaState) error {
+	// First remove the standby's copies of the users, then put back the primary's. Grants to and from users in
+	// the batch can then be put back whatever order the users are in.
+	for _, user := range users {
+		_, err := QueryReleaseUserCertContent.Tx(tx).Exec(user.Id)
+		if err != nil {
+			return err
+		}
+		_, err = QueryDeleteReceivedGrants.Tx(tx).Exec(user.Id)
+		if err != nil {
+			return err
+		}
+		// Grants made by the user and attachments go with the certificates
+		_, err = QueryCertDeleteUsers.Tx(tx).Exec(user.Id)
+		if err != nil {
+			return err
+		}
+		if user.Deleted {
+			_, err = QueryDeleteUser.Tx(tx).Exec(user.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, user := range users {
+		if user.Deleted {
+			continue
+		}
+		_, err := QueryReplicateUser.Tx(tx).Exec(user.Id, user.Name, user.Email, user.EmailIndex, user.Extra)
+		if err != nil {
+			return err
+		}
+		for _, cert := range user.Certs {
+			_, err = QueryCreateCertContent.Tx(tx).Exec(cert)
+			if err != nil {
+				return err
+			}
+			var certPEM StoredPEM
+			err = certPEM.Scan(cert.Cert)
+			if err != nil {
+				return err
+			}
+			err = databaseIndexNamesTx(tx, cert.Id, certPEM)
+			if err != nil {
+				return err
+			}
+			_, err = QueryReplicateCert.Tx(tx).Exec(cert.Id, user.Id, cert.Active, cert.Key, cert.Notes, cert.ActivateAt, cert.DeactivateAt, cert.Extra)
+			if err != nil {
+				return err
+			}
+		}
+		for _, a := range user.Attachments {
+			_, err = QueryReplicateAttachment.Tx(tx).Exec(a.CertId, user.Id, a.Name, a.Type, a.Size, a.Created, a.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, user := range users {
+		for _, grant := range user.Grants {
+			_, err := QueryReplicateGrant.Tx(tx).Exec(grant.CertId, grant.OwnerId, grant.UserId, grant.Access)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := QueryPurgeCertContent.Tx(tx).Exec()
+	if err != nil {
+		return err
+	}
+
+	// Audit entries keep their ids and hashes, so the chain can be checked on the standby
+	for _, entry := range audit {
+		_, err = QueryReplicateAudit.Tx(tx).Exec(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = QueryUpdateReplicaState.Tx(tx).Exec(state.EventId, state.AuditId, state.CopyUser, state.Copied)
+	return err
+}
+
+// Promote a standby: stop following the primary, and catch the sequences up with the rows copied from it
+func DatabasePromoteReplica() error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := QueryResetSequences.Tx(tx).Exec()
+		if err == nil {
+			_, err = QueryPromoteReplica.Tx(tx).Exec()
+		}
+		return err
+	})
+}
+
+// Add usage counts, all in one transaction so counts are never saved twice
+func DatabaseAddUsage(counts map[usageKey]int64) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		for key, n := range counts {
+			_, err := QueryAddUsage.Tx(tx).Exec(key.month, key.userid, key.metric, n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get the usage counts from one month to another, and the number of certificates stored now, for a user
+// or (given "") the whole server
+func DatabaseReadUsage(userid, from, to string) ([]*UsageRow, int64, error) {
+	var user *string
+	if userid != "" {
+		user = &userid
+	}
+	rows := []*UsageRow{}
+	err := QueryListUsage.Select(&rows, user, from, to)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, 0, err
+	}
+	var stored int64
+	err = QueryCountStoredCerts.Get(&stored, user)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rows, stored, nil
+}
+
+// Call fn with every user's certificates, a page at a time, stopping at the first error. Private keys aren't read.
+func DatabaseEachCert(pageSize int, fn func(*CertificateData) error) error {
+	userid, certid := "0", ""
+	for {
+		certs := []*CertificateData{}
+		err := QueryListAllCerts.Select(&certs, userid, certid, pageSize)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		for _, certData := range certs {
+			err = fn(certData)
+			if err != nil {
+				return err
+			}
+		}
+		if len(certs) < pageSize {
+			return nil
+		}
+		last := certs[len(certs)-1]
+		userid, certid = last.UserId, last.Id
+	}
+}
+
+// Read the latest compliance evaluation, with its findings. Returns ErrNotFound if there hasn't been one.
+func DatabaseReadCompliance() (*ComplianceReport, error) {
+	report := new(ComplianceReport)
+	err := QueryReadCompliance.Get(report)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Findings = []*ComplianceFinding{}
+	err = QueryListComplianceFindings.Select(&report.Findings)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Save a compliance evaluation, replacing the one before
+func DatabaseSaveCompliance(report *ComplianceReport) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := QueryClearComplianceFindings.Tx(tx).Exec()
+		if err != nil {
+			return err
+		}
+		for _, finding := range report.Findings {
+			_, err = QueryCreateComplianceFinding.Tx(tx).Exec(finding.UserId, finding.CertId, finding.CommonName, finding.NotAfter, finding.Violations)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = QuerySaveCompliance.Tx(tx).Exec(report.Generated, report.Policy, report.Checked)
+		return err
+	})
+}
+
+// Fingerprint the public keys of certificates stored before they were fingerprinted. Returns how many were.
+func DatabaseBackfillFingerprints(limit int) (int, error) {
+	rows := []*struct {
+		Id   string
+		Cert StoredPEM
+	}{}
+	err := QueryListUnfingerprinted.Select(&rows, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	for _, row := range rows {
+		cert, err := ParseCertificatePEM(string(row.Cert))
+		if err != nil {
+			return 0, err
+		}
+		_, err = QuerySetFingerprint.Exec(row.Id, SPKIFingerprint(cert))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// Index the names of certificates stored before names were indexed. Returns how many were.
+func DatabaseBackfillNames(limit int) (int, error) {
+	rows := []*struct {
+		Id   string
+		Cert StoredPEM
+	}{}
+	err := QueryListUnindexedNames.Select(&rows, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	err = WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		for _, row := range rows {
+			err = databaseIndexNamesTx(tx, row.Id, row.Cert)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// List the active certificates of users other than the given one that may cover any of the names. Wildcards are
+// matched loosely, so the caller checks the names returned with namesOverlap.
+func DatabaseListNameConflicts(userid string, names []string) ([]*SANHolder, error) {
+	holders := []*SANHolder{}
+	if len(names) == 0 {
+		return holders, nil
+	}
+	exact, patterns := sanCandidates(names)
+	err := QueryListNameConflicts.Select(&holders, userid, pq.Array(exact), pq.Array(patterns))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return holders, nil
+}
+
+// List the names every active certificate covers, ordered by name
+func DatabaseListActiveNames() ([]*SANHolder, error) {
+	holders := []*SANHolder{}
+	err := QueryListActiveNames.Select(&holders)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return holders, nil
+}
+
+// List the active certificates covering wildcard names
+func DatabaseListWildcardCerts() ([]*WildcardCert, error) {
+	rows := []*struct {
+		UserId     string
+		CertId     string
+		NotAfter   UTCTime
+		Wildcards  pq.StringArray
+		DeployedBy pq.StringArray
+	}{}
+	err := QueryListWildcardCerts.Select(&rows)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	certs := make([]*WildcardCert, len(rows))
+	for i, row := range rows {
+		certs[i] = &WildcardCert{
+			UserId:     row.UserId,
+			CertId:     row.CertId,
+			NotAfter:   row.NotAfter,
+			Wildcards:  row.Wildcards,
+			DeployedBy: row.DeployedBy,
+		}
+	}
+	return certs, nil
+}
+
+// List minted certificates that expired before a time, soonest expired first
+func DatabaseListExpiredMinted(now time.Time, limit int) ([]*MintedCert, error) {
+	minted := []*MintedCert{}
+	err := QueryListExpiredMinted.Select(&minted, now, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return minted, nil
+}
+
+// Create a provisioning batch and its devices, which are issued later (see RunProvisioning). The batch's id and
+// creation time are filled in.
+func DatabaseCreateProvisionBatch(ctx context.Context, batch *ProvisionBatch, devices []*ProvisionedDevice, reason string) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryCreateProvisionBatch.Tx(tx).QueryRowx(batch.UserId, batch.ParentId, batch.NotAfter, batch.VendorId, batch.ProductId).Scan(&batch.Id, &batch.Created)
+		if err != nil {
+			return err
+		}
+
+		createDeviceStmt := QueryCreateProvisionDevice.Tx(tx)
+		for _, device := range devices {
+			_, err = createDeviceStmt.Exec(batch.Id, device.Id, device.CSR)
+			if err != nil {
+				return err
+			}
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionCreateBatch,
+			UserId: batch.UserId,
+			CertId: batch.ParentId,
+			Detail: AuditDetail{"batch": batch.Id, "devices": len(devices), "notAfter": batch.NotAfter},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get a provisioning batch, with how many of its devices have been issued
+func DatabaseReadProvisionBatch(userid, batchid string) (*ProvisionBatch, error) {
+	batch := new(ProvisionBatch)
+	err := QueryReadProvisionBatch.Get(batch, userid, batchid)
+	if err == sql.ErrNoRows {
+		return nil, ErrProvisionBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// List a user's provisioning batches, oldest first
+func DatabaseListProvisionBatches(userid string, q *ListQuery) ([]*ProvisionBatch, *Page, error) {
+	forward, key, limit := q.read("0")
+	if err := numericCursorKey(key); err != nil {
+		return nil, nil, err
+	}
+	batches := []*ProvisionBatch{}
+	var err error
+	if forward {
+		err = QueryListProvisionBatches.Select(&batches, userid, key, limit)
+	} else {
+		err = QueryListProvisionBatchesBefore.Select(&batches, userid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(batches))
+	for i, batch := range batches {
+		keys[i] = batch.Id
+	}
+	start, end, page := q.page(keys)
+	return batches[start:end], page, nil
+}
+
+// List the provisioning batches with devices still to be issued, oldest first
+func DatabaseListPendingBatches() ([]*ProvisionBatch, error) {
+	batches := []*ProvisionBatch{}
+	err := QueryListPendingBatches.Select(&batches)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return batches, nil
+}
+
+// List a batch's devices still to be issued
+func DatabaseListPendingDevices(batchid string, limit int) ([]*ProvisionedDevice, error) {
+	devices := []*ProvisionedDevice{}
+	err := QueryListPendingDevices.Select(&devices, batchid, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Record a device's certificate and key, or the error issuing it. A device that has already been issued is left alone.
+func DatabaseSetDeviceCert(batchid string, device *ProvisionedDevice) error {
+	_, err := QuerySetDeviceCert.Exec(batchid, device.Id, device.Cert, device.Key, device.Error)
+	return err
+}
+
+// List a batch's issued and failed devices after a device ID, in order
+func DatabaseListProvisionedDevices(batchid, after string, limit int) ([]*ProvisionedDevice, error) {
+	devices := []*ProvisionedDevice{}
+	err := QueryListProvisionedDevices.Select(&devices, batchid, after, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// Clear the errors of a batch's failed devices, so they are issued again
+func DatabaseRetryProvisionBatch(userid, batchid string) (*ProvisionBatch, error) {
+	batch, err := DatabaseReadProvisionBatch(userid, batchid)
+	if err != nil {
+		return nil, err
+	}
+	_, err = QueryRetryProvisionBatch.Exec(batchid)
+	if err != nil {
+		return nil, err
+	}
+	batch.Pending, batch.Failed = batch.Pending+batch.Failed, 0
+	return batch, nil
+}
+
+// Delete a provisioning batch, and its devices' certificates and keys
+func DatabaseDeleteProvisionBatch(ctx context.Context, userid, batchid, reason string) (*ProvisionBatch, error) {
+	batch := new(ProvisionBatch)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryReadProvisionBatch.Tx(tx).Get(batch, userid, batchid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrProvisionBatchNotFound
+			}
+			return err
+		}
+
+		_, err = QueryDeleteProvisionBatch.Tx(tx).Exec(userid, batchid)
+		if err != nil {
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDeleteBatch,
+			UserId: userid,
+			CertId: batch.ParentId,
+			Detail: AuditDetail{"batch": batchid, "devices": batch.Devices},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Queue a submitted CSR, unless there are already maxPending waiting. Its submission time is filled in.
+func DatabaseCreateCSR(q *QueuedCSR, maxPending int) error {
+	err := QueryCreateCSR.QueryRowx(q.Id, q.CSR, q.Contact, q.Comment, q.Client, maxPending).Scan(&q.Submitted)
+	if err == sql.ErrNoRows {
+		return ErrCSRQueueFull
+	}
+	return err
+}
+
+// Get a queued CSR, with its subject and names
+func DatabaseReadCSR(csrid string) (*QueuedCSR, error) {
+	q := new(QueuedCSR)
+	err := QueryReadCSR.Get(q, csrid)
+	if err == sql.ErrNoRows {
+		return nil, ErrCSRNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.parse()
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// List the queued CSRs with a status, oldest first
+func DatabaseListCSRs(status string, query *ListQuery) ([]*QueuedCSR, *Page, error) {
+	// The key is when the CSR was submitted, then its id
+	forward, key, limit := query.read("-infinity ")
+	i := strings.LastIndex(key, " ")
+	if i < 0 {
+		return nil, nil, ErrInvalidCursor
+	}
+	submitted, id := key[:i], key[i+1:]
+	if _, err := time.Parse(time.RFC3339Nano, submitted); err != nil && submitted != "-infinity" {
+		return nil, nil, ErrInvalidCursor
+	}
+
+	csrs := []*QueuedCSR{}
+	var err error
+	if forward {
+		err = QueryListCSRs.Select(&csrs, status, submitted, id, limit)
+	} else {
+		err = QueryListCSRsBefore.Select(&csrs, status, submitted, id, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(csrs))
+	for i, q := range csrs {
+		_, err = q.parse()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = q.Submitted.UTC().Format(time.RFC3339Nano) + " " + q.Id
+	}
+	start, end, page := query.page(keys)
+	return csrs[start:end], page, nil
+}
+
+// Record the decision on a queued CSR: its certificate, from the issuer's CA certificate, if it was approved.
+// A CSR that has already been decided is left alone.
+func DatabaseDecideCSR(ctx context.Context, q *QueuedCSR, issuer *CertificateData) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := QueryDecideCSR.Tx(tx).Exec(q.Id, q.Status, q.Decided, q.DecidedBy, q.Reason, q.Cert, q.Chain)
+		if err == nil {
+			if affected, rowsErr := result.RowsAffected(); rowsErr != nil {
+				err = rowsErr
+			} else if affected == 0 {
+				err = ErrCSRDecided
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := &AuditEntry{
+			Action: AuditActionDenyCSR,
+			Detail: AuditDetail{"csr": q.Id, "subject": q.Subject, "names": q.Names, "decidedBy": q.DecidedBy},
+			Reason: q.Reason,
+		}
+		if issuer != nil {
+			entry.Action, entry.UserId, entry.CertId = AuditActionApproveCSR, issuer.UserId, issuer.Id
+			entry.Detail["issued"] = queuedCertId(q)
+			if q.CAA != nil {
+				entry.Detail["caa"] = q.CAA
+			}
+		}
+		return databaseCreateAuditTx(ctx, tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Count the other certificates with the same public key as a certificate
+func DatabaseCountKeyReuse(spki, certid string) (int, error) {
+	var count int
+	err := QueryCountKeyReuse.Get(&count, spki, certid)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// List every certificate whose public key is shared with another certificate, grouped by key
+func DatabaseListReusedKeys() ([]*ReusedKey, error) {
+	certs := []*ReusedKeyCert{}
+	err := QueryListReusedKeys.Select(&certs)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return groupReusedKeys(certs), nil
+}
+
+// Given a user-id and a reference to a certificate that isn't a full cert-id, find the cert-id among the
+// certificates the user holds or that are shared with them
+func DatabaseResolveCertRef(userid string, ref *CertRef) (string, error) {
+	ids := []string{}
+	if ref.IsCertIdPrefix() {
+		err := QueryResolveCertIdPrefix.Select(&ids, userid, ref.Value+"%")
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		return resolvedCertId(ids)
+	}
+
+	// Other references need every certificate to be parsed
+	certs := []*struct {
+		Id   string
+		Cert StoredPEM
+	}{}
+	err := QueryListHeldCerts.Select(&certs, userid)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	for _, c := range certs {
+		cert, err := ParseCertificatePEM(string(c.Cert))
+		if err != nil {
+			return "", err
+		}
+		if ref.Matches(cert) {
+			ids = append(ids, c.Id)
+		}
+	}
+	return resolvedCertId(ids)
+}
+
+// Register a domain for a user. If the user already has it, it is returned as it is, and nothing is audited.
+func DatabaseCreateDomain(ctx context.Context, domain *Domain, reason string) (*Domain, error) {
+	var exists bool
+	err := QueryUserExists.Get(&exists, domain.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	created := new(Domain)
+	existed := false
+	err = WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryCreateDomain.Tx(tx).Get(created, domain.UserId, domain.Name, domain.Token, NewUTCTime(Now()))
+		if err == sql.ErrNoRows {
+			existed = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		created.Record = domainRecordPrefix + created.Name
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionCreateDomain,
+			UserId: created.UserId,
+			Detail: AuditDetail{"domain": created.Name},
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if existed {
+		return DatabaseReadDomain(domain.UserId, domain.Name)
+	}
+	return created, nil
+}
+
+// Given a user-id and a domain name, get the domain
+func DatabaseReadDomain(userid, name string) (*Domain, error) {
+	domain := new(Domain)
+	err := QueryReadDomain.Get(domain, userid, name)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	domain.Record = domainRecordPrefix + domain.Name
+	return domain, nil
+}
+
+// List a user's domains, by name
+func DatabaseListDomains(userid string, q *ListQuery) ([]*Domain, *Page, error) {
+	var exists bool
+	err := QueryUserExists.Get(&exists, userid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, ErrNotFound
+	}
+
+	domains := []*Domain{}
+	forward, key, limit := q.read("")
+	if forward {
+		err = QueryListDomains.Select(&domains, userid, key, limit)
+	} else {
+		err = QueryListDomainsBefore.Select(&domains, userid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	keys := make([]string, len(domains))
+	for i, domain := range domains {
+		domain.Record = domainRecordPrefix + domain.Name
+		keys[i] = domain.Name
+	}
+	start, end, page := q.page(keys)
+	return domains[start:end], page, nil
+}
+
+// Record that a domain has been verified, at its Verified time
+func DatabaseVerifyDomain(ctx context.Context, domain *Domain, reason string) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := QueryVerifyDomain.Tx(tx).Exec(domain.UserId, domain.Name, domain.Verified)
+		if err == nil {
+			if affected, rowsErr := result.RowsAffected(); rowsErr != nil {
+				err = rowsErr
+			} else if affected == 0 {
+				err = ErrNotFound
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionVerifyDomain,
+			UserId: domain.UserId,
+			Detail: AuditDetail{"domain": domain.Name, "record": domain.Record},
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Given a user-id and a domain name, delete the domain. The deleted domain is returned.
+func DatabaseDeleteDomain(ctx context.Context, userid, name, reason string) (*Domain, error) {
+	domain := new(Domain)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryDeleteDomain.Tx(tx).Get(domain, userid, name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+		domain.Record = domainRecordPrefix + domain.Name
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDeleteDomain,
+			UserId: userid,
+			Detail: AuditDetail{"domain": domain.Name, "verified": !domain.Verified.IsZero()},
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+// A request template as stored, with the template as JSON
+type templateRow struct {
+	UserId  string
+	Name    string
+	Spec    []byte
+	Updated UTCTime
+}
+
+// Get the template from a stored row
+func (row *templateRow) template() (*RequestTemplate, error) {
+	template := new(RequestTemplate)
+	err := json.Unmarshal(row.Spec, template)
+	if err != nil {
+		return nil, err
+	}
+	template.UserId, template.Name, template.Updated = row.UserId, row.Name, row.Updated
+	template.findParams()
+	return template, nil
+}
+
+// Save a user's request template, replacing any with the same name
+func DatabaseSaveTemplate(ctx context.Context, template *RequestTemplate, reason string) error {
+	var exists bool
+	err := QueryUserExists.Get(&exists, template.UserId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	// The template is stored without what its row or the template itself gives
+	stored := *template
+	stored.UserId, stored.Name, stored.Params, stored.Updated = "", "", nil, UTCTime{}
+	spec, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	err = WithTx(ctx, func(tx *sqlx.Tx) error {
+		_, err = QuerySaveTemplate.Tx(tx).Exec(template.UserId, template.Name, spec, template.Updated)
+		if err != nil {
+			return err
+		}
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionSaveTemplate,
+			UserId: template.UserId,
+			Detail: AuditDetail{"template": template.Name, "names": template.Names, "keyType": template.KeyType},
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Given a user-id and a template name, get the template
+func DatabaseReadTemplate(userid, name string) (*RequestTemplate, error) {
+	row := new(templateRow)
+	err := QueryReadTemplate.Get(row, userid, name)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.template()
+}
+
+// List a user's request templates, by name
+func DatabaseListTemplates(userid string, q *ListQuery) ([]*RequestTemplate, *Page, error) {
+	var exists bool
+	err := QueryUserExists.Get(&exists, userid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, ErrNotFound
+	}
+
+	rows := []*templateRow{}
+	forward, key, limit := q.read("")
+	if forward {
+		err = QueryListTemplates.Select(&rows, userid, key, limit)
+	} else {
+		err = QueryListTemplatesBefore.Select(&rows, userid, key, limit)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	templates := make([]*RequestTemplate, len(rows))
+	keys := make([]string, len(rows))
+	for i, row := range rows {
+		templates[i], err = row.template()
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = templates[i].Name
+	}
+	start, end, page := q.page(keys)
+	return templates[start:end], page, nil
+}
+
+// Given a user-id and a template name, delete the template. The deleted template is returned.
+func DatabaseDeleteTemplate(ctx context.Context, userid, name, reason string) (*RequestTemplate, error) {
+	var template *RequestTemplate
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		row := new(templateRow)
+		err := QueryDeleteTemplate.Tx(tx).Get(row, userid, name)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+		template, err = row.template()
+		if err != nil {
+			return err
+		}
+
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDropTemplate,
+			UserId: userid,
+			Detail: AuditDetail{"template": template.Name},
+			Reason: reason,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// The count of a campaign's certificates in a state
+type campaignCount struct {
+	CampaignId string
+	Status     string
+	Count      int
+}
+
+// Count the certificates in each state of one campaign, or every campaign if the campaign-id is empty
+func databaseCampaignProgress(campaignid string) (map[string]map[string]int, error) {
+	var id *string
+	if campaignid != "" {
+		id = &campaignid
+	}
+	rows := []*campaignCount{}
+	err := QueryCampaignProgress.Select(&rows, id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	counts := make(map[string]map[string]int)
+	for _, row := range rows {
+		if counts[row.CampaignId] == nil {
+			counts[row.CampaignId] = make(map[string]int)
+		}
+		counts[row.CampaignId][row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// Create a campaign with the certificates it selected, setting its id
+func DatabaseCreateCampaign(ctx context.Context, campaign *Campaign, reason string) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryCreateCampaign.Tx(tx).Get(&campaign.Id, campaign.Name, campaign.Description, campaign.Selector, campaign.Due, campaign.Created, campaign.CreatedBy)
+		if err != nil {
+			return err
+		}
+		for _, c := range campaign.Certs {
+			c.CampaignId = campaign.Id
+			_, err = QueryCreateCampaignCert.Tx(tx).Exec(c.CampaignId, c.UserId, c.CertId, c.CommonName, c.NotAfter, c.Owner, c.Status, c.Note, c.RenewedBy, c.Updated)
+			if err != nil {
+				return err
+			}
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionNewCampaign,
+			Detail: AuditDetail{"campaign": campaign.Id, "name": campaign.Name, "selector": campaign.Selector, "certs": len(campaign.Certs), "createdBy": campaign.CreatedBy},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Given a campaign-id, get the campaign with its progress, but not its certificates
+func DatabaseReadCampaign(campaignid string) (*Campaign, error) {
+	campaign := new(Campaign)
+	err := QueryReadCampaign.Get(campaign, campaignid)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	counts, err := databaseCampaignProgress(campaignid)
+	if err != nil {
+		return nil, err
+	}
+	campaign.Progress = NewCampaignProgress(counts[campaignid])
+	return campaign, nil
+}
+
+// List the campaigns with their progress, oldest first
+func DatabaseListCampaigns() ([]*Campaign, error) {
+	campaigns := []*Campaign{}
+	err := QueryListCampaigns.Select(&campaigns)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	counts, err := databaseCampaignProgress("")
+	if err != nil {
+		return nil, err
+	}
+	for _, campaign := range campaigns {
+		campaign.Progress = NewCampaignProgress(counts[campaign.Id])
+	}
+	return campaigns, nil
+}
+
+// Given a campaign-id, delete the campaign and its record of its certificates. The deleted campaign is returned.
+func DatabaseDeleteCampaign(ctx context.Context, campaignid, reason string) (*Campaign, error) {
+	campaign, err := DatabaseReadCampaign(campaignid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = WithTx(ctx, func(tx *sqlx.Tx) error {
+		err = QueryDeleteCampaign.Tx(tx).Get(campaign, campaignid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionEndCampaign,
+			Detail: AuditDetail{"campaign": campaign.Id, "name": campaign.Name, "progress": campaign.Progress},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return campaign, nil
+}
+
+// Given a campaign-id, user-id and cert-id, get the certificate's place in the campaign
+func DatabaseReadCampaignCert(campaignid, userid, certid string) (*CampaignCert, error) {
+	c := new(CampaignCert)
+	err := QueryReadCampaignCert.Get(c, campaignid, userid, certid)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// List a campaign's certificates, soonest expiring first
+func DatabaseListCampaignCerts(campaignid string) ([]*CampaignCert, error) {
+	certs := []*CampaignCert{}
+	err := QueryListCampaignCerts.Select(&certs, campaignid)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Record updates to certificates in a campaign, by an administrator or a refresh, auditing each
+func DatabaseUpdateCampaignCerts(ctx context.Context, certs []*CampaignCert, updatedBy, reason string) error {
+	if len(certs) == 0 {
+		return nil
+	}
+
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		for _, c := range certs {
+			_, err := QueryUpdateCampaignCert.Tx(tx).Exec(c.CampaignId, c.UserId, c.CertId, c.Owner, c.Status, c.Note, c.RenewedBy, c.Updated)
+			if err != nil {
+				return err
+			}
+
+			detail := AuditDetail{"campaign": c.CampaignId, "status": c.Status, "owner": c.Owner, "updatedBy": updatedBy}
+			if c.RenewedBy != "" {
+				detail["renewedBy"] = c.RenewedBy
+			}
+			err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+				Action: AuditActionEditCampaign,
+				UserId: c.UserId,
+				CertId: c.CertId,
+				Detail: detail,
+				Reason: reason,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Given a user-id and cert-id, list the user's other active certificates for any of the same names, latest expiring
+// first. Private keys aren't read.
+func DatabaseListCertSuccessors(userid, certid string) ([]*CertificateData, error) {
+	certs := []*CertificateData{}
+	err := QueryListCertSuccessors.Select(&certs, userid, certid)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Given a URL, get its cached CRL
+func DatabaseReadCRL(url string) (*CachedCRL, error) {
+	crl := new(CachedCRL)
+	err := QueryReadCRL.Get(crl, url)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crl, nil
+}
+
+// List the cached CRLs, without the CRLs themselves
+func DatabaseListCRLs() ([]*CachedCRL, error) {
+	crls := []*CachedCRL{}
+	err := QueryListCRLs.Select(&crls)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return crls, nil
+}
+
+// Cache a CRL, or how fetching it went
+func DatabaseSaveCRL(crl *CachedCRL) error {
+	_, err := QuerySaveCRL.Exec(crl.URL, crl.Issuer, crl.ThisUpdate, crl.NextUpdate, crl.Fetched, crl.Checked, crl.Entries, crl.Error, crl.Data)
+	return err
+}
+
+// Mark a certificate revoked, auditing it for each user holding it. Nothing is done if it is already marked.
+func DatabaseMarkRevoked(certid string, holders []string, revocation *Revocation) error {
+	return WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		_, err := databaseMarkRevokedTx(context.Background(), tx, certid, holders, revocation)
+		return err
+	})
+}
+
+// Mark a certificate revoked within a transaction, auditing it for each user holding it. Returns whether it was
+// newly marked.
+func databaseMarkRevokedTx(ctx context.Context, tx *sqlx.Tx, certid string, holders []string, revocation *Revocation) (bool, error) {
+	result, err := QueryMarkCertRevoked.Tx(tx).Exec(certid, revocation.Revoked, revocation.Reason)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	for _, userid := range holders {
+		err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionRevokeCert,
+			UserId: userid,
+			CertId: certid,
+			Detail: revocation.auditDetail(),
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// List active certificates due to have their revocation status checked again: those not checked since a time, and
+// those already known to be revoked. Certificates held by more than one user are listed once for each.
+func DatabaseListRevocationDue(checkedBefore time.Time, limit int) ([]*CertificateData, error) {
+	certs := []*CertificateData{}
+	err := QueryListRevocationDue.Select(&certs, checkedBefore, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Record when a certificate's revocation status was checked
+func DatabaseSetRevocationChecked(certid string, now time.Time) error {
+	_, err := QuerySetRevocationChecked.Exec(certid, now)
+	return err
+}
+
+// Mark a certificate revoked, if it isn't already, and deactivate it for every user holding it active, auditing
+// each. The users it was deactivated for are returned.
+func DatabaseRevokeCert(ctx context.Context, certid string, revocation *Revocation, now time.Time) ([]string, error) {
+	deactivated := []string{}
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		holders := []string{}
+		err := QueryListAllCertHolders.Tx(tx).Select(&holders, certid)
+		if err == nil {
+			_, err = databaseMarkRevokedTx(ctx, tx, certid, holders, revocation)
+		}
+		if err == nil {
+			err = QueryDeactivateRevokedCerts.Tx(tx).Select(&deactivated, certid)
+		}
+		if err == nil {
+			_, err = QuerySetRevocationChecked.Tx(tx).Exec(certid, now)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, userid := range deactivated {
+			err = databaseCreateAuditTx(ctx, tx, &AuditEntry{
+				Action: AuditActionUpdateCert,
+				UserId: userid,
+				CertId: certid,
+				Detail: AuditDetail{"active": false, "revoked": true},
+				Reason: revocation.String(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deactivated, nil
+}
+
+// Get the user holding the most certificates
+func DatabaseBusiestUser() (string, error) {
+	var userid string
+	err := QueryBusiestUser.Get(&userid)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return userid, err
+}
+
+// Get the name the most certificates cover
+func DatabaseCommonestName() (string, error) {
+	var name string
+	err := QueryCommonestName.Get(&name)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return name, err
+}
+
+// Get a query's plan, as EXPLAIN (FORMAT JSON) gives it. With analyze, the query is run too, in a read-only
+// transaction that is rolled back. Unlike the other queries, EXPLAIN isn't prepared: it is only run on demand.
+func DatabaseExplain(query string, args []interface{}, analyze bool) (json.RawMessage, error) {
+	options := "FORMAT JSON"
+	if analyze {
+		options = "ANALYZE, BUFFERS, FORMAT JSON"
+	}
+	var plan []byte
+	err := withDryRunTx(true, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("SET TRANSACTION READ ONLY")
+		if err == nil {
+			_, err = tx.Exec("SET LOCAL statement_timeout = " + strconv.FormatInt(explainTimeout.Milliseconds(), 10))
+		}
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowx("EXPLAIN ("+options+") "+query, args...).Scan(&plan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(plan), nil
+}
+
+// Trust a root or an intermediate certificate. It must not be trusted already.
+func DatabaseCreateTrustRoot(ctx context.Context, root *TrustRoot, reason string) error {
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := QueryCreateTrustRoot.Tx(tx).Exec(root.Id, root.Kind, root.Cert, root.Subject, root.NotAfter, root.Added, root.AddedBy)
+		var created int64
+		if err == nil {
+			created, err = result.RowsAffected()
+		}
+		if err == nil && created == 0 {
+			err = ErrTrustRootExists
+		}
+		if err != nil {
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionTrustRoot,
+			Detail: AuditDetail{"trustRoot": root.Id, "kind": root.Kind, "subject": root.Subject, "addedBy": root.AddedBy},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// List the certificates trusted with the API
+func DatabaseListTrustRoots() ([]*TrustRoot, error) {
+	roots := []*TrustRoot{}
+	err := QueryListTrustRoots.Select(&roots)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// Stop trusting a certificate trusted with the API. The certificate is returned.
+func DatabaseDeleteTrustRoot(ctx context.Context, rootid, reason string) (*TrustRoot, error) {
+	root := new(TrustRoot)
+	err := WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := QueryDeleteTrustRoot.Tx(tx).Get(root, rootid)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		return databaseCreateAuditTx(ctx, tx, &AuditEntry{
+			Action: AuditActionDistrustRoot,
+			Detail: AuditDetail{"trustRoot": root.Id, "kind": root.Kind, "subject": root.Subject},
+			Reason: reason,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
 }
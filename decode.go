@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// A certificate to decode, such as a local file a client wants to inspect. Nothing is stored.
+type DecodeRequest struct {
+	Cert string `json:"cert"` // PEM encoded
+}
+
+// Decode a certificate into its details, as a client would show them, without storing it.
+// Anything the certificate would be warned about on upload is reported as a warning.
+func DecodeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req := new(DecodeRequest)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(req)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if req.Cert == "" {
+		HandleError(w, r, &FieldError{"cert", ErrRequiredField}, 0)
+		return
+	}
+
+	cert, err := ParseCertificatePEM(req.Cert)
+	if err != nil {
+		HandleError(w, r, &FieldError{"cert", err}, http.StatusBadRequest)
+		return
+	}
+	details := NewCertificateDetails(cert)
+
+	// Send the result
+	SendResult(w, r, details, details.Warnings("cert")...)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+)
+
+const (
+	KeyTypeRSA = "RSA"
+	KeyTypeEC  = "EC"
+)
+
+// CertificateDetails are the interesting fields of a parsed certificate, in a form that is easy to
+// deliver to clients. They never include anything about the private key other than its type and size.
+type CertificateDetails struct {
+	Subject            string   `json:"subject"`
+	CommonName         string   `json:"commonName"`
+	Issuer             string   `json:"issuer"`
+	SerialNumber       string   `json:"serialNumber"` // Hex-encoded
+	DNSNames           []string `json:"dnsNames"`
+	EmailAddresses     []string `json:"emailAddresses"`
+	IPAddresses        []string `json:"ipAddresses"`
+	URIs               []string `json:"uris"`
+	KeyType            string   `json:"keyType"` // KeyTypeRSA, KeyTypeEC, or empty if unknown
+	KeyBits            int      `json:"keyBits"`
+	SignatureAlgorithm string   `json:"signatureAlgorithm"`
+	IsCA               bool     `json:"isCA"`
+	NotBefore          UTCTime  `json:"notBefore"`
+	NotAfter           UTCTime  `json:"notAfter"`
+	SPIFFEID           string   `json:"spiffeId"` // The URI that is a SPIFFE ID, if the certificate is an SVID (see spiffe.go)
+
+	// Extensions that are marked critical, or that the certificate parser doesn't understand
+	Extensions []*CertificateExtension `json:"extensions"`
+}
+
+// A raw X.509 extension
+type CertificateExtension struct {
+	OID      string `json:"oid"`
+	Critical bool   `json:"critical"`
+	Value    []byte `json:"value"` // DER encoded. Base64 encoded in JSON.
+}
+
+// Extensions understood by crypto/x509. Their contents are already reported in other fields.
+var knownExtensions = map[string]bool{
+	"2.5.29.14":         true, // Subject key identifier
+	"2.5.29.15":         true, // Key usage
+	"2.5.29.17":         true, // Subject alternative name
+	"2.5.29.19":         true, // Basic constraints
+	"2.5.29.30":         true, // Name constraints
+	"2.5.29.31":         true, // CRL distribution points
+	"2.5.29.32":         true, // Certificate policies
+	"2.5.29.35":         true, // Authority key identifier
+	"2.5.29.37":         true, // Extended key usage
+	"1.3.6.1.5.5.7.1.1": true, // Authority information access
+}
+
+// Get the details of a parsed certificate
+func NewCertificateDetails(cert *x509.Certificate) *CertificateDetails {
+	details := &CertificateDetails{
+		Subject:            cert.Subject.String(),
+		CommonName:         cert.Subject.CommonName,
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       hex.EncodeToString(cert.SerialNumber.Bytes()),
+		DNSNames:           append([]string{}, cert.DNSNames...),
+		EmailAddresses:     append([]string{}, cert.EmailAddresses...),
+		IPAddresses:        []string{},
+		URIs:               []string{},
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		IsCA:               cert.IsCA,
+		NotBefore:          NewUTCTime(cert.NotBefore),
+		NotAfter:           NewUTCTime(cert.NotAfter),
+		Extensions:         []*CertificateExtension{},
+	}
+	for _, ip := range cert.IPAddresses {
+		details.IPAddresses = append(details.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		details.URIs = append(details.URIs, uri.String())
+		if uri.Scheme == "spiffe" && len(cert.URIs) == 1 {
+			details.SPIFFEID = uri.String()
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Critical || !knownExtensions[ext.Id.String()] {
+			details.Extensions = append(details.Extensions, &CertificateExtension{OID: ext.Id.String(), Critical: ext.Critical, Value: ext.Value})
+		}
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		details.KeyType = KeyTypeRSA
+		details.KeyBits = pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		details.KeyType = KeyTypeEC
+		details.KeyBits = pub.Curve.Params().BitSize
+	}
+
+	return details
+}
+
+// Parse the certificate (but not the private key) and get its details
+func (certData *CertificateData) Details() (*CertificateDetails, error) {
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	return NewCertificateDetails(cert), nil
+}
+
+// CertificateSummary is the part of a certificate's details that a listing shows, so a UI can show a table of
+// certificates without getting each one's details. The certificate is fetched for a listing anyway, so the summary
+// comes from parsing it rather than from columns of its own, which every stored certificate would need backfilling.
+type CertificateSummary struct {
+	CommonName string  `json:"commonName"`
+	Issuer     string  `json:"issuer"`
+	SANCount   int     `json:"sanCount"` // DNS names, IP addresses, email addresses and URIs
+	KeyType    string  `json:"keyType"`
+	KeyBits    int     `json:"keyBits"`
+	NotAfter   UTCTime `json:"notAfter"`
+	Wildcard   bool    `json:"wildcard"` // Does it cover a wildcard name? (see wildcards.go)
+}
+
+func NewCertificateSummary(details *CertificateDetails) *CertificateSummary {
+	return &CertificateSummary{
+		CommonName: details.CommonName,
+		Issuer:     details.Issuer,
+		SANCount:   len(details.DNSNames) + len(details.IPAddresses) + len(details.EmailAddresses) + len(details.URIs),
+		KeyType:    details.KeyType,
+		KeyBits:    details.KeyBits,
+		NotAfter:   details.NotAfter,
+		Wildcard:   hasWildcard(details.DNSNames),
+	}
+}
+
+// Fill in the summary of each certificate in a listing. Certificates that can't be parsed are left without one.
+func SummarizeCerts(certs []*CertificateData) {
+	for _, certData := range certs {
+		if details, err := certData.Details(); err == nil {
+			certData.Summary = NewCertificateSummary(details)
+		}
+	}
+}
+
+// KeyDetails describe a stored private key by its public parameters, for security reviews.
+// Nothing private is included: the fingerprint is of the public key.
+type KeyDetails struct {
+	KeyType            string `json:"keyType"`                  // KeyTypeRSA or KeyTypeEC
+	KeyBits            int    `json:"keyBits"`                  // RSA modulus size, or EC curve size
+	PublicExponent     int    `json:"publicExponent,omitempty"` // RSA only
+	Curve              string `json:"curve,omitempty"`          // EC only, eg. "P-256"
+	Fingerprint        string `json:"fingerprint"`              // SHA256 hash (hex-encoded) of the public key (DER-encoded SubjectPublicKeyInfo)
+	MatchesCertificate bool   `json:"matchesCertificate"`       // Does the key's public key match the certificate's?
+}
+
+// Get the details of a private key, and whether it belongs to the certificate
+func NewKeyDetails(key interface{}, cert *x509.Certificate) (*KeyDetails, error) {
+	details := new(KeyDetails)
+	var pub crypto.PublicKey
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		details.KeyType = KeyTypeRSA
+		details.KeyBits = priv.N.BitLen()
+		details.PublicExponent = priv.E
+		pub = &priv.PublicKey
+	case *ecdsa.PrivateKey:
+		details.KeyType = KeyTypeEC
+		details.KeyBits = priv.Curve.Params().BitSize
+		details.Curve = priv.Curve.Params().Name
+		pub = &priv.PublicKey
+	default:
+		return nil, ErrInvalidPrivateKey
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(der)
+	details.Fingerprint = hex.EncodeToString(hash[:])
+	if cert != nil {
+		if certPub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok {
+			details.MatchesCertificate = certPub.Equal(pub)
+		}
+	}
+	return details, nil
+}
+
+// Parse the private key and certificate, and get the details of the key
+func (certData *CertificateData) KeyDetails() (*KeyDetails, error) {
+	key, err := ParsePrivateKeyPEM(string(certData.Key))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyDetails(key, cert)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/idna"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Domains are verified by a TXT record under this prefix, such as _certstore-challenge.example.com
+const domainRecordPrefix = "_certstore-challenge."
+
+// Domain policies
+const (
+	DomainPolicyOff    = "off"
+	DomainPolicyWarn   = "warn"   // Accept certificates with names outside the user's domains, with a warning
+	DomainPolicyReject = "reject" // Reject certificates with names outside the user's domains
+)
+
+var (
+	ErrInvalidDomain      = NewError("invalid-domain", http.StatusBadRequest, "Invalid domain. Give a DNS name with at least two labels, such as example.com, without wildcards.")
+	ErrDomainNotVerified  = NewError("domain-not-verified", http.StatusBadRequest, "The domain's TXT record wasn't found. Publish the token as a TXT record at the domain's record, then try again.")
+	ErrNameOutsideDomains = NewError("name-outside-domains", http.StatusBadRequest, "The certificate has DNS names outside the domains the user has registered.")
+
+	WarnNameOutsideDomains = NewError("name-outside-domains", 0, "The certificate has DNS names outside the domains the user has registered.")
+)
+
+// Users register the DNS namespaces they own as domains. A domain covers its subdomains: example.com covers
+// www.example.com and *.example.com. The domain policy (the DomainPolicy option) checks the DNS names of uploaded
+// certificates (including those uploaded with a new user, who has no domains yet), minted certificates and approved
+// CSRs (against the CSR issuer's domains) and, depending on the option, warns about or rejects names outside the
+// user's domains. Other names, such as IP addresses, aren't in any
+// DNS namespace, so they are never outside.
+//
+// Registering a domain gives it a random token. Publishing the token as a TXT record at _certstore-challenge.<domain>
+// and asking for verification proves the user controls the domain's DNS. Verification is optional, unless the
+// VerifiedDomainsOnly option is on, when only verified domains count. Records are only checked when asked, not
+// again later. Several users may register the same domain, so a user can't block another by registering theirs.
+// Domains aren't replicated to a standby.
+
+// A DNS namespace a user owns
+type Domain struct {
+	UserId   string  `json:"user"`
+	Name     string  `json:"name"`   // Lower case, in ASCII (punycode) form
+	Token    string  `json:"token"`  // The value of the TXT record verifying the domain
+	Record   string  `json:"record"` // The name of the TXT record
+	Created  UTCTime `json:"created"`
+	Verified UTCTime `json:"verified"` // When the domain was verified. Zero if it hasn't been.
+}
+
+// Resolves TXT records. Replaced in tests.
+var lookupTXT = net.LookupTXT
+
+// Create a domain for a user, with a new token
+func NewDomain(userid, name string) (*Domain, error) {
+	name, err := NormalizeDomain(name)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	_, err = rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Domain{UserId: userid, Name: name, Token: hex.EncodeToString(token), Record: domainRecordPrefix + name}, nil
+}
+
+// Normalize a domain to lower case ASCII, without a trailing dot. Top-level domains can't be registered.
+func NormalizeDomain(name string) (string, error) {
+	name, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if err != nil || !isDNSName(name) || !strings.Contains(name, ".") {
+		return "", ErrInvalidDomain
+	}
+	return name, nil
+}
+
+// Does a domain cover a DNS name or wildcard, in lower case?
+func domainCovers(domain, name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// Find the names outside a user's domains. Only verified domains count if verifiedOnly is set.
+func namesOutsideDomains(names []string, domains []*Domain, verifiedOnly bool) []string {
+	var outside []string
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if net.ParseIP(name) != nil || !isDNSName(strings.TrimPrefix(lower, "*.")) {
+			continue
+		}
+		covered := false
+		for _, domain := range domains {
+			if (!verifiedOnly || !domain.Verified.IsZero()) && domainCovers(domain.Name, lower) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			outside = append(outside, name)
+		}
+	}
+	return outside
+}
+
+// Check a new certificate's names (see certNames) against the user's domains. If the policy rejects names outside
+// them, an error is returned. If it warns, a warning is. A warn policy doesn't fail if the domains can't be read.
+func CheckDomainPolicy(userid string, names []string, field string, config *RuntimeConfig) (ValidationErrors, error) {
+	if config.DomainPolicy == DomainPolicyOff {
+		return nil, nil
+	}
+	domains, _, err := DatabaseListDomains(userid, nil)
+	if err != nil {
+		if config.DomainPolicy == DomainPolicyReject {
+			return nil, err
+		}
+		log.Println("Unable to check the domain policy:", err)
+		return nil, nil
+	}
+	if len(namesOutsideDomains(names, domains, config.VerifiedDomainsOnly)) == 0 {
+		return nil, nil
+	}
+	if config.DomainPolicy == DomainPolicyReject {
+		return nil, &FieldError{field, ErrNameOutsideDomains}
+	}
+	var warnings ValidationErrors
+	warnings.Add(field, WarnNameOutsideDomains)
+	return warnings, nil
+}
+
+// Check the certificates uploaded with a new user against the domain policy. The user has no domains yet, so every
+// DNS name is outside them: with a reject policy, the user has to register their domains before uploading
+// certificates for them. Each certificate with a name outside is reported, with the field "certs[<index>]".
+func CheckNewUserDomainPolicy(certs []*CertificateData, config *RuntimeConfig) (ValidationErrors, error) {
+	if config.DomainPolicy == DomainPolicyOff {
+		return nil, nil
+	}
+	var errs, warnings ValidationErrors
+	for i, certData := range certs {
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			return nil, err
+		}
+		if len(namesOutsideDomains(certNames(cert), nil, false)) == 0 {
+			continue
+		}
+		field := "certs[" + strconv.Itoa(i) + "]"
+		if config.DomainPolicy == DomainPolicyReject {
+			errs.Add(field, ErrNameOutsideDomains)
+		} else {
+			warnings.Add(field, WarnNameOutsideDomains)
+		}
+	}
+	return warnings, errs.Err()
+}
+
+// Check that a domain's TXT record has its token
+func CheckDomainRecord(domain *Domain) error {
+	records, err := lookupTXT(domain.Record)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			return err
+		}
+		return ErrDomainNotVerified
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.Token {
+			return nil
+		}
+	}
+	return ErrDomainNotVerified
+}
+
+// Get the user-id and domain from a request
+func GetUserDomain(r *http.Request) (string, string, error) {
+	userid, err := GetUserID(r)
+	if err != nil {
+		return "", "", err
+	}
+	name, err := NormalizeDomain(mux.Vars(r)["domain"])
+	if err != nil {
+		return "", "", ErrNotFound
+	}
+	return userid, name, nil
+}
+
+// List a user's domains
+func ListDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	domains, page, err := DatabaseListDomains(userid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, domains, page)
+}
+
+// Get one of a user's domains
+func ReadDomainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserDomain(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	domain, err := DatabaseReadDomain(userid, name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, domain)
+}
+
+// Register a domain for a user. Registering a domain the user already has leaves it as it is.
+func CreateDomainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	domain, err := NewDomain(userid, mux.Vars(r)["domain"])
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	domain, err = DatabaseCreateDomain(r.Context(), domain, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, domain)
+}
+
+// Verify a user's domain by its TXT record
+func VerifyDomainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserDomain(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	domain, err := DatabaseReadDomain(userid, name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = CheckDomainRecord(domain)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	domain.Verified = NewUTCTime(Now())
+	err = DatabaseVerifyDomain(r.Context(), domain, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, domain)
+}
+
+// Delete one of a user's domains
+func DeleteDomainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserDomain(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	domain, err := DatabaseDeleteDomain(r.Context(), userid, name, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, domain)
+}
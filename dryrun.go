@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrInvalidDryRun = NewError("invalid-dry-run", http.StatusBadRequest, "Invalid dry-run parameter. Use dry-run=true or dry-run=false.")
+)
+
+// A ChangeReport describes what a destructive operation changed or, in a dry run, what it would have changed.
+// Dry runs do all the work in a transaction and then roll it back, so the report is exactly what a real run would do
+// (as long as nothing else changes in the meantime).
+type ChangeReport struct {
+	DryRun      bool     `json:"dryRun"`
+	Users       []string `json:"users"`       // Users deleted
+	Certs       []string `json:"certs"`       // Certificates deleted or moved to another user
+	Grants      int64    `json:"grants"`      // Sharing grants deleted or moved to another user
+	CertContent int64    `json:"certContent"` // Stored certificates deleted because nobody holds them any more
+}
+
+// Check if the request asks for a dry run (?dry-run=true)
+func IsDryRun(r *http.Request) (bool, error) {
+	dryRun := r.URL.Query().Get("dry-run")
+	if dryRun == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(dryRun)
+	if err != nil {
+		return false, ErrInvalidDryRun
+	}
+	return parsed, nil
+}
+
+// Returned by a dry run's operation, so that its transaction is rolled back
+var errDryRun = errors.New("dry run")
+
+// Run fn in a transaction (see WithTx), rolling it back rather than committing it if this is a dry run
+func withDryRunTx(dryRun bool, fn func(tx *sqlx.Tx) error) error {
+	err := WithTx(context.Background(), func(tx *sqlx.Tx) error {
+		err := fn(tx)
+		if err == nil && dryRun {
+			return errDryRun
+		}
+		return err
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"net/http"
+)
+
+const (
+	MediaTypeJSON     = "application/json"
+	MediaTypeCBOR     = "application/cbor"
+	MediaTypeProtobuf = "application/x-protobuf"
+)
+
+var (
+	ErrNotAcceptable = NewError("not-acceptable", http.StatusNotAcceptable, "This resource is not available in the requested encoding. Please use application/json.")
+)
+
+// A response encoding that can be negotiated with the Accept header
+type Encoding struct {
+	MediaType string
+	Marshal   func(res *HTTPResult) ([]byte, error)
+}
+
+// The supported response encodings. JSON is the default when the client expresses no usable preference.
+// CBOR encodes exactly what JSON does (using the same field names). Protobuf only covers the core resources
+// (users and certificates) using the messages defined in certstore.proto, and is intended for high-volume agents.
+var (
+	EncodingJSON     = &Encoding{MediaTypeJSON, func(res *HTTPResult) ([]byte, error) { return json.Marshal(res) }}
+	EncodingCBOR     = &Encoding{MediaTypeCBOR, func(res *HTTPResult) ([]byte, error) { return cborEncMode.Marshal(res) }}
+	EncodingProtobuf = &Encoding{MediaTypeProtobuf, MarshalResultProto}
+)
+
+// Times are encoded in CBOR as RFC3339 strings with the standard date/time tag, matching the JSON encoding.
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339, TimeTag: cbor.EncTagRequired}.EncMode()
+
+// Choose the response encoding from the request's Accept header
+func NegotiateEncoding(r *http.Request) *Encoding {
+	if !FlagEnabled(FlagBinaryEncodings) {
+		return EncodingJSON
+	}
+	for _, mediaType := range parseQualityList(r.Header.Get("Accept")) {
+		switch mediaType {
+		case MediaTypeCBOR:
+			return EncodingCBOR
+		case MediaTypeProtobuf, "application/protobuf":
+			return EncodingProtobuf
+		case MediaTypeJSON, "application/*", "*/*":
+			return EncodingJSON
+		}
+	}
+	return EncodingJSON
+}
+
+// Encode a result in the encoding negotiated with the client, setting the Content-Type to match
+func encodeResult(w http.ResponseWriter, r *http.Request, res *HTTPResult) ([]byte, error) {
+	enc := NegotiateEncoding(r)
+	var body []byte
+	var err error
+	if enc == EncodingJSON {
+		body, err = marshalJSONResult(w, r, res)
+	} else {
+		body, err = enc.Marshal(res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Content-Type", enc.MediaType)
+	w.Header().Add("Vary", "Accept")
+	return body, nil
+}
+
+func (t UTCTime) MarshalCBOR() ([]byte, error) {
+	if t.IsZero() {
+		return cborEncMode.Marshal(nil)
+	}
+	return cborEncMode.Marshal(t.UTC())
+}
+
+// Field numbers from certstore.proto
+const (
+	protoResultSuccess  protowire.Number = 1
+	protoResultError    protowire.Number = 2
+	protoResultCode     protowire.Number = 3
+	protoResultErrors   protowire.Number = 4
+	protoResultUser     protowire.Number = 5
+	protoResultCert     protowire.Number = 6
+	protoResultCerts    protowire.Number = 7
+	protoResultNext     protowire.Number = 8
+	protoResultPrev     protowire.Number = 9
+	protoResultWarnings protowire.Number = 10
+
+	protoFieldErrorField   protowire.Number = 1
+	protoFieldErrorCode    protowire.Number = 2
+	protoFieldErrorMessage protowire.Number = 3
+
+	protoUserId    protowire.Number = 1
+	protoUserName  protowire.Number = 2
+	protoUserEmail protowire.Number = 3
+	protoUserCerts protowire.Number = 4
+
+	protoCertId           protowire.Number = 1
+	protoCertUser         protowire.Number = 2
+	protoCertActive       protowire.Number = 3
+	protoCertCert         protowire.Number = 4
+	protoCertKey          protowire.Number = 5
+	protoCertNotBefore    protowire.Number = 6
+	protoCertNotAfter     protowire.Number = 7
+	protoCertNotes        protowire.Number = 8
+	protoCertAttachments  protowire.Number = 9
+	protoCertActivateAt   protowire.Number = 10
+	protoCertDeactivateAt protowire.Number = 11
+
+	protoAttachmentName    protowire.Number = 1
+	protoAttachmentType    protowire.Number = 2
+	protoAttachmentSize    protowire.Number = 3
+	protoAttachmentCreated protowire.Number = 4
+
+	protoCertListCerts protowire.Number = 1
+
+	protoTimestampSeconds protowire.Number = 1
+	protoTimestampNanos   protowire.Number = 2
+)
+
+// Encode a result as a certstore.Result protobuf message.
+// Returns ErrNotAcceptable if the result is not one of the core resources.
+func MarshalResultProto(res *HTTPResult) ([]byte, error) {
+	var b []byte
+	b = protoAppendBool(b, protoResultSuccess, res.Success)
+	b = protoAppendString(b, protoResultError, res.Error)
+	b = protoAppendString(b, protoResultCode, res.Code)
+	for _, fieldErr := range res.Errors {
+		b = protoAppendMessage(b, protoResultErrors, protoMarshalFieldError(fieldErr))
+	}
+
+	switch result := res.Result.(type) {
+	case nil:
+	case *User:
+		b = protoAppendMessage(b, protoResultUser, protoMarshalUser(result))
+	case *CertificateData:
+		b = protoAppendMessage(b, protoResultCert, protoMarshalCert(result))
+	case []*CertificateData:
+		var m []byte
+		for _, certData := range result {
+			m = protoAppendMessage(m, protoCertListCerts, protoMarshalCert(certData))
+		}
+		// Always present, even when empty, so an empty list can be told apart from no result
+		b = protoAppendMessage(b, protoResultCerts, m)
+	default:
+		return nil, ErrNotAcceptable
+	}
+
+	b = protoAppendString(b, protoResultNext, res.Next)
+	b = protoAppendString(b, protoResultPrev, res.Prev)
+	for _, warning := range res.Warnings {
+		b = protoAppendMessage(b, protoResultWarnings, protoMarshalFieldError(warning))
+	}
+	return b, nil
+}
+
+func protoMarshalFieldError(fieldErr *FieldErrorResult) []byte {
+	var b []byte
+	b = protoAppendString(b, protoFieldErrorField, fieldErr.Field)
+	b = protoAppendString(b, protoFieldErrorCode, fieldErr.Code)
+	b = protoAppendString(b, protoFieldErrorMessage, fieldErr.Message)
+	return b
+}
+
+func protoMarshalUser(user *User) []byte {
+	var b []byte
+	b = protoAppendString(b, protoUserId, user.Id)
+	b = protoAppendString(b, protoUserName, user.Name)
+	b = protoAppendString(b, protoUserEmail, user.Email)
+	for _, certData := range user.Certs {
+		b = protoAppendMessage(b, protoUserCerts, protoMarshalCert(certData))
+	}
+	return b
+}
+
+func protoMarshalCert(certData *CertificateData) []byte {
+	var b []byte
+	b = protoAppendString(b, protoCertId, certData.Id)
+	b = protoAppendString(b, protoCertUser, certData.UserId)
+	b = protoAppendBool(b, protoCertActive, certData.Active)
+	b = protoAppendString(b, protoCertCert, string(certData.Cert))
+	b = protoAppendString(b, protoCertKey, string(certData.Key))
+	b = protoAppendTimestamp(b, protoCertNotBefore, certData.NotBefore)
+	b = protoAppendTimestamp(b, protoCertNotAfter, certData.NotAfter)
+	b = protoAppendString(b, protoCertNotes, certData.Notes)
+	b = protoAppendTimestamp(b, protoCertActivateAt, certData.ActivateAt)
+	b = protoAppendTimestamp(b, protoCertDeactivateAt, certData.DeactivateAt)
+	for _, attachment := range certData.Attachments {
+		b = protoAppendMessage(b, protoCertAttachments, protoMarshalAttachment(attachment))
+	}
+	return b
+}
+
+// Proto3 does not encode fields holding their zero value, so neither do these helpers
+
+func protoMarshalAttachment(attachment *Attachment) []byte {
+	var b []byte
+	b = protoAppendString(b, protoAttachmentName, attachment.Name)
+	b = protoAppendString(b, protoAttachmentType, attachment.Type)
+	if attachment.Size != 0 {
+		b = protowire.AppendTag(b, protoAttachmentSize, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(attachment.Size))
+	}
+	b = protoAppendTimestamp(b, protoAttachmentCreated, attachment.Created)
+	return b
+}
+
+func protoAppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func protoAppendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func protoAppendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// Append a google.protobuf.Timestamp
+func protoAppendTimestamp(b []byte, num protowire.Number, t UTCTime) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	if seconds := t.Unix(); seconds != 0 {
+		m = protowire.AppendTag(m, protoTimestampSeconds, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(seconds))
+	}
+	if nanos := t.Nanosecond(); nanos != 0 {
+		m = protowire.AppendTag(m, protoTimestampNanos, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(nanos))
+	}
+	return protoAppendMessage(b, num, m)
+}
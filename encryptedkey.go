@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// The most PBKDF2 iterations an uploaded key may ask for. Tools use thousands to hundreds of thousands.
+const maxPBKDF2Iterations = 1 << 22
+
+var (
+	ErrKeyPassphraseRequired    = NewError("key-passphrase-required", http.StatusBadRequest, "The private key is encrypted. Give its passphrase in the passphrase field.")
+	ErrKeyPassphrase            = NewError("key-passphrase", http.StatusBadRequest, "The private key's passphrase is incorrect.")
+	ErrUnsupportedKeyEncryption = NewError("unsupported-key-encryption", http.StatusBadRequest, "The private key's encryption isn't supported. Use PKCS#8 with PBES2 (PBKDF2 with AES or 3DES), as \"openssl pkcs8 -topk8\" does, or legacy PEM encryption.")
+	WarnUnusedPassphrase        = NewError("unused-passphrase", 0, "A passphrase was given, but nothing was encrypted. It was ignored.")
+)
+
+// A private key can be uploaded encrypted: as a PKCS#8 "ENCRYPTED PRIVATE KEY", or as a legacy PEM block encrypted
+// with a DEK-Info header, as "openssl genrsa -aes256" writes. The passphrase is given in the "passphrase" field (the
+// same as for PKCS#12 bundles, see pkcs12.go). It is only used to decrypt the key on upload, and is never stored:
+// the key is stored like any other, in the KeyFormat option's format. Keys in bundles can be encrypted too.
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// The PEM type of a PKCS#8 encrypted private key
+const encryptedKeyPEMType = "ENCRYPTED PRIVATE KEY"
+
+// PKCS#8 EncryptedPrivateKeyInfo (RFC 5958)
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// PBES2 and PBKDF2 parameters (RFC 8018)
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Is a PEM block an encrypted private key?
+func isEncryptedKeyBlock(block *pem.Block) bool {
+	return block.Type == encryptedKeyPEMType || (isKeyPEMType(block.Type) && x509.IsEncryptedPEMBlock(block))
+}
+
+// Decrypt the encrypted private keys in a field, which may also hold other blocks, such as a bundle's. Each is
+// replaced by the key, unencrypted, as PKCS#8. found is whether there were any.
+func DecryptKeyBlocks(s, passphrase string) (decrypted string, found bool, err error) {
+	var out strings.Builder
+	last := 0
+	for _, b := range findPEMBlocks(s) {
+		if !isKeyPEMType(b.Type) {
+			continue
+		}
+		text := strings.Replace(s[b.start:b.end], "\r\n", "\n", -1)
+		block, _ := pem.Decode([]byte(text + "\n"))
+		if block == nil && !strings.Contains(text, "\n") {
+			// JSON compatible PEM
+			normalized, err := PEMBlockNormalize(text)
+			if err == nil {
+				block, _ = pem.Decode(normalized)
+			}
+		}
+		if block == nil || !isEncryptedKeyBlock(block) {
+			continue
+		}
+		if passphrase == "" {
+			return "", true, ErrKeyPassphraseRequired
+		}
+		der, err := decryptKeyBlock(block, []byte(passphrase))
+		if err != nil {
+			return "", true, err
+		}
+		out.WriteString(s[last:b.start])
+		out.WriteString(strings.TrimSuffix(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), "\n"))
+		last, found = b.end, true
+	}
+	if !found {
+		return s, false, nil
+	}
+	out.WriteString(s[last:])
+	return out.String(), true, nil
+}
+
+// Decrypt an encrypted private key block, and get the key as PKCS#8 DER
+func decryptKeyBlock(block *pem.Block, passphrase []byte) ([]byte, error) {
+	var der []byte
+	var err error
+	if block.Type == encryptedKeyPEMType {
+		der, err = decryptPKCS8(block.Bytes, passphrase)
+	} else {
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if err == x509.IncorrectPasswordError {
+			return nil, ErrKeyPassphrase
+		}
+		if err != nil {
+			return nil, ErrUnsupportedKeyEncryption
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A wrong passphrase usually leaves bad padding, but not always, so a key that can't be parsed is put down to it too
+	var key interface{}
+	if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		key = k
+	} else if k, err := x509.ParseECPrivateKey(der); err == nil {
+		key = k
+	} else {
+		return nil, ErrKeyPassphrase
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// Decrypt a PKCS#8 EncryptedPrivateKeyInfo encrypted with PBES2
+func decryptPKCS8(data, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(data, &info); err != nil || len(rest) != 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, ErrUnsupportedKeyEncryption
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, ErrUnsupportedKeyEncryption
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxPBKDF2Iterations {
+		return nil, ErrUnsupportedKeyEncryption
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, ErrUnsupportedKeyEncryption
+	}
+
+	var keySize int
+	var newCipher func([]byte) (cipher.Block, error)
+	scheme := params.EncryptionScheme.Algorithm
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keySize, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keySize, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keySize, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keySize, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, ErrUnsupportedKeyEncryption
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keySize {
+		return nil, ErrInvalidPrivateKey
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	block, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keySize, prf))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	der := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(der, info.EncryptedData)
+
+	// Remove the PKCS#7 padding
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrKeyPassphrase
+	}
+	for _, b := range der[len(der)-padding:] {
+		if int(b) != padding {
+			return nil, ErrKeyPassphrase
+		}
+	}
+	return der[:len(der)-padding], nil
+}
@@ -0,0 +1,41 @@
+package main
+
+// Error is a structured API error. The Code is stable and safe for clients to program against,
+// while the Message is human readable and may be localized (see i18n.go).
+type Error struct {
+	Message    string // Human readable error message. May contain a hint about how to fix.
+	Code       string // A standard error code so clients don't need to program against strings.
+	Err        error  // The original low-level error that caused this error to happen. Can be nil.
+	StatusCode int    // An HTTP Status Code for this error. 0 means 500 Internal Server Error.
+}
+
+// Create a new structured error
+func NewError(code string, statusCode int, message string) *Error {
+	return &Error{
+		Message:    message,
+		Code:       code,
+		StatusCode: statusCode,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap a low-level error, keeping the code, message and status code of this error
+func (e *Error) Wrap(err error) *Error {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// Is reports whether target is the same structured error, ignoring any wrapped low-level error.
+// This lets errors.Is(err, ErrNotFound) match errors created with Wrap.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
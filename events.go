@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Event types published when certificates or users change
+const (
+	EventCertCreated     = "cert.created"
+	EventCertUpdated     = "cert.updated"
+	EventCertDeleted     = "cert.deleted"
+	EventCertTransferred = "cert.transferred"
+	EventCertDeferred    = "cert.deferred" // A scheduled change is waiting for a change freeze to end (see freeze.go)
+	EventUserCreated     = "user.created"
+	EventUserUpdated     = "user.updated"
+	EventUserDeleted     = "user.deleted"
+	EventUserMerged      = "user.merged"
+	EventGrantCreated    = "grant.created"
+	EventGrantDeleted    = "grant.deleted"
+)
+
+// An Event describes a change to a certificate or user. Events never carry certificate or key material,
+// subscribers that need it should read the certificate.
+type Event struct {
+	Id       int64   `json:"id,omitempty"` // Position in the event log, for events read back from it
+	Type     string  `json:"type"`
+	Time     UTCTime `json:"time"`
+	UserId   string  `json:"user"`
+	TargetId string  `json:"target,omitempty"` // The other user involved in a transfer, merge or grant
+	CertId   string  `json:"cert,omitempty"`
+}
+
+// An EventBus delivers events to subscribers within this process
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*EventSubscription]struct{}
+	Log  func(*Event) error // Records each event durably before it is delivered, if set (see replication.go)
+}
+
+// An EventSubscription receives events on C until it is closed.
+// Slow subscribers do not hold up publishers: events that do not fit in C are dropped, and counted in Dropped.
+type EventSubscription struct {
+	C       chan *Event
+	UserId  string // Only events involving this user are delivered. Empty means all events.
+	Dropped int64
+	bus     *EventBus
+}
+
+// Events is the event bus for this process
+var Events = NewEventBus()
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*EventSubscription]struct{})}
+}
+
+// Subscribe to events involving a user (or all events if userid is empty), buffering up to buffer events
+func (b *EventBus) Subscribe(userid string, buffer int) *EventSubscription {
+	sub := &EventSubscription{
+		C:      make(chan *Event, buffer),
+		UserId: userid,
+		bus:    b,
+	}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Stop receiving events. C is closed.
+func (sub *EventSubscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	if _, ok := sub.bus.subs[sub]; ok {
+		delete(sub.bus.subs, sub)
+		close(sub.C)
+	}
+}
+
+// Publish an event to every interested subscriber. The time is filled in if it is not set.
+func (b *EventBus) Publish(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = NewUTCTime(Now())
+	}
+	if b.Log != nil {
+		if err := b.Log(e); err != nil {
+			log.Println("Unable to log event:", err)
+		}
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.UserId != "" && sub.UserId != e.UserId && sub.UserId != e.TargetId {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			atomic.AddInt64(&sub.Dropped, 1)
+		}
+	}
+}
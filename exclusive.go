@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidKeepOthers = NewError("invalid-keep-others", http.StatusBadRequest, "Invalid keep-others parameter. Use keep-others=true or keep-others=false.")
+
+	WarnDeactivatedOthers = NewError("deactivated-others", 0, "Other certificates for the same names were deactivated, so that only this one is active.")
+)
+
+// With the ExclusiveActive option, a user has at most one active certificate for each name, so there's never a
+// question of which certificate is live. Storing an active certificate, or activating one, deactivates the user's
+// other active certificates that cover any of the same names, unless the request has ?keep-others=true.
+// Users created with several certificates, and certificates transferred between users, are left as they are.
+
+// Check if the request asks to keep other certificates for the same names active (?keep-others=true)
+func IsKeepOthers(r *http.Request) (bool, error) {
+	keepOthers := r.URL.Query().Get("keep-others")
+	if keepOthers == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(keepOthers)
+	if err != nil {
+		return false, ErrInvalidKeepOthers
+	}
+	return parsed, nil
+}
+
+// The names a certificate is for: its DNS names and IP addresses or, if it has neither, its common name
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(cert.Subject.CommonName))
+	}
+	return names
+}
+
+// Does a name cover another? A wildcard covers names one label deeper, as in RFC 6125.
+func nameCovers(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	i := strings.IndexByte(name, '.')
+	return i > 0 && name[i:] == pattern[1:]
+}
+
+// Do two certificates cover any of the same names?
+func namesOverlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if nameCovers(x, y) || nameCovers(y, x) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrCertExpired          = NewError("certificate-expired", http.StatusBadRequest, "The certificate has already expired. Upload a certificate that is still valid, or use reject-expired=false to store it anyway.")
+	ErrInvalidRejectExpired = NewError("invalid-reject-expired", http.StatusBadRequest, "Invalid reject-expired parameter. Use reject-expired=true or reject-expired=false.")
+)
+
+// Expired certificates are stored like any other by default, and marked active if they are uploaded as active, since
+// keeping an old certificate on record can be the point. With the RejectExpired option, a certificate whose NotAfter
+// has passed (allowing for the ClockSkew option) is refused instead, when it is stored on its own or with a new user.
+// A request can override the option either way with ?reject-expired=true or ?reject-expired=false.
+
+// Check if the request asks for expired certificates to be rejected (?reject-expired=true) or stored
+// (?reject-expired=false), or else if the RejectExpired option says to reject them
+func IsRejectExpired(r *http.Request, config *RuntimeConfig) (bool, error) {
+	rejectExpired := r.URL.Query().Get("reject-expired")
+	if rejectExpired == "" {
+		return config.RejectExpired, nil
+	}
+	parsed, err := strconv.ParseBool(rejectExpired)
+	if err != nil {
+		return false, ErrInvalidRejectExpired
+	}
+	return parsed, nil
+}
+
+// Has a certificate expired, allowing for clock skew (see IsValidAt)?
+func isExpired(notAfter, now time.Time) bool {
+	return now.Add(-time.Duration(Config().ClockSkew)).After(notAfter)
+}
+
+// Check that a new certificate hasn't expired
+func (cert *Certificate) CheckNotExpired(now time.Time) error {
+	if isExpired(cert.Cert.NotAfter, now) {
+		return &FieldError{"cert", ErrCertExpired}
+	}
+	return nil
+}
+
+// Check that none of the certificates uploaded with a new user have expired. Each expired certificate is reported,
+// with the field "certs[i]".
+func CheckNewUserNotExpired(certs []*CertificateData, now time.Time) error {
+	var errs ValidationErrors
+	for i, certData := range certs {
+		if isExpired(certData.NotAfter.Time, now) {
+			errs.Add("certs["+strconv.Itoa(i)+"]", ErrCertExpired)
+		}
+	}
+	return errs.Err()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most plans kept. Older ones are dropped.
+const maxCapturedPlans = 50
+
+// How often a slow statement's plan is captured again, so a statement that is always slow doesn't flood the plans
+const explainCaptureInterval = 10 * time.Minute
+
+// How long EXPLAIN ANALYZE may run a query for
+const explainTimeout = 30 * time.Second
+
+var (
+	ErrQueryDebugOff       = NewError("query-debug-off", http.StatusNotFound, "Query debugging is not enabled on this server.")
+	ErrUnknownQueryPath    = NewError("unknown-query-path", http.StatusNotFound, "Unknown query path. See GET /admin/db/explain for the query paths that can be explained.")
+	ErrExplainNoData       = NewError("explain-no-data", http.StatusConflict, "There is no data to choose the query's parameters from. Give them in the request.")
+	ErrInvalidExplainParam = NewError("invalid-explain-param", http.StatusBadRequest, "Unknown parameter for this query path.")
+)
+
+// In debug mode (the QueryDebug option), an administrator can see how Postgres runs the main query paths against
+// this deployment's data, to check the indexes are used under its distribution:
+//
+// - POST /admin/db/explain/{query} runs EXPLAIN ANALYZE on a query path, in a read-only transaction that is rolled
+//   back, and gives the plan with the indexes it used, the tables it read in full, and advice when an index the path
+//   is meant to use wasn't. Parameters not given are chosen from the data, for the worst case: the user with the most
+//   certificates, or the most common name.
+// - Statements slower than the SlowQueryThreshold option (see querystats.go) have their plans captured
+//   automatically, with EXPLAIN rather than EXPLAIN ANALYZE, so they aren't run again. Each statement is captured at
+//   most every explainCaptureInterval.
+//
+// The latest plans are kept in memory, at /admin/db/plans. EXPLAIN ANALYZE loads the database as the query itself
+// does, so debug mode needs the QueryDebug option, which needs a restart, like fault injection (see faults.go).
+
+// A query path that can be explained
+type QueryPath struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	SQL         string   `json:"sql"`
+	Params      []string `json:"params"`  // The parameters that can be given. Those not given are chosen from the data.
+	Indexes     []string `json:"indexes"` // The indexes the path is meant to use
+	args        func(params map[string]string, now time.Time) ([]interface{}, error)
+}
+
+// The query paths that can be explained, by name
+var queryPaths = []*QueryPath{
+	{
+		Name:        "list-certs",
+		Description: "The first page of a user's certificates (GET /user/{user-id}/cert)",
+		SQL:         SQLListCertsAfter,
+		Params:      []string{"userId"},
+		Indexes:     []string{"certstore_cert_userid_active_idx"},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			userid, err := explainParam(params, "userId", DatabaseBusiestUser)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{userid, "", nil, nil, now, now, OptDefaultPageSize}, nil
+		},
+	},
+	{
+		Name:        "name-conflicts",
+		Description: "Other users' active certificates for a name, exactly or by wildcard (see conflicts.go)",
+		SQL:         SQLListNameConflicts,
+		Params:      []string{"name"},
+		Indexes:     []string{"certstore_cert_name_name_idx"},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			name, err := explainParam(params, "name", DatabaseCommonestName)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{0, pq.Array([]string{name}), pq.Array([]string{"*." + name})}, nil
+		},
+	},
+	{
+		Name:        "status-expiry",
+		Description: "Active certificates by expiry, for the public status (GET /status). Every active certificate is counted, so it reads them all.",
+		SQL:         SQLStatusCounts,
+		Indexes:     []string{},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			return []interface{}{now, now.AddDate(0, 0, 7), now.AddDate(0, 0, 30)}, nil
+		},
+	},
+	{
+		Name:        "expired-minted",
+		Description: "Expired minted certificates, to be deleted (see mint.go)",
+		SQL:         SQLListExpiredMinted,
+		Indexes:     []string{"certstore_minted_notafter_idx"},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			return []interface{}{now, 100}, nil
+		},
+	},
+	{
+		Name:        "revocation-due",
+		Description: "Active certificates due to have their revocation status checked again (see revocation.go)",
+		SQL:         SQLListRevocationDue,
+		Indexes:     []string{"certstore_cert_content_revocationchecked_idx"},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			return []interface{}{now.Add(-time.Duration(Config().RevocationInterval)), revocationBatchSize}, nil
+		},
+	},
+	{
+		Name:        "user-audit",
+		Description: "A user's audit log (GET /user/{user-id}/audit)",
+		SQL:         SQLListUserAudit,
+		Params:      []string{"userId"},
+		Indexes:     []string{"certstore_audit_userid_idx", "certstore_audit_targetid_idx"},
+		args: func(params map[string]string, now time.Time) ([]interface{}, error) {
+			userid, err := explainParam(params, "userId", DatabaseBusiestUser)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{userid, OptDefaultPageSize}, nil
+		},
+	},
+}
+
+// Get a parameter, or choose it from the data if it wasn't given
+func explainParam(params map[string]string, name string, choose func() (string, error)) (string, error) {
+	if value := params[name]; value != "" {
+		return value, nil
+	}
+	value, err := choose()
+	if err == ErrNotFound {
+		return "", ErrExplainNoData
+	}
+	return value, err
+}
+
+func findQueryPath(name string) *QueryPath {
+	for _, path := range queryPaths {
+		if path.Name == name {
+			return path
+		}
+	}
+	return nil
+}
+
+// A query plan, from EXPLAIN on request or captured for a slow statement
+type QueryPlan struct {
+	Query    string          `json:"query"` // The query path, or the statement's id (see querystats.go) if it was slow
+	SQL      string          `json:"sql"`
+	Analyzed bool            `json:"analyzed"` // Was the query run (EXPLAIN ANALYZE), or only planned?
+	Captured UTCTime         `json:"captured"`
+	Duration Duration        `json:"duration"` // How long the query took to run. Zero if it wasn't.
+	Indexes  []string        `json:"indexes"`  // The indexes used
+	SeqScans []string        `json:"seqScans"` // The tables read in full
+	Advice   []string        `json:"advice"`
+	Plan     json.RawMessage `json:"plan"` // As EXPLAIN (FORMAT JSON) gives it
+}
+
+// A node of a plan from EXPLAIN (FORMAT JSON)
+type planNode struct {
+	NodeType     string      `json:"Node Type"`
+	RelationName string      `json:"Relation Name"`
+	IndexName    string      `json:"Index Name"`
+	Plans        []*planNode `json:"Plans"`
+}
+
+// Fill in the indexes a plan uses and the tables it reads in full, with advice for the indexes expected but not used
+func (plan *QueryPlan) summarize(expected []string) error {
+	var explained []struct {
+		Plan          *planNode `json:"Plan"`
+		ExecutionTime float64   `json:"Execution Time"` // In milliseconds, if analyzed
+	}
+	err := json.Unmarshal(plan.Plan, &explained)
+	if err != nil {
+		return err
+	}
+	indexes, seqScans := make(map[string]bool), make(map[string]bool)
+	var walk func(node *planNode)
+	walk = func(node *planNode) {
+		if node == nil {
+			return
+		}
+		if node.IndexName != "" {
+			indexes[node.IndexName] = true
+		}
+		if node.NodeType == "Seq Scan" && node.RelationName != "" {
+			seqScans[node.RelationName] = true
+		}
+		for _, child := range node.Plans {
+			walk(child)
+		}
+	}
+	for _, e := range explained {
+		walk(e.Plan)
+		plan.Duration += Duration(time.Duration(e.ExecutionTime * float64(time.Millisecond)))
+	}
+
+	plan.Indexes, plan.SeqScans, plan.Advice = sortedKeys(indexes), sortedKeys(seqScans), []string{}
+	for _, index := range expected {
+		if !indexes[index] {
+			plan.Advice = append(plan.Advice, "The index "+index+" wasn't used. Postgres reads small tables in full rather than use an index; if the table isn't small, run ANALYZE on it, and check the index exists.")
+		}
+	}
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Explain a query path with EXPLAIN ANALYZE
+func ExplainQueryPath(path *QueryPath, params map[string]string, now time.Time) (*QueryPlan, error) {
+	for name := range params {
+		known := false
+		for _, p := range path.Params {
+			known = known || p == name
+		}
+		if !known {
+			return nil, &FieldError{name, ErrInvalidExplainParam}
+		}
+	}
+	args, err := path.args(params, now)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := DatabaseExplain(path.SQL, args, true)
+	if err != nil {
+		return nil, err
+	}
+	plan := &QueryPlan{Query: path.Name, SQL: path.SQL, Analyzed: true, Captured: NewUTCTime(now), Plan: raw}
+	err = plan.summarize(path.Indexes)
+	if err != nil {
+		return nil, err
+	}
+	QueryPlans.Add(plan)
+	return plan, nil
+}
+
+// PlanCapture keeps the latest query plans
+type PlanCapture struct {
+	mu       sync.Mutex
+	plans    []*QueryPlan
+	captured map[string]time.Time // When each slow statement's plan was last captured, by its SQL
+}
+
+// The latest query plans
+var QueryPlans = &PlanCapture{captured: make(map[string]time.Time)}
+
+// Keep a plan, dropping the oldest if there are too many
+func (c *PlanCapture) Add(plan *QueryPlan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plans = append(c.plans, plan)
+	if len(c.plans) > maxCapturedPlans {
+		c.plans = c.plans[len(c.plans)-maxCapturedPlans:]
+	}
+}
+
+// List the plans, newest first
+func (c *PlanCapture) List() []*QueryPlan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	plans := make([]*QueryPlan, len(c.plans))
+	for i, plan := range c.plans {
+		plans[len(plans)-1-i] = plan
+	}
+	return plans
+}
+
+// Should a slow statement's plan be captured now? It is noted as captured if so.
+func (c *PlanCapture) due(query string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.captured[query]; ok && now.Sub(last) < explainCaptureInterval {
+		return false
+	}
+	for q, last := range c.captured {
+		if now.Sub(last) >= explainCaptureInterval {
+			delete(c.captured, q)
+		}
+	}
+	c.captured[query] = now
+	return true
+}
+
+// Capture the plan of a slow statement, in debug mode. Only queries are explained, and they aren't run again.
+func captureSlowPlan(query string, args []driver.NamedValue) {
+	if !OptQueryDebug || db == nil || !strings.HasPrefix(queryLabel(query), "select") {
+		return
+	}
+	id, now := queryId(query), Now()
+	if !QueryPlans.due(query, now) {
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if b, ok := arg.Value.([]byte); ok {
+			arg.Value = append([]byte(nil), b...)
+		}
+		values[i] = arg.Value
+	}
+	go func() {
+		raw, err := DatabaseExplain(query, values, false)
+		if err != nil {
+			log.Println("Unable to capture plan of slow query", id+":", err)
+			return
+		}
+		plan := &QueryPlan{Query: id, SQL: query, Captured: NewUTCTime(now), Plan: raw}
+		err = plan.summarize(nil)
+		if err != nil {
+			log.Println("Unable to capture plan of slow query", id+":", err)
+			return
+		}
+		QueryPlans.Add(plan)
+	}()
+}
+
+// List the query paths that can be explained
+func ListQueryPathsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !OptQueryDebug {
+		HandleError(w, r, ErrQueryDebugOff, 0)
+		return
+	}
+	SendResult(w, r, queryPaths)
+}
+
+// Explain a query path with EXPLAIN ANALYZE. The body gives its parameters, if any.
+func ExplainQueryPathHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !OptQueryDebug {
+		HandleError(w, r, ErrQueryDebugOff, 0)
+		return
+	}
+	path := findQueryPath(mux.Vars(r)["query"])
+	if path == nil {
+		HandleError(w, r, ErrUnknownQueryPath, 0)
+		return
+	}
+
+	// Load the parameters from the body, if there is one
+	params := make(map[string]string)
+	if r.ContentLength != 0 {
+		d := json.NewDecoder(r.Body)
+		err := d.Decode(&params)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	plan, err := ExplainQueryPath(path, params, Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, plan)
+}
+
+// List the latest query plans, newest first
+func ListQueryPlansHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !OptQueryDebug {
+		HandleError(w, r, ErrQueryDebugOff, 0)
+		return
+	}
+	SendResult(w, r, QueryPlans.List())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The header a certificate export's password is given in. It isn't taken from the query, which ends up in logs.
+const ExportPasswordHeader = "X-Export-Password"
+
+var (
+	ErrInvalidExportLink     = NewError("invalid-export-link", http.StatusNotFound, "This download link is invalid, has expired, or has already been used.")
+	ErrInvalidExportFormat   = NewError("invalid-export-format", http.StatusBadRequest, "Invalid export format. Use pkcs12, pkcs12-legacy for older software that can't read AES encrypted bundles, or jks.")
+	ErrMissingExportPassword = NewError("missing-export-password", http.StatusBadRequest, "Give the password to encrypt the export with in the X-Export-Password header.")
+)
+
+// A KeyExport is a pending export of a private key. The key is not handed over when the export is made: instead the
+// client gets a link (see ExportLink) that can be used once, and only until it expires. Only a hash of the link's
+// id is stored, so the database can't be used to recreate a link.
+type KeyExport struct {
+	Id      string  `json:"-"`    // SHA256 hash (hex-encoded) of the link's id
+	OwnerId string  `json:"-"`    // The user holding the certificate
+	CertId  string  `json:"cert"` // The certificate whose key is exported
+	UserId  string  `json:"user"` // The user the key is exported to: the owner, or a user the certificate is shared with
+	Expires UTCTime `json:"expires"`
+	Used    bool    `json:"-"`
+}
+
+// An ExportLink is a single-use download link for a KeyExport
+type ExportLink struct {
+	URL     string  `json:"url"` // Relative to the server, eg. "/export/<token>"
+	Expires UTCTime `json:"expires"`
+}
+
+var (
+	exportKeyOnce sync.Once
+	exportKey     []byte
+)
+
+// The key export links are signed with. Without OptExportSigningKey a random key is used, so links don't survive
+// a restart and only work on the server that made them.
+func exportSigningKey() []byte {
+	exportKeyOnce.Do(func() {
+		if OptExportSigningKey != "" {
+			exportKey = []byte(OptExportSigningKey)
+			return
+		}
+		exportKey = make([]byte, 32)
+		if _, err := rand.Read(exportKey); err != nil {
+			panic(err)
+		}
+	})
+	return exportKey
+}
+
+// Create a pending export of a certificate's key, and the link to download it
+func NewKeyExport(ownerid, certid, userid string, ttl time.Duration) (*KeyExport, *ExportLink, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	expires := Now().Add(ttl).Truncate(time.Second)
+
+	// The token is "<id>.<expiry>.<signature>"
+	payload := base64.RawURLEncoding.EncodeToString(id) + "." + strconv.FormatInt(expires.Unix(), 10)
+	token := payload + "." + signExportPayload(payload)
+
+	export := &KeyExport{
+		Id:      hashExportId(id),
+		OwnerId: ownerid,
+		CertId:  certid,
+		UserId:  userid,
+		Expires: NewUTCTime(expires),
+	}
+	link := &ExportLink{
+		URL:     "/export/" + token,
+		Expires: export.Expires,
+	}
+	return export, link, nil
+}
+
+// Check an export link's token and get the hashed id of its KeyExport.
+// Forged and expired tokens are rejected here, without needing the database.
+func ParseExportToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidExportLink
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signExportPayload(payload))) {
+		return "", ErrInvalidExportLink
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || Now().Unix() >= expires {
+		return "", ErrInvalidExportLink
+	}
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidExportLink
+	}
+	return hashExportId(id), nil
+}
+
+func signExportPayload(payload string) string {
+	mac := hmac.New(sha256.New, exportSigningKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashExportId(id []byte) string {
+	hash := sha256.Sum256(id)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrInvalidExtra = NewError("invalid-extra", http.StatusInternalServerError, "Invalid extra attributes in the database.")
+)
+
+// Users and certificates have an "extra" JSONB column for optional attributes, such as tags, metadata or flags, so
+// a minor feature can ship without a migration of its own. Fields that are read or filtered on a lot stay in typed
+// columns. Each attribute is declared once with NewExtraAttr, and read and written only through it, with
+// DatabaseReadUserExtra and DatabaseUpdateUserExtra (or the Cert equivalents) to load and save it.
+//
+// The extra attributes carry a version ("v"). When an attribute's stored form has to change, an upgrade is added to
+// extraUpgrades, and rows are upgraded as they are read rather than all at once. Attributes a build doesn't know,
+// such as those written by a newer build during a rolling upgrade, are kept as they are when the rest are written.
+
+// The key of the version in the extra attributes
+const extraVersionKey = "v"
+
+// Upgrades of the extra attributes: extraUpgrades[i] upgrades version i+1 to version i+2. Upgrades are only ever
+// appended.
+var extraUpgrades []func(extra Extra) error
+
+// The names of the attributes declared
+var extraAttrs = map[string]bool{extraVersionKey: true}
+
+// Extra is the optional attributes of a user or certificate, as stored, by name
+type Extra map[string]json.RawMessage
+
+// The version of the extra attributes this build writes
+func ExtraVersion() int {
+	return len(extraUpgrades) + 1
+}
+
+// Get the version the extra attributes were written in. Attributes written before they were versioned are version 1.
+func (e Extra) Version() int {
+	var version int
+	if err := json.Unmarshal(e[extraVersionKey], &version); err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+// Upgrade the extra attributes to the version this build writes. Attributes written by a newer build are left as
+// they are.
+func (e Extra) upgrade() error {
+	for version := e.Version(); version < ExtraVersion(); version++ {
+		err := extraUpgrades[version-1](e)
+		if err != nil {
+			return err
+		}
+		e[extraVersionKey] = json.RawMessage(strconv.Itoa(version + 1))
+	}
+	return nil
+}
+
+// Value implements driver.Valuer for writing to the database.
+func (e Extra) Value() (driver.Value, error) {
+	if len(e) == 0 {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(e)
+}
+
+// Scan implements sql.Scanner for reading from the database. The attributes are upgraded as they are read.
+func (e *Extra) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		data = []byte("{}")
+	default:
+		return ErrInvalidExtra
+	}
+	*e = Extra{}
+	err := json.Unmarshal(data, e)
+	if err != nil {
+		return ErrInvalidExtra
+	}
+	return e.upgrade()
+}
+
+// An ExtraAttr is an optional attribute stored in the extra attributes, by name
+type ExtraAttr struct {
+	name string
+}
+
+// Declare an optional attribute. Attributes are declared as the program starts, each with its own name.
+func NewExtraAttr(name string) ExtraAttr {
+	if extraAttrs[name] {
+		panic("extra attribute declared twice: " + name)
+	}
+	extraAttrs[name] = true
+	return ExtraAttr{name}
+}
+
+// Get the attribute, unmarshalled into dest. It is false if the attribute isn't set.
+func (a ExtraAttr) Get(e Extra, dest interface{}) (bool, error) {
+	data, ok := e[a.name]
+	if !ok {
+		return false, nil
+	}
+	err := json.Unmarshal(data, dest)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Set the attribute, or unset it if value is nil
+func (a ExtraAttr) Set(e *Extra, value interface{}) error {
+	if value == nil {
+		delete(*e, a.name)
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if *e == nil {
+		*e = Extra{extraVersionKey: json.RawMessage(strconv.Itoa(ExtraVersion()))}
+	}
+	(*e)[a.name] = data
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest faults can be injected for at once, so forgotten faults stop on their own
+const maxFaultDuration = 24 * time.Hour
+
+// How long faults are injected for if the request doesn't say
+const defaultFaultDuration = time.Hour
+
+// The most latency a rule can add
+const maxFaultLatency = time.Minute
+
+// The routes faults are managed at, which faults are never injected into
+const faultsRoute = "/admin/faults"
+
+var (
+	ErrFaultInjectionOff = NewError("fault-injection-off", http.StatusNotFound, "Fault injection is not enabled on this server.")
+	ErrInvalidFaultRate  = NewError("invalid-fault-rate", http.StatusBadRequest, "Invalid error rate. It must be between 0 and 1.")
+	ErrInvalidFaultDelay = NewError("invalid-fault-latency", http.StatusBadRequest, "Invalid latency. It must be between 0 and 1m.")
+	ErrInvalidFaultCode  = NewError("invalid-fault-status", http.StatusBadRequest, "Invalid status. Injected errors must be 429 or a 5xx status.")
+	ErrInvalidFaultRoute = NewError("invalid-fault-route", http.StatusBadRequest, "Invalid route. It must be a route template, such as \"/user/{user-id}/cert\", or empty for every route.")
+	ErrInvalidFaultUntil = NewError("invalid-fault-until", http.StatusBadRequest, "Invalid end. Faults can be injected for at most 24 hours from now.")
+
+	// What injected faults fail with
+	ErrFaultInjected = NewError("fault-injected", http.StatusServiceUnavailable, "This request failed because a fault was injected for testing.")
+	ErrFaultDatabase = NewError("database-unavailable", http.StatusInternalServerError, "The database couldn't be reached.")
+)
+
+// Fault injection degrades the server on purpose, so clients, and the agents that drive them, can be tested against
+// slow responses, failing routes and an unreachable database before it happens for real. An administrator sets the
+// faults at /admin/faults:
+//
+// - Rules add latency to requests, and fail a share of them with a status (503 by default). The first rule matching
+//   a request's route template and method applies.
+// - A share of the statements sent to the database can fail as if the database were down. They fail in the database
+//   driver (see querystats.go), so transactions are rolled back, and whatever handles database errors, in requests
+//   and background jobs alike, is exercised as it would be by a real failure. Requests failed by them get a 500 with
+//   the database-unavailable code.
+//
+// Responses a rule touched have a "Certstore-Fault" header saying what it was, so tests can tell injected failures
+// from real ones. Faults are never injected into /admin/faults itself, so they can always be cleared. They stop on
+// their own (after an hour, unless the request says, and after 24 hours at most), are kept in memory on this instance
+// only, and are lost on restart. Fault injection needs the FaultInjection option, or a sandbox, so a production server
+// can't be degraded.
+
+// A rule for the faults injected into matching requests
+type FaultRule struct {
+	Route     string   `json:"route"`     // A route template, such as "/user/{user-id}/cert". Empty for every route.
+	Method    string   `json:"method"`    // Empty for every method
+	Latency   Duration `json:"latency"`   // Added before the request is handled
+	ErrorRate float64  `json:"errorRate"` // The share of requests failed, from 0 to 1
+	Status    int      `json:"status"`    // The status failed requests get. 503 if it is zero.
+}
+
+// The faults being injected
+type FaultInjection struct {
+	Rules             []*FaultRule `json:"rules"`
+	DatabaseErrorRate float64      `json:"databaseErrorRate"` // The share of statements failed as if the database were down
+	Until             UTCTime      `json:"until"`             // When the faults stop. An hour from now if not given.
+}
+
+var (
+	activeFaults   *FaultInjection // Nil if there are none
+	activeFaultsMu sync.RWMutex
+)
+
+// Rolls for whether a request fails, from 0 to 1. Replaced in tests.
+var faultRand = rand.Float64
+
+// Is fault injection allowed on this server?
+func faultInjectionEnabled() bool {
+	return OptFaultInjection || OptSandbox
+}
+
+// Validate faults, filling in the defaults
+func validateFaults(faults *FaultInjection, now time.Time) error {
+	var errs ValidationErrors
+	if faults.Rules == nil {
+		faults.Rules = []*FaultRule{}
+	}
+	for i, rule := range faults.Rules {
+		field := "rules[" + strconv.Itoa(i) + "]"
+		if rule.Route != "" && !strings.HasPrefix(rule.Route, "/") {
+			errs.Add(field+".route", ErrInvalidFaultRoute)
+		}
+		rule.Method = strings.ToUpper(rule.Method)
+		if rule.Latency < 0 || time.Duration(rule.Latency) > maxFaultLatency {
+			errs.Add(field+".latency", ErrInvalidFaultDelay)
+		}
+		if rule.ErrorRate < 0 || rule.ErrorRate > 1 {
+			errs.Add(field+".errorRate", ErrInvalidFaultRate)
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusServiceUnavailable
+		}
+		if rule.Status != http.StatusTooManyRequests && (rule.Status < 500 || rule.Status > 599) {
+			errs.Add(field+".status", ErrInvalidFaultCode)
+		}
+	}
+	if faults.DatabaseErrorRate < 0 || faults.DatabaseErrorRate > 1 {
+		errs.Add("databaseErrorRate", ErrInvalidFaultRate)
+	}
+	if faults.Until.IsZero() {
+		faults.Until = NewUTCTime(now.Add(defaultFaultDuration))
+	}
+	if !faults.Until.After(now) || faults.Until.After(now.Add(maxFaultDuration)) {
+		errs.Add("until", ErrInvalidFaultUntil)
+	}
+	return errs.Err()
+}
+
+// The faults being injected now, or nil if there are none
+func currentFaults(now time.Time) *FaultInjection {
+	activeFaultsMu.RLock()
+	defer activeFaultsMu.RUnlock()
+	if activeFaults == nil || !now.Before(activeFaults.Until.Time) {
+		return nil
+	}
+	return activeFaults
+}
+
+// Set (or clear, if faults is nil) the faults being injected
+func setFaults(faults *FaultInjection) {
+	activeFaultsMu.Lock()
+	defer activeFaultsMu.Unlock()
+	activeFaults = faults
+}
+
+// The first rule matching a request, or nil
+func (faults *FaultInjection) match(route, method string) *FaultRule {
+	for _, rule := range faults.Rules {
+		if (rule.Route == "" || rule.Route == route) && (rule.Method == "" || rule.Method == method) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Fail a statement sent to the database, if database faults are being injected and the roll says so
+func injectDatabaseFault() error {
+	faults := currentFaults(Now())
+	if faults != nil && faults.DatabaseErrorRate > 0 && faultRand() < faults.DatabaseErrorRate {
+		return ErrFaultDatabase
+	}
+	return nil
+}
+
+// Middleware that injects the faults being injected into requests. It is used on the router, so the route template
+// is known.
+func FaultInjectionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		faults := currentFaults(Now())
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if faults == nil || route == faultsRoute {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := faults.match(route, r.Method)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if rule.Latency > 0 {
+			w.Header().Add("Certstore-Fault", "latency")
+			select {
+			case <-time.After(time.Duration(rule.Latency)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rule.ErrorRate > 0 && faultRand() < rule.ErrorRate {
+			w.Header().Add("Certstore-Fault", "error")
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrFaultInjected, rule.Status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Read the faults being injected. Null if there are none.
+func ReadFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !faultInjectionEnabled() {
+		HandleError(w, r, ErrFaultInjectionOff, 0)
+		return
+	}
+	SendResult(w, r, currentFaults(Now()))
+}
+
+// Replace the faults being injected
+func UpdateFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !faultInjectionEnabled() {
+		HandleError(w, r, ErrFaultInjectionOff, 0)
+		return
+	}
+
+	// Load the faults from the body
+	faults := new(FaultInjection)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(faults)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	err = validateFaults(faults, Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	setFaults(faults)
+	log.Println("Injecting faults until", faults.Until.Format(time.RFC3339), "by", RequestPrincipal(r))
+
+	// Send the result
+	SendResult(w, r, faults)
+}
+
+// Stop injecting faults
+func DeleteFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !faultInjectionEnabled() {
+		HandleError(w, r, ErrFaultInjectionOff, 0)
+		return
+	}
+	setFaults(nil)
+	log.Println("Stopped injecting faults, by", RequestPrincipal(r))
+
+	// Send the result
+	SendResult(w, r, nil)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The weak key type a fixture can have, besides the template key types (see templates.go)
+const FixtureKeyRSA1024 = "rsa-1024"
+
+// The most intermediates a fixture's chain can have
+const maxFixtureChain = 50
+
+// The name of a fixture that doesn't ask for any
+const defaultFixtureName = "fixture.example.com"
+
+var (
+	ErrInvalidFixture        = NewError("invalid-fixture", http.StatusBadRequest, "Invalid fixture. A certificate can't be both expired and not yet valid.")
+	ErrInvalidFixtureKeyType = NewError("invalid-fixture-key-type", http.StatusBadRequest, "Invalid key type. Use rsa-1024, rsa-2048, rsa-3072, rsa-4096, ec-p256 or ec-p384.")
+	ErrInvalidFixtureChain   = NewError("invalid-fixture-chain", http.StatusBadRequest, "Invalid chain length. A fixture can have at most 50 intermediates.")
+	ErrInvalidFixtureName    = NewError("invalid-fixture-name", http.StatusBadRequest, "Invalid name. Use DNS names and IP addresses.")
+)
+
+// A sandbox can make fixtures: throwaway certificates and keys with the properties an integrator asks for, to test
+// how their client handles what the store says about them, such as an expired certificate, a weak key, a key that
+// isn't the certificate's, or a very long chain. Nothing is stored. Each fixture is issued by its own throwaway root,
+// which is returned but not in the chain, so its chain isn't trusted unless the root is added to the sandbox's test CA
+// (OptSandboxCA). Fixtures can only be made in a sandbox, since the weak keys and signatures are never wanted
+// elsewhere.
+
+// The properties of a fixture. The zero value is a valid certificate for fixture.example.com, with an EC P-256 key.
+type FixtureRequest struct {
+	Names         []string `json:"names"`         // DNS names and IP addresses. The first is the common name.
+	KeyType       string   `json:"keyType"`       // A template key type, or rsa-1024. Shorter keys than the minimums are allowed.
+	Expired       bool     `json:"expired"`       // Expired a day ago
+	NotYetValid   bool     `json:"notYetValid"`   // Valid from tomorrow
+	WeakSignature bool     `json:"weakSignature"` // Signed with SHA-1
+	MismatchedKey bool     `json:"mismatchedKey"` // The key returned isn't the certificate's
+	ChainLength   int      `json:"chainLength"`   // The number of intermediates between the certificate and the root
+}
+
+// A fixture, in the form certificates are uploaded in
+type Fixture struct {
+	Cert  string `json:"cert"`
+	Key   string `json:"key"`   // In the KeyFormat option's format
+	Chain string `json:"chain"` // The intermediates, the certificate's issuer first. Empty if there are none.
+	Root  string `json:"root"`  // The throwaway root that issued the chain
+}
+
+// Validate a fixture request, filling in the defaults
+func validateFixtureRequest(req *FixtureRequest) error {
+	var errs ValidationErrors
+	if len(req.Names) == 0 {
+		req.Names = []string{defaultFixtureName}
+	}
+	for i, name := range req.Names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if net.ParseIP(name) == nil && !isDNSName(strings.TrimPrefix(name, "*.")) {
+			errs.Add("names["+strconv.Itoa(i)+"]", ErrInvalidFixtureName)
+		}
+		req.Names[i] = name
+	}
+	if req.KeyType == "" {
+		req.KeyType = TemplateKeyECP256
+	}
+	switch req.KeyType {
+	case FixtureKeyRSA1024, TemplateKeyRSA2048, TemplateKeyRSA3072, TemplateKeyRSA4096, TemplateKeyECP256, TemplateKeyECP384:
+	default:
+		errs.Add("keyType", ErrInvalidFixtureKeyType)
+	}
+	if req.Expired && req.NotYetValid {
+		errs.Add("notYetValid", ErrInvalidFixture)
+	}
+	if req.ChainLength < 0 || req.ChainLength > maxFixtureChain {
+		errs.Add("chainLength", ErrInvalidFixtureChain)
+	}
+	return errs.Err()
+}
+
+// Make a fixture. The root and intermediates have EC P-256 keys, so long chains are quick to make.
+func NewFixture(req *FixtureRequest, config *RuntimeConfig, now time.Time) (*Fixture, error) {
+	err := validateFixtureRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root, then each intermediate, issued by the one before
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := newFixtureCert(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Certstore Fixture Root"},
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, issuerKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{Root: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw}))}
+	var chain []*x509.Certificate
+	for i := 1; i <= req.ChainLength; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		issuer, err = newFixtureCert(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: "Certstore Fixture Intermediate " + strconv.Itoa(i)},
+			NotBefore:             now.Add(-24 * time.Hour),
+			NotAfter:              now.Add(5 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, issuer, key, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*x509.Certificate{issuer}, chain...)
+		issuerKey = key
+	}
+	for _, c := range chain {
+		fixture.Chain += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+	}
+
+	// The certificate itself
+	bits := 256
+	if req.KeyType == TemplateKeyECP384 {
+		bits = 384
+	} else if strings.HasPrefix(req.KeyType, "rsa-") {
+		bits, _ = strconv.Atoi(strings.TrimPrefix(req.KeyType, "rsa-"))
+	}
+	key, err := generateTemplateKey(req.KeyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: req.Names[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(90 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if req.Expired {
+		template.NotBefore, template.NotAfter = now.Add(-91*24*time.Hour), now.Add(-24*time.Hour)
+	}
+	if req.NotYetValid {
+		template.NotBefore, template.NotAfter = now.Add(24*time.Hour), now.Add(91*24*time.Hour)
+	}
+	if req.WeakSignature {
+		template.SignatureAlgorithm = x509.ECDSAWithSHA1
+	}
+	for _, name := range req.Names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	cert, err := newFixtureCert(template, issuer, key, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	fixture.Cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	// A mismatched key is another of the same type, so only the public key gives it away
+	if req.MismatchedKey {
+		key, err = generateTemplateKey(req.KeyType, bits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyPEM, err := EncodePrivateKeyPEM(key, config.KeyFormat)
+	if err != nil {
+		return nil, err
+	}
+	fixture.Key = string(keyPEM)
+	return fixture, nil
+}
+
+// Issue a fixture certificate, self-signed if there is no issuer
+func newFixtureCert(template, issuer *x509.Certificate, key, issuerKey crypto.Signer) (*x509.Certificate, error) {
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	if issuer == nil {
+		issuer = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Make a fixture, in a sandbox. The properties are optional, for a valid certificate.
+func CreateFixtureHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !OptSandbox {
+		HandleError(w, r, ErrNotSandbox, 0)
+		return
+	}
+
+	req := new(FixtureRequest)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(req)
+	if err != nil && err != io.EOF {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	fixture, err := NewFixture(req, Config(), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, fixture)
+}
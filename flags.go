@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Feature flags gate subsystems that are still being rolled out
+const (
+	FlagGraphQL         = "graphql"          // The /graphql endpoint
+	FlagWebSocket       = "websocket"        // The /ws endpoint
+	FlagBinaryEncodings = "binary-encodings" // CBOR and protobuf response encodings
+)
+
+var (
+	ErrUnknownFlag     = NewError("unknown-flag", http.StatusNotFound, "Unknown feature flag.")
+	ErrFeatureDisabled = NewError("feature-disabled", http.StatusNotFound, "This feature is not enabled on this server.")
+)
+
+// A FeatureFlag is a known flag and its default state
+type FeatureFlag struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+// Every known flag. A flag must be listed here before it can be set in the config file or toggled.
+var FeatureFlags = map[string]*FeatureFlag{
+	FlagGraphQL:         {FlagGraphQL, "GraphQL API at /graphql", true},
+	FlagWebSocket:       {FlagWebSocket, "WebSocket API at /ws", true},
+	FlagBinaryEncodings: {FlagBinaryEncodings, "CBOR and protobuf response encodings", true},
+}
+
+// Flags toggled at runtime through the admin API. These take precedence over the config file,
+// and are lost on restart: the config file is where a flag's state is kept for good.
+var (
+	flagOverrides   = make(map[string]bool)
+	flagOverridesMu sync.RWMutex
+)
+
+// The state of a flag, as reported by the admin API
+type FlagState struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Source      string `json:"source"` // "default", "config" or "override"
+}
+
+// Check if a feature is enabled. A runtime override wins over the config file, which wins over the default.
+func FlagEnabled(name string) bool {
+	return flagState(name, Config()).Enabled
+}
+
+func flagState(name string, config *RuntimeConfig) *FlagState {
+	flag, ok := FeatureFlags[name]
+	if !ok {
+		return &FlagState{Name: name}
+	}
+	state := &FlagState{Name: name, Description: flag.Description, Enabled: flag.Default, Source: "default"}
+	if enabled, ok := config.Flags[name]; ok {
+		state.Enabled = enabled
+		state.Source = "config"
+	}
+	flagOverridesMu.RLock()
+	if enabled, ok := flagOverrides[name]; ok {
+		state.Enabled = enabled
+		state.Source = "override"
+	}
+	flagOverridesMu.RUnlock()
+	return state
+}
+
+// Set or clear (enabled == nil) the runtime override for a flag
+func SetFlagOverride(name string, enabled *bool) error {
+	if _, ok := FeatureFlags[name]; !ok {
+		return ErrUnknownFlag
+	}
+	flagOverridesMu.Lock()
+	defer flagOverridesMu.Unlock()
+	if enabled == nil {
+		delete(flagOverrides, name)
+	} else {
+		flagOverrides[name] = *enabled
+	}
+	return nil
+}
+
+// Only serve a handler while a feature is enabled. Otherwise the endpoint does not exist.
+func RequireFlag(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !FlagEnabled(name) {
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrFeatureDisabled, 0)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func ListFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	config := Config()
+	flags := make([]*FlagState, 0, len(FeatureFlags))
+	for name := range FeatureFlags {
+		flags = append(flags, flagState(name, config))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+
+	SendResult(w, r, flags)
+}
+
+func UpdateFlagHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["flag"]
+
+	// Load the new state from the body
+	flagPatch := new(struct {
+		Enabled *bool `json:"enabled"`
+	})
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(flagPatch)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	err = SetFlagOverride(name, flagPatch.Enabled)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, flagState(name, Config()))
+}
+
+func DeleteFlagHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["flag"]
+	err := SetFlagOverride(name, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, flagState(name, Config()))
+}
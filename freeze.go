@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrChangeFreeze         = NewError("change-freeze", http.StatusConflict, "Changes are frozen. Try again once the change freeze is over, or present a freeze-override token in an emergency.")
+	ErrFreezeOverrideReason = NewError("freeze-override-reason", http.StatusBadRequest, "Overriding a change freeze needs a reason. Please give one in the X-Change-Reason header.")
+)
+
+// A change freeze is a period, such as a holiday season or a product launch, when automated and bulk changes wait.
+// During a freeze the scheduler defers scheduled activations and deactivations until the freeze ends, notifying
+// each certificate's user with a cert.deferred event, and bulk operations (transfers and merges) are refused. In an
+// emergency a request presenting a freeze-override token goes ahead, if it gives a reason for the audit log.
+// Changes to single certificates, and dry runs, are not held up. There are no automated renewals yet.
+//
+// Freezes are in the configuration (ChangeFreezes), so they apply to the whole server.
+type ChangeFreeze struct {
+	Name  string  `json:"name"`
+	Start UTCTime `json:"start"`
+	End   UTCTime `json:"end"` // The freeze is over at this time
+}
+
+// The freeze in force at a time, or nil if there is none. Freezes may overlap: the one ending last is returned.
+func ActiveFreeze(config *RuntimeConfig, at time.Time) *ChangeFreeze {
+	var active *ChangeFreeze
+	for _, freeze := range config.ChangeFreezes {
+		if at.Before(freeze.Start.Time) || !at.Before(freeze.End.Time) {
+			continue
+		}
+		if active == nil || freeze.End.After(active.End.Time) {
+			active = freeze
+		}
+	}
+	return active
+}
+
+// The freezes in force at a time or later, in order of start
+func UpcomingFreezes(config *RuntimeConfig, at time.Time) []*ChangeFreeze {
+	freezes := []*ChangeFreeze{}
+	for _, freeze := range config.ChangeFreezes {
+		if freeze.End.After(at) {
+			freezes = append(freezes, freeze)
+		}
+	}
+	sort.SliceStable(freezes, func(i, j int) bool { return freezes[i].Start.Before(freezes[j].Start.Time) })
+	return freezes
+}
+
+// Check that a bulk change can go ahead. During a freeze it can only if the request presents a freeze-override token
+// and gives a reason. Dry runs change nothing, so they always can.
+func CheckChangeFreeze(r *http.Request, reason string, dryRun bool) error {
+	config := Config()
+	freeze := ActiveFreeze(config, Now())
+	if freeze == nil || dryRun {
+		return nil
+	}
+	if !HasScope(r, ScopeFreezeOverride, config) {
+		return ErrChangeFreeze
+	}
+	if reason == "" {
+		return ErrFreezeOverrideReason
+	}
+	log.Printf("Change freeze %q overridden for %s %s", freeze.Name, r.Method, r.URL.Path)
+	return nil
+}
+
+// Publish a cert.deferred event for each scheduled change held up by a freeze, once per freeze. Notified holds the
+// changes already notified.
+func notifyDeferred(freeze *ChangeFreeze, now time.Time, notified map[string]bool) error {
+	due, err := DatabaseListDueCerts(now)
+	if err != nil {
+		return err
+	}
+	deferred := 0
+	for _, c := range due {
+		key := freeze.Start.String() + " " + c.UserId + " " + c.CertId
+		if notified[key] {
+			continue
+		}
+		notified[key] = true
+		deferred++
+		Events.Publish(&Event{Type: EventCertDeferred, UserId: c.UserId, CertId: c.CertId})
+	}
+	if deferred != 0 {
+		log.Printf("%d scheduled changes deferred by change freeze %q", deferred, freeze.Name)
+	}
+	return nil
+}
+
+// Validate the configured change freezes
+func validateChangeFreezes(freezes []*ChangeFreeze, errs *ValidationErrors) {
+	for i, freeze := range freezes {
+		if freeze == nil || freeze.Start.IsZero() || !freeze.End.After(freeze.Start.Time) {
+			errs.Add("changeFreezes["+strconv.Itoa(i)+"]", ErrInvalidConfig)
+		}
+	}
+}
+
+// List the change freezes in force now or later, so changes can be planned around them
+func ListFreezesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, UpcomingFreezes(Config(), Now()))
+}
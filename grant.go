@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	GrantAccessRead   = "read"   // The grantee may read the certificate, but not its private key
+	GrantAccessDeploy = "deploy" // The grantee may read the certificate and its private key
+)
+
+var (
+	ErrInvalidGrantAccess = NewError("invalid-grant-access", http.StatusBadRequest, "Invalid Grant. Access must be either \"read\" or \"deploy\".")
+	ErrInvalidGrantUser   = NewError("invalid-grant-user", http.StatusBadRequest, "Invalid Grant. The user being granted access is malformed or does not exist.")
+	ErrGrantToSelf        = NewError("grant-to-self", http.StatusBadRequest, "Invalid Grant. A certificate may not be shared with its owner.")
+)
+
+// A Grant shares one of a user's certificates with another user, without duplicating the certificate.
+type Grant struct {
+	CertId  string `json:"cert"`
+	OwnerId string `json:"owner"`
+	UserId  string `json:"user"` // The user the certificate is shared with
+	Access  string `json:"access"`
+}
+
+// Validate that the grantee id is numeric, isn't the owner, and that the access level is known
+func (g *Grant) Validate() error {
+	if checkid, err := strconv.Atoi(g.UserId); err != nil || checkid <= 0 {
+		return ErrInvalidGrantUser
+	}
+	if g.UserId == g.OwnerId {
+		return ErrGrantToSelf
+	}
+	if g.Access != GrantAccessRead && g.Access != GrantAccessDeploy {
+		return ErrInvalidGrantAccess
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/graphql-go/graphql"
+	"net/http"
+	"sync"
+)
+
+// GraphQLSchema is the schema served at /graphql. It is read-only: it exposes users, their certificates
+// (including the parsed certificate fields) and sharing grants, but never private keys.
+var GraphQLSchema graphql.Schema
+
+// A certificate being resolved by GraphQL. The certificate is only parsed if a parsed field is selected.
+type graphqlCert struct {
+	data        *CertificateData
+	detailsOnce sync.Once
+	details     *CertificateDetails
+	detailsErr  error
+}
+
+func (c *graphqlCert) Details() (*CertificateDetails, error) {
+	c.detailsOnce.Do(func() {
+		c.details, c.detailsErr = c.data.Details()
+	})
+	return c.details, c.detailsErr
+}
+
+// A GraphQL field for a parsed certificate field
+func graphqlDetailField(fieldType graphql.Output, get func(*CertificateDetails) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: fieldType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			details, err := p.Source.(*graphqlCert).Details()
+			if err != nil {
+				return nil, err
+			}
+			return get(details), nil
+		},
+	}
+}
+
+// A GraphQL argument for a boolean filter. Leaving it out disables the filter.
+func graphqlNullBool(args map[string]interface{}, name string) sql.NullBool {
+	if b, ok := args[name].(bool); ok {
+		return sql.NullBool{Bool: b, Valid: true}
+	}
+	return sql.NullBool{}
+}
+
+// A nullable GraphQL DateTime. The zero time is null.
+func graphqlTime(t UTCTime) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+func init() {
+	grantType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Grant",
+		Fields: graphql.Fields{
+			"cert":   &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*Grant).CertId, nil }},
+			"owner":  &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*Grant).OwnerId, nil }},
+			"user":   &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*Grant).UserId, nil }},
+			"access": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*Grant).Access, nil }},
+		},
+	})
+
+	extensionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Extension",
+		Fields: graphql.Fields{
+			"oid": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*CertificateExtension).OID, nil }},
+			"critical": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*CertificateExtension).Critical, nil
+			}},
+			"value": &graphql.Field{Type: graphql.String, Description: "DER encoded, then base64 encoded", Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return base64.StdEncoding.EncodeToString(p.Source.(*CertificateExtension).Value), nil
+			}},
+		},
+	})
+
+	certType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Certificate",
+		Fields: graphql.Fields{
+			"id":     &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*graphqlCert).data.Id, nil }},
+			"user":   &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*graphqlCert).data.UserId, nil }},
+			"active": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*graphqlCert).data.Active, nil }},
+			"notes":  &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*graphqlCert).data.Notes, nil }},
+			"cert": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(*graphqlCert).data.Cert), nil
+			}},
+			"notBefore": &graphql.Field{Type: graphql.DateTime, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*graphqlCert).data.NotBefore.UTC(), nil
+			}},
+			"notAfter": &graphql.Field{Type: graphql.DateTime, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*graphqlCert).data.NotAfter.UTC(), nil
+			}},
+			"activateAt": &graphql.Field{Type: graphql.DateTime, Description: "Scheduled activation, if any", Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlTime(p.Source.(*graphqlCert).data.ActivateAt), nil
+			}},
+			"deactivateAt": &graphql.Field{Type: graphql.DateTime, Description: "Scheduled deactivation, if any", Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlTime(p.Source.(*graphqlCert).data.DeactivateAt), nil
+			}},
+			"currentlyValid": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*graphqlCert).data.IsCurrentlyValid(), nil
+			}},
+			"subject":            graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.Subject }),
+			"commonName":         graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.CommonName }),
+			"issuer":             graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.Issuer }),
+			"serialNumber":       graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.SerialNumber }),
+			"dnsNames":           graphqlDetailField(graphql.NewList(graphql.String), func(d *CertificateDetails) interface{} { return d.DNSNames }),
+			"emailAddresses":     graphqlDetailField(graphql.NewList(graphql.String), func(d *CertificateDetails) interface{} { return d.EmailAddresses }),
+			"ipAddresses":        graphqlDetailField(graphql.NewList(graphql.String), func(d *CertificateDetails) interface{} { return d.IPAddresses }),
+			"uris":               graphqlDetailField(graphql.NewList(graphql.String), func(d *CertificateDetails) interface{} { return d.URIs }),
+			"keyType":            graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.KeyType }),
+			"keyBits":            graphqlDetailField(graphql.Int, func(d *CertificateDetails) interface{} { return d.KeyBits }),
+			"signatureAlgorithm": graphqlDetailField(graphql.String, func(d *CertificateDetails) interface{} { return d.SignatureAlgorithm }),
+			"isCA":               graphqlDetailField(graphql.Boolean, func(d *CertificateDetails) interface{} { return d.IsCA }),
+			"extensions":         graphqlDetailField(graphql.NewList(extensionType), func(d *CertificateDetails) interface{} { return d.Extensions }),
+			"holders": &graphql.Field{
+				Type: graphql.NewList(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					data := p.Source.(*graphqlCert).data
+					return DatabaseReadCertHolders(data.UserId, data.Id)
+				},
+			},
+			"grants": &graphql.Field{
+				Type: graphql.NewList(grantType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					data := p.Source.(*graphqlCert).data
+					grants, _, err := DatabaseListCertGrants(data.UserId, data.Id, nil)
+					return grants, err
+				},
+			},
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.ID, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*User).Id, nil }},
+			"name":  &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*User).Name, nil }},
+			"email": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*User).Email, nil }},
+			"certs": &graphql.Field{
+				Type: graphql.NewList(certType),
+				Args: graphql.FieldConfigArgument{
+					"active": &graphql.ArgumentConfig{Type: graphql.Boolean, Description: "Only active (or inactive) certificates"},
+					"valid":  &graphql.ArgumentConfig{Type: graphql.Boolean, Description: "Only currently valid (or invalid) certificates"},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, Description: "Page size"},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String, Description: "Cursor from a previous page"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Source.(*User)
+					filter := CertFilter{
+						Active: graphqlNullBool(p.Args, "active"),
+						Valid:  graphqlNullBool(p.Args, "valid"),
+					}
+					config := Config()
+					limit := config.DefaultPageSize
+					if first, ok := p.Args["first"].(int); ok {
+						if first <= 0 {
+							return nil, ErrInvalidLimit
+						}
+						if first < config.MaxPageSize {
+							limit = first
+						} else {
+							limit = config.MaxPageSize
+						}
+					}
+					after, _ := p.Args["after"].(string)
+					cursor, err := DecodeCursor(after)
+					if err != nil {
+						return nil, err
+					}
+					certs, _, err := DatabaseListCerts(user.Id, cursor, limit, filter)
+					if err != nil {
+						return nil, err
+					}
+					resolved := make([]*graphqlCert, len(certs))
+					for i, certData := range certs {
+						resolved[i] = &graphqlCert{data: certData}
+					}
+					return resolved, nil
+				},
+			},
+			"certCount": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*User).CertCount, nil }},
+			"shared": &graphql.Field{
+				Type: graphql.NewList(grantType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					grants, _, err := DatabaseListUserGrants(p.Source.(*User).Id, nil)
+					return grants, err
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					// The certs are fetched by their own field, a page at a time
+					user, _, err := DatabaseReadUser(p.Args["id"].(string), &UserCertsQuery{CountOnly: true})
+					return user, err
+				},
+			},
+			"cert": &graphql.Field{
+				Type: certType,
+				Args: graphql.FieldConfigArgument{
+					"user": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					certData, err := DatabaseReadCert(p.Args["user"].(string), p.Args["id"].(string))
+					if err != nil {
+						return nil, err
+					}
+					return &graphqlCert{data: certData}, nil
+				},
+			},
+		},
+	})
+
+	var err error
+	GraphQLSchema, err = graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// A GraphQL request, as POSTed by GraphQL clients
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Serve GraphQL queries. Both POSTed JSON requests and GET requests with a "query" parameter are accepted.
+// Results are in the standard GraphQL response format rather than HTTPResult, since that is what GraphQL clients expect.
+func GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req := new(GraphQLRequest)
+	if r.Method == "GET" {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+	} else {
+		d := json.NewDecoder(r.Body)
+		err := d.Decode(req)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         GraphQLSchema,
+		RequestString:  req.Query,
+		OperationName:  req.OperationName,
+		VariableValues: req.Variables,
+		Context:        r.Context(),
+	})
+	for i := range result.Errors {
+		result.Errors[i].Message = Redact(result.Errors[i].Message)
+	}
+	jsonResult, err := json.Marshal(result)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	w.Write(jsonResult)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Middleware that sets the security headers on every response, including errors and routes that don't match.
+// Handlers may still override a header where they need something stricter.
+func SecurityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := Config()
+		h := w.Header()
+
+		// Responses are never meant to be sniffed into something else, so this isn't configurable
+		h.Set("X-Content-Type-Options", "nosniff")
+
+		// HSTS is only meaningful over TLS. Browsers ignore it over plain HTTP.
+		if r.TLS != nil && config.HSTSMaxAge > 0 {
+			hsts := "max-age=" + strconv.FormatInt(int64(time.Duration(config.HSTSMaxAge)/time.Second), 10)
+			if config.HSTSSubdomains {
+				hsts += "; includeSubDomains"
+			}
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		if config.FrameOptions != "" {
+			h.Set("X-Frame-Options", config.FrameOptions)
+		}
+		if config.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", config.ReferrerPolicy)
+		}
+
+		csp := config.CSP
+		if r.URL.Path == "/admin" || strings.HasPrefix(r.URL.Path, "/admin/") {
+			csp = config.AdminCSP
+		}
+		if csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Validate the configured security headers. Header values can't contain line breaks.
+func validateSecurityHeaders(config *RuntimeConfig, errs *ValidationErrors) {
+	if config.HSTSMaxAge < 0 {
+		errs.Add("hstsMaxAge", ErrInvalidConfig)
+	}
+	if config.FrameOptions != "" && !strings.EqualFold(config.FrameOptions, "DENY") && !strings.EqualFold(config.FrameOptions, "SAMEORIGIN") {
+		errs.Add("frameOptions", ErrInvalidConfig)
+	}
+	values := map[string]string{
+		"referrerPolicy": config.ReferrerPolicy,
+		"csp":            config.CSP,
+		"adminCSP":       config.AdminCSP,
+	}
+	for field, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			errs.Add(field, ErrInvalidConfig)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultLanguage = "en"
+
+var (
+	// Message catalogs, keyed by lower-case language tag and then by error code.
+	// English is built in: it is the Message of each Error and needs no catalog.
+	messageCatalogs   = map[string]map[string]string{}
+	messageCatalogsMu sync.RWMutex
+)
+
+// Register (or replace) the catalog of localized error messages for a language.
+// The catalog maps error codes to human readable messages.
+func RegisterMessageCatalog(lang string, messages map[string]string) {
+	messageCatalogsMu.Lock()
+	defer messageCatalogsMu.Unlock()
+	messageCatalogs[strings.ToLower(lang)] = messages
+}
+
+// Load every "<lang>.json" file in a directory as a message catalog
+func LoadMessageCatalogs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		messages := make(map[string]string)
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			return err
+		}
+		RegisterMessageCatalog(strings.TrimSuffix(filepath.Base(file), ".json"), messages)
+	}
+	return nil
+}
+
+// Parse an Accept-Language header into a list of lower-case language tags, most preferred first
+func ParseAcceptLanguage(header string) []string {
+	return parseQualityList(header)
+}
+
+// Parse a header made of a comma separated list of values with optional q-values (Accept, Accept-Language etc.)
+// Values are lower-cased, and returned most preferred first. Values with q=0 are dropped.
+func parseQualityList(header string) []string {
+	type valueQ struct {
+		value string
+		q     float64
+	}
+	var values []valueQ
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			values = append(values, valueQ{value, q})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].q > values[j].q })
+
+	list := make([]string, len(values))
+	for i, v := range values {
+		list[i] = v.value
+	}
+	return list
+}
+
+// Find the localized message for an error code, given the client's preferred languages.
+// Returns the message and the language it is in, or false if no catalog has the code.
+func lookupMessage(code string, langs []string) (string, string, bool) {
+	messageCatalogsMu.RLock()
+	defer messageCatalogsMu.RUnlock()
+	for _, lang := range langs {
+		// Try the exact tag ("fr-ca") and then the base language ("fr")
+		candidates := []string{lang}
+		if i := strings.Index(lang, "-"); i > 0 {
+			candidates = append(candidates, lang[:i])
+		}
+		for _, candidate := range candidates {
+			if candidate == DefaultLanguage {
+				return "", "", false
+			}
+			if message, ok := messageCatalogs[candidate][code]; ok {
+				return message, candidate, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// Get the human readable message for an error in the language requested by the client.
+// Errors without a code, or codes missing from the client's catalogs, fall back to English.
+func LocalizeError(w http.ResponseWriter, r *http.Request, e error) string {
+	var apiErr *Error
+	if !errors.As(e, &apiErr) {
+		return e.Error()
+	}
+	message, lang, ok := lookupMessage(apiErr.Code, ParseAcceptLanguage(r.Header.Get("Accept-Language")))
+	if !ok {
+		w.Header().Set("Content-Language", DefaultLanguage)
+		return apiErr.Message
+	}
+	w.Header().Set("Content-Language", lang)
+	return message
+}
+
+// Get the machine readable code for an error. Errors without a code give an empty string.
+func ErrorCode(e error) string {
+	var apiErr *Error
+	if errors.As(e, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
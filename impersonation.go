@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The header an administrator sends an impersonation token in
+const ImpersonationHeader = "X-Impersonation-Token"
+
+var (
+	ErrInvalidImpersonation = NewError("invalid-impersonation", http.StatusUnauthorized, "Unknown or expired impersonation token. Impersonation sessions are time-boxed: start a new one to carry on.")
+	ErrImpersonationScope   = NewError("impersonation-out-of-scope", http.StatusForbidden, "An impersonation token only covers the endpoints of the user being impersonated.")
+	ErrImpersonationReason  = NewError("impersonation-reason", http.StatusBadRequest, "Impersonating a user needs a reason, such as a support ticket. Please give one in the X-Change-Reason header.")
+)
+
+// For support, an administrator can act as a user: POST /admin/impersonation/user/{user-id} starts an impersonation
+// session, with a reason, and gives a token. Requests sending the token in the X-Impersonation-Token header are
+// made as that user, and only that user: any other route is refused. Sessions end after the ImpersonationTTL
+// option, or when they are ended with DELETE /admin/impersonation/{impersonation-id}.
+//
+// Every impersonated request that succeeds is recorded in the audit log once it has been served, attributed to both
+// the administrator and the user. The changes it makes have their own audit entries too, as they would without
+// impersonation, and those carry the administrator and the impersonation session as well, so each change can be
+// traced to whoever actually made it. Requests that fail change nothing, and aren't recorded. Like admin sessions,
+// impersonation sessions belong to this process.
+
+// An Impersonation is an administrator acting as a user
+type Impersonation struct {
+	Id      string  `json:"id"`
+	Admin   string  `json:"admin"` // Who started it (see RequestPrincipal)
+	UserId  string  `json:"user"`
+	Reason  string  `json:"reason"`
+	Started UTCTime `json:"started"`
+	Expires UTCTime `json:"expires"`
+}
+
+// A new impersonation session, with its token. The token is only ever given out here.
+type NewImpersonation struct {
+	*Impersonation
+	Token string `json:"token"`
+}
+
+// ImpersonationStore holds the impersonation sessions of this process, keyed by the SHA256 hash of their token
+type ImpersonationStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Impersonation
+}
+
+// Impersonations are the impersonation sessions of this process
+var Impersonations = &ImpersonationStore{sessions: make(map[string]*Impersonation)}
+
+// Start impersonating a user, returning the token to send in the X-Impersonation-Token header
+func (s *ImpersonationStore) Create(admin, userid, reason string, ttl time.Duration) (string, *Impersonation, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", nil, err
+	}
+	now := Now()
+	impersonation := &Impersonation{
+		Id:      hex.EncodeToString(id),
+		Admin:   admin,
+		UserId:  userid,
+		Reason:  reason,
+		Started: NewUTCTime(now),
+		Expires: NewUTCTime(now.Add(ttl)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetExpired()
+	s.sessions[hashSessionToken(token)] = impersonation
+	return token, impersonation, nil
+}
+
+// Get the impersonation session for a token, or nil if there isn't one or it has expired
+func (s *ImpersonationStore) Get(token string) *Impersonation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	impersonation, ok := s.sessions[hashSessionToken(token)]
+	if !ok || Now().After(impersonation.Expires.Time) {
+		return nil
+	}
+	return impersonation
+}
+
+// List the impersonation sessions that haven't expired, oldest first
+func (s *ImpersonationStore) List() []*Impersonation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetExpired()
+	list := make([]*Impersonation, 0, len(s.sessions))
+	for _, impersonation := range s.sessions {
+		list = append(list, impersonation)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Started.Equal(list[j].Started.Time) {
+			return list[i].Started.Before(list[j].Started.Time)
+		}
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// End an impersonation session by its id, returning it, or nil if there isn't one
+func (s *ImpersonationStore) Delete(id string) *Impersonation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetExpired()
+	for key, impersonation := range s.sessions {
+		if impersonation.Id == id {
+			delete(s.sessions, key)
+			return impersonation
+		}
+	}
+	return nil
+}
+
+// Forget expired sessions. The lock must be held.
+func (s *ImpersonationStore) forgetExpired() {
+	for key, old := range s.sessions {
+		if Now().After(old.Expires.Time) {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+type impersonationKey struct{}
+
+// Get the impersonation session a request is made in, set by ImpersonationMiddleware. Nil if it isn't impersonated.
+func RequestImpersonation(r *http.Request) *Impersonation {
+	return contextImpersonation(r.Context())
+}
+
+// Get the impersonation session of a request's context. Nil if it isn't impersonated.
+func contextImpersonation(ctx context.Context) *Impersonation {
+	impersonation, _ := ctx.Value(impersonationKey{}).(*Impersonation)
+	return impersonation
+}
+
+// Attribute an audit entry written while serving an impersonated request to the administrator, as well as the user
+func stampImpersonation(ctx context.Context, entry *AuditEntry) {
+	impersonation := contextImpersonation(ctx)
+	if impersonation == nil {
+		return
+	}
+	if entry.Detail == nil {
+		entry.Detail = AuditDetail{}
+	}
+	entry.Detail["admin"] = impersonation.Admin
+	entry.Detail["impersonation"] = impersonation.Id
+}
+
+// Records the status of a response, so ImpersonationMiddleware knows if the request succeeded
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// The audit entry recording an impersonated request, attributed to both the administrator and the user
+func impersonatedRequestAudit(r *http.Request, impersonation *Impersonation) *AuditEntry {
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+	return &AuditEntry{
+		Action: AuditActionImpersonated,
+		UserId: impersonation.UserId,
+		CertId: mux.Vars(r)["cert-id"],
+		Detail: AuditDetail{
+			"admin":         impersonation.Admin,
+			"impersonation": impersonation.Id,
+			"method":        r.Method,
+			"route":         route,
+		},
+		Reason: impersonation.Reason,
+	}
+}
+
+// Middleware that checks the impersonation token of each request that sends one, and records the request in the
+// audit log if it succeeds. It is used on the router, so the user-id is known, and before the authorization policy,
+// so the policy can see the impersonation.
+func ImpersonationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(ImpersonationHeader)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowAttempt(w, r, ClientIPKey(r)) {
+			return
+		}
+		impersonation := Impersonations.Get(token)
+		if impersonation == nil {
+			failedAttempt(r, "impersonation-token", ClientIPKey(r))
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrInvalidImpersonation, 0)
+			return
+		}
+		userid, err := GetUserID(r)
+		if err != nil || userid != impersonation.UserId || strings.HasPrefix(r.URL.Path, "/admin") {
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrImpersonationScope, 0)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), impersonationKey{}, impersonation))
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status >= http.StatusBadRequest {
+			return
+		}
+		// The response has been sent, so a request that can't be recorded can only be logged
+		err = DatabaseCreateAudit(r.Context(), impersonatedRequestAudit(r, impersonation))
+		if err != nil {
+			log.Println("Unable to record an impersonated request by", impersonation.Admin, "as user", impersonation.UserId+":", err)
+		}
+	})
+}
+
+// Start impersonating a user
+func CreateImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrImpersonationReason, 0)
+		return
+	}
+	// Only users that exist can be impersonated
+	_, _, err = DatabaseReadUser(userid, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	token, impersonation, err := Impersonations.Create(RequestPrincipal(r), userid, reason, time.Duration(Config().ImpersonationTTL))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = DatabaseCreateAudit(r.Context(), &AuditEntry{
+		Action: AuditActionImpersonate,
+		UserId: userid,
+		Detail: AuditDetail{"admin": impersonation.Admin, "impersonation": impersonation.Id, "expires": impersonation.Expires},
+		Reason: reason,
+	})
+	if err != nil {
+		// A session that isn't on record mustn't be usable
+		Impersonations.Delete(impersonation.Id)
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, &NewImpersonation{Impersonation: impersonation, Token: token})
+}
+
+// List the impersonation sessions that haven't expired
+func ListImpersonationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Send the result
+	SendResult(w, r, Impersonations.List())
+}
+
+// End an impersonation session before it expires
+func DeleteImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	impersonation := Impersonations.Delete(mux.Vars(r)["impersonation-id"])
+	if impersonation == nil {
+		HandleError(w, r, ErrNotFound, 0)
+		return
+	}
+	err = DatabaseCreateAudit(r.Context(), &AuditEntry{
+		Action: AuditActionUnimpersonate,
+		UserId: impersonation.UserId,
+		Detail: AuditDetail{"admin": impersonation.Admin, "impersonation": impersonation.Id, "endedBy": RequestPrincipal(r)},
+		Reason: reason,
+	})
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, impersonation)
+}
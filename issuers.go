@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Certificates are grouped a batch at a time, so the inventory doesn't hold every certificate in memory at once
+const issuerBatchSize = 500
+
+// The issuer inventory groups every stored certificate by the CA that issued it, to answer "how exposed are we to CA
+// X being distrusted" in one call. Issuers are identified by their distinguished name, as in certificate details'
+// "issuer". The issuer isn't a column, so every certificate is parsed, as for the compliance report.
+
+// The certificates issued by one CA
+type IssuerSummary struct {
+	Issuer   string         `json:"issuer"`
+	Certs    int            `json:"certs"`
+	Active   int            `json:"active"`
+	Expired  int            `json:"expired"`       // Active, but expired
+	Users    int            `json:"users"`         // How many users hold its certificates
+	Soonest  UTCTime        `json:"soonestExpiry"` // The soonest an active certificate expires, not counting the expired. Null if none.
+	KeyTypes map[string]int `json:"keyTypes"`      // Certificates by key, such as "RSA-2048" or "EC-256"
+	users    map[string]bool
+}
+
+// A certificate issued by a CA, as listed by the inventory
+type IssuerCert struct {
+	UserId     string  `json:"user"`
+	CertId     string  `json:"cert"`
+	CommonName string  `json:"commonName"`
+	Active     bool    `json:"active"`
+	NotAfter   UTCTime `json:"notAfter"`
+	KeyType    string  `json:"keyType"`
+	KeyBits    int     `json:"keyBits"`
+}
+
+// Describe a certificate's key, for the inventory's key breakdown
+func keyTypeName(details *CertificateDetails) string {
+	if details.KeyType == "" {
+		return "unknown"
+	}
+	return details.KeyType + "-" + strconv.Itoa(details.KeyBits)
+}
+
+// Add a certificate to its issuer's summary
+func (summary *IssuerSummary) add(certData *CertificateData, details *CertificateDetails, now time.Time) {
+	summary.Certs++
+	summary.KeyTypes[keyTypeName(details)]++
+	summary.users[certData.UserId] = true
+	summary.Users = len(summary.users)
+	if !certData.Active {
+		return
+	}
+	summary.Active++
+	if certData.NotAfter.Before(now) {
+		summary.Expired++
+	} else if summary.Soonest.IsZero() || certData.NotAfter.Before(summary.Soonest.Time) {
+		summary.Soonest = certData.NotAfter
+	}
+}
+
+// Certificates grouped by issuer, as they are read
+type issuerInventory struct {
+	now      time.Time
+	byIssuer map[string]*IssuerSummary
+}
+
+func newIssuerInventory(now time.Time) *issuerInventory {
+	return &issuerInventory{now: now, byIssuer: make(map[string]*IssuerSummary)}
+}
+
+func (inv *issuerInventory) add(certData *CertificateData, details *CertificateDetails) {
+	summary, ok := inv.byIssuer[details.Issuer]
+	if !ok {
+		summary = &IssuerSummary{Issuer: details.Issuer, KeyTypes: make(map[string]int), users: make(map[string]bool)}
+		inv.byIssuer[details.Issuer] = summary
+	}
+	summary.add(certData, details, inv.now)
+}
+
+// The issuers, most certificates first
+func (inv *issuerInventory) issuers() []*IssuerSummary {
+	issuers := make([]*IssuerSummary, 0, len(inv.byIssuer))
+	for _, summary := range inv.byIssuer {
+		issuers = append(issuers, summary)
+	}
+	sort.Slice(issuers, func(i, j int) bool {
+		if issuers[i].Certs != issuers[j].Certs {
+			return issuers[i].Certs > issuers[j].Certs
+		}
+		return issuers[i].Issuer < issuers[j].Issuer
+	})
+	return issuers
+}
+
+// Group every stored certificate by issuer
+func NewIssuerInventory() ([]*IssuerSummary, error) {
+	inv := newIssuerInventory(Now())
+	err := DatabaseEachCert(issuerBatchSize, func(certData *CertificateData) error {
+		details, err := certData.Details()
+		if err != nil {
+			return err
+		}
+		inv.add(certData, details)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv.issuers(), nil
+}
+
+// List every stored certificate issued by a CA, soonest expiring first
+func ListIssuerCerts(issuer string) ([]*IssuerCert, error) {
+	certs := []*IssuerCert{}
+	err := DatabaseEachCert(issuerBatchSize, func(certData *CertificateData) error {
+		details, err := certData.Details()
+		if err != nil {
+			return err
+		}
+		if details.Issuer != issuer {
+			return nil
+		}
+		certs = append(certs, &IssuerCert{
+			UserId:     certData.UserId,
+			CertId:     certData.Id,
+			CommonName: details.CommonName,
+			Active:     certData.Active,
+			NotAfter:   certData.NotAfter,
+			KeyType:    details.KeyType,
+			KeyBits:    details.KeyBits,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].NotAfter.Before(certs[j].NotAfter.Time) })
+	return certs, nil
+}
+
+// List the issuers of the stored certificates, with how many certificates each issued
+func ListIssuersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	issuers, err := NewIssuerInventory()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, issuers)
+}
+
+// List the certificates issued by the CA given as ?issuer=<distinguished name>
+func ListIssuerCertsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	issuer := r.URL.Query().Get("issuer")
+	if issuer == "" {
+		HandleError(w, r, &FieldError{"issuer", ErrRequiredField}, 0)
+		return
+	}
+	certs, err := ListIssuerCerts(issuer)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, certs)
+}
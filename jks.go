@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The JKS export format, for Java software that can't load PKCS#12 keystores
+const ExportFormatJKS = "jks"
+
+// The alias of the key entry in an exported keystore, if the caller doesn't give one
+const ExportDefaultAlias = "certstore"
+
+var ErrInvalidExportAlias = NewError("invalid-export-alias", http.StatusBadRequest, "Invalid keystore alias. It must be at most 255 printable characters.")
+
+// A certificate can be exported as a Java KeyStore (see ExportCertHandler), for Java before 9 and software that only
+// loads JKS. The keystore holds a single key entry, under the caller's alias, with the certificate and its chain. The
+// key is protected with the store password, as keytool does by default. JKS protects keys with SHA-1 and a weak
+// home-grown cipher, so prefer PKCS#12 where it can be loaded.
+
+// Validate a keystore alias. The keystore lower-cases it, as keytool does.
+func exportAlias(alias string) (string, error) {
+	if alias == "" {
+		return ExportDefaultAlias, nil
+	}
+	if !utf8.ValidString(alias) || utf8.RuneCountInString(alias) > 255 {
+		return "", ErrInvalidExportAlias
+	}
+	for _, r := range alias {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalidExportAlias
+		}
+	}
+	return alias, nil
+}
+
+// Encode a certificate, its private key and its chain as a JKS keystore, protected with a password
+func EncodeJKS(certData *CertificateData, alias, password string) ([]byte, error) {
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseSignerPEM(string(certData.Key))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ParseChainPEM(string(certData.Chain))
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := keystore.PrivateKeyEntry{
+		CreationTime:     Now(),
+		PrivateKey:       der,
+		CertificateChain: []keystore.Certificate{{Type: "X509", Content: cert.Raw}},
+	}
+	for _, c := range chain {
+		entry.CertificateChain = append(entry.CertificateChain, keystore.Certificate{Type: "X509", Content: c.Raw})
+	}
+	ks := keystore.New()
+	err = ks.SetPrivateKeyEntry(alias, entry, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = ks.Store(&buf, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
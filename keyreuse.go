@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Certificates stored before keys were fingerprinted are fingerprinted this many at a time
+const fingerprintBatchSize = 500
+
+var (
+	WarnKeyReused = NewError("key-reused", 0, "The certificate's public key is also used by another certificate. A new key should be generated whenever a certificate is renewed.")
+)
+
+// A certificate's public key is fingerprinted (the SHA256 hash of its SubjectPublicKeyInfo, as for private keys' details)
+// and indexed, so that certificates sharing a key can be found. Sharing a key usually means a certificate was renewed
+// without generating a new key, against the rotation policy, and sharing it between users means whoever holds one
+// certificate's private key holds the other's. A certificate is only counted once however many users hold it.
+// Uploading a certificate with a reused key is allowed, with a warning, and administrators can list every reused key.
+// Reuse is found across all users.
+
+// A certificate with a reused public key
+type ReusedKeyCert struct {
+	SPKI     string  `json:"-"`
+	UserId   string  `json:"user"`
+	Id       string  `json:"cert"`
+	Active   bool    `json:"active"`
+	NotAfter UTCTime `json:"notAfter"`
+}
+
+// A public key used by more than one certificate
+type ReusedKey struct {
+	Fingerprint string           `json:"fingerprint"`
+	Certs       int              `json:"certs"`     // How many distinct certificates use the key
+	Users       int              `json:"users"`     // How many users hold them
+	CrossUser   bool             `json:"crossUser"` // Are they held by more than one user? This is the most serious reuse.
+	Holders     []*ReusedKeyCert `json:"holders"`   // Every user's copy of every certificate using the key
+}
+
+// Get the fingerprint of a certificate's public key
+func SPKIFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// Group certificates, ordered by fingerprint, by their public key. Those held by more than one user come first.
+func groupReusedKeys(certs []*ReusedKeyCert) []*ReusedKey {
+	var keys, crossUser []*ReusedKey
+	for i := 0; i < len(certs); {
+		key := &ReusedKey{Fingerprint: certs[i].SPKI}
+		ids, users := make(map[string]bool), make(map[string]bool)
+		for ; i < len(certs) && certs[i].SPKI == key.Fingerprint; i++ {
+			key.Holders = append(key.Holders, certs[i])
+			ids[certs[i].Id] = true
+			users[certs[i].UserId] = true
+		}
+		key.Certs, key.Users, key.CrossUser = len(ids), len(users), len(users) > 1
+		if key.CrossUser {
+			crossUser = append(crossUser, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return append(append([]*ReusedKey{}, crossUser...), keys...)
+}
+
+// Warn about a new certificate if another certificate has the same public key. Failing to check isn't an error.
+func keyReuseWarnings(certData *CertificateData, field string) ValidationErrors {
+	var warnings ValidationErrors
+	count, err := DatabaseCountKeyReuse(certData.KeyFingerprint, certData.Id)
+	if err != nil {
+		log.Println("Unable to check for key reuse:", err)
+		return nil
+	}
+	if count != 0 {
+		warnings.Add(field, WarnKeyReused)
+	}
+	return warnings
+}
+
+// Fingerprint the public keys of certificates stored before keys were fingerprinted
+func BackfillFingerprints() {
+	// A standby's certificates are the primary's, and are fingerprinted there
+	if Replica.Standby() {
+		return
+	}
+	total := 0
+	for {
+		count, err := DatabaseBackfillFingerprints(fingerprintBatchSize)
+		total += count
+		if err != nil {
+			log.Println("Unable to fingerprint certificates' public keys:", err)
+			return
+		}
+		if count < fingerprintBatchSize {
+			break
+		}
+	}
+	if total != 0 {
+		log.Printf("Fingerprinted the public keys of %d certificates", total)
+	}
+}
+
+// List every public key used by more than one certificate
+func ListReusedKeysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	keys, err := DatabaseListReusedKeys()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, keys)
+}
@@ -1,31 +1,40 @@
 // This is a prototype. A full production version would have several important differences:
 //
-// 1. Errors, as they are used right now in this prototype, are suboptimial.  In a full production version,
-//    a custom error container struct should be used to give the user of the API more fine-grained error
-//    messages to help them debug. This struct would look something like this:
-//      type Error struct {
-//        Message: "You did somethig bad", // Human readable error message. May contain a hint about how to fix.
-//        Code: ErrCode1,                  // A standard error code so clients don't need to program against strings.
-//        Err: error,                      // The original low-level error that caused this error to happen. Can be nil.
-//        StatusCode int,                  // An HTTP Status Code for this error. Not providing this would mean 500 Internal Server Error.
-//      }
+// 1. API errors use the structured Error type (see errors.go), carrying a stable code, a localizable message and
+//    an HTTP status code. Low-level errors (database, JSON decoding) are still passed through to the client as-is.
+//    In a full production version these should be wrapped in an Error as well.
 //
 // 2. The current design just uses HTTP. In a full production version HTTPS should be used exclusively.
 //
-// 3. The current design uses hardcoded configuration options. In production this should be parsed
-//    from an ini file, or from environment variables.
+// 3. The current design uses hardcoded configuration options. Only the non-structural options can be overridden,
+//    from the JSON file in OptConfigFile (see config.go). In production everything should be configurable,
+//    from a file or from environment variables.
 //
-// 4. The current design doesn't implement x509 revocation checking. A production version should obviously
-//    fully check a certificate to verify it is not revoked.
+// 4. Revocation is checked with OCSP when a certificate is uploaded, if the OCSPCheck option is on (see ocsp.go),
+//    against stored certificates' CRLs from time to time, if the CRLCheck option is on (see crl.go), and with both
+//    for active certificates, if the RevocationInterval option is set (see revocation.go). OCSP stapling and
+//    delta CRLs are not supported.
 //
-// 5. The current design does not support ECDSA keys where the curve is specified in a "BEGIN EC PARAMETERS" block.
-//    This should be supported in a production version.
+// 5. ECDSA keys where the curve is specified in a "BEGIN EC PARAMETERS" block are accepted, but only for named curves
+//    (see StripECParameters). Keys with explicit curve parameters are rejected.
 //
 // 6. The current version does not test the full HTTP interface when running "go test". This should obviously be fixed
 //    in any production version.
 //
-// 7. Right now, passing "?limit-certs=active" filters the certificates after they have already been fetched from the database.
-//    In a production version, we would have a query that does the filtering.
+// 7. All data is kept in the one database in OptDatabaseConnection, and there are no organizations to route by.
+//    Keeping an organization's data in a designated database (for data residency) isn't supported, and is deferred
+//    until users belong to organizations. It will need the statements in database.go to be held in a
+//    StatementRegistry per database rather than the global one (see statements.go), the operations that span users
+//    (grants, transfers, merges, and the shared certstore_cert_content rows) to be limited to users in the same
+//    database, and admin queries across databases to be fanned out and merged.
+//    Without organizations, whatever isn't a single user's own is server-wide: the configuration, with its policies,
+//    rules, freezes, issuers and trust domains, and the admin reports, campaigns and analytics, which take in every
+//    user. Checks across certificates, such as key reuse and name conflicts, are across all users too.
+//
+// 8. There is no command line client (certstorectl) yet. One would list certificates with the API, and inspect
+//    stored or local certificates with POST /decode, which gives the same details as the server uses.
+//    Named server profiles, shell completion and logging in belong in that client. Logging in with the OIDC device
+//    flow would also need the server to accept OIDC tokens: it only knows scope tokens and admin sessions.
 
 package main
 
@@ -34,9 +43,14 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 )
 
 const (
@@ -47,50 +61,407 @@ const (
 var (
 	// Options - change these
 	OptDatabaseConnection = "postgres://postgres@localhost/certstore?sslmode=disable"
-	OptVerifyCertificate  = false // Should the full certificate chain be fully verified and vetted?
-	OptMinimumRSABits     = 1024  // Minimum key length for RSA. In production this should be 2048 or greater.
-	OptMinimumECBits      = 160   // Minimum key length for ECC. In production this should be 224 or greater.
+	OptVerifyCertificate  = false                // Should the full certificate chain be fully verified and vetted?
+	OptMinimumRSABits     = 1024                 // Minimum key length for RSA. In production this should be 2048 or greater.
+	OptMinimumECBits      = 160                  // Minimum key length for ECC. In production this should be 224 or greater.
+	OptDefaultPageSize    = 100                  // Number of items returned by list endpoints when no limit is given.
+	OptMaxPageSize        = 1000                 // Maximum number of items that may be requested from list endpoints.
+	OptStorageCompression = true                 // Should certificates and keys be gzip compressed in the database?
+	OptKeyFormat          = "traditional"        // How private keys are PEM encoded: "traditional" (PKCS#1 or SEC 1) or "pkcs8".
+	OptParseMode          = "lenient"            // "strict" rejects untidy uploaded PEM, "lenient" repairs it with warnings.
+	OptExclusiveActive    = false                // Does activating a certificate deactivate the user's others for the same names?
+	OptRejectExpired      = false                // Refuse to store certificates that have already expired (see expired.go)?
+	OptWarnSANConflicts   = false                // Warn on upload if another user's active certificates cover the same names (see conflicts.go)?
+	OptClockSkew          = 5 * time.Minute      // Tolerance either side of a certificate's validity period when deciding if it is currently valid.
+	OptMessageCatalogDir  = ""                   // Directory of <lang>.json error message catalogs. Empty means English only.
+	OptMaxNameLength      = 746                  // Maximum length of a user's name in characters. The longest known name has 746.
+	OptMaxEmailLength     = 254                  // Maximum length of a user's email address in bytes, per RFC 5321.
+	OptMaxNotesLength     = 4096                 // Maximum length of a certificate's notes in characters.
+	OptMaxReasonLength    = 1000                 // Maximum length of a change reason in characters.
+	OptRequireReason      = false                // Must mutations give a reason (the X-Change-Reason header) for the audit log?
+	OptVerifyEmailMX      = false                // Should email domains be checked for MX (or address) records?
+	OptValidateRequests   = true                 // Should requests be validated against the OpenAPI document (openapi.json)?
+	OptWebSocketBuffer    = 64                   // Number of events buffered per WebSocket subscription before events are dropped.
+	OptWarnRSABits        = 2048                 // RSA keys shorter than this are accepted with a warning.
+	OptWarnECBits         = 256                  // EC keys shorter than this are accepted with a warning.
+	OptWarnValidity       = 398 * 24 * time.Hour // Certificates valid for longer than this are accepted with a warning.
+	OptMaxAttachmentSize  = 1 << 20              // Maximum size of a certificate attachment in bytes.
+	OptMaxRequestSize     = 4 << 20              // Maximum size of a JSON request body in bytes, when requests are validated.
+	OptMaxAttachments     = 10                   // Maximum number of attachments per certificate. Zero disables attachments.
+	OptExportLinkTTL      = 5 * time.Minute      // How long a private key download link can be used for.
+	OptExportSigningKey   = ""                   // Secret used to sign download links. Empty means a random key for each run.
+	OptAnalyticsKey       = ""                   // Secret pseudonyms in the analytics export are made with (see analytics.go). Empty means a random key for each run.
+	OptPIIEncryptionKey   = ""                   // 64 hex digits. Users' names and emails are encrypted at rest with it (see pii.go). Empty means they aren't.
+	OptVaultAddress       = ""                   // Vault server private keys are encrypted with, such as https://vault.example.com:8200 (see vault.go). Empty means they aren't. Needs a restart.
+	OptVaultToken         = ""                   // Vault token. Empty means the VAULT_TOKEN environment variable.
+	OptVaultNamespace     = ""                   // Vault Enterprise namespace. Empty for none.
+	OptVaultTransitMount  = "transit"            // Where Vault's transit secrets engine is mounted.
+	OptVaultTransitKey    = "certstore"          // The transit key private keys are encrypted with.
+	OptSessionTTL         = 8 * time.Hour        // How long an administrator stays logged in.
+	OptImpersonationTTL   = 30 * time.Minute     // How long an administrator can act as a user for each time they start (see impersonation.go).
+	OptMaxMintValidity    = 7 * 24 * time.Hour   // The longest a minted short-lived certificate may be valid for (see mint.go).
+	OptMintCleanupEvery   = 10 * time.Minute     // How often expired minted certificates are deleted.
+	OptMaxBatchDevices    = 100000               // The most devices in one provisioning batch (see provision.go).
+	OptProvisionEvery     = 10 * time.Second     // How often pending provisioning batches are issued.
+	OptAuthMaxFailures    = 5                    // Failed authentication attempts, by a client or against an account, before it is locked out.
+	OptAuthFailureWindow  = 15 * time.Minute     // How long failed authentication attempts are counted for.
+	OptAuthLockout        = 15 * time.Minute     // How long a client or account is locked out for after too many failed attempts.
+	OptAuthDelay          = time.Second / 4      // Delay after a failed authentication attempt. It doubles with each further failure.
+	OptStatusRateLimit    = 60                   // Requests per minute each client may make for the public status (GET /status).
+	OptCSRRateLimit       = 10                   // CSRs each client may submit for approval per hour (see csrqueue.go).
+	OptMaxPendingCSRs     = 1000                 // The most CSRs waiting for approval at once. Submissions beyond it are refused.
+	OptHSTSMaxAge         = 365 * 24 * time.Hour // How long browsers should only use HTTPS. Only sent over TLS. Zero turns HSTS off.
+	OptHSTSSubdomains     = false                // Should HSTS also cover subdomains?
+	OptFrameOptions       = "DENY"               // X-Frame-Options header. DENY, SAMEORIGIN, or empty for no header.
+	OptReferrerPolicy     = "no-referrer"        // Referrer-Policy header. Empty for no header.
+	OptAnomalyExports     = 5                    // Key exports by one token or client within the anomaly window that count as an anomaly.
+	OptAnomalyWindow      = time.Hour            // Window for counting key exports, and for not repeating an anomaly.
+	OptAnomalySpike       = 10                   // Requests per minute, as a multiple of the usual rate, that count as a spike.
+	OptAnomalyWebhook     = ""                   // URL anomalies are posted to as JSON, such as a Slack incoming webhook. Needs a restart.
+	OptTimestampAuthority = ""                   // URL of an RFC 3161 timestamp authority to anchor the audit log with. Empty means no anchoring.
+	OptAnchorInterval     = time.Hour            // How often the audit log is anchored, if there is a timestamp authority.
+	OptSIEMURL            = ""                   // Where to forward the audit log: udp://, tcp:// or tls:// for syslog, or an http(s):// collector. Empty means no forwarding.
+	OptSIEMFormat         = "json"               // Format of events forwarded to the SIEM: json or cef.
+	OptSIEMAuthorization  = ""                   // Authorization header for an HTTP collector, such as "Splunk <token>".
+	OptSIEMInterval       = 10 * time.Second     // How often new audit entries are forwarded to the SIEM.
+	OptReplicaOf          = ""                   // URL of the primary to follow as a standby (see replication.go). Empty means this is a primary.
+	OptReplicaToken       = ""                   // Admin scope token a standby uses with its primary.
+	OptReplicaInterval    = 5 * time.Second      // How often a standby polls its primary for changes.
+	OptTimeTravel         = false                // Can administrators move the clock forwards (PUT /admin/clock)? Only for tests and sandboxes.
+	OptFaultInjection     = false                // Can administrators inject faults (PUT /admin/faults, see faults.go)? Only for tests and staging.
+	OptSandbox            = false                // Run as a sandbox for integrators to test against (see sandbox.go). Needs its own database.
+	OptSandboxCA          = ""                   // PEM file of test CA certificates that chains are verified against in a sandbox.
+	OptPolicyURL          = ""                   // URL of an OPA decision that every request is checked against (see authz.go). Empty means no policy.
+	OptPolicyFailOpen     = false                // Allow requests when the policy can't be checked? Otherwise they are refused.
+	OptUsageInterval      = time.Minute          // How often usage counts are saved to the database.
+	OptScheduleInterval   = time.Minute          // How often scheduled activations and deactivations are run (see schedule.go).
+	OptComplianceInterval = 5 * time.Minute      // How often to check whether the certificates are due to be evaluated (see compliance.go).
+	OptSlowQueryThreshold = time.Second          // Statements slower than this are logged, with their parameters redacted (see querystats.go). Zero for none.
+	OptQueryDebug         = false                // Can administrators EXPLAIN the main queries, and are slow queries' plans captured (see explain.go)? Not for production.
+	OptSecureCookies      = true                 // Should session cookies only be sent over HTTPS? Only turn off for local development.
+	OptConfigFile         = ""                   // JSON file overriding the options above. Reloaded on SIGHUP. See RuntimeConfig.
+
+	// Media types that may be attached to a certificate
+	OptAttachmentTypes = []string{"application/pkcs10", "application/pkix-cert", "application/pkcs7-mime", "application/x-pem-file", "application/pdf", "application/json", "text/plain"}
+
+	// Extension policy for new certificates, as dotted OIDs (see policy.go)
+	OptRequiredExtensions  = []string{} // Extensions every certificate must have, such as an internal inventory-ID extension
+	OptForbiddenExtensions = []string{} // Extensions no certificate may have
+
+	// Usage policy for new certificates (see policy.go), by name, such as "digitalSignature" or "serverAuth"
+	OptRequiredKeyUsages    = []string{} // Key usages every certificate must allow
+	OptRequiredExtKeyUsages = []string{} // Extended key usages every certificate must allow, by name or dotted OID
+	OptRequireExtKeyUsage   = false      // Reject certificates without the extended key usage extension, rather than take them to allow every usage
+
+	// Signature policy for new certificates (see policy.go), by the names certificate details give the algorithms
+	OptForbiddenSignatures = []string{"MD5-RSA", "SHA1-RSA", "DSA-SHA1", "ECDSA-SHA1"} // Algorithms no certificate or intermediate may be signed with
+
+	// Acceptance rules for new certificates (see acceptance.go), on top of the minimum key lengths. Empty rules allow anything.
+	OptAcceptanceRules = AcceptanceRules{}
+
+	// Validity policy for new certificates (see policy.go)
+	OptValidityPolicy   = "warn"               // "off", "warn" or "reject" certificates valid for longer than allowed.
+	OptPublicValidity   = 398 * 24 * time.Hour // The CA/Browser Forum limit for publicly trusted server certificates.
+	OptInternalValidity = time.Duration(0)     // The limit for certificates from internal CAs. Zero for no limit.
+	OptInternalIssuers  = []string{}           // Distinguished names of internal CAs, as in certificate details' "issuer".
+
+	// Domain policy for new certificates (see domains.go)
+	OptDomainPolicy        = "off" // "off", "warn" or "reject" certificates with DNS names outside their user's domains.
+	OptVerifiedDomainsOnly = false // Do only domains verified by their TXT record count? Otherwise any registered domain does.
+
+	// CAA checking before the built-in CA issues a certificate (see caa.go)
+	OptCAAIdentities = []string{} // The issuer domain names, such as "ca.example.net", that CAA records allow the CA by. Empty turns checking off.
+	OptCAAResolver   = ""         // The DNS server to look up CAA records from, as host:port. Empty for the system's, from /etc/resolv.conf.
+
+	// Revocation checking of uploaded certificates (see ocsp.go)
+	OptOCSPCheck = "off" // "off", "soft-fail" (warn if the status can't be found) or "hard-fail" (reject unless known to be good).
+
+	// Certificate Transparency evidence of publicly trusted certificates (see ct.go)
+	OptCTLogList = ""    // JSON file of the CT logs SCTs are verified against, in the v3 log list format. Reloaded with the configuration.
+	OptCTPolicy  = "off" // "off", "warn" or "reject" publicly trusted certificates without enough valid SCTs.
+	OptCTMinSCTs = 2     // The fewest valid SCTs a publicly trusted certificate must have.
+
+	// Revocation checking of stored certificates against their CRLs (see crl.go)
+	OptCRLCheck    = false     // Are the CRLs refreshed, and the certificates on them marked revoked?
+	OptCRLInterval = time.Hour // How often the CRLs are checked. Each is only fetched again once it is due.
+
+	// Checking active certificates' revocation status again, with OCSP and their CRLs (see revocation.go)
+	OptRevocationInterval = time.Duration(0) // How often each active certificate is checked. Zero for never, otherwise at least an hour.
+	OptRevocationPoll     = 5 * time.Minute  // How often to look for certificates due to be checked.
+
+	// Custom trust roots for verifying certificate chains (see trustroots.go). Reloaded with the configuration.
+	OptTrustRoots         = ""   // PEM file of root CA certificates chains are verified up to, as well as any added with the API.
+	OptTrustIntermediates = ""   // PEM file of intermediate CA certificates used to complete chains.
+	OptTrustSystemRoots   = true // Are the system's roots still trusted once there are custom roots?
+
+	// Change freezes, when scheduled changes and bulk operations wait (see freeze.go)
+	OptChangeFreezes = []*ChangeFreeze{}
+
+	// Tokens granting elevated scopes (see scopes.go), by scope. Tokens are given as their SHA256 hash (hex-encoded).
+	// An endpoint that needs a scope with no tokens can't be used at all.
+	OptScopeTokens = map[string][]string{ScopeKeyExport: {}, ScopeAdmin: {}, ScopeFreezeOverride: {}}
+
+	// Response profiles (see compat.go), by the SHA256 hash (hex-encoded) of the API key they apply to. Keys without
+	// a profile get the documented camelCase fields in the standard envelope.
+	OptResponseProfiles = ResponseProfiles{}
+
+	// SPIFFE trust domains (see spiffe.go), by name, with the user holding their CA certificates and the CA
+	// certificates' cert-ids. SVIDs can only be minted in a configured trust domain.
+	OptTrustDomains = TrustDomains{}
+
+	// The CA certificate that issues CSRs submitted for approval, once they are approved (see csrqueue.go). Nil means
+	// CSRs aren't accepted.
+	OptCSRIssuer *CSRIssuer
+
+	// Rules for approving CSRs without review (see autoapprove.go). CSRs meeting none wait for an administrator.
+	OptCSRAutoApprove = []*CSRApprovalRule{}
+
+	// Content-Security-Policy headers. The API only serves data, so it allows nothing; the admin UI may use its own
+	// scripts, styles and images. Empty for no header.
+	OptCSP      = "default-src 'none'; frame-ancestors 'none'"
+	OptAdminCSP = "default-src 'self'; frame-ancestors 'none'; form-action 'self'; base-uri 'none'"
+
+	// Administrators who can log in to the admin UI, by username, with bcrypt hashes of their passwords
+	OptAdminUsers = map[string]string{}
 
 	// Errors
-	ErrNotFound          = errors.New("Not Found")
-	ErrNoIDOnNewUser     = errors.New("No user-id may be specified when POSTing a new user")
-	ErrBadUserPatchID    = errors.New("The user-id may not be updated in a PATCH request")
-	ErrBadUserPatchCerts = errors.New("The user certificates may not be updated in a PATCH request")
-	ErrBadCertPatchID    = errors.New("The certificate-id may not be updated in a PATCH request")
-	ErrBadCertPatchCert  = errors.New("The certificate data may not be updated in a PATCH request")
-	ErrBadCertPatchKey   = errors.New("The certificate key may not be updated in a PATCH request")
+	ErrNotFound = NewError("not-found", http.StatusNotFound, "Not Found")
 )
 
 type HTTPResult struct {
-	Success bool        `json:"success"`
-	Error   string      `json:"error"`
-	Result  interface{} `json:"result"`
+	Success  bool                `json:"success"`
+	Error    string              `json:"error"`
+	Code     string              `json:"code,omitempty"`     // Machine readable error code. Stable across languages.
+	Errors   []*FieldErrorResult `json:"errors,omitempty"`   // Every field that failed validation, if the request body was invalid
+	Warnings []*FieldErrorResult `json:"warnings,omitempty"` // Problems that didn't stop the request succeeding, but soon might
+	Result   interface{}         `json:"result"`
+	Next     string              `json:"next,omitempty"` // Cursor for the next page of a list endpoint
+	Prev     string              `json:"prev,omitempty"` // Cursor for the previous page of a list endpoint
 }
 
 func main() {
-	err := DatabaseSetup()
+	// Nothing logged may contain a private key or a token, whatever logs it
+	log.SetOutput(NewRedactingWriter(os.Stderr))
+
+	// With time travel, the clock runs from now but can be moved on. A sandbox always has time travel.
+	if OptTimeTravel || OptSandbox {
+		clock = NewTestClock(time.Now(), true)
+		log.Println("Time travel is enabled. Do not use this server in production.")
+	}
+	if OptFaultInjection {
+		log.Println("Fault injection is enabled. Do not use this server in production.")
+	}
+	if OptQueryDebug {
+		log.Println("Query debugging is enabled. Do not use this server in production.")
+	}
+
+	err := validateSandboxOptions()
+	if err != nil {
+		log.Println("Unable to run as a sandbox")
+		log.Fatal(err)
+	}
+	if OptSandbox {
+		log.Println("Running as a sandbox. Webhooks and the SIEM are captured rather than sent.")
+	}
+
+	err = validatePIIOptions()
+	if err != nil {
+		log.Println("Unable to encrypt users' names and email addresses")
+		log.Fatal(err)
+	}
+	err = setupKeyWrap()
+	if err != nil {
+		log.Println("Unable to encrypt private keys with Vault")
+		log.Fatal(err)
+	}
+
+	err = DatabaseSetup()
 	defer DatabaseShutdown()
 	if err != nil {
 		log.Println("Unable to connect to database")
 		log.Fatal(err)
 	}
 
+	// Load the config file and error message catalogs
+	_, err = ReloadConfig()
+	if err != nil {
+		log.Println("Unable to load configuration")
+		log.Fatal(err)
+	}
+	WatchConfigReload()
+	go AnchorAuditLog(OptAnchorInterval)
+
+	err = validateSIEMOptions()
+	if err != nil {
+		log.Println("Unable to forward audit log to SIEM")
+		log.Fatal(err)
+	}
+	go ForwardAuditToSIEM(OptSIEMInterval)
+
+	// Keep an event log for standbys, and follow the primary if this is a standby
+	Events.Log = DatabaseCreateEvent
+	err = Replica.Start(OptReplicaInterval)
+	if err != nil {
+		log.Println("Unable to follow primary")
+		log.Fatal(err)
+	}
+
 	r := mux.NewRouter()
+	if OptValidateRequests {
+		spec, err := LoadOpenAPISpec(OpenAPIDocument)
+		if err != nil {
+			log.Println("Unable to load OpenAPI document")
+			log.Fatal(err)
+		}
+		r.Use(OpenAPIValidationMiddleware(spec))
+	}
+	err = validatePolicyOptions()
+	if err != nil {
+		log.Println("Unable to check authorization policy")
+		log.Fatal(err)
+	}
+	r.Use(ImpersonationMiddleware)
+	r.Use(AuthorizationPolicyMiddleware)
+	r.Use(UsageMiddleware)
+	r.Use(PEMFormatMiddleware)
+	r.Use(FaultInjectionMiddleware)
+	go Usage.FlushEvery(OptUsageInterval)
+	go RunScheduleEvery(OptScheduleInterval)
+	go RunComplianceEvery(OptComplianceInterval)
+	go RefreshCRLsEvery(OptCRLInterval)
+	go RunRevocationChecksEvery(OptRevocationPoll)
+	go CleanupMintedEvery(OptMintCleanupEvery)
+	go RunProvisioningEvery(OptProvisionEvery)
+	go BackfillFingerprints()
+	go BackfillNames()
 
 	r.HandleFunc("/", IndexHandler)
+	r.HandleFunc("/openapi.json", OpenAPIHandler).Methods("GET")
+	r.HandleFunc("/graphql", RequireFlag(FlagGraphQL, GraphQLHandler)).Methods("GET", "POST")
+	r.HandleFunc("/admin/login", LoginHandler).Methods("POST")
+	r.HandleFunc("/admin/logout", RequireAdmin(LogoutHandler)).Methods("POST")
+	r.HandleFunc("/admin/sandbox/outbox", RequireAdmin(ListSandboxOutboxHandler)).Methods("GET")
+	r.HandleFunc("/admin/sandbox/outbox", RequireAdmin(ClearSandboxOutboxHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/session", ReadSessionHandler).Methods("GET")
+	r.HandleFunc("/admin/clock", RequireAdmin(ReadClockHandler)).Methods("GET")
+	r.HandleFunc("/admin/clock", RequireAdmin(UpdateClockHandler)).Methods("PUT")
+	r.HandleFunc("/admin/faults", RequireAdmin(ReadFaultsHandler)).Methods("GET")
+	r.HandleFunc("/admin/faults", RequireAdmin(UpdateFaultsHandler)).Methods("PUT")
+	r.HandleFunc("/admin/faults", RequireAdmin(DeleteFaultsHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/config", RequireAdmin(ReadConfigHandler)).Methods("GET")
+	r.HandleFunc("/admin/metrics", RequireAdmin(MetricsHandler)).Methods("GET")
+	r.HandleFunc("/admin/db/queries", RequireAdmin(ListDatabaseQueriesHandler)).Methods("GET")
+	r.HandleFunc("/admin/db/explain", RequireAdmin(ListQueryPathsHandler)).Methods("GET")
+	r.HandleFunc("/admin/db/explain/{query}", RequireAdmin(ExplainQueryPathHandler)).Methods("POST")
+	r.HandleFunc("/admin/db/plans", RequireAdmin(ListQueryPlansHandler)).Methods("GET")
+	r.HandleFunc("/admin/config/reload", RequireAdmin(ReloadConfigHandler)).Methods("POST")
+	r.HandleFunc("/admin/anomalies", RequireAdmin(ListAnomaliesHandler)).Methods("GET")
+	r.HandleFunc("/admin/audit/verify", RequireAdmin(VerifyAuditHandler)).Methods("GET")
+	r.HandleFunc("/admin/compliance", RequireAdmin(ReadComplianceHandler)).Methods("GET")
+	r.HandleFunc("/admin/compliance/evaluate", RequireAdmin(EvaluateComplianceHandler)).Methods("POST")
+	r.HandleFunc("/admin/auth/attempts", RequireAdmin(ListAuthAttemptsHandler)).Methods("GET")
+	r.HandleFunc("/admin/issuers", RequireAdmin(ListIssuersHandler)).Methods("GET")
+	r.HandleFunc("/admin/analytics", RequireAdmin(ExportAnalyticsHandler)).Methods("GET")
+	r.HandleFunc("/admin/impersonation", RequireAdmin(ListImpersonationsHandler)).Methods("GET")
+	r.HandleFunc("/admin/impersonation/user/{user-id}", RequireAdmin(CreateImpersonationHandler)).Methods("POST")
+	r.HandleFunc("/admin/impersonation/{impersonation-id}", RequireAdmin(DeleteImpersonationHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/issuers/certs", RequireAdmin(ListIssuerCertsHandler)).Methods("GET")
+	r.HandleFunc("/admin/keys/reused", RequireAdmin(ListReusedKeysHandler)).Methods("GET")
+	r.HandleFunc("/admin/names/conflicts", RequireAdmin(ListSANConflictsHandler)).Methods("GET")
+	r.HandleFunc("/admin/pem/legacy", RequireAdmin(ListLegacyPEMClientsHandler)).Methods("GET")
+	r.HandleFunc("/admin/wildcards", RequireAdmin(ReadWildcardsHandler)).Methods("GET")
+	r.HandleFunc("/admin/flags", RequireAdmin(ListFlagsHandler)).Methods("GET")
+	r.HandleFunc("/admin/replication", RequireAdmin(ReadReplicationHandler)).Methods("GET")
+	r.HandleFunc("/admin/replication/changes", RequireAdmin(ReplicationChangesHandler)).Methods("GET")
+	r.HandleFunc("/admin/replication/users", RequireAdmin(ReplicationUsersHandler)).Methods("GET")
+	r.HandleFunc("/admin/replication/promote", RequireAdmin(PromoteReplicaHandler)).Methods("POST")
+	r.HandleFunc("/admin/flags/{flag}", RequireAdmin(UpdateFlagHandler)).Methods("PUT")
+	r.HandleFunc("/admin/flags/{flag}", RequireAdmin(DeleteFlagHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/csr", RequireAdmin(ListQueuedCSRsHandler)).Methods("GET")
+	r.HandleFunc("/admin/csr/{csr-id}", RequireAdmin(ReadQueuedCSRHandler)).Methods("GET")
+	r.HandleFunc("/admin/csr/{csr-id}/approve", RequireAdmin(ApproveCSRHandler)).Methods("POST")
+	r.HandleFunc("/admin/csr/{csr-id}/deny", RequireAdmin(DenyCSRHandler)).Methods("POST")
+	r.HandleFunc("/admin/campaign", RequireAdmin(ListCampaignsHandler)).Methods("GET")
+	r.HandleFunc("/admin/campaign", RequireAdmin(CreateCampaignHandler)).Methods("POST")
+	r.HandleFunc("/admin/campaign/{campaign-id}", RequireAdmin(ReadCampaignHandler)).Methods("GET")
+	r.HandleFunc("/admin/campaign/{campaign-id}", RequireAdmin(DeleteCampaignHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/campaign/{campaign-id}/refresh", RequireAdmin(RefreshCampaignHandler)).Methods("POST")
+	r.HandleFunc("/admin/campaign/{campaign-id}/cert/{user-id}/{cert-id}", RequireAdmin(UpdateCampaignCertHandler)).Methods("PATCH")
+	r.HandleFunc("/admin/crl", RequireAdmin(ListCRLsHandler)).Methods("GET")
+	r.HandleFunc("/admin/crl/refresh", RequireAdmin(RefreshCRLsHandler)).Methods("POST")
+	r.HandleFunc("/admin/revocation/check", RequireAdmin(CheckRevocationsHandler)).Methods("POST")
+	r.HandleFunc("/admin/trust/roots", RequireAdmin(ListTrustRootsHandler)).Methods("GET")
+	r.HandleFunc("/admin/trust/roots", RequireAdmin(CreateTrustRootHandler)).Methods("POST")
+	r.HandleFunc("/admin/trust/roots/{root-id}", RequireAdmin(DeleteTrustRootHandler)).Methods("DELETE")
+	r.HandleFunc("/csr", SubmitCSRHandler).Methods("POST")
+	r.HandleFunc("/csr/{csr-id}", ReadCSRHandler).Methods("GET")
+	r.HandleFunc("/decode", DecodeHandler).Methods("POST")
+	r.HandleFunc("/sandbox/fixture", CreateFixtureHandler).Methods("POST")
+	r.HandleFunc("/export/{token}", DownloadExportHandler).Methods("GET")
+	r.HandleFunc("/freezes", ListFreezesHandler).Methods("GET")
+	r.HandleFunc("/match", MatchHandler).Methods("POST")
+	r.HandleFunc("/status", ReadStatusHandler).Methods("GET")
+	r.HandleFunc("/usage", RequireAdmin(ReadUsageHandler)).Methods("GET")
 	r.HandleFunc("/user", CreateUserHandler).Methods("POST")
 	r.HandleFunc("/user/{user-id}", ReadUserHandler).Methods("GET")
 	r.HandleFunc("/user/{user-id}", UpdateUserHandler).Methods("PATCH")
 	r.HandleFunc("/user/{user-id}", DeleteUserHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/transfer", TransferCertsHandler).Methods("POST")
+	r.HandleFunc("/user/{user-id}/merge", MergeUsersHandler).Methods("POST")
+	r.HandleFunc("/user/{user-id}/pins", ReadPinsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/domain", ListDomainsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/domain/{domain}", ReadDomainHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/domain/{domain}", CreateDomainHandler).Methods("PUT")
+	r.HandleFunc("/user/{user-id}/domain/{domain}", DeleteDomainHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/domain/{domain}/verify", VerifyDomainHandler).Methods("POST")
+	r.HandleFunc("/user/{user-id}/template", ListTemplatesHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/template/{template}", ReadTemplateHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/template/{template}", SaveTemplateHandler).Methods("PUT")
+	r.HandleFunc("/user/{user-id}/template/{template}", DeleteTemplateHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/template/{template}/request", RequireScope(ScopeKeyExport, TemplateRequestHandler)).Methods("POST")
+	r.HandleFunc("/user/{user-id}/resolve", ResolveHandler).Methods("POST")
+	r.HandleFunc("/user/{user-id}/audit", ListUserAuditHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert", ListCertsHandler).Methods("GET")
 	r.HandleFunc("/user/{user-id}/cert", CreateCertHandler).Methods("POST")
 	r.HandleFunc("/user/{user-id}/cert/{cert-id}", ReadCertHandler).Methods("GET")
 	r.HandleFunc("/user/{user-id}/cert/{cert-id}", UpdateCertHandler).Methods("PATCH")
 	r.HandleFunc("/user/{user-id}/cert/{cert-id}", DeleteCertHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/key", ReadKeyDetailsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/key/export", RequireScope(ScopeKeyExport, ExportKeyHandler)).Methods("POST")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/export", RequireScope(ScopeKeyExport, ExportCertHandler)).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/mint", RequireScope(ScopeMint, MintCertHandler)).Methods("POST")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/provision", RequireScope(ScopeMint, CreateProvisionBatchHandler)).Methods("POST")
+	r.HandleFunc("/user/{user-id}/provision", ListProvisionBatchesHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/provision/{batch-id}", ReadProvisionBatchHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/provision/{batch-id}", DeleteProvisionBatchHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/provision/{batch-id}/retry", RequireScope(ScopeMint, RetryProvisionBatchHandler)).Methods("POST")
+	r.HandleFunc("/user/{user-id}/provision/{batch-id}/export", RequireScope(ScopeKeyExport, ExportProvisionBatchHandler)).Methods("POST")
+	r.HandleFunc("/spiffe/{trust-domain}/bundle", ReadTrustBundleHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/holders", ReadCertHoldersHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/grant", ListCertGrantsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/grant", CreateGrantHandler).Methods("POST")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/grant/{grantee-id}", DeleteGrantHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/attachment", ListAttachmentsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/attachment/{name}", ReadAttachmentHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/attachment/{name}", CreateAttachmentHandler).Methods("PUT")
+	r.HandleFunc("/user/{user-id}/cert/{cert-id}/attachment/{name}", DeleteAttachmentHandler).Methods("DELETE")
+	r.HandleFunc("/user/{user-id}/shared", ListSharedCertsHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/shared/{cert-id}", ReadSharedCertHandler).Methods("GET")
+	r.HandleFunc("/user/{user-id}/shared/{cert-id}/key/export", RequireScope(ScopeKeyExport, ExportSharedKeyHandler)).Methods("POST")
 
-	http.Handle("/", r)
+	// Requests made over a WebSocket go through the same middleware as any other
+	handler := ServerMiddleware(r)
+	r.HandleFunc("/ws", RequireFlag(FlagWebSocket, WebSocketHandler(handler))).Methods("GET")
+
+	http.Handle("/", handler)
 	http.ListenAndServe(":8080", nil)
 }
 
+// Wrap the router in the middleware every request goes through, before it is routed
+func ServerMiddleware(next http.Handler) http.Handler {
+	return SecurityHeadersMiddleware(SandboxMiddleware(AnomalyMiddleware(StandbyMiddleware(next))))
+}
+
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Index help page goes here")
 }
@@ -106,21 +477,29 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		HandleError(w, r, err, http.StatusBadRequest)
 		return
 	}
-	if user.Id != "" {
-		HandleError(w, r, ErrNoIDOnNewUser, http.StatusBadRequest)
+	err = user.ValidateNormalize()
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-	if user.Name == "" {
-		HandleError(w, r, ErrInvalidUserName, http.StatusBadRequest)
+	rejectExpired, err := IsRejectExpired(r, Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-	if user.Email == "" {
-		HandleError(w, r, ErrInvalidUserEmail, http.StatusBadRequest)
-		return
+	if rejectExpired {
+		err = CheckNewUserNotExpired(user.Certs, Now())
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
 	}
-	err = user.ValidateNormalize()
+
+	// Check the certificates' names against the domain policy
+	domainWarnings, err := CheckNewUserDomainPolicy(user.Certs, Config())
 	if err != nil {
 		HandleError(w, r, err, 0)
+		return
 	}
 
 	// Store the user
@@ -129,9 +508,24 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		HandleError(w, r, err, 0)
 		return
 	}
+	Events.Publish(&Event{Type: EventUserCreated, UserId: user.Id})
+	warnings := append(user.warnings, domainWarnings...)
+	warnings = append(warnings, duplicateEmailWarnings(user)...)
+	Usage.Record(user.Id, UsageCertsCreated, int64(len(user.Certs)))
+	for i, certData := range user.Certs {
+		Events.Publish(&Event{Type: EventCertCreated, UserId: user.Id, CertId: certData.Id})
+		if details, err := certData.Details(); err == nil {
+			warnings = append(warnings, details.Warnings(fmt.Sprintf("certs[%d]", i))...)
+		}
+		warnings = append(warnings, keyReuseWarnings(certData, fmt.Sprintf("certs[%d]", i))...)
+		warnings = append(warnings, sanConflictWarnings(certData, fmt.Sprintf("certs[%d]", i))...)
+		// Private keys are only ever sent by the export endpoints
+		certData.Key = ""
+	}
 
 	// Send the result
-	SendResult(w, r, user)
+	user.CertCount = len(user.Certs)
+	SendResult(w, r, user, warnings...)
 }
 
 func ReadUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,32 +538,21 @@ func ReadUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the user from the database
-	user, err := DatabaseReadUser(userid)
+	// Get the user from the database, with a page of their certificates
+	certs, err := ParseUserCertsQuery(r)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
-
-	// Limit the certificates to only active or inactive certificates if specified
-	// TODO: Move this to a database query
-	limitcerts := r.URL.Query().Get("show-certs")
-	if limitcerts == LimitCertsActive {
-		for i, cert := range user.Certs {
-			if !cert.Active {
-				user.Certs = append(user.Certs[:i], user.Certs[i+1:]...)
-			}
-		}
-	} else if limitcerts == LimitCertsInactive {
-		for i, cert := range user.Certs {
-			if cert.Active {
-				user.Certs = append(user.Certs[:i], user.Certs[i+1:]...)
-			}
-		}
+	user, page, err := DatabaseReadUser(userid, certs)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
 	}
+	SummarizeCerts(user.Certs)
 
 	// Send the result
-	SendResult(w, r, user)
+	SendPagedResult(w, r, user, page)
 }
 
 func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -190,17 +573,14 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		HandleError(w, r, err, http.StatusBadRequest)
 		return
 	}
-	if userPatch.Id != "" {
-		HandleError(w, r, ErrBadUserPatchID, http.StatusBadRequest)
-		return
-	}
-	if len(userPatch.Certs) != 0 {
-		HandleError(w, r, ErrBadUserPatchCerts, http.StatusBadRequest)
+
+	// Get the user, with the page of their certificates the response is to have
+	certs, err := ParseUserCertsQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-
-	// Get the user
-	user, err := DatabaseReadUser(userid)
+	user, page, err := DatabaseReadUser(userid, certs)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
@@ -218,6 +598,7 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	err = user.ValidateNormalize()
 	if err != nil {
 		HandleError(w, r, err, 0)
+		return
 	}
 
 	// Save the user
@@ -226,9 +607,14 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		HandleError(w, r, err, 0)
 		return
 	}
+	Events.Publish(&Event{Type: EventUserUpdated, UserId: user.Id})
+	var warnings ValidationErrors
+	if userPatch.Email != "" {
+		warnings = duplicateEmailWarnings(user)
+	}
 
 	// Send the result
-	SendResult(w, r, user)
+	SendPagedResult(w, r, user, page, warnings...)
 }
 
 func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -241,20 +627,36 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dryRun, err := IsDryRun(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
 	// Delete the user
-	err = DatabaseDeleteUser(userid)
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	report, err := DatabaseDeleteUser(r.Context(), userid, reason, dryRun)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
+	if !dryRun {
+		Events.Publish(&Event{Type: EventUserDeleted, UserId: userid})
+	}
 
 	// Send the result
 	SendResult(w, r, struct {
-		Id string `json:"id"`
-	}{userid})
+		Id      string        `json:"id"`
+		Changes *ChangeReport `json:"changes"`
+	}{userid, report})
 }
 
-func CreateCertHandler(w http.ResponseWriter, r *http.Request) {
+func TransferCertsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	userid, err := GetUserID(r)
@@ -263,199 +665,990 @@ func CreateCertHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cert := new(Certificate)
+	// Load the transfer from the body
+	transfer := new(Transfer)
 	d := json.NewDecoder(r.Body)
-	err = d.Decode(cert)
+	err = d.Decode(transfer)
 	if err != nil {
-		HandleError(w, r, err, 0)
+		HandleError(w, r, err, http.StatusBadRequest)
 		return
 	}
-	if cert.UserId != userid {
-		HandleError(w, r, ErrInvalidUserId, 0)
+	transfer.FromId = userid
+	err = transfer.Validate()
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
 
-	certData := cert.GetData()
-
-	err = DatabaseCreateCert(certData)
+	dryRun, err := IsDryRun(r)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
-	// Send the result
-	SendResult(w, r, certData)
-}
-
-func ReadCertHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
 
-	userid, certid, err := GetUserCertID(r)
+	// Bulk changes wait for a change freeze to end, unless it is overridden
+	err = CheckChangeFreeze(r, reason, dryRun)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
-	certData, err := DatabaseReadCert(userid, certid)
+	report, err := DatabaseTransferCerts(r.Context(), transfer, reason, dryRun)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
+	if !dryRun {
+		for _, certid := range report.Certs {
+			Events.Publish(&Event{Type: EventCertTransferred, UserId: transfer.FromId, TargetId: transfer.ToId, CertId: certid})
+		}
+	}
 
 	// Send the result
-	SendResult(w, r, certData)
+	transfer.Certs = report.Certs
+	SendResult(w, r, struct {
+		*Transfer
+		Changes *ChangeReport `json:"changes"`
+	}{transfer, report})
 }
 
-func UpdateCertHandler(w http.ResponseWriter, r *http.Request) {
+func MergeUsersHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	userid, certid, err := GetUserCertID(r)
+	userid, err := GetUserID(r)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
-	// Load the patch from the body
-	certPatch := new(CertificateData)
+	// Load the merge from the body
+	merge := new(Merge)
 	d := json.NewDecoder(r.Body)
-	err = d.Decode(certPatch)
+	err = d.Decode(merge)
 	if err != nil {
-		HandleError(w, r, err, 0)
+		HandleError(w, r, err, http.StatusBadRequest)
 		return
 	}
-	if certPatch.Id != "" {
-		HandleError(w, r, ErrBadCertPatchID, http.StatusBadRequest)
+	merge.IntoId = userid
+	err = merge.Validate()
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-	if certPatch.UserId != "" {
-		HandleError(w, r, ErrBadUserPatchID, http.StatusBadRequest)
+
+	dryRun, err := IsDryRun(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-	if certPatch.Cert != "" {
-		HandleError(w, r, ErrBadCertPatchCert, http.StatusBadRequest)
+	certs, err := ParseUserCertsQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
-	if certPatch.Key != "" {
-		HandleError(w, r, ErrBadCertPatchKey, http.StatusBadRequest)
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
 		return
 	}
 
-	// Update the certficate
-	err = DatabaseUpdateCertActive(userid, certid, certPatch.Active)
+	// Bulk changes wait for a change freeze to end, unless it is overridden
+	err = CheckChangeFreeze(r, reason, dryRun)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
-	// Load the patched certificate to send it back
-	// TODO: This is a bit racey
-	certData, err := DatabaseReadCert(userid, certid)
+	report, err := DatabaseMergeUsers(r.Context(), merge, reason, dryRun)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
+	if !dryRun {
+		Events.Publish(&Event{Type: EventUserMerged, UserId: merge.IntoId, TargetId: merge.FromId})
+	}
 
-	// Send the result
-	SendResult(w, r, certData)
+	// Send back the merged user, with a page of their certificates. In a dry run nothing was merged, so this is the
+	// user as they are now.
+	user, page, err := DatabaseReadUser(userid, certs)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	SendPagedResult(w, r, struct {
+		*User
+		Changes *ChangeReport `json:"changes"`
+	}{user, report}, page)
 }
 
-func DeleteCertHandler(w http.ResponseWriter, r *http.Request) {
+func ListUserAuditHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	userid, certid, err := GetUserCertID(r)
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	q, err := ParseListQuery(r)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
-	err = DatabaseDeleteCert(userid, certid)
+	entries, page, err := DatabaseListUserAudit(userid, q)
 	if err != nil {
 		HandleError(w, r, err, 0)
 		return
 	}
 
 	// Send the result
-	SendResult(w, r, struct {
-		Id     string `json:"id"`
-		UserId string `json:"user"`
-	}{userid, certid})
+	SendPagedResult(w, r, entries, page)
 }
 
-func GetUserID(r *http.Request) (string, error) {
-	vars := mux.Vars(r)
-	userid := vars["user-id"]
-	// Verify the userid is numeric as a quick sanity check
-	if checkid, err := strconv.Atoi(userid); err != nil || checkid <= 0 {
-		return "", ErrNotFound
+func ListCertsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
 	}
-	return userid, nil
+
+	// Get the paging parameters and filters
+	query, err := ParseUserCertsQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	certs, page, err := DatabaseListCerts(userid, query.Cursor, query.Limit, query.Filter)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	SummarizeCerts(certs)
+
+	// Send the result
+	SendPagedResult(w, r, certs, page)
 }
 
-func GetUserCertID(r *http.Request) (string, string, error) {
+func CreateCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
 	userid, err := GetUserID(r)
 	if err != nil {
-		return "", "", err
+		HandleError(w, r, err, 0)
+		return
 	}
 
-	// Get the cert-id and verify the cert-id is 64 characters as a quick sanity check
-	vars := mux.Vars(r)
-	certid := vars["cert-id"]
-	if len(certid) != 64 {
-		return "", "", ErrNotFound
+	cert := new(Certificate)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(cert)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if cert.UserId != userid {
+		HandleError(w, r, ErrInvalidUserId, 0)
+		return
+	}
+	rejectExpired, err := IsRejectExpired(r, Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if rejectExpired {
+		err = cert.CheckNotExpired(Now())
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
+	}
+	err = cert.CheckOCSP(Config(), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = cert.CheckCT(Config(), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
 	}
 
-	return userid, certid, nil
-}
+	certData := cert.GetData()
 
-// Given an error, and an optional HTTP Status Code, deliver JSON to the client that describes the error
-// An httpCode of 0 may be given and an appropriate code will be determined from the error (defaults to 500)
-func HandleError(w http.ResponseWriter, r *http.Request, e error, httpCode int) {
-	res := HTTPResult{
-		Success: false,
-		Error:   e.Error(),
-		Result:  nil,
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
 	}
-	jsonResult, err := json.Marshal(res)
+	keepOthers, err := IsKeepOthers(r)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, e.Error(), http.StatusInternalServerError)
+		HandleError(w, r, err, 0)
 		return
 	}
 
-	if httpCode == 0 {
-		switch e {
-		case ErrNotFound:
-			httpCode = http.StatusNotFound
-		case ErrDSANotSupported,
-			ErrInvalidPEMBlock,
-			ErrInvalidCertificatePEM,
-			ErrInvalidCertificateId,
-			ErrInvalidPrivateKey,
-			ErrMissingPrivateKey,
-			ErrKeyTooSmall,
-			ErrInvalidUserId,
-			ErrInvalidUserName,
-			ErrInvalidUserEmail:
-			httpCode = http.StatusBadRequest
-		default:
-			httpCode = http.StatusInternalServerError
-		}
+	// Check the certificate's names against the user's domains
+	domainWarnings, err := CheckDomainPolicy(userid, certNames(cert.Cert), "cert", Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
 	}
 
-	http.Error(w, string(jsonResult), httpCode)
-}
+	deactivated, err := DatabaseCreateCert(r.Context(), certData, reason, Config().ExclusiveActive && certData.Active && !keepOthers)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventCertCreated, UserId: certData.UserId, CertId: certData.Id})
+	for _, id := range deactivated {
+		Events.Publish(&Event{Type: EventCertUpdated, UserId: certData.UserId, CertId: id})
+	}
+	Usage.Record(certData.UserId, UsageCertsCreated, 1)
 
-// Send a sucessful result to the client.
-func SendResult(w http.ResponseWriter, r *http.Request, result interface{}) {
-	res := HTTPResult{
-		Success: true,
-		Result:  result,
+	// Send the result. Private keys are only ever sent by the export endpoints.
+	certData.Key = ""
+	warnings := append(cert.Warnings, NewCertificateDetails(cert.Cert).Warnings("cert")...)
+	warnings = append(warnings, keyReuseWarnings(certData, "cert")...)
+	warnings = append(warnings, sanConflictWarnings(certData, "cert")...)
+	warnings = append(warnings, keptChainWarnings(certData, "chain")...)
+	warnings = append(warnings, domainWarnings...)
+	if len(deactivated) != 0 {
+		warnings.Add("active", WarnDeactivatedOthers)
 	}
-	jsonResult, err := json.Marshal(res)
+	SendResult(w, r, certData, warnings...)
+}
+
+func ReadCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
 	if err != nil {
 		HandleError(w, r, err, 0)
-	} else {
-		w.Write(jsonResult)
+		return
 	}
 
+	certData, err := DatabaseReadCert(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certData.Attachments, _, err = DatabaseListAttachments(userid, certid, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certData.CT, err = certData.CTStatus(Now())
+	if err != nil {
+		log.Println("Unable to check CT evidence of certificate", certid+":", err)
+	}
+
+	// Send the result
+	SendResult(w, r, certData)
+}
+
+func UpdateCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Load the patch from the body
+	certPatch := new(CertificatePatch)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(certPatch)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	err = certPatch.ValidateNormalize()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	keepOthers, err := IsKeepOthers(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Update the certficate
+	activating := certPatch.Active != nil && *certPatch.Active
+	deactivated, err := DatabaseUpdateCert(r.Context(), userid, certid, certPatch, reason, Config().ExclusiveActive && activating && !keepOthers)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: certid})
+	for _, id := range deactivated {
+		Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: id})
+	}
+
+	// Load the patched certificate to send it back
+	// TODO: This is a bit racey
+	certData, err := DatabaseReadCert(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	var warnings ValidationErrors
+	if len(deactivated) != 0 {
+		warnings.Add("active", WarnDeactivatedOthers)
+	}
+	SendResult(w, r, certData, warnings...)
+}
+
+func DeleteCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	dryRun, err := IsDryRun(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	report, err := DatabaseDeleteCert(r.Context(), userid, certid, reason, dryRun)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if !dryRun {
+		Events.Publish(&Event{Type: EventCertDeleted, UserId: userid, CertId: certid})
+	}
+
+	// Send the result
+	SendResult(w, r, struct {
+		Id      string        `json:"id"`
+		UserId  string        `json:"user"`
+		Changes *ChangeReport `json:"changes"`
+	}{certid, userid, report})
+}
+
+// Export a certificate's private key. A justification (the X-Change-Reason header) is always required.
+// The key is not returned: the result is a single-use link to download it from (see DownloadExportHandler).
+func ExportKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrMissingReason, 0)
+		return
+	}
+
+	link, err := DatabaseExportKey(r.Context(), userid, certid, userid, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Anomalies.RecordExport(r, certid)
+	Usage.Record(userid, UsageKeyExports, 1)
+
+	// Send the result
+	SendResult(w, r, link)
+}
+
+// Export a certificate with its chain and private key, as a PKCS#12 bundle encrypted with the caller's password, or a
+// JKS keystore protected with it. The keystore's alias is ?alias=, or "certstore". Unlike a key export, the bundle is
+// sent at once, since it is encrypted. A justification is always required.
+func ExportCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != ExportFormatPKCS12 && format != ExportFormatPKCS12Legacy && format != ExportFormatJKS {
+		HandleError(w, r, ErrInvalidExportFormat, 0)
+		return
+	}
+	alias, err := exportAlias(r.URL.Query().Get("alias"))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	password := r.Header.Get(ExportPasswordHeader)
+	if password == "" {
+		HandleError(w, r, ErrMissingExportPassword, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrMissingReason, 0)
+		return
+	}
+
+	certData, err := DatabaseExportCert(r.Context(), userid, certid, format, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Anomalies.RecordExport(r, certid)
+	Usage.Record(userid, UsageKeyExports, 1)
+	var bundle []byte
+	contentType, filename := "application/x-pkcs12", certData.Id+".p12"
+	if format == ExportFormatJKS {
+		bundle, err = EncodeJKS(certData, alias, password)
+		contentType, filename = "application/x-java-keystore", certData.Id+".jks"
+	} else {
+		bundle, err = EncodePKCS12(certData, format, password)
+	}
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Write(bundle)
+}
+
+func ReadKeyDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	certData, err := DatabaseReadKey(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	keyDetails, err := certData.KeyDetails()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, keyDetails)
+}
+
+func ReadCertHoldersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	holders, err := DatabaseReadCertHolders(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, struct {
+		Id    string   `json:"id"`
+		Users []string `json:"users"`
+	}{certid, holders})
+}
+
+func CreateGrantHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Load the grant from the body
+	grant := new(Grant)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(grant)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	grant.CertId = certid
+	grant.OwnerId = userid
+	err = grant.Validate()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	err = DatabaseCreateGrant(grant)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventGrantCreated, UserId: userid, TargetId: grant.UserId, CertId: certid})
+
+	// Send the result
+	SendResult(w, r, grant)
+}
+
+func ListCertGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	grants, page, err := DatabaseListCertGrants(userid, certid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, grants, page)
+}
+
+func DeleteGrantHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	granteeid := mux.Vars(r)["grantee-id"]
+	if checkid, err := strconv.Atoi(granteeid); err != nil || checkid <= 0 {
+		HandleError(w, r, ErrNotFound, 0)
+		return
+	}
+
+	dryRun, err := IsDryRun(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	report, err := DatabaseDeleteGrant(userid, certid, granteeid, dryRun)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if !dryRun {
+		Events.Publish(&Event{Type: EventGrantDeleted, UserId: userid, TargetId: granteeid, CertId: certid})
+	}
+
+	// Send the result
+	SendResult(w, r, struct {
+		*Grant
+		Changes *ChangeReport `json:"changes"`
+	}{&Grant{CertId: certid, OwnerId: userid, UserId: granteeid}, report})
+}
+
+func ListAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	attachments, page, err := DatabaseListAttachments(userid, certid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, attachments, page)
+}
+
+// Attach a file to a certificate. The body is the file itself, and its type is taken from the Content-Type header.
+func CreateAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err = ValidateAttachmentName(name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	config := Config()
+	mediaType, err := NormalizeAttachmentType(r.Header.Get("Content-Type"), config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Read one byte more than is allowed, so that we can tell if the file is too large
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(config.MaxAttachmentSize)+1))
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(data) > config.MaxAttachmentSize {
+		HandleError(w, r, ErrAttachmentTooLarge, 0)
+		return
+	}
+
+	attachment := &Attachment{
+		CertId: certid,
+		UserId: userid,
+		Name:   name,
+		Type:   mediaType,
+		Size:   len(data),
+		Data:   data,
+	}
+	err = DatabaseCreateAttachment(r.Context(), attachment, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: certid})
+
+	// Send the result
+	SendResult(w, r, attachment)
+}
+
+// Send an attachment's data as-is, with the type it was attached with
+func ReadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if ValidateAttachmentName(name) != nil {
+		HandleError(w, r, ErrNotFound, 0)
+		return
+	}
+
+	attachment, err := DatabaseReadAttachment(userid, certid, name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Attachments are whatever the client uploaded, so make sure browsers never render them inline
+	w.Header().Set("Content-Type", attachment.Type)
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	w.Write(attachment.Data)
+}
+
+func DeleteAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if ValidateAttachmentName(name) != nil {
+		HandleError(w, r, ErrNotFound, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	attachment, err := DatabaseDeleteAttachment(r.Context(), userid, certid, name, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: certid})
+
+	// Send the result
+	SendResult(w, r, attachment)
+}
+
+func ListSharedCertsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	grants, page, err := DatabaseListUserGrants(userid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, grants, page)
+}
+
+func ReadSharedCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	certData, grant, err := DatabaseReadSharedCert(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, struct {
+		*CertificateData
+		Access string `json:"access"`
+	}{certData, grant.Access})
+}
+
+// Export the private key of a certificate shared with deploy access. A justification is always required.
+func ExportSharedKeyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrMissingReason, 0)
+		return
+	}
+
+	link, err := DatabaseExportSharedKey(r.Context(), userid, certid, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Anomalies.RecordExport(r, certid)
+	Usage.Record(userid, UsageKeyExports, 1)
+
+	// Send the result
+	SendResult(w, r, link)
+}
+
+// Download an exported private key, using the link from an export endpoint. The link is all that is needed,
+// and it stops working once it has been used.
+func DownloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	// Guessing links is an attempt at authentication like any other
+	if !allowAttempt(w, r, ClientIPKey(r)) {
+		return
+	}
+	id, err := ParseExportToken(mux.Vars(r)["token"])
+	if err != nil {
+		failedAttempt(r, "export-link", ClientIPKey(r))
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	certData, err := DatabaseDownloadKeyExport(r.Context(), id)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": certData.Id + ".key"}))
+	w.Write([]byte(certData.Key))
+}
+
+func GetUserID(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+	userid := vars["user-id"]
+	// Verify the userid is numeric as a quick sanity check
+	if checkid, err := strconv.Atoi(userid); err != nil || checkid <= 0 {
+		return "", ErrNotFound
+	}
+	return userid, nil
+}
+
+func GetUserCertID(r *http.Request) (string, string, error) {
+	userid, err := GetUserID(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Get the cert-id. Other references to a certificate (see certref.go) are resolved to its cert-id.
+	vars := mux.Vars(r)
+	ref, err := ParseCertRef(vars["cert-id"])
+	if err != nil {
+		return "", "", err
+	}
+	if ref.IsCertId() {
+		return userid, ref.Value, nil
+	}
+	certid, err := DatabaseResolveCertRef(userid, ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	return userid, certid, nil
+}
+
+// Given an error, and an optional HTTP Status Code, deliver JSON to the client that describes the error
+// An httpCode of 0 may be given and an appropriate code will be determined from the error (defaults to 500)
+// The error message is localized according to the client's Accept-Language header.
+func HandleError(w http.ResponseWriter, r *http.Request, e error, httpCode int) {
+	res := HTTPResult{
+		Success: false,
+		Error:   Redact(LocalizeError(w, r, e)),
+		Code:    ErrorCode(e),
+		Result:  nil,
+	}
+	var fieldErrs ValidationErrors
+	if errors.As(e, &fieldErrs) {
+		res.Errors = fieldErrorResults(w, r, fieldErrs)
+	}
+	if httpCode == 0 {
+		var apiErr *Error
+		if errors.As(e, &apiErr) && apiErr.StatusCode != 0 {
+			httpCode = apiErr.StatusCode
+		} else {
+			httpCode = http.StatusInternalServerError
+		}
+	}
+
+	if NegotiateEncoding(r) == EncodingJSON {
+		jsonResult, err := marshalJSONResult(w, r, &res)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, Redact(e.Error()), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, string(jsonResult), httpCode)
+		return
+	}
+
+	body, err := encodeResult(w, r, &res)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, Redact(e.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(httpCode)
+	w.Write(body)
+}
+
+// Send a sucessful result to the client, along with any warnings.
+func SendResult(w http.ResponseWriter, r *http.Request, result interface{}, warnings ...*FieldError) {
+	res := HTTPResult{
+		Success:  true,
+		Result:   result,
+		Warnings: fieldErrorResults(w, r, append(warnings[:len(warnings):len(warnings)], requestWarnings(r)...)),
+	}
+	body, err := encodeResult(w, r, &res)
+	if err != nil {
+		HandleError(w, r, err, 0)
+	} else {
+		w.Write(body)
+	}
+
+}
+
+// Send a sucessful page of results to the client, along with the cursors for the neighbouring pages.
+func SendPagedResult(w http.ResponseWriter, r *http.Request, result interface{}, page *Page, warnings ...*FieldError) {
+	res := HTTPResult{
+		Success:  true,
+		Result:   result,
+		Warnings: fieldErrorResults(w, r, append(warnings[:len(warnings):len(warnings)], requestWarnings(r)...)),
+		Next:     page.Next.Encode(),
+		Prev:     page.Prev.Encode(),
+	}
+	body, err := encodeResult(w, r, &res)
+	if err != nil {
+		HandleError(w, r, err, 0)
+	} else {
+		w.Write(body)
+	}
 }
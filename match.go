@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// The most certificates, and the most keys, that can be matched at once
+const maxMatchItems = 1000
+
+var (
+	ErrTooManyToMatch = NewError("too-many-to-match", http.StatusBadRequest, "Too many certificates or keys to match at once. At most 1000 of each can be matched.")
+	ErrNothingToMatch = NewError("nothing-to-match", http.StatusBadRequest, "Give at least one certificate and one private key to match.")
+)
+
+// Certificates and private keys to pair up, such as the files in a directory, before they are uploaded.
+// Nothing is stored.
+type MatchRequest struct {
+	Certs []string `json:"certs"` // PEM encoded certificates
+	Keys  []string `json:"keys"`  // PEM encoded private keys
+}
+
+// A certificate and a private key that go together, by their positions in the request
+type MatchPair struct {
+	Cert   int    `json:"cert"`
+	Key    int    `json:"key"`
+	CertId string `json:"certId"` // The cert-id the certificate would be stored under
+	SPKI   string `json:"spki"`   // SHA256 of the public key, as used in spki: references (see certref.go)
+}
+
+// The pairs found, and what was left over
+type MatchResult struct {
+	Pairs          []*MatchPair `json:"pairs"`
+	UnmatchedCerts []int        `json:"unmatchedCerts"`
+	UnmatchedKeys  []int        `json:"unmatchedKeys"`
+}
+
+// Does a private key go with a certificate?
+func publicKeysMatch(cert *x509.Certificate, key crypto.Signer) bool {
+	pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(key.Public())
+}
+
+// Parse a PEM encoded private key that can be compared with a certificate's public key
+func parseSignerPEM(data string) (crypto.Signer, error) {
+	key, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrInvalidPrivateKey
+	}
+	return signer, nil
+}
+
+// Pair up certificates and private keys by public key. Entries that can't be parsed are reported, but don't stop the
+// rest being matched. A certificate or key given more than once is paired each time.
+func MatchCertsKeys(req *MatchRequest) (*MatchResult, ValidationErrors) {
+	var problems ValidationErrors
+	certs := make([]*x509.Certificate, len(req.Certs))
+	for i, data := range req.Certs {
+		cert, err := ParseCertificatePEM(data)
+		problems.Add("certs["+strconv.Itoa(i)+"]", err)
+		certs[i] = cert
+	}
+	keys := make([]crypto.Signer, len(req.Keys))
+	for i, data := range req.Keys {
+		key, err := parseSignerPEM(data)
+		problems.Add("keys["+strconv.Itoa(i)+"]", err)
+		keys[i] = key
+	}
+
+	result := &MatchResult{Pairs: []*MatchPair{}, UnmatchedCerts: []int{}, UnmatchedKeys: []int{}}
+	keyMatched := make([]bool, len(keys))
+	for i, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		matched := false
+		for j, key := range keys {
+			if key == nil || !publicKeysMatch(cert, key) {
+				continue
+			}
+			id := sha256.Sum256(cert.Raw)
+			spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			result.Pairs = append(result.Pairs, &MatchPair{Cert: i, Key: j, CertId: hex.EncodeToString(id[:]), SPKI: hex.EncodeToString(spki[:])})
+			matched, keyMatched[j] = true, true
+		}
+		if !matched {
+			result.UnmatchedCerts = append(result.UnmatchedCerts, i)
+		}
+	}
+	for j, key := range keys {
+		if key != nil && !keyMatched[j] {
+			result.UnmatchedKeys = append(result.UnmatchedKeys, j)
+		}
+	}
+	return result, problems
+}
+
+// Pair up certificates and private keys. Entries that couldn't be parsed are reported as warnings.
+func MatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req := new(MatchRequest)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(req)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Certs) == 0 || len(req.Keys) == 0 {
+		HandleError(w, r, ErrNothingToMatch, 0)
+		return
+	}
+	if len(req.Certs) > maxMatchItems || len(req.Keys) > maxMatchItems {
+		HandleError(w, r, ErrTooManyToMatch, 0)
+		return
+	}
+
+	result, problems := MatchCertsKeys(req)
+
+	// Send the result
+	SendResult(w, r, result, problems...)
+}
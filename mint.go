@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a minted certificate is valid for when the request doesn't say
+const defaultMintValidity = 24 * time.Hour
+
+// Expired minted certificates are deleted this many at a time
+const mintCleanupBatchSize = 100
+
+var (
+	ErrNotDelegationCapable = NewError("not-delegation-capable", http.StatusBadRequest, "The certificate can't sign certificates. Minting needs a CA certificate that may be used for certificate signing.")
+	ErrParentNotUsable      = NewError("parent-not-usable", http.StatusConflict, "The certificate is inactive or isn't currently valid, so it can't mint certificates.")
+	ErrInvalidMintValidity  = NewError("invalid-mint-validity", http.StatusBadRequest, "Invalid validity. Give a duration such as \"24h\", no longer than the maxMintValidity option.")
+	ErrMintOutlivesParent   = NewError("mint-outlives-parent", http.StatusBadRequest, "The minted certificate would outlive the certificate minting it. Give a shorter validity.")
+	ErrInvalidMintName      = NewError("invalid-mint-name", http.StatusBadRequest, "Names must be DNS names or IP addresses. Wildcards can't be minted.")
+)
+
+// Workloads that want their certificates rotated often, without the long-lived key being touched each time, can have
+// short-lived certificates minted for them. A user's stored CA certificate (one that may sign certificates) signs a
+// new leaf certificate, for the names asked for, valid for hours or days: up to the MaxMintValidity option, and never
+// past the CA certificate's own expiry. The leaf's key is a new P-256 key, and its chain is the CA certificate and the
+// CA certificate's own chain. The leaf is stored as an active certificate of the same user, with notes saying where it
+// came from, and its key is exported like any other. Minting needs a mint scope token, since it issues certificates
+// for any names the CA may sign, and is refused if the names' CAA records don't allow it (see caa.go).
+//
+// Minted certificates are deleted once they expire, by a background job. The deletions are audited as any other, and
+// aren't held up by change freezes, since the certificates are no longer any use.
+
+// A request to mint a short-lived certificate
+type MintRequest struct {
+	Names    []string `json:"names"`    // DNS names and IP addresses. The first is also the common name.
+	Validity string   `json:"validity"` // How long the certificate is valid for, such as "24h". Empty means a day, or the most allowed if less.
+	SPIFFEID string   `json:"spiffeId"` // Mint an X.509-SVID with this SPIFFE ID (see spiffe.go). Names are optional then.
+}
+
+// A minted certificate that has expired, to be deleted
+type MintedCert struct {
+	UserId string
+	CertId string
+}
+
+// Check that a certificate may sign certificates
+func checkDelegationCapable(cert *x509.Certificate) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return ErrNotDelegationCapable
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return ErrNotDelegationCapable
+	}
+	return nil
+}
+
+// Normalize the names a certificate is to be minted for, in lower case
+func normalizeMintNames(names []string, required bool) ([]string, error) {
+	if len(names) == 0 && required {
+		return nil, &FieldError{"names", ErrRequiredField}
+	}
+	var errs ValidationErrors
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if net.ParseIP(name) == nil && !isDNSName(name) {
+			errs.Add("names["+strconv.Itoa(i)+"]", ErrInvalidMintName)
+		}
+		normalized[i] = name
+	}
+	return normalized, errs.Err()
+}
+
+// Check a lower case DNS name, without wildcards
+func isDNSName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Get a random 128 bit serial number for a new certificate
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// A parent certificate that may sign certificates now, parsed: its certificate, key and chain
+type mintParent struct {
+	Cert  *x509.Certificate
+	Key   crypto.Signer
+	Chain []*x509.Certificate
+}
+
+// Parse a parent certificate, checking that it may sign certificates now
+func parseMintParent(parent *CertificateData, now time.Time) (*mintParent, error) {
+	cert, err := ParseCertificatePEM(string(parent.Cert))
+	if err != nil {
+		return nil, err
+	}
+	err = checkDelegationCapable(cert)
+	if err != nil {
+		return nil, err
+	}
+	if !parent.Active || !IsValidAt(cert.NotBefore, cert.NotAfter, now) {
+		return nil, ErrParentNotUsable
+	}
+	key, err := parseSignerPEM(string(parent.Key))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ParseChainPEM(string(parent.Chain))
+	if err != nil {
+		return nil, err
+	}
+	return &mintParent{Cert: cert, Key: key, Chain: chain}, nil
+}
+
+// Mint a short-lived certificate signed by a parent certificate and its key
+func MintCertificate(parent *CertificateData, req *MintRequest, config *RuntimeConfig, now time.Time) (*Certificate, error) {
+	signer, err := parseMintParent(parent, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var spiffeID *url.URL
+	if req.SPIFFEID != "" {
+		spiffeID, err = ParseSPIFFEID(req.SPIFFEID)
+		if err != nil {
+			return nil, &FieldError{"spiffeId", err}
+		}
+		err = checkTrustDomainCA(config, spiffeID.Host, parent)
+		if err != nil {
+			return nil, &FieldError{"spiffeId", err}
+		}
+	}
+	names, err := normalizeMintNames(req.Names, spiffeID == nil)
+	if err != nil {
+		return nil, err
+	}
+	maxValidity := time.Duration(config.MaxMintValidity)
+	validity := defaultMintValidity
+	if validity > maxValidity {
+		validity = maxValidity
+	}
+	if req.Validity != "" {
+		validity, err = time.ParseDuration(req.Validity)
+		if err != nil {
+			return nil, &FieldError{"validity", ErrInvalidMintValidity}
+		}
+	}
+	if validity <= 0 || validity > maxValidity {
+		return nil, &FieldError{"validity", ErrInvalidMintValidity}
+	}
+	notAfter := now.Add(validity)
+	if notAfter.After(signer.Cert.NotAfter) {
+		return nil, &FieldError{"validity", ErrMintOutlivesParent}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             now,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if len(names) != 0 {
+		template.Subject = pkix.Name{CommonName: names[0]}
+	}
+	if spiffeID != nil {
+		template.URIs = []*url.URL{spiffeID}
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.Cert, key.Public(), signer.Key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(der)
+	return &Certificate{
+		Id:     hex.EncodeToString(hash[:]),
+		UserId: parent.UserId,
+		Active: true,
+		Cert:   cert,
+		Key:    key,
+		Chain:  append([]*x509.Certificate{signer.Cert}, signer.Chain...),
+		Notes:  "Short-lived certificate minted from " + parent.Id,
+	}, nil
+}
+
+// Delete the minted certificates that have expired
+func CleanupMinted(now time.Time) (int, error) {
+	deleted := 0
+	for {
+		expired, err := DatabaseListExpiredMinted(now, mintCleanupBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		for _, minted := range expired {
+			_, err = DatabaseDeleteCert(context.Background(), minted.UserId, minted.CertId, "Expired short-lived certificate", false)
+			if err != nil {
+				return deleted, err
+			}
+			Events.Publish(&Event{Type: EventCertDeleted, UserId: minted.UserId, CertId: minted.CertId})
+			deleted++
+		}
+		if len(expired) < mintCleanupBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// Delete expired minted certificates every interval, unless this is a standby
+func CleanupMintedEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if Replica.Standby() {
+			continue
+		}
+		deleted, err := CleanupMinted(Now())
+		if err != nil {
+			log.Println("Unable to delete expired short-lived certificates:", err)
+		}
+		if deleted != 0 {
+			log.Printf("Deleted %d expired short-lived certificates", deleted)
+		}
+	}
+}
+
+// Mint a short-lived certificate from one of a user's CA certificates
+func MintCertHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	req := new(MintRequest)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(req)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	keepOthers, err := IsKeepOthers(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	parent, err := DatabaseReadKey(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	config := Config()
+	caa, err := CheckCAA(req.Names, "names", config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	cert, err := MintCertificate(parent, req, config, Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	warnings, err := CheckDomainPolicy(userid, certNames(cert.Cert), "names", config)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certData := cert.GetData()
+
+	deactivated, err := DatabaseCreateMintedCert(r.Context(), certData, certid, reason, config.ExclusiveActive && !keepOthers, caa)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Events.Publish(&Event{Type: EventCertCreated, UserId: certData.UserId, CertId: certData.Id})
+	for _, id := range deactivated {
+		Events.Publish(&Event{Type: EventCertUpdated, UserId: certData.UserId, CertId: id})
+	}
+	Usage.Record(certData.UserId, UsageCertsCreated, 1)
+
+	// Send the result. Private keys are only ever sent by the export endpoints.
+	certData.Key = ""
+	if len(deactivated) != 0 {
+		warnings.Add("active", WarnDeactivatedOthers)
+	}
+	SendResult(w, r, certData, warnings...)
+}
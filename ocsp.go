@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How OCSP failures are handled (see the OCSPCheck option)
+const (
+	OCSPCheckOff      = "off"
+	OCSPCheckSoftFail = "soft-fail" // Store the certificate with a warning if its status can't be found
+	OCSPCheckHardFail = "hard-fail" // Reject the certificate unless it is known to be good
+)
+
+// The OCSP status recorded with a certificate. Empty if it wasn't checked.
+const (
+	OCSPStatusGood        = "good"
+	OCSPStatusRevoked     = "revoked"
+	OCSPStatusUnknown     = "unknown"     // The responder doesn't know the certificate
+	OCSPStatusUnavailable = "unavailable" // The responder couldn't be asked, or its answer couldn't be used
+)
+
+// How long an OCSP responder may take to answer
+const ocspTimeout = 5 * time.Second
+
+// The largest OCSP response read
+const maxOCSPResponse = 1 << 16
+
+var (
+	ErrCertRevoked       = NewError("cert-revoked", http.StatusBadRequest, "The certificate has been revoked by its CA.")
+	ErrOCSPUnknown       = NewError("ocsp-unknown", http.StatusBadRequest, "The certificate's OCSP responder doesn't know the certificate, so its revocation status couldn't be checked.")
+	ErrOCSPMissingIssuer = NewError("ocsp-missing-issuer", http.StatusBadRequest, "The certificate's issuer is needed to check its revocation status. Include it in the chain.")
+	ErrOCSPUnavailable   = NewError("ocsp-unavailable", http.StatusServiceUnavailable, "The certificate's OCSP responder couldn't be reached, so its revocation status couldn't be checked. Try again later.")
+
+	WarnOCSPUnchecked = NewError("ocsp-unchecked", 0, "The certificate's revocation status couldn't be checked with its OCSP responder.")
+)
+
+// When a certificate is uploaded, its revocation status can be checked with the OCSP responder named in its authority
+// information access extension, as the OCSPCheck option says:
+//
+// - "off" doesn't check.
+// - "soft-fail" rejects revoked certificates, but stores certificates whose status couldn't be found (the responder
+//   couldn't be reached, didn't know the certificate, or the issuer isn't in the chain) with a warning.
+// - "hard-fail" rejects every certificate that isn't known to be good.
+//
+// Certificates that don't name a responder aren't checked. The status and when it was checked are stored with the
+// certificate, and shared by every user holding it. The status isn't checked again later.
+
+// Asks an OCSP responder about a certificate, returning the raw response. Replaced in tests.
+var queryOCSP = httpQueryOCSP
+
+// Post an OCSP request to a responder
+func httpQueryOCSP(responder string, request []byte) ([]byte, error) {
+	client := &http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OCSP responder " + responder + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+}
+
+// Find a certificate's issuer in its chain
+func chainIssuer(cert *x509.Certificate, chain []*x509.Certificate) *x509.Certificate {
+	for _, c := range chain {
+		if bytes.Equal(cert.RawIssuer, c.RawSubject) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Ask a certificate's OCSP responders about it, in turn until one answers
+func ocspResponse(cert, issuer *x509.Certificate, now time.Time) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("the certificate doesn't name an OCSP responder")
+	}
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, responder := range cert.OCSPServer {
+		var raw []byte
+		var resp *ocsp.Response
+		raw, err = queryOCSP(responder, request)
+		if err == nil {
+			resp, err = ocsp.ParseResponseForCert(raw, cert, issuer)
+		}
+		if err == nil && !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+			err = errors.New("stale OCSP response from " + responder)
+		}
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// Ask a certificate's OCSP responders for its status
+func ocspStatus(cert, issuer *x509.Certificate, now time.Time) (string, error) {
+	resp, err := ocspResponse(cert, issuer, now)
+	if err != nil {
+		return "", err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return OCSPStatusGood, nil
+	case ocsp.Revoked:
+		return OCSPStatusRevoked, nil
+	default:
+		return OCSPStatusUnknown, nil
+	}
+}
+
+// Check a new certificate's revocation status with its OCSP responder, as the OCSPCheck option says, recording it on
+// the certificate. A revoked certificate is always rejected.
+func (cert *Certificate) CheckOCSP(config *RuntimeConfig, now time.Time) error {
+	if config.OCSPCheck == OCSPCheckOff || len(cert.Cert.OCSPServer) == 0 {
+		return nil
+	}
+	hardFail := config.OCSPCheck == OCSPCheckHardFail
+
+	issuer := chainIssuer(cert.Cert, cert.Chain)
+	if issuer == nil {
+		if hardFail {
+			return &FieldError{"chain", ErrOCSPMissingIssuer}
+		}
+		cert.OCSPStatus, cert.OCSPChecked = OCSPStatusUnavailable, NewUTCTime(now)
+		cert.Warnings.Add("chain", WarnOCSPUnchecked)
+		return nil
+	}
+
+	status, err := ocspStatus(cert.Cert, issuer, now)
+	if err != nil {
+		log.Println("Unable to check OCSP status:", err)
+		status = OCSPStatusUnavailable
+	}
+	cert.OCSPStatus, cert.OCSPChecked = status, NewUTCTime(now)
+	switch {
+	case status == OCSPStatusRevoked:
+		return &FieldError{"cert", ErrCertRevoked}
+	case status == OCSPStatusGood:
+		return nil
+	case hardFail && status == OCSPStatusUnknown:
+		return &FieldError{"cert", ErrOCSPUnknown}
+	case hardFail:
+		return &FieldError{"cert", ErrOCSPUnavailable}
+	}
+	cert.Warnings.Add("cert", WarnOCSPUnchecked)
+	return nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// The OpenAPI document describing the API. Requests are validated against it by OpenAPIValidationMiddleware.
+	//go:embed openapi.json
+	OpenAPIDocument []byte
+
+	ErrInvalidJSON      = NewError("invalid-json", http.StatusBadRequest, "The request body is not valid JSON.")
+	ErrMissingBody      = NewError("missing-body", http.StatusBadRequest, "A request body is required.")
+	ErrRequestTooLarge  = NewError("request-too-large", http.StatusRequestEntityTooLarge, "The request body is too large.")
+	ErrRequiredField    = NewError("required-field", http.StatusBadRequest, "This field is required.")
+	ErrReadOnlyField    = NewError("read-only-field", http.StatusBadRequest, "This field may not be set in a request.")
+	ErrUnknownField     = NewError("unknown-field", http.StatusBadRequest, "This field is not recognized.")
+	ErrInvalidFieldType = NewError("invalid-type", http.StatusBadRequest, "This field is of the wrong type.")
+	ErrInvalidEnum      = NewError("invalid-enum", http.StatusBadRequest, "This field is not one of the allowed values.")
+	ErrInvalidFormat    = NewError("invalid-format", http.StatusBadRequest, "This field is not correctly formatted.")
+	ErrFieldTooShort    = NewError("too-short", http.StatusBadRequest, "This field is too short.")
+	ErrFieldTooLong     = NewError("too-long", http.StatusBadRequest, "This field is too long.")
+	ErrBelowMinimum     = NewError("below-minimum", http.StatusBadRequest, "This field is below the minimum allowed value.")
+)
+
+// OpenAPISpec is the subset of an OpenAPI 3 document needed to validate requests.
+// Supported schema keywords are $ref, type, properties, required, additionalProperties (boolean only),
+// items, enum, pattern, format (date-time only), minimum, minLength, maxLength and readOnly.
+type OpenAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]*apiParameter `json:"parameters"`
+		Schemas    map[string]*apiSchema    `json:"schemas"`
+	} `json:"components"`
+
+	operations map[string]*apiOperation // Keyed by method and path template, eg "PATCH /user/{user-id}"
+}
+
+type apiOperation struct {
+	Parameters  []*apiParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *apiSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// The largest request body an operation takes: MaxRequestSize, or MaxAttachmentSize for binary bodies if it is larger
+func (op *apiOperation) maxBodySize(config *RuntimeConfig) int64 {
+	size := config.MaxRequestSize
+	if op.RequestBody != nil {
+		for _, content := range op.RequestBody.Content {
+			if content.Schema != nil && content.Schema.Format == "binary" && config.MaxAttachmentSize > size {
+				size = config.MaxAttachmentSize
+			}
+		}
+	}
+	return int64(size)
+}
+
+type apiParameter struct {
+	Ref      string     `json:"$ref"`
+	Name     string     `json:"name"`
+	In       string     `json:"in"`
+	Required bool       `json:"required"`
+	Schema   *apiSchema `json:"schema"`
+}
+
+type apiSchema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Properties           map[string]*apiSchema `json:"properties"`
+	Required             []string              `json:"required"`
+	AdditionalProperties *bool                 `json:"additionalProperties"`
+	Items                *apiSchema            `json:"items"`
+	Enum                 []interface{}         `json:"enum"`
+	Pattern              string                `json:"pattern"`
+	Format               string                `json:"format"`
+	Minimum              *float64              `json:"minimum"`
+	MinLength            *int                  `json:"minLength"`
+	MaxLength            *int                  `json:"maxLength"`
+	ReadOnly             bool                  `json:"readOnly"`
+
+	compileOnce sync.Once
+	pattern     *regexp.Regexp
+}
+
+// Parse an OpenAPI document
+func LoadOpenAPISpec(document []byte) (*OpenAPISpec, error) {
+	spec := new(OpenAPISpec)
+	err := json.Unmarshal(document, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flatten path-level parameters into each operation
+	spec.operations = make(map[string]*apiOperation)
+	for path, item := range spec.Paths {
+		var pathParams []*apiParameter
+		if raw, ok := item["parameters"]; ok {
+			err = json.Unmarshal(raw, &pathParams)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for method, raw := range item {
+			if method == "parameters" || method == "summary" || method == "description" {
+				continue
+			}
+			op := new(apiOperation)
+			err = json.Unmarshal(raw, op)
+			if err != nil {
+				return nil, err
+			}
+			op.Parameters = append(append([]*apiParameter{}, pathParams...), op.Parameters...)
+			for i, param := range op.Parameters {
+				op.Parameters[i] = spec.resolveParameter(param)
+			}
+			spec.operations[strings.ToUpper(method)+" "+path] = op
+		}
+	}
+
+	return spec, nil
+}
+
+// Get the operation for a method and a path template, or nil if the spec doesn't describe it
+func (spec *OpenAPISpec) Operation(method, path string) *apiOperation {
+	return spec.operations[method+" "+path]
+}
+
+func (spec *OpenAPISpec) resolveParameter(param *apiParameter) *apiParameter {
+	if param.Ref == "" {
+		return param
+	}
+	if resolved, ok := spec.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]; ok {
+		return resolved
+	}
+	return param
+}
+
+// Resolve a $ref. Any readOnly next to the $ref is kept.
+func (spec *OpenAPISpec) resolveSchema(schema *apiSchema) *apiSchema {
+	for depth := 0; schema.Ref != "" && depth < 16; depth++ {
+		resolved, ok := spec.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if !ok {
+			return schema
+		}
+		if schema.ReadOnly && !resolved.ReadOnly {
+			return &apiSchema{Ref: resolved.Ref, Type: resolved.Type, Properties: resolved.Properties, Required: resolved.Required,
+				AdditionalProperties: resolved.AdditionalProperties, Items: resolved.Items, Enum: resolved.Enum, Pattern: resolved.Pattern,
+				Format: resolved.Format, Minimum: resolved.Minimum, MinLength: resolved.MinLength, MaxLength: resolved.MaxLength, ReadOnly: true}
+		}
+		schema = resolved
+	}
+	return schema
+}
+
+// Validate a request against an operation. Path parameters that don't match are reported as ErrNotFound,
+// everything else is reported as ValidationErrors.
+func (spec *OpenAPISpec) ValidateRequest(op *apiOperation, r *http.Request, body []byte) error {
+	var errs ValidationErrors
+
+	// Parameters
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		var value string
+		var present bool
+		switch param.In {
+		case "path":
+			value, present = vars[param.Name]
+		case "query":
+			present = len(query[param.Name]) != 0
+			value = query.Get(param.Name)
+		case "header":
+			value = r.Header.Get(param.Name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present {
+			if param.Required {
+				errs.Add(param.Name, ErrRequiredField)
+			}
+			continue
+		}
+		if param.Schema == nil {
+			continue
+		}
+		err := spec.validateParameter(value, param.Schema)
+		if err != nil {
+			if param.In == "path" {
+				return ErrNotFound
+			}
+			errs.Add(param.Name, err)
+		}
+	}
+
+	// Body. Bodies of the other media types an operation takes, such as CSV, are left to the handler.
+	if op.RequestBody != nil {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		_, other := op.RequestBody.Content[mediaType]
+		if len(bytes.TrimSpace(body)) == 0 {
+			if op.RequestBody.Required {
+				return ErrMissingBody
+			}
+		} else if other && mediaType != MediaTypeJSON {
+			return errs.Err()
+		} else if content, ok := op.RequestBody.Content["application/json"]; ok && content.Schema != nil {
+			var value interface{}
+			err := json.Unmarshal(body, &value)
+			if err != nil {
+				return ErrInvalidJSON.Wrap(err)
+			}
+			spec.validateValue("", value, content.Schema, &errs)
+		}
+	}
+
+	return errs.Err()
+}
+
+// Parameters arrive as strings, so convert them to the type in the schema before validating them
+func (spec *OpenAPISpec) validateParameter(value string, schema *apiSchema) error {
+	var errs ValidationErrors
+	var typed interface{} = value
+	switch spec.resolveSchema(schema).Type {
+	case "integer", "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return ErrInvalidFieldType
+		}
+		typed = f
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return ErrInvalidFieldType
+		}
+		typed = b
+	}
+	spec.validateValue("", typed, schema, &errs)
+	if len(errs) != 0 {
+		return errs[0].Err
+	}
+	return nil
+}
+
+// Validate a decoded JSON value against a schema, adding an error for every problem found
+func (spec *OpenAPISpec) validateValue(field string, value interface{}, schema *apiSchema, errs *ValidationErrors) {
+	schema = spec.resolveSchema(schema)
+
+	// Check the type
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			errs.Add(field, ErrInvalidFieldType)
+			return
+		}
+		spec.validateObject(field, obj, schema, errs)
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			errs.Add(field, ErrInvalidFieldType)
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range arr {
+				spec.validateValue(field+"["+strconv.Itoa(i)+"]", item, schema.Items, errs)
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			errs.Add(field, ErrInvalidFieldType)
+			return
+		}
+		if schema.MinLength != nil && len(s) < *schema.MinLength {
+			errs.Add(field, ErrFieldTooShort)
+			return
+		}
+		if schema.MaxLength != nil && len(s) > *schema.MaxLength {
+			errs.Add(field, ErrFieldTooLong)
+			return
+		}
+		if schema.Pattern != "" {
+			schema.compileOnce.Do(func() { schema.pattern, _ = regexp.Compile(schema.Pattern) })
+			if schema.pattern != nil && !schema.pattern.MatchString(s) {
+				errs.Add(field, ErrInvalidFormat)
+				return
+			}
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs.Add(field, ErrInvalidFormat)
+				return
+			}
+		}
+	case "integer", "number":
+		f, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && f != math.Trunc(f)) {
+			errs.Add(field, ErrInvalidFieldType)
+			return
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			errs.Add(field, ErrBelowMinimum)
+			return
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs.Add(field, ErrInvalidFieldType)
+			return
+		}
+	}
+
+	// Check the enum
+	if len(schema.Enum) != 0 {
+		for _, allowed := range schema.Enum {
+			if allowed == value {
+				return
+			}
+		}
+		errs.Add(field, ErrInvalidEnum)
+	}
+}
+
+func (spec *OpenAPISpec) validateObject(field string, obj map[string]interface{}, schema *apiSchema, errs *ValidationErrors) {
+	prefix := field
+	if prefix != "" {
+		prefix += "."
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := obj[name]; !ok {
+			errs.Add(prefix+name, ErrRequiredField)
+		}
+	}
+
+	// Go through the properties in a stable order so errors are always reported the same way
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propSchema, ok := schema.Properties[name]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				errs.Add(prefix+name, ErrUnknownField)
+			}
+			continue
+		}
+		if spec.resolveSchema(propSchema).ReadOnly {
+			errs.Add(prefix+name, ErrReadOnlyField)
+			continue
+		}
+		spec.validateValue(prefix+name, obj[name], propSchema, errs)
+	}
+}
+
+// Middleware that validates every request described by the spec before it reaches its handler.
+// Must be installed on the router with Use(), so the matched route is known.
+func OpenAPIValidationMiddleware(spec *OpenAPISpec) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			op := spec.Operation(r.Method, path)
+			if op == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Read the body so it can be validated, and then put it back for the handler. It is read whole, so its
+			// size is limited to what the operation takes.
+			var body []byte
+			if r.Body != nil {
+				body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, op.maxBodySize(Config())))
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					w.Header().Set("Content-Type", "application/json")
+					HandleError(w, r, ErrRequestTooLarge, 0)
+					return
+				}
+				if err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					HandleError(w, r, err, http.StatusBadRequest)
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+
+			err = spec.ValidateRequest(op, r, body)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				HandleError(w, r, err, 0)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPIDocument)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CursorForward  = "n"
+	CursorBackward = "p"
+)
+
+var (
+	ErrInvalidCursor = NewError("invalid-cursor", http.StatusBadRequest, "Invalid cursor. Cursors are opaque tokens and must be passed back exactly as they were received.")
+	ErrInvalidLimit  = NewError("invalid-limit", http.StatusBadRequest, "Invalid limit. The limit must be a positive integer.")
+
+	ErrInvalidCountOnly = NewError("invalid-count-only", http.StatusBadRequest, "Invalid count-only parameter. Use count-only=true or count-only=false.")
+)
+
+// A Cursor marks a position in a keyset-paginated listing.
+// Listings are always ordered by their key (for certificates this is the certificate-id),
+// so a cursor only needs to remember the key at the edge of the page and which direction to read in.
+type Cursor struct {
+	Direction string // CursorForward or CursorBackward
+	Key       string // Read the rows after (CursorForward) or before (CursorBackward) this key
+}
+
+// A Page is a single page of results from a keyset-paginated listing.
+// Next and Prev are nil if there are no more results in that direction.
+type Page struct {
+	Next *Cursor
+	Prev *Cursor
+}
+
+// Encode the cursor into an opaque token suitable for passing to clients
+func (c *Cursor) Encode() string {
+	if c == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Direction + ":" + c.Key))
+}
+
+// Decode an opaque cursor token. An empty token decodes to a nil cursor (the first page).
+func DecodeCursor(token string) (*Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, ErrInvalidCursor
+	}
+	if parts[0] != CursorForward && parts[0] != CursorBackward {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Direction: parts[0], Key: parts[1]}, nil
+}
+
+// Parse a page size from a query string value. An empty value gives the default page size.
+// Page sizes larger than the maximum page size are clamped.
+func ParseLimit(limit string) (int, error) {
+	config := Config()
+	if limit == "" {
+		return config.DefaultPageSize, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return 0, ErrInvalidLimit
+	}
+	if n > config.MaxPageSize {
+		n = config.MaxPageSize
+	}
+	return n, nil
+}
+
+// Which page of a list a request asks for. Every list endpoint whose list grows with use is paginated like a user's
+// certificates: domains, templates, attachments, grants, certificates shared with a user, provisioning batches, the
+// audit log and the CSR queue. Each list is ordered by a key the rows are read after, or before, in the database.
+// The admin endpoints listing what this process holds in memory, or what is configured, such as feature flags,
+// freezes or sessions, aren't paginated: they are small, and have no stable key to page by.
+type ListQuery struct {
+	Cursor *Cursor // Nil for the first page
+	Limit  int
+}
+
+// Parse which page of a list a request asks for, from the cursor and limit query parameters
+func ParseListQuery(r *http.Request) (*ListQuery, error) {
+	query := r.URL.Query()
+	cursor, err := DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	limit, err := ParseLimit(query.Get("limit"))
+	if err != nil {
+		return nil, err
+	}
+	return &ListQuery{Cursor: cursor, Limit: limit}, nil
+}
+
+// Get what to read a page of a list with: whether to read forwards, the rows after the key, or backwards, the rows
+// before it, and how many rows to read, one more than the page size so we know if there is another page. The first
+// page is read forwards from first, a key before every row. A nil query reads the whole list, with no limit.
+func (q *ListQuery) read(first string) (forward bool, key string, limit interface{}) {
+	if q == nil {
+		return true, first, nil
+	}
+	if q.Cursor == nil {
+		return true, first, q.Limit + 1
+	}
+	return q.Cursor.Direction == CursorForward, q.Cursor.Key, q.Limit + 1
+}
+
+// Get which of the rows read for a page are on it, from their keys, and the cursors for the neighbouring pages. The
+// rows must be in the list's order, whichever way they were read.
+func (q *ListQuery) page(keys []string) (start, end int, page *Page) {
+	page = new(Page)
+	if q == nil {
+		return 0, len(keys), page
+	}
+	forward := q.Cursor == nil || q.Cursor.Direction == CursorForward
+	more := len(keys) > q.Limit
+	start, end = 0, len(keys)
+	if more && forward {
+		end = q.Limit
+	} else if more {
+		start = len(keys) - q.Limit
+	}
+	if start == end {
+		return start, end, page
+	}
+	first, last := keys[start], keys[end-1]
+	if forward {
+		if more {
+			page.Next = &Cursor{CursorForward, last}
+		}
+		if q.Cursor != nil {
+			page.Prev = &Cursor{CursorBackward, first}
+		}
+	} else {
+		page.Next = &Cursor{CursorForward, last}
+		if more {
+			page.Prev = &Cursor{CursorBackward, first}
+		}
+	}
+	return start, end, page
+}
+
+// Check that a cursor's key is a number, for lists ordered by a numeric id
+func numericCursorKey(key string) error {
+	if _, err := strconv.ParseInt(key, 10, 64); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// Parse which of a user's certificates a request asks for: the page (cursor and limit), the show-certs and
+// show-validity filters, and count-only, for just the number of certificates
+func ParseUserCertsQuery(r *http.Request) (*UserCertsQuery, error) {
+	query := r.URL.Query()
+	cursor, err := DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	limit, err := ParseLimit(query.Get("limit"))
+	if err != nil {
+		return nil, err
+	}
+	certs := &UserCertsQuery{Cursor: cursor, Limit: limit}
+
+	// Limit the certificates to only active or inactive, and valid or invalid, certificates if specified
+	switch query.Get("show-certs") {
+	case LimitCertsActive:
+		certs.Filter.Active = sql.NullBool{Bool: true, Valid: true}
+	case LimitCertsInactive:
+		certs.Filter.Active = sql.NullBool{Bool: false, Valid: true}
+	}
+	switch query.Get("show-validity") {
+	case LimitValidityValid:
+		certs.Filter.Valid = sql.NullBool{Bool: true, Valid: true}
+	case LimitValidityInvalid:
+		certs.Filter.Valid = sql.NullBool{Bool: false, Valid: true}
+	}
+
+	if countOnly := query.Get("count-only"); countOnly != "" {
+		certs.CountOnly, err = strconv.ParseBool(countOnly)
+		if err != nil {
+			return nil, ErrInvalidCountOnly
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Encodings of an uploaded certificate and key
+const (
+	CertFormatPEM = "pem" // PEM blocks, the default
+	CertFormatDER = "der" // Base64-encoded DER, for clients that would otherwise convert it with openssl
+)
+
+// Parsing modes for uploaded PEM
+const (
+	ParseModeStrict  = "strict"  // Reject anything but a single, correctly labeled PEM block per field
+	ParseModeLenient = "lenient" // Repair common mistakes, and split concatenated PEM, and report what was repaired as warnings
+)
+
+var (
+	ErrTrailingPEMData = NewError("trailing-pem-data", http.StatusBadRequest, "There is data outside the PEM block. Only a single PEM block is accepted per field.")
+	ErrWrongPEMHeader  = NewError("wrong-pem-header", http.StatusBadRequest, "The PEM block's BEGIN and END lines don't match, or don't label what the field should hold.")
+	ErrMixedPEMBlocks  = NewError("mixed-pem-blocks", http.StatusBadRequest, "The field holds more than one PEM block. Give the certificate, the private key and the chain in their own fields, or all of them in the bundle field.")
+
+	WarnRepairedLineEndings  = NewError("repaired-line-endings", 0, "Windows line endings were converted.")
+	WarnRepairedFinalNewline = NewError("repaired-final-newline", 0, "The final newline was missing, and was added.")
+	WarnRepairedPEMData      = NewError("repaired-pem-data", 0, "Data outside the PEM block was removed.")
+	WarnRepairedPEMHeader    = NewError("repaired-pem-header", 0, "The PEM block's END line didn't match its BEGIN line, and was corrected.")
+	WarnSplitCertKey         = NewError("split-cert-key", 0, "The certificate and private key were given in one field, and were split.")
+	WarnSplitPEMBlocks       = NewError("split-pem-blocks", 0, "The certificate and key fields held more than one PEM block, and were sorted into the certificate, its key and its chain.")
+
+	ErrInvalidCertFormat = NewError("invalid-cert-format", http.StatusBadRequest, "Unknown format. Use pem or der.")
+	ErrInvalidDER        = NewError("invalid-der", http.StatusBadRequest, "The field isn't base64-encoded DER. Give the certificate as X.509, and the key as PKCS#8, PKCS#1 or SEC 1.")
+	ErrDERWithBundle     = NewError("der-with-bundle", http.StatusBadRequest, "Bundles are only accepted as PEM. Give the certificate and key in their own fields.")
+
+	ErrBundleWithCertKey  = NewError("bundle-with-cert-key", http.StatusBadRequest, "Give either a bundle, or a certificate and key, not both.")
+	ErrNoMatchingKeyPair  = NewError("no-matching-key-pair", http.StatusBadRequest, "None of the private keys match any of the certificates.")
+	ErrAmbiguousKeyPair   = NewError("ambiguous-key-pair", http.StatusBadRequest, "More than one certificate and private key pair was found. Upload them separately.")
+	WarnBundleExtraBlocks = NewError("bundle-extra-blocks", 0, "Keys and other blocks that aren't part of the pair were ignored.")
+
+	ErrUnsupportedECParameters = NewError("unsupported-ec-parameters", http.StatusBadRequest, "The EC parameters must name the curve: P-224, P-256, P-384 or P-521. Explicit curve parameters and other curves aren't supported.")
+	ErrECParametersMismatch    = NewError("ec-parameters-mismatch", http.StatusBadRequest, "The EC parameters name a different curve from the private key after them.")
+)
+
+// The curves EC parameters may name, by OID (RFC 5480)
+var namedCurves = map[string]elliptic.Curve{
+	"1.3.132.0.33":        elliptic.P224(),
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// A PEM block in an upload. JSON compatible PEM blocks, with spaces in place of newlines, are found too.
+var pemBlockPattern = regexp.MustCompile(`-----BEGIN ([^-\r\n]*)-----[\s\S]*?-----END ([^-\r\n]*)-----`)
+
+type pemSpan struct {
+	Type       string // From the BEGIN line
+	EndType    string // From the END line
+	start, end int
+}
+
+func findPEMBlocks(s string) []*pemSpan {
+	var spans []*pemSpan
+	for _, m := range pemBlockPattern.FindAllStringSubmatchIndex(s, -1) {
+		spans = append(spans, &pemSpan{Type: s[m[2]:m[3]], EndType: s[m[4]:m[5]], start: m[0], end: m[1]})
+	}
+	return spans
+}
+
+func isCertPEMType(t string) bool {
+	return t == "CERTIFICATE"
+}
+
+// Key types are checked properly when the key is parsed. "DSA PRIVATE KEY" is let through to be reported as such.
+func isKeyPEMType(t string) bool {
+	return strings.HasSuffix(t, "PRIVATE KEY")
+}
+
+// OpenSSL writes the curve of an EC private key in an "EC PARAMETERS" block before it, as "openssl ecparam -genkey"
+// does by default. SEC 1 keys name their curve themselves, so the blocks are removed, along with the whitespace after
+// them. The curve must be a supported one, and the same as the key's after it, if there is one.
+func StripECParameters(s string) (string, error) {
+	blocks := findPEMBlocks(s)
+	var out strings.Builder
+	last := 0
+	for i, b := range blocks {
+		if b.Type != "EC PARAMETERS" {
+			continue
+		}
+		curve, err := parseECParameters(s[b.start:b.end])
+		if err != nil {
+			return "", err
+		}
+		if i+1 < len(blocks) && blocks[i+1].Type == "EC PRIVATE KEY" {
+			// A key that can't be parsed is left for the parser to report
+			key, err := ParsePrivateKeyPEM(s[blocks[i+1].start:blocks[i+1].end])
+			if ecKey, ok := key.(*ecdsa.PrivateKey); err == nil && ok && ecKey.Curve != curve {
+				return "", ErrECParametersMismatch
+			}
+		}
+		out.WriteString(s[last:b.start])
+		last = b.end
+		for last < len(s) && strings.IndexByte(" \t\r\n", s[last]) >= 0 {
+			last++
+		}
+	}
+	if last == 0 {
+		return s, nil
+	}
+	out.WriteString(s[last:])
+	return out.String(), nil
+}
+
+// Get the named curve from an EC parameters block
+func parseECParameters(s string) (elliptic.Curve, error) {
+	normalized, err := PEMBlockNormalize(s)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(normalized)
+	if block == nil {
+		return nil, ErrInvalidPEMBlock
+	}
+	var oid asn1.ObjectIdentifier
+	if rest, err := asn1.Unmarshal(block.Bytes, &oid); err != nil || len(rest) != 0 {
+		return nil, ErrUnsupportedECParameters
+	}
+	curve, ok := namedCurves[oid.String()]
+	if !ok {
+		return nil, ErrUnsupportedECParameters
+	}
+	return curve, nil
+}
+
+// Check the PEM fields of an upload, before they are parsed. In the lenient parsing mode, common mistakes are
+// repaired, and what was repaired is returned as warnings. In the strict mode they are errors. Windows line endings
+// and a missing final newline are valid PEM (RFC 7468), so they are only reported when repaired. Base64-encoded DER
+// fields are converted to PEM first.
+func NormalizeUploadPEM(certData *CertificateData, mode string) (ValidationErrors, error) {
+	var warnings ValidationErrors
+	lenient := mode == ParseModeLenient
+
+	// DER is converted to PEM, and then checked as if it had been uploaded as PEM
+	switch certData.Format {
+	case "", CertFormatPEM:
+	case CertFormatDER:
+		if certData.Bundle != "" || certData.PKCS12 != "" {
+			return nil, &FieldError{"format", ErrDERWithBundle}
+		}
+		cert, err := derCertToPEM(string(certData.Cert))
+		if err != nil {
+			return nil, &FieldError{"cert", err}
+		}
+		key, err := derKeyToPEM(string(certData.Key))
+		if err != nil {
+			return nil, &FieldError{"key", err}
+		}
+		certData.Cert, certData.Key, certData.Format = StoredPEM(cert), StoredPEM(key), ""
+	default:
+		return nil, &FieldError{"format", ErrInvalidCertFormat}
+	}
+
+	// The certificate, key and chain given as a PKCS#12 bundle
+	if certData.PKCS12 != "" {
+		if certData.Cert != "" || certData.Key != "" || certData.Bundle != "" {
+			return nil, &FieldError{"pkcs12", ErrPKCS12WithCertKey}
+		}
+		cert, key, chain, extra, err := DecodePKCS12(certData.PKCS12, certData.Passphrase)
+		if err != nil {
+			return nil, &FieldError{"pkcs12", err}
+		}
+		certData.Cert, certData.Key = StoredPEM(cert), StoredPEM(key)
+		if chain != "" && certData.Chain == "" {
+			certData.Chain = StoredChain(chain)
+		}
+		certData.PKCS12, certData.Passphrase = "", ""
+		if extra {
+			warnings.Add("pkcs12", WarnPKCS12ExtraBlocks)
+		}
+	}
+
+	// Encrypted keys are decrypted with the passphrase, which is then forgotten (see encryptedkey.go). EC parameters
+	// blocks are removed, since EC keys name their curves themselves.
+	fields := []struct {
+		name  string
+		value *string
+	}{{"key", (*string)(&certData.Key)}, {"bundle", &certData.Bundle}, {"cert", (*string)(&certData.Cert)}}
+	encrypted := false
+	for _, field := range fields {
+		decrypted, found, err := DecryptKeyBlocks(*field.value, certData.Passphrase)
+		if err != nil {
+			return nil, &FieldError{field.name, err}
+		}
+		*field.value, encrypted = decrypted, encrypted || found
+	}
+	if certData.Passphrase != "" && !encrypted {
+		warnings.Add("passphrase", WarnUnusedPassphrase)
+	}
+	certData.Passphrase = ""
+	for _, field := range fields {
+		stripped, err := StripECParameters(*field.value)
+		if err != nil {
+			return nil, &FieldError{field.name, err}
+		}
+		*field.value = stripped
+	}
+
+	// The certificate and chain given as a PKCS#7 bundle, with the key in its own field
+	if certData.PKCS7 == "" && isPKCS7PEM(string(certData.Cert)) {
+		certData.PKCS7, certData.Cert = string(certData.Cert), ""
+	}
+	if certData.PKCS7 != "" {
+		if certData.Cert != "" || certData.Bundle != "" {
+			return nil, &FieldError{"pkcs7", ErrPKCS7WithCert}
+		}
+		cert, chain, err := DecodePKCS7(certData.PKCS7, string(certData.Key))
+		if err != nil {
+			return nil, &FieldError{"pkcs7", err}
+		}
+		certData.Cert, certData.PKCS7 = StoredPEM(cert), ""
+		if chain != "" && certData.Chain == "" {
+			certData.Chain = StoredChain(chain)
+		}
+	}
+
+	// The certificate and key given as a bundle, or, in the lenient mode, concatenated in their fields in any way, such
+	// as the full chain in the certificate's field (as certbot's fullchain.pem has it), or everything in one field
+	certBlocks, keyBlocks := len(findPEMBlocks(string(certData.Cert))), len(findPEMBlocks(string(certData.Key)))
+	if certData.Bundle != "" {
+		if certData.Cert != "" || certData.Key != "" {
+			return nil, &FieldError{"bundle", ErrBundleWithCertKey}
+		}
+		cert, key, chain, extra, err := SplitBundle(certData.Bundle)
+		if err != nil {
+			return nil, &FieldError{"bundle", err}
+		}
+		certData.Cert, certData.Key, certData.Bundle = StoredPEM(cert), StoredPEM(key), ""
+		if chain != "" && certData.Chain == "" {
+			certData.Chain = StoredChain(chain)
+		}
+		if extra {
+			warnings.Add("bundle", WarnBundleExtraBlocks)
+		}
+	} else if lenient && (certBlocks > 1 || keyBlocks > 1) {
+		field := "cert"
+		if certBlocks <= 1 {
+			field = "key"
+		}
+		cert, key, chain, extra, err := SplitBundle(string(certData.Cert) + "\n" + string(certData.Key))
+		if err != nil {
+			return nil, &FieldError{field, err}
+		}
+		if certData.Key == "" {
+			warnings.Add(field, WarnSplitCertKey)
+		} else {
+			warnings.Add(field, WarnSplitPEMBlocks)
+		}
+		certData.Cert, certData.Key = StoredPEM(cert), StoredPEM(key)
+		if chain != "" && certData.Chain == "" {
+			certData.Chain = StoredChain(chain)
+		}
+		if extra {
+			warnings.Add(field, WarnBundleExtraBlocks)
+		}
+	}
+	if certData.Cert == "" {
+		return nil, &FieldError{"cert", ErrRequiredField}
+	}
+
+	cert, err := normalizeFieldPEM("cert", string(certData.Cert), isCertPEMType, lenient, &warnings)
+	if err != nil {
+		return nil, &FieldError{"cert", err}
+	}
+	key, err := normalizeFieldPEM("key", string(certData.Key), isKeyPEMType, lenient, &warnings)
+	if err != nil {
+		return nil, &FieldError{"key", err}
+	}
+	certData.Cert, certData.Key = StoredPEM(cert), StoredPEM(key)
+	return warnings, nil
+}
+
+// Split a bundle of PEM blocks, as many tools write them, into a certificate, its private key and its chain. The key is
+// paired with the certificate by its public key, so the blocks can be in any order. The chain is the other certificates,
+// in the order given (see chain.go). extra is whether there were other blocks, such as other keys, which are ignored.
+func SplitBundle(bundle string) (cert string, key string, chain string, extra bool, err error) {
+	var certs []*x509.Certificate
+	var certBlocks []string
+	var keys []crypto.Signer
+	var keyBlocks []string
+	for _, b := range findPEMBlocks(bundle) {
+		block := bundle[b.start:b.end] + "\n"
+		switch {
+		case isCertPEMType(b.Type):
+			c, err := ParseCertificatePEM(block)
+			if err != nil {
+				return "", "", "", false, err
+			}
+			certs, certBlocks = append(certs, c), append(certBlocks, block)
+		case isKeyPEMType(b.Type):
+			k, err := parseSignerPEM(block)
+			if err != nil {
+				return "", "", "", false, err
+			}
+			keys, keyBlocks = append(keys, k), append(keyBlocks, block)
+		default:
+			extra = true
+		}
+	}
+
+	pairs, paired := 0, 0
+	for i, c := range certs {
+		for j, k := range keys {
+			if publicKeysMatch(c, k) {
+				cert, key, paired = certBlocks[i], keyBlocks[j], i
+				pairs++
+			}
+		}
+	}
+	switch {
+	case len(certs) == 0:
+		return "", "", "", false, ErrInvalidCertificatePEM
+	case len(keys) == 0:
+		return "", "", "", false, ErrMissingPrivateKey
+	case pairs == 0:
+		return "", "", "", false, ErrNoMatchingKeyPair
+	case pairs > 1:
+		return "", "", "", false, ErrAmbiguousKeyPair
+	}
+	for i, block := range certBlocks {
+		if i != paired {
+			chain += block
+		}
+	}
+	return cert, key, chain, extra || len(keys) > 1, nil
+}
+
+// Decode a base64-encoded DER field. Empty fields are left empty, to be reported as missing.
+func decodeDERField(encoded string) ([]byte, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, ErrInvalidDER
+	}
+	return der, nil
+}
+
+// Convert a base64-encoded DER certificate to PEM. Invalid certificates are reported by the parser.
+func derCertToPEM(encoded string) (string, error) {
+	der, err := decodeDERField(encoded)
+	if err != nil || len(der) == 0 {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// Convert a base64-encoded DER private key to PEM, labeled as whichever of PKCS#8, PKCS#1, SEC 1 or encrypted PKCS#8 it is
+func derKeyToPEM(encoded string) (string, error) {
+	der, err := decodeDERField(encoded)
+	if err != nil || len(der) == 0 {
+		return "", err
+	}
+	var keyType string
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		keyType = "PRIVATE KEY"
+	} else if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		keyType = "RSA PRIVATE KEY"
+	} else if _, err := x509.ParseECPrivateKey(der); err == nil {
+		keyType = "EC PRIVATE KEY"
+	} else if rest, err := asn1.Unmarshal(der, new(encryptedPrivateKeyInfo)); err == nil && len(rest) == 0 {
+		keyType = encryptedKeyPEMType
+	} else {
+		return "", ErrInvalidDER
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: der})), nil
+}
+
+func normalizeFieldPEM(field, s string, expected func(string) bool, lenient bool, warnings *ValidationErrors) (string, error) {
+	if lenient && strings.Contains(s, "\r\n") {
+		s = strings.Replace(s, "\r\n", "\n", -1)
+		warnings.Add(field, WarnRepairedLineEndings)
+	}
+
+	// Missing or malformed blocks are reported by the parser
+	blocks := findPEMBlocks(s)
+	if len(blocks) == 0 {
+		return s, nil
+	}
+	if len(blocks) > 1 {
+		return "", ErrMixedPEMBlocks
+	}
+	b := blocks[0]
+
+	if strings.TrimSpace(s[:b.start]+s[b.end:]) != "" {
+		if !lenient {
+			return "", ErrTrailingPEMData
+		}
+		s = s[b.start:b.end] + "\n"
+		b.end -= b.start
+		b.start = 0
+		warnings.Add(field, WarnRepairedPEMData)
+	}
+
+	// A block that holds the wrong thing can't be repaired. In the lenient mode it is left for the parser to reject.
+	if !expected(b.Type) {
+		if !lenient {
+			return "", ErrWrongPEMHeader
+		}
+		return s, nil
+	}
+	if b.EndType != b.Type {
+		if !lenient {
+			return "", ErrWrongPEMHeader
+		}
+		s = s[:b.end-len(b.EndType)-5] + b.Type + s[b.end-5:]
+		warnings.Add(field, WarnRepairedPEMHeader)
+	}
+
+	// JSON compatible PEM blocks are on one line, and need no final newline
+	if lenient && strings.Contains(s, "\n") && !strings.HasSuffix(s, "\n") {
+		s += "\n"
+		warnings.Add(field, WarnRepairedFinalNewline)
+	}
+	return s, nil
+}
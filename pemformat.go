@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PEM transport formats
+const (
+	PEMFormatStandard = "standard" // Newlines between the lines of a PEM block, as in a PEM file
+	PEMFormatLegacy   = "legacy"   // Space-normalized: spaces in place of newlines, so a block fits on one line. Deprecated.
+)
+
+// The header a request chooses the PEM format of its response with. Responses in the legacy format have it too.
+const PEMFormatHeader = "Certstore-PEM-Format"
+
+// How much of a request body is looked at for legacy PEM
+const maxPEMSniff = 1 << 20
+
+var (
+	ErrInvalidPEMFormat = NewError("invalid-pem-format", http.StatusBadRequest, "Unknown PEM format. Use standard or legacy.")
+
+	WarnLegacyPEM = NewError("legacy-pem", 0, "Space-normalized PEM is deprecated and will stop being accepted. Send PEM with newlines, and ask for standard PEM responses.")
+)
+
+// Clients of the system certstore replaced sent PEM with spaces in place of newlines, so a block fit in a JSON string
+// without escapes (see PEMBlockNormalize). That form is deprecated, and both forms are accepted and sent during the
+// migration:
+//
+// - Requests may send either form. A request sending space-normalized PEM is warned, in the envelope's warnings.
+// - Responses are in standard PEM, unless the request's Certstore-PEM-Format header, or else its API key's response
+//   profile (see compat.go), asks for "legacy". Those responses are warned too, and have a "Deprecation: true"
+//   header.
+//
+// Each request relying on the legacy form is counted in the user's legacy-pem usage (see usage.go), and against the
+// client, by its principal (see RequestPrincipal) and user agent, at /admin/pem/legacy, so the clients still to be
+// ported can be found. Client counts are kept in memory, since the last restart. Like profiles, the format only
+// applies to JSON responses.
+
+// A request's PEM transport
+type pemTransport struct {
+	format      string // The format of the response
+	legacyInput bool   // Did the request send space-normalized PEM?
+}
+
+type pemTransportKey struct{}
+
+// A PEM block beginning with a space rather than a newline, in a JSON request body
+var legacyPEMPattern = regexp.MustCompile(`-----BEGIN [^-\r\n"]*----- `)
+
+// Does a request body have space-normalized PEM in it?
+func hasLegacyPEM(body []byte) bool {
+	return legacyPEMPattern.Match(body)
+}
+
+// The PEM format a request asks for: its header's, else its API key's profile's, else standard
+func requestPEMFormat(r *http.Request, config *RuntimeConfig) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(r.Header.Get(PEMFormatHeader)))
+	if format == "" {
+		if profile := RequestProfile(r, config); profile != nil {
+			format = profile.PEMFormat
+		}
+	}
+	switch format {
+	case "", PEMFormatStandard:
+		return PEMFormatStandard, nil
+	case PEMFormatLegacy:
+		return PEMFormatLegacy, nil
+	}
+	return "", ErrInvalidPEMFormat
+}
+
+// Get a request's PEM transport, set by PEMFormatMiddleware. Nil outside a request through the router.
+func requestPEMTransport(r *http.Request) *pemTransport {
+	transport, _ := r.Context().Value(pemTransportKey{}).(*pemTransport)
+	return transport
+}
+
+// The warnings every response to a request gets, whatever its handler
+func requestWarnings(r *http.Request) []*FieldError {
+	transport := requestPEMTransport(r)
+	if transport == nil || (transport.format != PEMFormatLegacy && !transport.legacyInput) {
+		return nil
+	}
+	return []*FieldError{{PEMFormatHeader, WarnLegacyPEM}}
+}
+
+// Middleware that negotiates the PEM format of each request, and notes requests relying on the legacy format. It is
+// used on the router, so the user-id is known.
+func PEMFormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, err := requestPEMFormat(r, Config())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, err, 0)
+			return
+		}
+		transport := &pemTransport{format: format}
+
+		// Look at the start of JSON bodies, then put it back
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Body != nil && (mediaType == "" || mediaType == "application/json") {
+			start, err := io.ReadAll(io.LimitReader(r.Body, maxPEMSniff))
+			if err != nil {
+				HandleError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			transport.legacyInput = hasLegacyPEM(start)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(start), r.Body), r.Body}
+		}
+
+		if transport.format == PEMFormatLegacy || transport.legacyInput {
+			userid, err := GetUserID(r)
+			if err != nil {
+				userid = ""
+			}
+			Usage.Record(userid, UsageLegacyPEM, 1)
+			LegacyPEMClients.Record(RequestPrincipal(r), r.UserAgent(), transport)
+			w.Header().Set("Deprecation", "true")
+		}
+		if transport.format == PEMFormatLegacy {
+			w.Header().Set(PEMFormatHeader, PEMFormatLegacy)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), pemTransportKey{}, transport)))
+	})
+}
+
+// Put every PEM string in a JSON body into the legacy format
+func legacyPEMJSON(body []byte) ([]byte, error) {
+	var decoded interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(legacyPEMValues(decoded))
+}
+
+func legacyPEMValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = legacyPEMValues(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = legacyPEMValues(value)
+		}
+	case string:
+		if strings.Contains(v, "-----BEGIN ") {
+			return strings.TrimSpace(strings.NewReplacer("\r\n", " ", "\n", " ").Replace(v))
+		}
+	}
+	return v
+}
+
+// A client still relying on the legacy PEM format
+type LegacyPEMClient struct {
+	Principal string  `json:"principal"`
+	UserAgent string  `json:"userAgent"` // The latest seen
+	Sent      int64   `json:"sent"`      // Requests sending space-normalized PEM
+	Asked     int64   `json:"asked"`     // Requests asking for legacy responses
+	FirstSeen UTCTime `json:"firstSeen"`
+	LastSeen  UTCTime `json:"lastSeen"`
+}
+
+// LegacyPEMTracker counts the requests relying on the legacy PEM format, by client
+type LegacyPEMTracker struct {
+	mu      sync.Mutex
+	clients map[string]*LegacyPEMClient
+}
+
+// The clients relying on the legacy PEM format since this process started
+var LegacyPEMClients = &LegacyPEMTracker{clients: make(map[string]*LegacyPEMClient)}
+
+// Count a request relying on the legacy PEM format
+func (t *LegacyPEMTracker) Record(principal, userAgent string, transport *pemTransport) {
+	now := NewUTCTime(Now())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	client, ok := t.clients[principal]
+	if !ok {
+		client = &LegacyPEMClient{Principal: principal, FirstSeen: now}
+		t.clients[principal] = client
+	}
+	client.UserAgent, client.LastSeen = userAgent, now
+	if transport.legacyInput {
+		client.Sent++
+	}
+	if transport.format == PEMFormatLegacy {
+		client.Asked++
+	}
+}
+
+// List the clients, most recently seen first
+func (t *LegacyPEMTracker) List() []*LegacyPEMClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clients := make([]*LegacyPEMClient, 0, len(t.clients))
+	for _, client := range t.clients {
+		c := *client
+		clients = append(clients, &c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].LastSeen.Equal(clients[j].LastSeen.Time) {
+			return clients[i].LastSeen.After(clients[j].LastSeen.Time)
+		}
+		return clients[i].Principal < clients[j].Principal
+	})
+	return clients
+}
+
+func ListLegacyPEMClientsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, LegacyPEMClients.List())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidPIIKey       = NewError("invalid-pii-key", http.StatusInternalServerError, "Invalid PII encryption key. Use 64 hex digits: a 256-bit key.")
+	ErrInvalidEncryptedPII = NewError("invalid-encrypted-pii", http.StatusInternalServerError, "Unable to decrypt a user's name or email address from the database.")
+)
+
+// Users' names and email addresses can be encrypted at rest, for deployments that don't trust the database itself,
+// by setting OptPIIEncryptionKey. They are encrypted with AES-256-GCM, each with a random nonce, so equal names
+// aren't equal in the database. Since encrypted email addresses can't be compared, each is stored with a blind
+// index: an HMAC of the address in lower case, keyed separately, which users are looked up by instead.
+//
+// Rows written before the key was set stay in plaintext, and are read as they are, until they are next written.
+// A standby is sent the encrypted values as they are stored, so it needs the same key.
+
+// The prefix of an encrypted value. Plaintext names could start with it too, but plaintext is only written without
+// a key, and a prefixed name that doesn't decrypt is an error rather than being taken as plaintext.
+const encryptedPIIPrefix = "enc1:"
+
+var (
+	piiMu     sync.Mutex
+	piiKeyHex string // The key that piiAEAD and piiIndexKey were derived from
+	piiAEAD   cipher.AEAD
+	piiIndex  []byte
+)
+
+// Check the PII encryption key, if there is one
+func validatePIIOptions() error {
+	_, _, err := piiKeys()
+	return err
+}
+
+// Get the cipher names and email addresses are encrypted with, and the key of the blind index, derived from
+// OptPIIEncryptionKey. Both are nil if there is no key.
+func piiKeys() (cipher.AEAD, []byte, error) {
+	piiMu.Lock()
+	defer piiMu.Unlock()
+	if OptPIIEncryptionKey == piiKeyHex {
+		return piiAEAD, piiIndex, nil
+	}
+	if OptPIIEncryptionKey == "" {
+		piiKeyHex, piiAEAD, piiIndex = "", nil, nil
+		return nil, nil, nil
+	}
+	key, err := hex.DecodeString(OptPIIEncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, nil, ErrInvalidPIIKey
+	}
+
+	// The encryption and index keys are derived from the one key, so neither gives away the other
+	block, err := aes.NewCipher(derivePIIKey(key, "certstore pii encryption"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	piiKeyHex, piiAEAD, piiIndex = OptPIIEncryptionKey, aead, derivePIIKey(key, "certstore pii index")
+	return piiAEAD, piiIndex, nil
+}
+
+func derivePIIKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Get the blind index of an email address, or nil if there is no PII encryption key
+func EmailIndex(email string) (*string, error) {
+	_, indexKey, err := piiKeys()
+	if err != nil || indexKey == nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	index := hex.EncodeToString(mac.Sum(nil))
+	return &index, nil
+}
+
+// EncryptedString is a name or email address, encrypted when it is written to the database if there is a PII
+// encryption key, and decrypted when it is read back
+type EncryptedString string
+
+// Value implements driver.Valuer for writing to the database.
+func (s EncryptedString) Value() (driver.Value, error) {
+	aead, _, err := piiKeys()
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil || s == "" {
+		return string(s), nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(s), nil)
+	return encryptedPIIPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (s *EncryptedString) Scan(src interface{}) error {
+	var value string
+	switch v := src.(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	case nil:
+		*s = ""
+		return nil
+	default:
+		return ErrInvalidEncryptedPII
+	}
+	if !strings.HasPrefix(value, encryptedPIIPrefix) {
+		*s = EncryptedString(value)
+		return nil
+	}
+
+	aead, _, err := piiKeys()
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(encryptedPIIPrefix):])
+	if aead == nil || err != nil || len(sealed) < aead.NonceSize() {
+		return ErrInvalidEncryptedPII
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return ErrInvalidEncryptedPII
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// A user's row as stored, with the name and email address encrypted if there is a PII encryption key
+type storedUser struct {
+	Id         string          `db:"id"`
+	Name       EncryptedString `db:"name"`
+	Email      EncryptedString `db:"email"`
+	EmailIndex *string         `db:"emailindex"`
+}
+
+// Get the row a user is stored as
+func newStoredUser(user *User) (*storedUser, error) {
+	index, err := EmailIndex(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &storedUser{Id: user.Id, Name: EncryptedString(user.Name), Email: EncryptedString(user.Email), EmailIndex: index}, nil
+}
+
+// Get the user a row is
+func (stored *storedUser) user() *User {
+	return &User{Id: stored.Id, Name: string(stored.Name), Email: string(stored.Email)}
+}
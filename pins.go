@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long clients should keep the pins in an HPKP-style header, as its max-age
+const pinMaxAge = 30 * 24 * time.Hour
+
+const (
+	PinFormatJSON = "json"
+	PinFormatHPKP = "hpkp"
+)
+
+var (
+	ErrInvalidPinFormat = NewError("invalid-pin-format", http.StatusBadRequest, "Invalid format. Use json or hpkp.")
+)
+
+// A pinning manifest lists the pins of a user's certificates for mobile apps that pin keys, so they can fetch the
+// current pins and the next ones from one place. A pin is the base64 SHA256 hash of a certificate's public key
+// (its SubjectPublicKeyInfo), as in HPKP's pin-sha256. The certificates are those given by ?cert=<cert-ref>
+// (repeated), or all of the user's active certificates. Each certificate's successors are pinned too: the user's
+// inactive certificates scheduled to be activated (see schedule.go) that cover any of the same names. Apps should
+// accept every pin in the manifest, so they keep working when a successor is activated.
+//
+// The manifest is JSON by default. With ?format=hpkp it is a Public-Key-Pins style string, as text/plain.
+
+// A pinned certificate
+type Pin struct {
+	CertId     string   `json:"cert"`
+	Pin        string   `json:"pin"` // Base64 SHA256 hash of the public key
+	Names      []string `json:"names"`
+	Active     bool     `json:"active"`
+	Successor  bool     `json:"successor"`  // Scheduled to be activated, for the same names as a certificate asked for
+	ActivateAt UTCTime  `json:"activateAt"` // When a successor will be activated
+	NotAfter   UTCTime  `json:"notAfter"`
+}
+
+type PinManifest struct {
+	Generated UTCTime  `json:"generated"`
+	Pins      []*Pin   `json:"pins"`   // The current certificates first, then their successors by activation time
+	Unique    []string `json:"unique"` // Each distinct pin once, in the same order
+	HPKP      string   `json:"hpkp"`   // The pins as a Public-Key-Pins style string
+}
+
+// Get a certificate's pin
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Find the certificate a reference refers to among the user's certificates
+func findCertRef(certs []*namedCert, s string) (*namedCert, error) {
+	ref, err := ParseCertRef(s)
+	if err != nil {
+		return nil, err
+	}
+	var found *namedCert
+	for _, cert := range certs {
+		if ref.Matches(cert.cert) {
+			if found != nil {
+				return nil, ErrAmbiguousCertRef
+			}
+			found = cert
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Build the manifest for the selected certificates and their successors
+func NewPinManifest(certs, selected []*namedCert, now time.Time) *PinManifest {
+	manifest := &PinManifest{Generated: NewUTCTime(now), Pins: []*Pin{}, Unique: []string{}}
+	included := make(map[string]bool)
+	pin := func(cert *namedCert, successor bool) {
+		if included[cert.data.Id] {
+			return
+		}
+		included[cert.data.Id] = true
+		manifest.Pins = append(manifest.Pins, &Pin{
+			CertId:     cert.data.Id,
+			Pin:        SPKIPin(cert.cert),
+			Names:      cert.names,
+			Active:     cert.data.Active,
+			Successor:  successor,
+			ActivateAt: cert.data.ActivateAt,
+			NotAfter:   cert.data.NotAfter,
+		})
+	}
+
+	for _, cert := range selected {
+		pin(cert, false)
+	}
+	var successors []*namedCert
+	for _, cert := range certs {
+		if cert.data.Active || cert.data.ActivateAt.IsZero() || included[cert.data.Id] {
+			continue
+		}
+		for _, s := range selected {
+			if namesOverlap(cert.names, s.names) {
+				successors = append(successors, cert)
+				break
+			}
+		}
+	}
+	sort.SliceStable(successors, func(i, j int) bool {
+		return successors[i].data.ActivateAt.Before(successors[j].data.ActivateAt.Time)
+	})
+	for _, cert := range successors {
+		pin(cert, true)
+	}
+
+	seen := make(map[string]bool)
+	var hpkp []string
+	for _, p := range manifest.Pins {
+		if !seen[p.Pin] {
+			seen[p.Pin] = true
+			manifest.Unique = append(manifest.Unique, p.Pin)
+			hpkp = append(hpkp, `pin-sha256="`+p.Pin+`"`)
+		}
+	}
+	hpkp = append(hpkp, "max-age="+strconv.Itoa(int(pinMaxAge.Seconds())))
+	manifest.HPKP = strings.Join(hpkp, "; ")
+	return manifest
+}
+
+// Get the pinning manifest for a user's certificates
+func ReadPinsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != PinFormatJSON && format != PinFormatHPKP {
+		HandleError(w, r, &FieldError{"format", ErrInvalidPinFormat}, 0)
+		return
+	}
+
+	user, _, err := DatabaseReadUser(userid, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certs := namedCerts(user.Certs)
+
+	var selected []*namedCert
+	if refs := r.URL.Query()["cert"]; len(refs) != 0 {
+		for _, s := range refs {
+			cert, err := findCertRef(certs, s)
+			if err != nil {
+				HandleError(w, r, &FieldError{"cert", err}, 0)
+				return
+			}
+			selected = append(selected, cert)
+		}
+	} else {
+		for _, cert := range certs {
+			if cert.data.Active {
+				selected = append(selected, cert)
+			}
+		}
+	}
+
+	manifest := NewPinManifest(certs, selected, Now())
+	if format == PinFormatHPKP {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(manifest.HPKP + "\n"))
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, manifest)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"golang.org/x/crypto/pkcs12"
+	"net/http"
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+	"strings"
+)
+
+var (
+	ErrInvalidPKCS12      = NewError("invalid-pkcs12", http.StatusBadRequest, "Invalid PKCS#12 bundle. It must be base64-encoded, and encrypted with 3DES or RC2 (as \"openssl pkcs12 -export -legacy\" does), or not at all.")
+	ErrPKCS12Passphrase   = NewError("pkcs12-passphrase", http.StatusBadRequest, "The PKCS#12 bundle's passphrase is incorrect.")
+	ErrPKCS12WithCertKey  = NewError("pkcs12-with-cert-key", http.StatusBadRequest, "Give either a PKCS#12 bundle, or a certificate and key, or a PEM bundle, not more than one.")
+	WarnPKCS12ExtraBlocks = NewError("pkcs12-extra-blocks", 0, "Keys in the PKCS#12 bundle that aren't the certificate's were ignored.")
+)
+
+// A certificate can be uploaded as a PKCS#12 (.p12 or .pfx) bundle, base64-encoded in the "pkcs12" field, with its
+// passphrase, if it has one, in "passphrase". The certificate is paired with its key as for a PEM bundle (see
+// SplitBundle), and the bundle's other certificates are its chain (see chain.go). Only bundles encrypted the legacy
+// way, with 3DES or RC2, can be read.
+//
+// A certificate can be exported as a PKCS#12 bundle too, for Java and Windows, with its key and chain (see
+// ExportCertHandler). The bundle is encrypted with AES-256, or with 3DES for older software that can't read that.
+
+// Decode a base64-encoded PKCS#12 bundle into PEM: the certificate, its private key, and the chain certificates
+// (concatenated, or empty if there are none). extra is whether there were other keys, which are ignored.
+func DecodePKCS12(encoded, passphrase string) (cert string, key string, chain string, extra bool, err error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return "", "", "", false, ErrInvalidPKCS12
+	}
+	blocks, err := pkcs12.ToPEM(data, passphrase)
+	if err == pkcs12.ErrIncorrectPassword || err == pkcs12.ErrDecryption {
+		return "", "", "", false, ErrPKCS12Passphrase
+	}
+	if err != nil {
+		return "", "", "", false, ErrInvalidPKCS12
+	}
+
+	var bundle strings.Builder
+	for _, block := range blocks {
+		// The bags' attributes (friendlyName, localKeyId) aren't kept, and keys are labeled as what they are.
+		// They are given as "PRIVATE KEY", but are PKCS#1 or SEC 1, not PKCS#8.
+		block = &pem.Block{Type: block.Type, Bytes: block.Bytes}
+		if isKeyPEMType(block.Type) {
+			if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+				block.Type = "RSA PRIVATE KEY"
+			} else if _, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+				block.Type = "EC PRIVATE KEY"
+			}
+		}
+		bundle.Write(pem.EncodeToMemory(block))
+	}
+	return SplitBundle(bundle.String())
+}
+
+// PKCS#12 export formats
+const (
+	ExportFormatPKCS12       = "pkcs12"        // Encrypted with AES-256 and PBKDF2, with a SHA-256 MAC
+	ExportFormatPKCS12Legacy = "pkcs12-legacy" // Encrypted with 3DES, with a SHA-1 MAC, for Windows before Server 2019 and Java before 8u301
+)
+
+// Encode a certificate, its private key and its chain as a PKCS#12 bundle, encrypted with a password
+func EncodePKCS12(certData *CertificateData, format, password string) ([]byte, error) {
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseSignerPEM(string(certData.Key))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ParseChainPEM(string(certData.Chain))
+	if err != nil {
+		return nil, err
+	}
+	encoder := gopkcs12.Modern
+	if format == ExportFormatPKCS12Legacy {
+		encoder = gopkcs12.LegacyDES
+	}
+	return encoder.Encode(key, cert, chain, password)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"net/http"
+)
+
+var (
+	ErrInvalidPKCS7  = NewError("invalid-pkcs7", http.StatusBadRequest, "Invalid PKCS#7 bundle. Give the .p7b file as PEM (BEGIN PKCS7), or base64-encoded. It must be DER, and hold certificates.")
+	ErrPKCS7WithCert = NewError("pkcs7-with-cert", http.StatusBadRequest, "Give either a PKCS#7 bundle, or a certificate, or a PEM or PKCS#12 bundle, not more than one. The key goes in its own field.")
+)
+
+// A certificate can be uploaded as a PKCS#7 (.p7b) bundle of certificates, as Microsoft CAs export them, in the
+// "pkcs7" field, with its key in the "key" field. The bundle is given as PEM, or as base64-encoded DER. A bundle
+// pasted into the "cert" field on its own is taken as one too. The certificate is the one paired with the key (see
+// SplitBundle), and the bundle's other certificates are its chain (see chain.go). A PKCS#7 bundle is a set, so its
+// order means nothing: the chain is put in order, starting with the certificate's issuer, without a warning.
+// BER bundles with indefinite lengths can't be read, but Windows and OpenSSL both write DER.
+
+// The PKCS#7 signedData content type (RFC 2315)
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// A signedData, as a certificates-only bundle has it, without signers
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// Check if a field holds a PKCS#7 bundle as PEM, and nothing else
+func isPKCS7PEM(s string) bool {
+	blocks := findPEMBlocks(s)
+	return len(blocks) == 1 && blocks[0].Type == "PKCS7"
+}
+
+// Parse the certificates of a PKCS#7 bundle, as PEM or base64-encoded DER
+func ParsePKCS7Certs(encoded string) ([]*x509.Certificate, error) {
+	var der []byte
+	if blocks := findPEMBlocks(encoded); len(blocks) != 0 {
+		if !isPKCS7PEM(encoded) {
+			return nil, ErrInvalidPKCS7
+		}
+		normalized, err := PEMBlockNormalize(encoded[blocks[0].start:blocks[0].end])
+		if err != nil {
+			return nil, ErrInvalidPKCS7
+		}
+		block, _ := pem.Decode(normalized)
+		if block == nil {
+			return nil, ErrInvalidPKCS7
+		}
+		der = block.Bytes
+	} else {
+		decoded, err := decodeDERField(encoded)
+		if err != nil {
+			return nil, ErrInvalidPKCS7
+		}
+		der = decoded
+	}
+
+	var info pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) != 0 || !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, ErrInvalidPKCS7
+	}
+	var signed pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, ErrInvalidPKCS7
+	}
+	certs, err := x509.ParseCertificates(signed.Certificates.Bytes)
+	if err != nil || len(certs) == 0 {
+		return nil, ErrInvalidPKCS7
+	}
+	return certs, nil
+}
+
+// Decode a PKCS#7 bundle into PEM: the certificate paired with the key, and the other certificates as its chain, in
+// order if they can be put in order (or empty if there are none). If the key can't be parsed, the certificate is the
+// one that issued none of the others, and the key is left to be reported when it is parsed.
+func DecodePKCS7(encoded, key string) (cert string, chain string, err error) {
+	certs, err := ParsePKCS7Certs(encoded)
+	if err != nil {
+		return "", "", err
+	}
+
+	leaf := -1
+	if signer, err := parseSignerPEM(key); err == nil {
+		for i, c := range certs {
+			if publicKeysMatch(c, signer) {
+				leaf = i
+				break
+			}
+		}
+		if leaf < 0 {
+			return "", "", ErrNoMatchingKeyPair
+		}
+	} else {
+		for i, c := range certs {
+			issuer := false
+			for j, other := range certs {
+				if i != j && other.CheckSignatureFrom(c) == nil {
+					issuer = true
+					break
+				}
+			}
+			if !issuer {
+				leaf = i
+				break
+			}
+		}
+		if leaf < 0 {
+			return "", "", ErrInvalidPKCS7
+		}
+	}
+
+	others := append(append([]*x509.Certificate{}, certs[:leaf]...), certs[leaf+1:]...)
+	if ordered, ok := orderChain(certs[leaf], others); ok {
+		others = ordered
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[leaf].Raw})), string(EncodeChain(others)), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingExtension   = NewError("missing-required-extension", http.StatusBadRequest, "The certificate does not have an extension that is required on this server.")
+	ErrForbiddenExtension = NewError("forbidden-extension", http.StatusBadRequest, "The certificate has an extension that is not allowed on this server.")
+	ErrPublicValidity     = NewError("public-validity", http.StatusBadRequest, "The certificate is valid for longer than browsers accept for a publicly trusted server certificate.")
+	ErrInternalValidity   = NewError("internal-validity", http.StatusBadRequest, "The certificate is valid for longer than this server allows for certificates from an internal CA.")
+	ErrWeakSignature      = NewError("weak-signature", http.StatusBadRequest, "The certificate is signed with a signature algorithm that is not allowed on this server, such as SHA-1 or MD5. Have the CA reissue it with a SHA-256 signature.")
+	ErrMissingKeyUsage    = NewError("missing-key-usage", http.StatusBadRequest, "The certificate does not allow a key usage that is required on this server.")
+	ErrMissingExtKeyUsage = NewError("missing-ext-key-usage", http.StatusBadRequest, "The certificate does not allow an extended key usage that is required on this server, such as serverAuth for a TLS server certificate.")
+
+	WarnPublicValidity   = NewError("public-validity", 0, "The certificate is valid for longer than browsers accept for a publicly trusted server certificate. Browsers will reject it.")
+	WarnInternalValidity = NewError("internal-validity", 0, "The certificate is valid for longer than this server allows for certificates from an internal CA.")
+)
+
+// Validity policies
+const (
+	ValidityPolicyOff    = "off"
+	ValidityPolicyWarn   = "warn"   // Accept certificates that break the validity policy, with a warning
+	ValidityPolicyReject = "reject" // Reject certificates that break the validity policy
+)
+
+// Publicly trusted server certificates issued from this date on may be valid for at most 398 days (CA/Browser
+// Forum ballot SC31, enforced by browsers from the same date)
+var publicValidityFrom = time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+// Check a certificate against the extension policy: every extension in the RequiredExtensions option must be
+// present, and none in ForbiddenExtensions may be. Each failing extension is reported, with the field
+// "extensions.<oid>".
+func CheckExtensionPolicy(cert *x509.Certificate, config *RuntimeConfig) error {
+	present := make(map[string]bool, len(cert.Extensions))
+	for _, ext := range cert.Extensions {
+		present[ext.Id.String()] = true
+	}
+
+	var errs ValidationErrors
+	for _, oid := range config.RequiredExtensions {
+		if !present[oid] {
+			errs.Add("extensions."+oid, ErrMissingExtension)
+		}
+	}
+	for _, oid := range config.ForbiddenExtensions {
+		if present[oid] {
+			errs.Add("extensions."+oid, ErrForbiddenExtension)
+		}
+	}
+	return errs.Err()
+}
+
+// Key usages, by the names the usage policy gives them (those of RFC 5280)
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+// Check a certificate against the usage policy: it must allow every key usage in the RequiredKeyUsages option, and
+// every extended key usage in RequiredExtKeyUsages (by name, as in the acceptance rules, or dotted OID). A
+// certificate without the key usage or extended key usage extension may be used for anything, and so allows them
+// all, as does one with the "any" extended key usage. With the RequireExtKeyUsage option, a certificate without the
+// extended key usage extension allows none of them instead, as some clients won't use such a certificate for TLS. Each missing usage is reported, with the field
+// "keyUsages.<name>" or "extKeyUsages.<name>", so a client-auth or code-signing certificate can't be stored in a TLS
+// store by mistake.
+func CheckUsagePolicy(cert *x509.Certificate, config *RuntimeConfig) error {
+	var errs ValidationErrors
+	if cert.KeyUsage != 0 {
+		for _, name := range config.RequiredKeyUsages {
+			if cert.KeyUsage&keyUsageNames[name] == 0 {
+				errs.Add("keyUsages."+name, ErrMissingKeyUsage)
+			}
+		}
+	}
+
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 && !config.RequireExtKeyUsage {
+		return errs.Err()
+	}
+	allows := func(required string) bool {
+		for _, usage := range cert.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageAny || extKeyUsageMatches(required, usage) {
+				return true
+			}
+		}
+		for _, oid := range cert.UnknownExtKeyUsage {
+			if oid.String() == required {
+				return true
+			}
+		}
+		return false
+	}
+	for _, required := range config.RequiredExtKeyUsages {
+		if !allows(required) {
+			errs.Add("extKeyUsages."+required, ErrMissingExtKeyUsage)
+		}
+	}
+	return errs.Err()
+}
+
+// Is name a signature algorithm crypto/x509 knows, by the name it gives it (as in CertificateDetails)?
+func isSignatureAlgorithm(name string) bool {
+	for alg := x509.MD2WithRSA; alg <= x509.PureEd25519; alg++ {
+		if strings.EqualFold(name, alg.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the signatures of a certificate, and of the intermediates in its chain, against the signature policy: none
+// may use an algorithm in the ForbiddenSignatures option. Roots' signatures aren't checked, since nothing relies on
+// them. The first failing certificate is reported, with the field "cert" or "chain".
+func CheckSignaturePolicy(cert *x509.Certificate, chain []*x509.Certificate, config *RuntimeConfig) error {
+	forbidden := func(alg x509.SignatureAlgorithm) bool {
+		for _, name := range config.ForbiddenSignatures {
+			if strings.EqualFold(name, alg.String()) {
+				return true
+			}
+		}
+		return false
+	}
+	if forbidden(cert.SignatureAlgorithm) {
+		return &FieldError{"cert", ErrWeakSignature}
+	}
+	for _, c := range chain {
+		if !bytes.Equal(c.RawIssuer, c.RawSubject) && forbidden(c.SignatureAlgorithm) {
+			return &FieldError{"chain", ErrWeakSignature}
+		}
+	}
+	return nil
+}
+
+// Is a certificate a TLS server certificate? CAs aren't, and neither are certificates only for other purposes.
+func isServerCert(cert *x509.Certificate) bool {
+	if cert.IsCA || (len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0) {
+		return false
+	}
+	if len(cert.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageServerAuth || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+// Was a certificate issued by an internal CA? It was if its issuer is one of the InternalIssuers, by distinguished
+// name (as in CertificateDetails), or if it is self-signed.
+func isInternalCert(cert *x509.Certificate, config *RuntimeConfig) bool {
+	issuer := cert.Issuer.String()
+	for _, internal := range config.InternalIssuers {
+		if issuer == internal {
+			return true
+		}
+	}
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// Check a certificate against the validity policy. Certificates from internal CAs may be valid for at most
+// InternalValidity (if it isn't zero). Other server certificates are taken to be publicly trusted, and may be valid
+// for at most PublicValidity (398 days, the CA/Browser Forum limit, by default) if they were issued after the limit
+// came in. Browsers reject longer lived public certificates anyway, so they are better caught on upload.
+func CheckValidityPolicy(cert *x509.Certificate, config *RuntimeConfig) error {
+	if config.ValidityPolicy == ValidityPolicyOff {
+		return nil
+	}
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	if isInternalCert(cert, config) {
+		if config.InternalValidity > 0 && validity > time.Duration(config.InternalValidity) {
+			return ErrInternalValidity
+		}
+		return nil
+	}
+	if isServerCert(cert) && !cert.NotBefore.Before(publicValidityFrom) && validity > time.Duration(config.PublicValidity) {
+		return ErrPublicValidity
+	}
+	return nil
+}
+
+// Parse a dotted object identifier, such as "1.3.6.1.4.1.11129.2.4.2"
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, ErrInvalidConfig
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return nil, ErrInvalidConfig
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Devices are issued, and exported, this many at a time
+const provisionChunkSize = 500
+
+// The media type of a batch's export
+const MediaTypeZIP = "application/zip"
+
+var (
+	ErrInvalidProvisionCSV    = NewError("invalid-provision-csv", http.StatusBadRequest, "Invalid CSV. It needs a header row with a device_id column, and optionally a csr column.")
+	ErrNoDevices              = NewError("no-devices", http.StatusBadRequest, "The batch has no devices.")
+	ErrTooManyDevices         = NewError("too-many-devices", http.StatusBadRequest, "Too many devices for one batch. Split it up, or raise the maxBatchDevices option.")
+	ErrInvalidDeviceId        = NewError("invalid-device-id", http.StatusBadRequest, "Invalid device ID. Device IDs are up to 64 letters, digits, dots, colons, dashes and underscores.")
+	ErrDuplicateDeviceId      = NewError("duplicate-device-id", http.StatusBadRequest, "The device ID is in the batch more than once.")
+	ErrInvalidCSR             = NewError("invalid-csr", http.StatusBadRequest, "Invalid certificate signing request. It must be a PEM CSR, signed by its RSA or EC key.")
+	ErrInvalidBatchValidity   = NewError("invalid-batch-validity", http.StatusBadRequest, "Invalid validity. Give a duration such as \"87600h\", no longer than the CA certificate has left.")
+	ErrInvalidMatterId        = NewError("invalid-matter-id", http.StatusBadRequest, "Invalid Matter vendor or product ID. Give it as 4 hex digits, such as \"FFF1\". A product ID needs a vendor ID.")
+	ErrMatterKeyType          = NewError("matter-key-type", http.StatusBadRequest, "Matter device certificates need P-256 keys.")
+	ErrProvisionBatchNotFound = NewError("provision-batch-not-found", http.StatusNotFound, "Provisioning batch not found.")
+)
+
+// Manufacturing lines provision devices in batches: a user's stored CA certificate (one that may sign certificates,
+// as for minting, see mint.go) issues a certificate for each device in the batch, named for its device ID. Devices
+// that generate their keys themselves send a CSR, and get a certificate for its key. For the rest, a P-256 key is
+// generated here. A batch is given as JSON, or as a CSV file with a device_id column and an optional csr column.
+// Batches for Matter devices give the vendor ID, and optionally the product ID, and get Device Attestation
+// Certificates: the IDs are in their subjects, and they have no extended key usage.
+//
+// The certificates are issued in the background, a chunk at a time, so a batch of any size is accepted at once.
+// Issuing picks up where it left off after a restart. A device whose certificate couldn't be issued is marked with
+// the error's code, and can be retried. Issued certificates, and the keys generated here, are exported as a ZIP file
+// of a directory per device, with the CA's chain and a manifest.csv. An export can start after a given device ID,
+// so a download that was cut off can be resumed, and a batch can be exported while it is still being issued.
+// Exporting needs a key-export scope token and a reason, like any other key export, and is audited.
+//
+// The devices' certificates aren't stored as the user's certificates: there are far too many, and they belong to the
+// devices. They are kept with the batch until it is deleted. Batches aren't replicated to a standby.
+
+// A request to provision a batch of devices
+type ProvisionRequest struct {
+	Devices   []*ProvisionDevice `json:"devices"`
+	Validity  string             `json:"validity"`  // How long the certificates are valid for, such as "87600h". Empty means as long as the CA certificate.
+	VendorId  string             `json:"vendorId"`  // The Matter vendor ID, as 4 hex digits. Empty for devices that aren't Matter devices.
+	ProductId string             `json:"productId"` // The Matter product ID, as 4 hex digits. Optional.
+}
+
+// A device to be provisioned
+type ProvisionDevice struct {
+	Id  string `json:"id"`
+	CSR string `json:"csr,omitempty"` // PEM. Empty to have a key generated.
+}
+
+// A batch of devices being provisioned
+type ProvisionBatch struct {
+	Id        string  `json:"id"`
+	UserId    string  `json:"user"`
+	ParentId  string  `json:"parent"` // The certificate issuing the devices' certificates
+	NotAfter  UTCTime `json:"notAfter"`
+	VendorId  string  `json:"vendorId,omitempty"`
+	ProductId string  `json:"productId,omitempty"`
+	Created   UTCTime `json:"created"`
+	Devices   int     `json:"devices"`
+	Issued    int     `json:"issued"`
+	Failed    int     `json:"failed"`
+	Pending   int     `json:"pending"` // Devices still to be issued. The batch is done when there are none.
+}
+
+// A device in a batch, as stored
+type ProvisionedDevice struct {
+	Id    string     `db:"deviceid"`
+	CSR   StoredBlob `db:"csr"`   // DER. Empty if the key is generated here.
+	Cert  StoredPEM  `db:"cert"`  // Empty until issued
+	Key   StoredPEM  `db:"key"`   // Empty until issued, and for devices that sent a CSR
+	Error string     `db:"error"` // The code of the error issuing the certificate, if it couldn't be
+}
+
+var deviceIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+var matterIdPattern = regexp.MustCompile(`^[0-9A-F]{4}$`)
+
+// The Matter subject attributes for vendor and product IDs
+var (
+	oidMatterVendorId  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37244, 2, 1}
+	oidMatterProductId = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37244, 2, 2}
+)
+
+// Parse a batch's devices from CSV. The header row names the columns: device_id, and optionally csr.
+func ParseProvisionCSV(r io.Reader) ([]*ProvisionDevice, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, ErrInvalidProvisionCSV
+	}
+	idColumn, csrColumn := -1, -1
+	for i, name := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "device_id":
+			idColumn = i
+		case "csr":
+			csrColumn = i
+		}
+	}
+	if idColumn < 0 {
+		return nil, ErrInvalidProvisionCSV
+	}
+	devices := make([]*ProvisionDevice, 0, len(records)-1)
+	for _, record := range records[1:] {
+		device := &ProvisionDevice{Id: strings.TrimSpace(record[idColumn])}
+		if csrColumn >= 0 {
+			device.CSR = record[csrColumn]
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// Parse a PEM CSR, and check its signature
+func ParseCSRPEM(s string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(s)))
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, ErrInvalidCSR
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		return nil, ErrInvalidCSR
+	}
+	switch csr.PublicKey.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, ErrInvalidCSR
+	}
+	return csr, nil
+}
+
+// Check a CSR's key for a Matter device, which must be P-256
+func checkMatterKey(pub interface{}) error {
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return ErrMatterKeyType
+	}
+	return nil
+}
+
+// Validate a provisioning request against the CA certificate that is to issue it, and get the batch and its devices
+// as they are stored
+func NewProvisionBatch(parent *CertificateData, req *ProvisionRequest, config *RuntimeConfig, now time.Time) (*ProvisionBatch, []*ProvisionedDevice, error) {
+	signer, err := parseMintParent(parent, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch := &ProvisionBatch{
+		UserId:    parent.UserId,
+		ParentId:  parent.Id,
+		VendorId:  strings.ToUpper(req.VendorId),
+		ProductId: strings.ToUpper(req.ProductId),
+		Devices:   len(req.Devices),
+		Pending:   len(req.Devices),
+	}
+	if batch.VendorId != "" && !matterIdPattern.MatchString(batch.VendorId) {
+		return nil, nil, &FieldError{"vendorId", ErrInvalidMatterId}
+	}
+	if batch.ProductId != "" && (batch.VendorId == "" || !matterIdPattern.MatchString(batch.ProductId)) {
+		return nil, nil, &FieldError{"productId", ErrInvalidMatterId}
+	}
+
+	notAfter := signer.Cert.NotAfter
+	if req.Validity != "" {
+		validity, err := time.ParseDuration(req.Validity)
+		if err != nil || validity <= 0 || now.Add(validity).After(notAfter) {
+			return nil, nil, &FieldError{"validity", ErrInvalidBatchValidity}
+		}
+		notAfter = now.Add(validity)
+	}
+	batch.NotAfter = NewUTCTime(notAfter.Truncate(time.Second))
+
+	if len(req.Devices) == 0 {
+		return nil, nil, &FieldError{"devices", ErrNoDevices}
+	}
+	if len(req.Devices) > config.MaxBatchDevices {
+		return nil, nil, &FieldError{"devices", ErrTooManyDevices}
+	}
+	var errs ValidationErrors
+	devices := make([]*ProvisionedDevice, len(req.Devices))
+	seen := make(map[string]bool, len(req.Devices))
+	for i, device := range req.Devices {
+		field := "devices[" + strconv.Itoa(i) + "]"
+		devices[i] = &ProvisionedDevice{Id: device.Id}
+		if !deviceIdPattern.MatchString(device.Id) {
+			errs.Add(field+".id", ErrInvalidDeviceId)
+		} else if seen[device.Id] {
+			errs.Add(field+".id", ErrDuplicateDeviceId)
+		}
+		seen[device.Id] = true
+		if device.CSR == "" {
+			continue
+		}
+		csr, err := ParseCSRPEM(device.CSR)
+		if err == nil && batch.VendorId != "" {
+			err = checkMatterKey(csr.PublicKey)
+		}
+		if err != nil {
+			errs.Add(field+".csr", err)
+			continue
+		}
+		devices[i].CSR = csr.Raw
+	}
+	if len(errs) != 0 {
+		return nil, nil, errs
+	}
+	return batch, devices, nil
+}
+
+// Issue a device's certificate. Its key is the CSR's, or generated here if it has no CSR.
+func IssueDeviceCertificate(signer *mintParent, batch *ProvisionBatch, device *ProvisionedDevice, now time.Time) (*x509.Certificate, crypto.Signer, error) {
+	var pub interface{}
+	var key crypto.Signer
+	if len(device.CSR) != 0 {
+		csr, err := x509.ParseCertificateRequest(device.CSR)
+		if err != nil {
+			return nil, nil, ErrInvalidCSR
+		}
+		pub = csr.PublicKey
+	} else {
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		pub, key = generated.Public(), generated
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: device.Id},
+		NotBefore:             now,
+		NotAfter:              batch.NotAfter.Time,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if batch.VendorId != "" {
+		// Matter needs the IDs as UTF8Strings, which Go wouldn't choose for hex digits
+		template.Subject.ExtraNames = append(template.Subject.ExtraNames, pkix.AttributeTypeAndValue{
+			Type:  oidMatterVendorId,
+			Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(batch.VendorId)},
+		})
+		if batch.ProductId != "" {
+			template.Subject.ExtraNames = append(template.Subject.ExtraNames, pkix.AttributeTypeAndValue{
+				Type:  oidMatterProductId,
+				Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(batch.ProductId)},
+			})
+		}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.Cert, pub, signer.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Issue the certificates of a batch's devices that haven't been issued yet. Devices whose certificates can't be
+// issued, such as when the CA certificate has expired or been deleted, are marked with the error's code.
+func IssueProvisionBatch(batch *ProvisionBatch, now time.Time) (int, error) {
+	var signer *mintParent
+	parent, err := DatabaseReadKey(batch.UserId, batch.ParentId)
+	if err == nil {
+		signer, err = parseMintParent(parent, now)
+	}
+	parentErr := err
+
+	issued := 0
+	for {
+		devices, err := DatabaseListPendingDevices(batch.Id, provisionChunkSize)
+		if err != nil {
+			return issued, err
+		}
+		for _, device := range devices {
+			err := parentErr
+			if err == nil {
+				var cert *x509.Certificate
+				var key crypto.Signer
+				cert, key, err = IssueDeviceCertificate(signer, batch, device, now)
+				if err == nil {
+					device.Cert = StoredPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+					if key != nil {
+						encoded, err := EncodePrivateKeyPEM(key, KeyFormatPKCS8)
+						if err != nil {
+							return issued, err
+						}
+						device.Key = StoredPEM(encoded)
+					}
+				}
+			}
+			if err != nil {
+				device.Error = ErrorCode(err)
+				if device.Error == "" {
+					log.Printf("Unable to issue device %s's certificate in batch %s: %v", device.Id, batch.Id, err)
+					device.Error = "internal-error"
+				}
+			}
+			err = DatabaseSetDeviceCert(batch.Id, device)
+			if err != nil {
+				return issued, err
+			}
+			if device.Error == "" {
+				issued++
+			}
+		}
+		if len(devices) < provisionChunkSize {
+			return issued, nil
+		}
+	}
+}
+
+// Issue the certificates of every batch that isn't done
+func RunProvisioning(now time.Time) error {
+	batches, err := DatabaseListPendingBatches()
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		issued, err := IssueProvisionBatch(batch, now)
+		if issued != 0 {
+			Usage.Record(batch.UserId, UsageCertsCreated, int64(issued))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Issue pending batches every interval, unless this is a standby
+func RunProvisioningEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		if Replica.Standby() {
+			continue
+		}
+		err := RunProvisioning(Now())
+		if err != nil {
+			log.Println("Unable to provision devices:", err)
+		}
+	}
+}
+
+// Write a batch's export as a ZIP file: a directory per device with its cert.pem and, if it was generated here, its
+// key.pem, then the CA's chain.pem and a manifest.csv listing each device's cert-id, expiry, or error. The devices
+// are read a page at a time from next, until it returns none.
+func WriteProvisionZip(w io.Writer, chainPEM string, next func() ([]*ProvisionedDevice, error)) error {
+	zw := zip.NewWriter(w)
+	manifest := [][]string{{"device_id", "cert_id", "not_after", "error"}}
+	for {
+		devices, err := next()
+		if err != nil {
+			return err
+		}
+		if len(devices) == 0 {
+			break
+		}
+		for _, device := range devices {
+			if device.Error != "" {
+				manifest = append(manifest, []string{device.Id, "", "", device.Error})
+				continue
+			}
+			cert, err := ParseCertificatePEM(string(device.Cert))
+			if err != nil {
+				return err
+			}
+			hash := sha256.Sum256(cert.Raw)
+			manifest = append(manifest, []string{device.Id, hex.EncodeToString(hash[:]), cert.NotAfter.UTC().Format(time.RFC3339), ""})
+			err = writeZipFile(zw, device.Id+"/cert.pem", []byte(device.Cert))
+			if err != nil {
+				return err
+			}
+			if device.Key != "" {
+				err = writeZipFile(zw, device.Id+"/key.pem", []byte(device.Key))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	err := writeZipFile(zw, "chain.pem", []byte(chainPEM))
+	if err != nil {
+		return err
+	}
+	fw, err := zw.Create("manifest.csv")
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(fw)
+	err = cw.WriteAll(manifest)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+// Get the batch-id from a request
+func GetBatchID(r *http.Request) (string, string, error) {
+	userid, err := GetUserID(r)
+	if err != nil {
+		return "", "", err
+	}
+	batchid := mux.Vars(r)["batch-id"]
+	if checkid, err := strconv.ParseInt(batchid, 10, 64); err != nil || checkid <= 0 {
+		return "", "", ErrProvisionBatchNotFound
+	}
+	return userid, batchid, nil
+}
+
+// Provision a batch of devices from one of a user's CA certificates
+func CreateProvisionBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, certid, err := GetUserCertID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// The devices come as JSON, or as CSV with the other fields in the query
+	req := new(ProvisionRequest)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == MediaTypeCSV {
+		req.Devices, err = ParseProvisionCSV(r.Body)
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
+		query := r.URL.Query()
+		req.Validity, req.VendorId, req.ProductId = query.Get("validity"), query.Get("vendorId"), query.Get("productId")
+	} else {
+		d := json.NewDecoder(r.Body)
+		err = d.Decode(req)
+		if err != nil {
+			HandleError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	parent, err := DatabaseReadKey(userid, certid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	batch, devices, err := NewProvisionBatch(parent, req, Config(), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = DatabaseCreateProvisionBatch(r.Context(), batch, devices, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result. The certificates are issued in the background.
+	SendResult(w, r, batch)
+}
+
+// List a user's provisioning batches
+func ListProvisionBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	batches, page, err := DatabaseListProvisionBatches(userid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, batches, page)
+}
+
+// Get a provisioning batch, with how far issuing it has got
+func ReadProvisionBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, batchid, err := GetBatchID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	batch, err := DatabaseReadProvisionBatch(userid, batchid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, batch)
+}
+
+// Issue a batch's failed devices again
+func RetryProvisionBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, batchid, err := GetBatchID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	batch, err := DatabaseRetryProvisionBatch(userid, batchid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, batch)
+}
+
+// Export a batch's certificates and generated keys as a ZIP file. With "after", the export starts after that device.
+func ExportProvisionBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, batchid, err := GetBatchID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	after := r.URL.Query().Get("after")
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if reason == "" {
+		HandleError(w, r, ErrMissingReason, 0)
+		return
+	}
+
+	batch, err := DatabaseReadProvisionBatch(userid, batchid)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// The chain is the CA certificate's, unless it has since been deleted
+	var chain string
+	parent, err := DatabaseReadCert(userid, batch.ParentId)
+	if err == nil {
+		chain = string(parent.Cert) + string(parent.Chain)
+	} else if err != ErrNotFound {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = DatabaseCreateAudit(r.Context(), &AuditEntry{
+		Action: AuditActionExportBatch,
+		UserId: userid,
+		CertId: batch.ParentId,
+		Detail: AuditDetail{"batch": batchid, "after": after},
+		Reason: reason,
+	})
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	Usage.Record(userid, UsageKeyExports, 1)
+
+	// The export is streamed, so an error partway through can only cut it off. The manifest, written last, shows
+	// whether it is complete.
+	filename := "batch-" + batchid + ".zip"
+	w.Header().Set("Content-Type", MediaTypeZIP)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	err = WriteProvisionZip(w, chain, func() ([]*ProvisionedDevice, error) {
+		devices, err := DatabaseListProvisionedDevices(batchid, after, provisionChunkSize)
+		if len(devices) != 0 {
+			after = devices[len(devices)-1].Id
+		}
+		return devices, err
+	})
+	if err != nil {
+		log.Printf("Unable to export batch %s: %v", batchid, err)
+	}
+}
+
+// Delete a provisioning batch, with its devices' certificates and keys
+func DeleteProvisionBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, batchid, err := GetBatchID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	batch, err := DatabaseDeleteProvisionBatch(r.Context(), userid, batchid, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, batch)
+}
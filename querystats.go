@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statements beyond this many are counted together, so the stats can't grow without bound
+const maxQueryStats = 1000
+
+// The id of the statements counted together beyond maxQueryStats
+const otherQueryId = "other"
+
+// The upper bounds of the query duration histogram's buckets, in seconds
+var queryDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Every statement sent to the database is timed, by wrapping the Postgres driver's connections, so the queries that
+// hurt Postgres can be found. For each statement (by its SQL) the calls, the rows returned (or affected), the time
+// taken and the errors (by their SQLSTATE name, such as "unique_violation") are counted since this process started.
+// A query's time runs until its rows are closed, so it includes reading them.
+//
+// The counts are exported at /admin/metrics in the Prometheus text format, labelled with a short id for each
+// statement and its operation and first table (such as "select certstore_cert"), and listed at /admin/db/queries
+// with the full SQL, slowest in total first. Statements taking longer than the SlowQueryThreshold option are logged
+// with their parameters redacted: only numbers, times, booleans, nulls and hex ids are shown, since the rest may be
+// names, email addresses, or keys.
+
+// The counts for a statement
+type QueryStats struct {
+	Id      string           `json:"id"`    // The first 12 hex digits of the SHA256 hash of the SQL
+	Label   string           `json:"label"` // The operation and the first table, such as "select certstore_cert"
+	SQL     string           `json:"sql"`
+	Calls   int64            `json:"calls"`
+	Rows    int64            `json:"rows"`   // Returned, or affected
+	Errors  map[string]int64 `json:"errors"` // By SQLSTATE name, or "canceled", "timeout", "bad-connection" or "other"
+	Slow    int64            `json:"slow"`   // Calls slower than the SlowQueryThreshold option at the time
+	Total   Duration         `json:"total"`
+	Max     Duration         `json:"max"`
+	buckets []int64          // Calls by queryDurationBuckets, with one more for the rest
+}
+
+// QueryStatsCollector counts the statements sent to the database
+type QueryStatsCollector struct {
+	mu    sync.Mutex
+	stats map[string]*QueryStats // By SQL
+}
+
+// The statements sent to the database since this process started
+var DatabaseQueries = NewQueryStatsCollector()
+
+func NewQueryStatsCollector() *QueryStatsCollector {
+	return &QueryStatsCollector{stats: make(map[string]*QueryStats)}
+}
+
+var (
+	queryOperationPattern = regexp.MustCompile(`^\s*([A-Za-z]+)`)
+	queryTablePattern     = regexp.MustCompile(`certstore_[a-z_]+`)
+)
+
+// The id of a statement: the first 12 hex digits of the SHA256 hash of its SQL
+func queryId(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:6])
+}
+
+// The operation and first table of a statement, such as "select certstore_cert"
+func queryLabel(query string) string {
+	label := "unknown"
+	if m := queryOperationPattern.FindStringSubmatch(query); m != nil {
+		label = strings.ToLower(m[1])
+	}
+	if table := queryTablePattern.FindString(query); table != "" {
+		label += " " + table
+	}
+	return label
+}
+
+// The error label for an error from the driver
+func queryErrorLabel(err error) string {
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr):
+		if name := pqErr.Code.Name(); name != "" {
+			return name
+		}
+		return string(pqErr.Code)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, driver.ErrBadConn):
+		return "bad-connection"
+	}
+	return "other"
+}
+
+// Count a statement
+func (c *QueryStatsCollector) Record(query string, elapsed time.Duration, rows int64, err error, slow bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.stats[query]
+	if !ok {
+		if len(c.stats) >= maxQueryStats {
+			query = ""
+			stats, ok = c.stats[query]
+		}
+		if !ok {
+			stats = &QueryStats{Id: otherQueryId, Label: "other", Errors: make(map[string]int64), buckets: make([]int64, len(queryDurationBuckets)+1)}
+			if query != "" {
+				stats.Id, stats.Label, stats.SQL = queryId(query), queryLabel(query), query
+			}
+			c.stats[query] = stats
+		}
+	}
+	stats.Calls++
+	stats.Rows += rows
+	if err != nil {
+		stats.Errors[queryErrorLabel(err)]++
+	}
+	if slow {
+		stats.Slow++
+	}
+	stats.Total += Duration(elapsed)
+	if Duration(elapsed) > stats.Max {
+		stats.Max = Duration(elapsed)
+	}
+	bucket := sort.SearchFloat64s(queryDurationBuckets, elapsed.Seconds())
+	stats.buckets[bucket]++
+}
+
+// List the statements, slowest in total first
+func (c *QueryStatsCollector) List() []*QueryStats {
+	c.mu.Lock()
+	list := make([]*QueryStats, 0, len(c.stats))
+	for _, stats := range c.stats {
+		s := *stats
+		s.Errors = make(map[string]int64, len(stats.Errors))
+		for label, n := range stats.Errors {
+			s.Errors[label] = n
+		}
+		s.buckets = append([]int64(nil), stats.buckets...)
+		list = append(list, &s)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Total != list[j].Total {
+			return list[i].Total > list[j].Total
+		}
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Write the counts in the Prometheus text format
+func (c *QueryStatsCollector) WriteMetrics(w io.Writer) error {
+	list := c.List()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	labels := func(stats *QueryStats) string {
+		return `query_id="` + stats.Id + `",query="` + stats.Label + `"`
+	}
+	var b strings.Builder
+	b.WriteString("# HELP certstore_db_queries_total Statements sent to the database.\n# TYPE certstore_db_queries_total counter\n")
+	for _, stats := range list {
+		fmt.Fprintf(&b, "certstore_db_queries_total{%s} %d\n", labels(stats), stats.Calls)
+	}
+	b.WriteString("# HELP certstore_db_query_rows_total Rows returned, or affected, by statements.\n# TYPE certstore_db_query_rows_total counter\n")
+	for _, stats := range list {
+		fmt.Fprintf(&b, "certstore_db_query_rows_total{%s} %d\n", labels(stats), stats.Rows)
+	}
+	b.WriteString("# HELP certstore_db_query_errors_total Statements that failed, by error.\n# TYPE certstore_db_query_errors_total counter\n")
+	for _, stats := range list {
+		errorLabels := make([]string, 0, len(stats.Errors))
+		for label := range stats.Errors {
+			errorLabels = append(errorLabels, label)
+		}
+		sort.Strings(errorLabels)
+		for _, label := range errorLabels {
+			fmt.Fprintf(&b, "certstore_db_query_errors_total{%s,error=\"%s\"} %d\n", labels(stats), label, stats.Errors[label])
+		}
+	}
+	b.WriteString("# HELP certstore_db_query_slow_total Statements slower than the slow query threshold.\n# TYPE certstore_db_query_slow_total counter\n")
+	for _, stats := range list {
+		fmt.Fprintf(&b, "certstore_db_query_slow_total{%s} %d\n", labels(stats), stats.Slow)
+	}
+	b.WriteString("# HELP certstore_db_query_duration_seconds Time taken by statements, including reading their rows.\n# TYPE certstore_db_query_duration_seconds histogram\n")
+	for _, stats := range list {
+		var cumulative int64
+		for i, bound := range queryDurationBuckets {
+			cumulative += stats.buckets[i]
+			fmt.Fprintf(&b, "certstore_db_query_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels(stats), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&b, "certstore_db_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(stats), stats.Calls)
+		fmt.Fprintf(&b, "certstore_db_query_duration_seconds_sum{%s} %s\n", labels(stats), strconv.FormatFloat(time.Duration(stats.Total).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "certstore_db_query_duration_seconds_count{%s} %d\n", labels(stats), stats.Calls)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Parameters shown in the slow query log. Other strings may be names, email addresses or keys.
+var loggableParamPattern = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+
+// Describe a statement's parameters for the slow query log, redacting any that may be personal or secret
+func redactQueryParams(args []driver.NamedValue) string {
+	params := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case nil:
+			params[i] = "NULL"
+		case int64, float64, bool:
+			params[i] = fmt.Sprint(v)
+		case time.Time:
+			params[i] = v.UTC().Format(time.RFC3339Nano)
+		case string:
+			if loggableParamPattern.MatchString(v) {
+				params[i] = v
+			} else {
+				params[i] = Redacted + " (" + strconv.Itoa(len(v)) + " bytes)"
+			}
+		case []byte:
+			params[i] = Redacted + " (" + strconv.Itoa(len(v)) + " bytes)"
+		default:
+			params[i] = Redacted
+		}
+	}
+	return "[" + strings.Join(params, ", ") + "]"
+}
+
+// Count a statement, logging it if it was slow
+func recordQuery(query string, args []driver.NamedValue, elapsed time.Duration, rows int64, err error) {
+	threshold := time.Duration(Config().SlowQueryThreshold)
+	slow := threshold > 0 && elapsed >= threshold
+	DatabaseQueries.Record(query, elapsed, rows, err, slow)
+	if slow {
+		captureSlowPlan(query, args)
+		log.Printf("Slow query (%s, %d rows): %s %s", elapsed, rows, strings.Join(strings.Fields(query), " "), redactQueryParams(args))
+	}
+}
+
+// A driver.Connector whose connections time their statements
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn}, nil
+}
+
+// A connection timing its statements, and failing them if database faults are being injected (see faults.go). The
+// driver's optional interfaces are passed through, or skipped if it doesn't have them.
+type instrumentedConn struct {
+	conn driver.Conn
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt: stmt, query: query}, nil
+}
+
+func (c *instrumentedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *instrumentedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.conn.Begin()
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := injectDatabaseFault(); err != nil {
+		recordQuery(query, args, 0, 0, err)
+		return nil, err
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	recordQuery(query, args, time.Since(start), rowsAffected(result, err), err)
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := injectDatabaseFault(); err != nil {
+		recordQuery(query, args, 0, 0, err)
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	if err != nil {
+		recordQuery(query, args, time.Since(start), 0, err)
+		return nil, err
+	}
+	return &instrumentedRows{rows: rows, query: query, args: args, start: start}, nil
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// A prepared statement, timed each time it is run
+type instrumentedStmt struct {
+	stmt  driver.Stmt
+	query string
+}
+
+func (s *instrumentedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *instrumentedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *instrumentedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *instrumentedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := injectDatabaseFault(); err != nil {
+		recordQuery(s.query, args, 0, 0, err)
+		return nil, err
+	}
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if execer, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		result, err = s.stmt.Exec(positionalValues(args))
+	}
+	recordQuery(s.query, args, time.Since(start), rowsAffected(result, err), err)
+	return result, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := injectDatabaseFault(); err != nil {
+		recordQuery(s.query, args, 0, 0, err)
+		return nil, err
+	}
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.stmt.Query(positionalValues(args))
+	}
+	if err != nil {
+		recordQuery(s.query, args, time.Since(start), 0, err)
+		return nil, err
+	}
+	return &instrumentedRows{rows: rows, query: s.query, args: args, start: start}, nil
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+func positionalValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+func rowsAffected(result driver.Result, err error) int64 {
+	if err != nil || result == nil {
+		return 0
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// A query's rows, counted as they are read. The query is recorded when they are closed.
+type instrumentedRows struct {
+	rows  driver.Rows
+	query string
+	args  []driver.NamedValue
+	start time.Time
+	count int64
+	err   error
+	done  bool
+}
+
+func (r *instrumentedRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.rows.Next(dest)
+	if err == nil {
+		r.count++
+	} else if err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	err := r.rows.Close()
+	if !r.done {
+		r.done = true
+		recordQuery(r.query, r.args, time.Since(r.start), r.count, r.err)
+	}
+	return err
+}
+
+func (r *instrumentedRows) HasNextResultSet() bool {
+	if sets, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return sets.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *instrumentedRows) NextResultSet() error {
+	if sets, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return sets.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *instrumentedRows) ColumnTypeScanType(index int) reflect.Type {
+	if types, ok := r.rows.(driver.RowsColumnTypeScanType); ok {
+		return types.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *instrumentedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if types, ok := r.rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return types.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *instrumentedRows) ColumnTypeLength(index int) (int64, bool) {
+	if types, ok := r.rows.(driver.RowsColumnTypeLength); ok {
+		return types.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *instrumentedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if types, ok := r.rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return types.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+// Export the metrics in the Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := DatabaseQueries.WriteMetrics(w)
+	if err != nil {
+		log.Println("Unable to write metrics:", err)
+	}
+}
+
+// List the statements sent to the database since this process started, slowest in total first
+func ListDatabaseQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, DatabaseQueries.List())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"regexp"
+)
+
+// What redacted secrets are replaced with
+const Redacted = "[REDACTED]"
+
+// Secrets that must never be written to logs, sent back in error messages or kept in the audit log.
+// Each pattern keeps its first group (such as "Bearer ") and replaces the rest.
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// PEM private keys of any type, encrypted or not. A block cut off before its END line is redacted to the end.
+	{regexp.MustCompile(`(?s)(-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----).*?(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`), "${1}" + Redacted},
+	// Tokens in Authorization headers
+	{regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[^\s"',;]+`), "${1}" + Redacted},
+	// Key export links (see export.go)
+	{regexp.MustCompile(`(/export/)[A-Za-z0-9_.\-]+`), "${1}" + Redacted},
+	// Vault service, batch and recovery tokens (see vault.go)
+	{regexp.MustCompile(`\b(hv[sbr]\.)[A-Za-z0-9_\-]+`), "${1}" + Redacted},
+	// Session cookies
+	{regexp.MustCompile(`(` + SessionCookie + `=)[^\s;"]+`), "${1}" + Redacted},
+	// Passwords, passphrases and tokens in JSON
+	{regexp.MustCompile(`(?i)("(?:password|passphrase|secret|token|csrfToken)"\s*:\s*")(?:[^"\\]|\\.)*"`), "${1}" + Redacted + `"`},
+}
+
+// Redact the secrets in a string
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// Redact the strings in a value decoded from JSON, such as an audit entry's detail
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return Redact(v)
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = Redact(s)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redactValue(item)
+		}
+		return redacted
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			redacted[key] = redactValue(item)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+// A RedactingWriter redacts secrets from everything written through it. The standard logger writes each message
+// in a single Write, so a key logged in one message is always redacted as a whole.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w}
+}
+
+func (rw *RedactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(rw.w, Redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The advisory lock held while logging an event
+const eventLockKey = "6576656e7400"
+
+// The most events, audit entries or users sent to a standby at once
+const replicationBatchSize = 100
+
+var (
+	ErrStandby              = NewError("standby", http.StatusServiceUnavailable, "This instance is a standby. Changes must be made on the primary.")
+	ErrNotStandby           = NewError("not-standby", http.StatusConflict, "This instance is not a standby.")
+	ErrReplicationFailed    = NewError("replication-failed", http.StatusBadGateway, "The primary refused a replication request.")
+	ErrInvalidReplicaOf     = NewError("invalid-replica-of", http.StatusBadRequest, "Invalid primary URL. It must be an http:// or https:// URL.")
+	ErrInvalidEventPosition = NewError("invalid-event-position", http.StatusBadRequest, "Invalid replication position. Positions are event and audit log ids.")
+)
+
+// Replication keeps a standby instance, typically in another region, up to date with the primary through the
+// HTTP API rather than Postgres replication, so the standby can run its own database anywhere.
+//
+// Every change is published as an event, and the primary keeps the events in its event log (certstore_event).
+// A standby polls the primary's event log. For each event it is sent the current state of the users involved
+// (a UserSnapshot), which replaces its copy of those users. Snapshots are of the current state rather than the
+// change itself, so applying them twice, or out of date, does no harm. The audit log is copied entry for entry,
+// hashes included, so its chain can still be verified on the standby.
+//
+// A new standby first copies every user, and then follows the event log from where the primary was when it
+// started copying. A standby refuses changes, until it is promoted to be a primary.
+//
+// Events are logged after the change they describe is committed, so a primary that crashes in between loses the
+// event, and the standby doesn't see the change until the user changes again.
+
+// A UserSnapshot is everything stored for a user, as sent to a standby. Deleted users only have an id.
+type UserSnapshot struct {
+	Id          string               `json:"id"`
+	Deleted     bool                 `json:"deleted,omitempty"`
+	Name        string               `json:"name,omitempty"`
+	Email       string               `json:"email,omitempty"`
+	EmailIndex  *string              `json:"emailIndex,omitempty" db:"emailindex"` // Names and emails are sent as stored, encrypted or not (see pii.go)
+	Extra       Extra                `json:"extra,omitempty"`                      // Including attributes the standby may not know
+	Certs       []*ReplicaCert       `json:"certs,omitempty"`
+	Grants      []*Grant             `json:"grants,omitempty"` // Grants made by the user and grants to the user
+	Attachments []*ReplicaAttachment `json:"attachments,omitempty"`
+}
+
+// A certificate as stored, with its content. Keys and content are sent as they are stored (see storage.go).
+type ReplicaCert struct {
+	Id        string  `json:"id"`
+	Active    bool    `json:"active"`
+	Key       []byte  `json:"key"`
+	Notes     string  `json:"notes"`
+	Cert      []byte  `json:"cert"`
+	NotBefore UTCTime `json:"notBefore"`
+	NotAfter  UTCTime `json:"notAfter"`
+	SPKI      string  `json:"spki"` // Empty if the primary hasn't fingerprinted it yet: the standby does
+	Extra     Extra   `json:"extra,omitempty"`
+
+	// Scheduled changes, which the standby runs once it is promoted
+	ActivateAt   UTCTime `json:"activateAt"`
+	DeactivateAt UTCTime `json:"deactivateAt"`
+
+	// The chain as stored (see StoredChain). Nil if there is none.
+	Chain []byte `json:"chain,omitempty"`
+}
+
+// An attachment as stored
+type ReplicaAttachment struct {
+	CertId  string  `json:"cert"`
+	Name    string  `json:"name"`
+	Type    string  `json:"type"`
+	Size    int     `json:"size"`
+	Created UTCTime `json:"created"`
+	Data    []byte  `json:"data"`
+}
+
+// The changes after a position in the event log and the audit log
+type ReplicationBatch struct {
+	Events  []*Event        `json:"events"`
+	Audit   []*AuditEntry   `json:"audit"`
+	Users   []*UserSnapshot `json:"users"`   // The users involved in the events
+	Event   int64           `json:"event"`   // The position reached in the event log
+	AuditId int64           `json:"auditId"` // The position reached in the audit log
+}
+
+// A page of users, for a standby's first copy
+type ReplicationUsers struct {
+	Users []*UserSnapshot `json:"users"`
+	Last  int64           `json:"last"` // The id of the last user, to page from
+}
+
+// The users involved in a list of events, in the order they first appear
+func eventUserIds(events []*Event) []string {
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, e := range events {
+		for _, id := range []string{e.UserId, e.TargetId} {
+			if id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// ReplicaStatus is the replication state of this instance
+type ReplicaStatus struct {
+	Role      string  `json:"role"`              // "primary" or "standby"
+	Primary   string  `json:"primary,omitempty"` // The primary's host, for a standby
+	Copied    bool    `json:"copied"`            // Has the first copy of every user finished?
+	Event     int64   `json:"event"`             // The position reached in the primary's event log
+	AuditId   int64   `json:"auditId"`           // The position reached in the primary's audit log
+	LastSync  UTCTime `json:"lastSync"`
+	LastError string  `json:"lastError,omitempty"`
+}
+
+// The replica state, as kept in the database
+type replicaState struct {
+	EventId  int64
+	AuditId  int64
+	CopyUser int64 // The last user copied, while the first copy is running
+	Copied   bool
+	Promoted bool
+}
+
+// Replicator follows a primary while this instance is a standby
+type Replicator struct {
+	mu      sync.Mutex
+	standby bool
+	status  ReplicaStatus
+	stop    chan struct{}
+	done    chan struct{}
+	client  *http.Client
+}
+
+// Replica is the replication state of this instance
+var Replica = &Replicator{status: ReplicaStatus{Role: "primary"}, client: &http.Client{Timeout: time.Minute}}
+
+// Is this instance a standby?
+func (rep *Replicator) Standby() bool {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.standby
+}
+
+func (rep *Replicator) Status() ReplicaStatus {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	return rep.status
+}
+
+func (rep *Replicator) synced(state *replicaState, err error) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.status.Copied, rep.status.Event, rep.status.AuditId = state.Copied, state.EventId, state.AuditId
+	if err != nil {
+		rep.status.LastError = Redact(err.Error())
+		return
+	}
+	rep.status.LastError = ""
+	rep.status.LastSync = NewUTCTime(Now())
+}
+
+// Start following OptReplicaOf, unless this instance has been promoted
+func (rep *Replicator) Start(interval time.Duration) error {
+	if OptReplicaOf == "" {
+		return nil
+	}
+	u, err := url.Parse(OptReplicaOf)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidReplicaOf
+	}
+	state, err := DatabaseReadReplicaState()
+	if err != nil {
+		return err
+	}
+	if state.Promoted {
+		log.Println("This instance has been promoted, so it no longer follows", u.Host)
+		return nil
+	}
+
+	rep.mu.Lock()
+	rep.standby = true
+	rep.status = ReplicaStatus{Role: "standby", Primary: u.Host, Copied: state.Copied, Event: state.EventId, AuditId: state.AuditId}
+	rep.stop = make(chan struct{})
+	rep.done = make(chan struct{})
+	rep.mu.Unlock()
+
+	go rep.follow(state, interval)
+	return nil
+}
+
+// Follow the primary until stopped. Failures are retried after a growing delay.
+func (rep *Replicator) follow(state *replicaState, interval time.Duration) {
+	defer close(rep.done)
+	wait := time.Duration(0)
+	backoff := interval
+	for {
+		select {
+		case <-rep.stop:
+			return
+		case <-clock.After(wait):
+		}
+
+		more, err := rep.syncOnce(state)
+		rep.synced(state, err)
+		switch {
+		case err != nil:
+			log.Println("Unable to replicate from primary:", err)
+			wait = backoff
+			backoff *= 2
+			if backoff > siemMaxBackoff {
+				backoff = siemMaxBackoff
+			}
+		case more:
+			wait, backoff = 0, interval
+		default:
+			wait, backoff = interval, interval
+		}
+	}
+}
+
+// Copy the next batch from the primary. Returns true if there is more to copy straight away.
+func (rep *Replicator) syncOnce(state *replicaState) (bool, error) {
+	// A new standby starts by noting where the primary's event log is, and then copying every user
+	if !state.Copied {
+		if state.CopyUser == 0 && state.EventId == 0 {
+			var batch ReplicationBatch
+			err := rep.get("/admin/replication/changes?event=-1", &batch)
+			if err != nil {
+				return false, err
+			}
+			state.EventId = batch.Event
+		}
+		var page ReplicationUsers
+		err := rep.get("/admin/replication/users?after="+strconv.FormatInt(state.CopyUser, 10), &page)
+		if err != nil {
+			return false, err
+		}
+		next := *state
+		if len(page.Users) == 0 {
+			next.Copied = true
+		} else {
+			next.CopyUser = page.Last
+		}
+		err = DatabaseApplyReplication(page.Users, nil, &next)
+		if err != nil {
+			return false, err
+		}
+		*state = next
+		return true, nil
+	}
+
+	var batch ReplicationBatch
+	err := rep.get("/admin/replication/changes?event="+strconv.FormatInt(state.EventId, 10)+"&audit="+strconv.FormatInt(state.AuditId, 10), &batch)
+	if err != nil {
+		return false, err
+	}
+	if len(batch.Events) == 0 && len(batch.Audit) == 0 {
+		return false, nil
+	}
+	next := *state
+	next.EventId, next.AuditId = batch.Event, batch.AuditId
+	err = DatabaseApplyReplication(batch.Users, batch.Audit, &next)
+	if err != nil {
+		return false, err
+	}
+	*state = next
+	return true, nil
+}
+
+// Get a result from the primary, using the admin scope token in OptReplicaToken
+func (rep *Replicator) get(path string, result interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(OptReplicaOf, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+OptReplicaToken)
+	req.Header.Set("Accept", "application/json")
+	res, err := rep.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ErrReplicationFailed
+	}
+	body := &HTTPResult{Result: result}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<30)).Decode(body)
+}
+
+// Stop following the primary and become a primary. Waits for a sync in progress to finish.
+func (rep *Replicator) Promote() error {
+	rep.mu.Lock()
+	if !rep.standby {
+		rep.mu.Unlock()
+		return ErrNotStandby
+	}
+	close(rep.stop)
+	done := rep.done
+	rep.mu.Unlock()
+	<-done
+
+	err := DatabasePromoteReplica()
+	if err != nil {
+		return err
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.standby = false
+	rep.status.Role = "primary"
+	return nil
+}
+
+// Middleware that refuses changes on a standby. Logging in and out, and promotion, are still allowed.
+func StandbyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readOnly := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+		allowed := r.URL.Path == "/admin/login" || r.URL.Path == "/admin/logout" || r.URL.Path == "/admin/replication/promote"
+		if !readOnly && !allowed && Replica.Standby() {
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrStandby, 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parse a position in the event log or audit log. Empty means the start, -1 means the end.
+func parseLogPosition(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	position, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || position < -1 {
+		return 0, ErrInvalidEventPosition
+	}
+	return position, nil
+}
+
+// Get the changes after a position in the event log and the audit log, for a standby
+func ReplicationChangesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	event, err := parseLogPosition(r.URL.Query().Get("event"))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	audit, err := parseLogPosition(r.URL.Query().Get("audit"))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	batch, err := DatabaseReplicationChanges(event, audit, replicationBatchSize)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, batch)
+}
+
+// Get a page of users, for a standby's first copy
+func ReplicationUsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	after, err := parseLogPosition(r.URL.Query().Get("after"))
+	if err != nil || after < 0 {
+		HandleError(w, r, ErrInvalidEventPosition, 0)
+		return
+	}
+
+	page, err := DatabaseReplicationUsers(after, replicationBatchSize)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, page)
+}
+
+func ReadReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, Replica.Status())
+}
+
+func PromoteReplicaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := Replica.Promote()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	log.Println("Promoted to primary")
+
+	// Send the result
+	SendResult(w, r, Replica.Status())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The most names that can be resolved at once
+const maxResolveNames = 100
+
+// The attachment holding a certificate's chain, for certificates uploaded without one (see chain.go): its PEM encoded
+// intermediate certificates, starting with its issuer
+const ChainAttachment = "chain.pem"
+
+var (
+	ErrNothingToResolve = NewError("nothing-to-resolve", http.StatusBadRequest, "Give at least one name to resolve.")
+	ErrTooManyToResolve = NewError("too-many-to-resolve", http.StatusBadRequest, "Too many names to resolve at once. At most 100 can be resolved.")
+)
+
+// Resolving names is for configuration management lookups (an Ansible lookup plugin, a Chef data source): given the
+// names a host serves, get the certificate to deploy for each, with its chain and, if asked for, its private key.
+// Each name is resolved on its own, and one that can't be doesn't fail the rest, so a playbook can report exactly
+// which names are missing. The request and result schemas are stable: fields may be added, but none will be removed
+// or change meaning.
+//
+// A name resolves to the user's active, currently valid certificate covering it (by a DNS name, wildcard, or IP
+// address). If there are several, the one expiring last is used. Private keys are exported as they are by the
+// key export endpoint: each as a single-use download link, with the key-export scope and a reason.
+
+// Names to resolve to certificates
+type ResolveRequest struct {
+	Names []string `json:"names"`
+	Keys  bool     `json:"keys"` // Also export each certificate's private key. Needs the key-export scope and a reason.
+}
+
+// A resolved name: the certificate for it, or why there isn't one
+type ResolveItem struct {
+	Name     string      `json:"name"`
+	CertId   string      `json:"certId,omitempty"`
+	Cert     string      `json:"cert,omitempty"`  // PEM encoded
+	Chain    string      `json:"chain,omitempty"` // PEM encoded intermediates: the certificate's chain, or its chain.pem attachment
+	NotAfter UTCTime     `json:"notAfter"`
+	Key      *ExportLink `json:"key,omitempty"`   // A link to download the private key from, if keys were asked for
+	Error    string      `json:"error,omitempty"` // Why the name couldn't be resolved
+	Code     string      `json:"code,omitempty"`
+}
+
+type ResolveResult struct {
+	Items []*ResolveItem `json:"items"` // In the order of the names asked for
+}
+
+// A certificate, with the names it covers
+type namedCert struct {
+	data  *CertificateData
+	cert  *x509.Certificate
+	names []string
+}
+
+// Find the active, currently valid certificate for a name among a user's certificates. If there are several, the
+// one expiring last is returned.
+func resolveName(certs []*namedCert, name string) (*CertificateData, error) {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	var found *CertificateData
+	for _, cert := range certs {
+		if !cert.data.Active || !cert.data.IsCurrentlyValid() || !namesOverlap(cert.names, []string{name}) {
+			continue
+		}
+		if found == nil || cert.data.NotAfter.After(found.NotAfter.Time) {
+			found = cert.data
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Parse the names each certificate covers. Certificates that can't be parsed are left out.
+func namedCerts(certs []*CertificateData) []*namedCert {
+	named := make([]*namedCert, 0, len(certs))
+	for _, certData := range certs {
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			continue
+		}
+		named = append(named, &namedCert{data: certData, cert: cert, names: certNames(cert)})
+	}
+	return named
+}
+
+// Resolve names to a user's certificates, for configuration management
+func ResolveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	req := new(ResolveRequest)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(req)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Names) == 0 {
+		HandleError(w, r, ErrNothingToResolve, 0)
+		return
+	}
+	if len(req.Names) > maxResolveNames {
+		HandleError(w, r, ErrTooManyToResolve, 0)
+		return
+	}
+
+	// Private keys are only exported with the key-export scope, and a reason, as by the key export endpoint
+	var reason string
+	if req.Keys {
+		if !allowAttempt(w, r, ClientIPKey(r)) {
+			return
+		}
+		if !HasScope(r, ScopeKeyExport, Config()) {
+			if r.Header.Get("Authorization") != "" {
+				failedAttempt(r, "scope-token", ClientIPKey(r))
+			}
+			HandleError(w, r, ErrMissingScope, 0)
+			return
+		}
+		reason, err = ChangeReason(r)
+		if err != nil {
+			HandleError(w, r, err, 0)
+			return
+		}
+		if reason == "" {
+			HandleError(w, r, ErrMissingReason, 0)
+			return
+		}
+	}
+
+	user, _, err := DatabaseReadUser(userid, nil)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	certs := namedCerts(user.Certs)
+
+	result := &ResolveResult{Items: make([]*ResolveItem, len(req.Names))}
+	for i, name := range req.Names {
+		item := &ResolveItem{Name: name}
+		result.Items[i] = item
+		certData, err := resolveName(certs, name)
+		if err == nil && req.Keys {
+			item.Key, err = DatabaseExportKey(r.Context(), userid, certData.Id, userid, reason)
+			if err == nil {
+				Anomalies.RecordExport(r, certData.Id)
+				Usage.Record(userid, UsageKeyExports, 1)
+			}
+		}
+		if err != nil {
+			item.Error, item.Code = Redact(LocalizeError(w, r, err)), ErrorCode(err)
+			continue
+		}
+		item.CertId, item.Cert, item.NotAfter = certData.Id, string(certData.Cert), certData.NotAfter
+		item.Chain = string(certData.Chain)
+		if item.Chain == "" {
+			if chain, err := DatabaseReadAttachment(userid, certData.Id, ChainAttachment); err == nil {
+				item.Chain = string(chain.Data)
+			}
+		}
+	}
+
+	// Send the result
+	SendResult(w, r, result)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"golang.org/x/crypto/ocsp"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Certificates are read a batch at a time
+const revocationBatchSize = 100
+
+// The shortest interval certificates can be checked again at, so OCSP responders and CRLs aren't hammered
+const minRevocationInterval = time.Hour
+
+// How a certificate's revocation was found
+const (
+	RevocationSourceCRL  = "crl"
+	RevocationSourceOCSP = "ocsp"
+)
+
+var ErrRevocationRunning = NewError("revocation-running", http.StatusConflict, "The certificates' revocation status is already being checked. Please wait for the check to finish.")
+
+// A certificate revoked by its CA after it was uploaded is only caught if its status is checked again. Every
+// RevocationInterval (if it isn't zero) each active certificate is checked again, with the OCSP responder named in
+// its authority information access extension and against the CRLs named in its CRL distribution points extension
+// (using the CRL cache, see crl.go). Its issuer must be in its chain for either. When a certificate is found revoked
+// it is marked revoked with the CA's reason, and deactivated for every user holding it, with an audit entry and an
+// update event for each. A certificate already marked revoked by a CRL refresh is deactivated at the next check.
+// Deactivation isn't held up by change freezes (see freeze.go): a revoked certificate shouldn't be served.
+//
+// When each certificate was last checked is kept with it, as revocationChecked, including certificates that name
+// neither an OCSP responder nor a CRL, or whose status couldn't be found. An administrator can check the due
+// certificates straight away. A standby doesn't check.
+
+// RFC 5280 revocation reasons, by their code. Code 7 isn't used.
+var revocationReasons = []string{"unspecified", "keyCompromise", "cACompromise", "affiliationChanged", "superseded",
+	"cessationOfOperation", "certificateHold", "", "removeFromCRL", "privilegeWithdrawn", "aACompromise"}
+
+// The name of an RFC 5280 revocation reason. Empty if it isn't known.
+func revocationReason(code int) string {
+	if code < 0 || code >= len(revocationReasons) {
+		return ""
+	}
+	return revocationReasons[code]
+}
+
+// How a certificate was found revoked
+type Revocation struct {
+	Revoked UTCTime
+	Reason  string // An RFC 5280 reason. Empty if not given.
+	Source  string // RevocationSourceCRL or RevocationSourceOCSP
+	URL     string // The CRL. Empty for OCSP.
+}
+
+func crlRevocation(entry *x509.RevocationListEntry, crlURL string) *Revocation {
+	return &Revocation{Revoked: NewUTCTime(entry.RevocationTime), Reason: revocationReason(entry.ReasonCode), Source: RevocationSourceCRL, URL: crlURL}
+}
+
+func (revocation *Revocation) auditDetail() AuditDetail {
+	detail := AuditDetail{"source": revocation.Source, "revoked": revocation.Revoked}
+	if revocation.URL != "" {
+		detail["crl"] = revocation.URL
+	}
+	if revocation.Reason != "" {
+		detail["reason"] = revocation.Reason
+	}
+	return detail
+}
+
+// The reason given when a revoked certificate is deactivated
+func (revocation *Revocation) String() string {
+	if revocation.Reason == "" {
+		return "Revoked by its CA"
+	}
+	return "Revoked by its CA: " + revocation.Reason
+}
+
+// A certificate deactivated because it was revoked
+type RevokedCert struct {
+	UserId  string  `json:"userId"`
+	CertId  string  `json:"certId"`
+	Revoked UTCTime `json:"revoked"`
+	Reason  string  `json:"reason,omitempty"`
+	Source  string  `json:"source"`
+}
+
+// What a check did
+type RevocationCheck struct {
+	Checked     int            `json:"checked"` // Certificates checked, counting those held by more than one user once
+	Deactivated []*RevokedCert `json:"deactivated"`
+}
+
+// A check of the due certificates. The CRLs are only read once each per check.
+type revocationChecker struct {
+	now  time.Time
+	crls map[string]*crlIndex // Nil for CRLs that couldn't be read
+}
+
+// Check a certificate's revocation status, returning how it was found revoked, or nil if it wasn't. A certificate
+// already marked revoked isn't checked again.
+func (checker *revocationChecker) check(certData *CertificateData) (*Revocation, error) {
+	if !certData.Revoked.IsZero() {
+		return &Revocation{Revoked: certData.Revoked, Reason: certData.RevocationReason, Source: RevocationSourceCRL}, nil
+	}
+	cert, err := ParseCertificatePEM(string(certData.Cert))
+	if err != nil {
+		return nil, err
+	}
+	chain, err := ParseChainPEM(string(certData.Chain))
+	if err != nil {
+		return nil, err
+	}
+	issuer := chainIssuer(cert, chain)
+	if issuer == nil {
+		return nil, nil
+	}
+
+	if len(cert.OCSPServer) > 0 {
+		resp, err := ocspResponse(cert, issuer, checker.now)
+		if err != nil {
+			log.Println("Unable to check OCSP status of", certData.Id+":", err)
+		} else if resp.Status == ocsp.Revoked {
+			return &Revocation{Revoked: NewUTCTime(resp.RevokedAt), Reason: revocationReason(resp.RevocationReason), Source: RevocationSourceOCSP}, nil
+		}
+	}
+
+	for _, u := range crlURLs(cert) {
+		index, ok := checker.crls[u]
+		if !ok {
+			crl, _, err := refreshCRL(u, []*crlCert{{id: certData.Id, cert: cert, issuer: issuer}}, checker.now)
+			if err != nil {
+				log.Println("Unable to refresh CRL", u+":", err)
+			}
+			if crl != nil {
+				index = newCRLIndex(crl)
+			}
+			checker.crls[u] = index
+		}
+		if index == nil {
+			continue
+		}
+		if entry := index.lookup(cert); entry != nil {
+			return crlRevocation(entry, u), nil
+		}
+	}
+	return nil, nil
+}
+
+// Is a check running?
+var revocationRunning int32
+
+// Check the revocation status of the active certificates not checked within the interval, deactivating those
+// found revoked
+func CheckRevocations(interval time.Duration, now time.Time) (*RevocationCheck, error) {
+	if !atomic.CompareAndSwapInt32(&revocationRunning, 0, 1) {
+		return nil, ErrRevocationRunning
+	}
+	defer atomic.StoreInt32(&revocationRunning, 0)
+
+	result := &RevocationCheck{Deactivated: []*RevokedCert{}}
+	checker := &revocationChecker{now: now, crls: make(map[string]*crlIndex)}
+	for {
+		// Every certificate in a batch is marked checked, or deactivated, so the next batch moves on
+		certs, err := DatabaseListRevocationDue(now.Add(-interval), revocationBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		done := make(map[string]bool)
+		for _, certData := range certs {
+			if done[certData.Id] {
+				continue
+			}
+			done[certData.Id] = true
+			result.Checked++
+
+			revocation, err := checker.check(certData)
+			if err != nil {
+				log.Println("Unable to check revocation status of", certData.Id+":", err)
+			}
+			if revocation == nil {
+				err = DatabaseSetRevocationChecked(certData.Id, now)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			deactivated, err := DatabaseRevokeCert(context.Background(), certData.Id, revocation, now)
+			if err != nil {
+				return nil, err
+			}
+			for _, userid := range deactivated {
+				result.Deactivated = append(result.Deactivated, &RevokedCert{UserId: userid, CertId: certData.Id, Revoked: revocation.Revoked, Reason: revocation.Reason, Source: revocation.Source})
+				Events.Publish(&Event{Type: EventCertUpdated, UserId: userid, CertId: certData.Id})
+			}
+		}
+		if len(certs) < revocationBatchSize {
+			break
+		}
+	}
+	if result.Checked > 0 {
+		log.Printf("Revocation status checked: %d certificates, %d deactivated", result.Checked, len(result.Deactivated))
+	}
+	return result, nil
+}
+
+// Check the due certificates every interval, if the RevocationInterval option isn't zero
+func RunRevocationChecksEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		config := Config()
+		if config.RevocationInterval == 0 || Replica.Standby() {
+			continue
+		}
+		_, err := CheckRevocations(time.Duration(config.RevocationInterval), Now())
+		if err != nil && err != ErrRevocationRunning {
+			log.Println("Unable to check revocation status:", err)
+		}
+	}
+}
+
+// Check the due certificates now, rather than waiting for the next check. If the RevocationInterval option is zero,
+// every active certificate is checked.
+func CheckRevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	result, err := CheckRevocations(time.Duration(Config().RevocationInterval), Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, result)
+}
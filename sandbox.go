@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var (
+	ErrInvalidSandboxCA = NewError("invalid-sandbox-ca", http.StatusBadRequest, "Invalid sandbox CA file. It must contain PEM encoded certificates.")
+	ErrSandboxReplica   = NewError("sandbox-replica", http.StatusBadRequest, "A sandbox can't follow a primary. It must have its own data.")
+	ErrNotSandbox       = NewError("not-sandbox", http.StatusNotFound, "This server is not a sandbox.")
+
+	WarnSandboxKeySize   = NewError("sandbox-key-size", 0, "The key is shorter than the minimum. It was only accepted because this server is a sandbox.")
+	WarnSandboxSignature = NewError("sandbox-signature", 0, "The certificate is signed with a signature algorithm that is not allowed. It was only accepted because this server is a sandbox.")
+)
+
+// A sandbox is a server for integrators to test against safely. Sandboxes are whole servers, each with its own
+// database. In a sandbox:
+//
+// - Keys shorter than the minimums are accepted, with a warning that they would be rejected elsewhere.
+// - Certificate chains are verified against the sandbox's test CA (OptSandboxCA), not the system roots.
+// - Webhooks and the SIEM are never contacted. What would have been sent is captured, for inspection at
+//   /admin/sandbox/outbox. The audit log isn't anchored, so the timestamp authority isn't contacted either.
+// - The clock can be moved on (see clock.go).
+// - Throwaway certificates and keys can be made to order, such as expired ones, to test clients against (see
+//   fixtures.go).
+// - Faults can be injected, such as latency and failing routes, to test clients against a degraded server (see
+//   faults.go).
+// - Every response has a "Certstore-Sandbox: true" header.
+//
+// A sandbox can't follow a primary, so production data never reaches it. The sandbox option needs a restart,
+// so a production server can't be turned into a sandbox while it is running.
+
+// The number of captured messages kept
+const sandboxOutboxSize = 1000
+
+// A message a sandbox would have sent, but captured instead
+type SandboxMessage struct {
+	Id          int64   `json:"id"`
+	Time        UTCTime `json:"time"`
+	Kind        string  `json:"kind"`        // "webhook" or "siem"
+	Destination string  `json:"destination"` // The host it would have gone to. Not the URL, which may hold a secret.
+	Body        string  `json:"body"`
+}
+
+// SandboxOutbox keeps the most recent captured messages
+type SandboxOutbox struct {
+	mu       sync.Mutex
+	messages []*SandboxMessage
+	nextId   int64
+}
+
+// The captured messages of this sandbox
+var Outbox = &SandboxOutbox{}
+
+// Capture a message instead of sending it to a URL
+func (o *SandboxOutbox) Capture(kind, rawurl string, body []byte) {
+	destination := ""
+	if u, err := url.Parse(rawurl); err == nil {
+		destination = u.Host
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.nextId++
+	o.messages = append(o.messages, &SandboxMessage{
+		Id:          o.nextId,
+		Time:        NewUTCTime(Now()),
+		Kind:        kind,
+		Destination: destination,
+		Body:        Redact(string(body)),
+	})
+	if len(o.messages) > sandboxOutboxSize {
+		o.messages = o.messages[len(o.messages)-sandboxOutboxSize:]
+	}
+}
+
+// List the captured messages, oldest first
+func (o *SandboxOutbox) List() []*SandboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*SandboxMessage{}, o.messages...)
+}
+
+func (o *SandboxOutbox) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = nil
+}
+
+// sandboxSink captures SIEM events in the outbox
+type sandboxSink struct {
+	url string
+}
+
+func (s *sandboxSink) Send(events [][]byte) error {
+	for _, event := range events {
+		Outbox.Capture("siem", s.url, event)
+	}
+	return nil
+}
+
+// The test CA certificates that chains are verified against in a sandbox
+var sandboxRoots *x509.CertPool
+
+// Load the test CA certificates from a PEM file
+func LoadSandboxCA(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return ErrInvalidSandboxCA
+	}
+	sandboxRoots = roots
+	return nil
+}
+
+// The options for verifying a certificate chain: the trusted roots (see trustroots.go), or the test CA in a sandbox
+func chainVerifyOptions() x509.VerifyOptions {
+	opts := trustVerifyOptions(Config())
+	if OptSandbox {
+		opts.Roots = sandboxRoots
+	}
+	return opts
+}
+
+// Check the sandbox options, which need a restart to change
+func validateSandboxOptions() error {
+	if !OptSandbox {
+		return nil
+	}
+	if OptReplicaOf != "" {
+		return ErrSandboxReplica
+	}
+	if OptSandboxCA != "" {
+		return LoadSandboxCA(OptSandboxCA)
+	}
+	sandboxRoots = x509.NewCertPool()
+	return nil
+}
+
+// Middleware that marks every response from a sandbox
+func SandboxMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if OptSandbox {
+			w.Header().Set("Certstore-Sandbox", "true")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ListSandboxOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !OptSandbox {
+		HandleError(w, r, ErrNotSandbox, 0)
+		return
+	}
+	SendResult(w, r, Outbox.List())
+}
+
+func ClearSandboxOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !OptSandbox {
+		HandleError(w, r, ErrNotSandbox, 0)
+		return
+	}
+	Outbox.Clear()
+	SendResult(w, r, Outbox.List())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The most scheduled changes run in one transaction. If there are more, the next batch is run straight away.
+const scheduleBatchSize = 100
+
+var (
+	ErrScheduleInPast  = NewError("schedule-in-past", http.StatusBadRequest, "Scheduled changes must be in the future.")
+	ErrInvalidSchedule = NewError("invalid-schedule", http.StatusBadRequest, "The certificate can't be scheduled to be deactivated before it is activated.")
+)
+
+// A certificate can be scheduled to be activated (activateAt) or deactivated (deactivateAt) at a given time, so a
+// rotation can be staged ahead and run during a maintenance window rather than by someone awake at 2am. The
+// scheduler runs due changes every OptScheduleInterval, by the server's clock, so a change runs up to that long
+// after its time. Each time is cleared once it has run. A change is audited and published like any other update,
+// with the reason "Scheduled activation" or "Scheduled deactivation". A scheduled activation deactivates other
+// certificates for the same names if the ExclusiveActive option is on (see exclusive.go).
+//
+// Scheduled changes wait for a change freeze to end (see freeze.go). Standbys don't run them at all: they are
+// copied from the primary once it has.
+
+// A scheduled change that has been run
+type ScheduledChange struct {
+	UserId      string
+	CertId      string
+	Active      bool
+	Deactivated []string // Other certificates deactivated by an activation (see exclusive.go)
+}
+
+// Check the scheduled times for a certificate. Zero times are not scheduled. Times in the past (allowing for clock
+// skew) are most likely mistakes, so they are refused rather than run straight away.
+func ValidateSchedule(activateAt, deactivateAt UTCTime) error {
+	earliest := Now().Add(-time.Duration(Config().ClockSkew))
+	var errs ValidationErrors
+	if !activateAt.IsZero() && activateAt.Before(earliest) {
+		errs.Add("activateAt", ErrScheduleInPast)
+	}
+	if !deactivateAt.IsZero() && deactivateAt.Before(earliest) {
+		errs.Add("deactivateAt", ErrScheduleInPast)
+	}
+	if !activateAt.IsZero() && !deactivateAt.IsZero() && !deactivateAt.After(activateAt.Time) {
+		errs.Add("deactivateAt", ErrInvalidSchedule)
+	}
+	return errs.Err()
+}
+
+// Should a certificate be active after its due changes run? Returns false if none are due. If both are due, the
+// later one wins, and deactivation wins a tie.
+func scheduledState(activateAt, deactivateAt UTCTime, now time.Time) (active, due bool) {
+	activate := !activateAt.IsZero() && !activateAt.After(now)
+	deactivate := !deactivateAt.IsZero() && !deactivateAt.After(now)
+	switch {
+	case activate && deactivate:
+		return activateAt.After(deactivateAt.Time), true
+	case activate:
+		return true, true
+	case deactivate:
+		return false, true
+	}
+	return false, false
+}
+
+// Run the changes that are due, in batches. Returns the changes run.
+func RunScheduledChanges(now time.Time) ([]*ScheduledChange, error) {
+	var changes []*ScheduledChange
+	for {
+		batch, err := DatabaseRunSchedule(context.Background(), now, scheduleBatchSize, Config().ExclusiveActive)
+		changes = append(changes, batch...)
+		if err != nil || len(batch) < scheduleBatchSize {
+			return changes, err
+		}
+	}
+}
+
+// Run the scheduled changes that are due every interval, unless this is a standby. During a change freeze they are
+// deferred until it ends (see freeze.go).
+func RunScheduleEvery(interval time.Duration) {
+	notified := make(map[string]bool)
+	for {
+		<-clock.After(interval)
+		if Replica.Standby() {
+			continue
+		}
+		now := Now()
+		if freeze := ActiveFreeze(Config(), now); freeze != nil {
+			err := notifyDeferred(freeze, now, notified)
+			if err != nil {
+				log.Println("Unable to notify deferred changes:", err)
+			}
+			continue
+		}
+		notified = make(map[string]bool)
+		changes, err := RunScheduledChanges(now)
+		for _, change := range changes {
+			Events.Publish(&Event{Type: EventCertUpdated, UserId: change.UserId, CertId: change.CertId})
+			for _, id := range change.Deactivated {
+				Events.Publish(&Event{Type: EventCertUpdated, UserId: change.UserId, CertId: id})
+			}
+		}
+		if err != nil {
+			log.Println("Unable to run scheduled changes:", err)
+		}
+	}
+}
@@ -1,20 +1,309 @@
 CREATE TABLE certstore_user (
   id SERIAL PRIMARY KEY, 
-  name TEXT,
-  email varchar(254)
+  name TEXT, -- Encrypted with the PII encryption key, if there is one (see pii.go)
+  email TEXT, -- Also encrypted. Addresses are at most 254 bytes, but encrypted ones are longer.
+  emailindex CHAR(64), -- The email address's blind index, to look users up by. Null if it isn't encrypted.
+  extra JSONB NOT NULL DEFAULT '{}' -- Optional attributes (see extra.go)
 );
 
--- email addresses should be stored case-sensitive, but they should be queried case-insensitive
+-- email addresses should be stored case-sensitive, but they should be queried case-insensitive: by the blind index,
+-- which is of the address in lower case, if they are encrypted
 CREATE INDEX ON certstore_user (lower(email));
+CREATE INDEX ON certstore_user (emailindex) WHERE emailindex IS NOT NULL;
+
+-- Certificate data is content-addressed and stored once, no matter how many users hold the certificate.
+-- The id is the SHA256 hash of the DER-encoded certificate, the same as certstore_cert.id
+CREATE TABLE certstore_cert_content (
+  id CHAR(64) PRIMARY KEY,
+  cert BYTEA NOT NULL, -- DER, optionally gzip compressed. Older rows may be PEM.
+  notbefore TIMESTAMP WITH TIME ZONE NOT NULL,
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  refcount INT NOT NULL, -- Number of rows in certstore_cert referencing this certificate
+  spki CHAR(64), -- SHA256 hash of the public key (DER-encoded SubjectPublicKeyInfo). Null until older rows are backfilled.
+  namesindexed BOOLEAN NOT NULL DEFAULT false, -- Are the certificate's names in certstore_cert_name?
+  chain BYTEA, -- The certificate's chain (see chain.go): DER, one after another, optionally gzip compressed. Null if none.
+  ocspstatus TEXT, -- The OCSP status found on upload (see ocsp.go): good, revoked, unknown or unavailable. Null if not checked.
+  ocspchecked TIMESTAMP WITH TIME ZONE, -- When the OCSP status was found
+  revoked TIMESTAMP WITH TIME ZONE, -- When it was revoked, as found on its CRL or by OCSP (see crl.go). Null if it hasn't been.
+  revocationreason TEXT, -- Why, as an RFC 5280 reason such as keyCompromise. Null if not given.
+  revocationchecked TIMESTAMP WITH TIME ZONE -- When the revocation status was last checked again (see revocation.go)
+);
+
+CREATE INDEX ON certstore_cert_content (notbefore, notafter);
+CREATE INDEX ON certstore_cert_content (spki);
+CREATE INDEX ON certstore_cert_content (refcount) WHERE refcount <= 0;
+CREATE INDEX ON certstore_cert_content (revocationchecked NULLS FIRST);
 
 CREATE TABLE certstore_cert (
-  id CHAR(64) NOT NULL, 
+  id CHAR(64) NOT NULL REFERENCES certstore_cert_content(id), 
   userid INT NOT NULL REFERENCES certstore_user(id), 
   active BOOLEAN NOT NULL, 
-  cert TEXT NOT NULL,
-  key TEXT  NOT NULL,
+  key BYTEA NOT NULL,  -- PKCS#8 DER, optionally gzip compressed, then encrypted with Vault if it is configured (see vault.go). Older rows may be PEM.
+  notes TEXT NOT NULL DEFAULT '', -- Free text, per user
+  activateat TIMESTAMP WITH TIME ZONE, -- When the scheduler activates the certificate (see schedule.go). Cleared once it has.
+  deactivateat TIMESTAMP WITH TIME ZONE, -- When the scheduler deactivates the certificate. Cleared once it has.
+  extra JSONB NOT NULL DEFAULT '{}', -- Optional attributes, per user (see extra.go)
   PRIMARY KEY(id, userid),
   UNIQUE (id, userid)
 );
 
-CREATE INDEX ON certstore_cert (userid, active);
\ No newline at end of file
+CREATE INDEX ON certstore_cert (userid, active);
+CREATE INDEX ON certstore_cert (activateat) WHERE activateat IS NOT NULL;
+CREATE INDEX ON certstore_cert (deactivateat) WHERE deactivateat IS NOT NULL;
+
+-- The names each certificate covers (see conflicts.go), to find certificates for the same names held by other users
+CREATE TABLE certstore_cert_name (
+  id CHAR(64) NOT NULL REFERENCES certstore_cert_content(id) ON DELETE CASCADE,
+  name TEXT NOT NULL, -- A DNS name or wildcard in lower case, or an IP address
+  PRIMARY KEY(id, name)
+);
+
+CREATE INDEX ON certstore_cert_name (name text_pattern_ops);
+
+-- Short-lived certificates minted from a user's CA certificate (see mint.go), deleted once they expire. The parent
+-- isn't a foreign key: a CA certificate can be deleted before the certificates it minted expire.
+CREATE TABLE certstore_minted (
+  certid CHAR(64) NOT NULL,
+  userid INT NOT NULL,
+  parentid CHAR(64) NOT NULL, -- The certificate that signed it
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY(certid, userid),
+  FOREIGN KEY(certid, userid) REFERENCES certstore_cert(id, userid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX ON certstore_minted (notafter);
+
+-- Batches of device certificates issued from a user's CA certificate (see provision.go). Like certstore_minted's, the
+-- parent isn't a foreign key. The devices' certificates and keys are kept until the batch is deleted.
+CREATE TABLE certstore_provision_batch (
+  id BIGSERIAL PRIMARY KEY,
+  userid INT NOT NULL REFERENCES certstore_user(id) ON DELETE CASCADE,
+  parentid CHAR(64) NOT NULL, -- The certificate issuing the devices' certificates
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  vendorid TEXT NOT NULL DEFAULT '', -- The Matter vendor ID, for Matter devices
+  productid TEXT NOT NULL DEFAULT '',
+  created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON certstore_provision_batch (userid);
+
+CREATE TABLE certstore_provision_device (
+  batchid BIGINT NOT NULL REFERENCES certstore_provision_batch(id) ON DELETE CASCADE,
+  deviceid TEXT NOT NULL,
+  csr BYTEA NOT NULL, -- The device's CSR, stored like an attachment. Empty if its key is generated here.
+  cert BYTEA NOT NULL DEFAULT '', -- DER, optionally gzip compressed. Empty until issued.
+  key BYTEA NOT NULL DEFAULT '', -- Stored like certstore_cert.key. Empty if the device sent a CSR.
+  error TEXT NOT NULL DEFAULT '', -- The code of the error issuing the certificate, if it couldn't be
+  PRIMARY KEY(batchid, deviceid)
+);
+
+CREATE INDEX ON certstore_provision_device (batchid) WHERE cert = '' AND error = '';
+
+-- CSRs submitted for approval by clients without accounts (see csrqueue.go). The id is random, since it is all a
+-- submitter needs to read their CSR's certificate.
+CREATE TABLE certstore_csr (
+  id CHAR(32) PRIMARY KEY,
+  status TEXT NOT NULL DEFAULT 'pending', -- pending, approved or denied
+  csr BYTEA NOT NULL, -- DER, stored like an attachment
+  contact TEXT NOT NULL DEFAULT '',
+  comment TEXT NOT NULL DEFAULT '',
+  client TEXT NOT NULL, -- The address it was submitted from
+  submitted TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  decided TIMESTAMP WITH TIME ZONE,
+  decidedby TEXT NOT NULL DEFAULT '',
+  reason TEXT NOT NULL DEFAULT '',
+  cert BYTEA NOT NULL DEFAULT '', -- DER, optionally gzip compressed. Empty until approved.
+  chain BYTEA
+);
+
+CREATE INDEX ON certstore_csr (status, submitted);
+
+-- DNS namespaces users own (see domains.go). Several users may register the same domain.
+CREATE TABLE certstore_domain (
+  userid INT NOT NULL REFERENCES certstore_user(id) ON DELETE CASCADE,
+  name TEXT NOT NULL, -- Lower case, in ASCII (punycode) form
+  token CHAR(32) NOT NULL, -- The value of the TXT record verifying it
+  created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  verified TIMESTAMP WITH TIME ZONE, -- Null until verified
+  PRIMARY KEY(userid, name)
+);
+
+-- Users' saved request templates (see templates.go). The template itself is kept as JSON, since it is only ever
+-- read whole.
+CREATE TABLE certstore_template (
+  userid INT NOT NULL REFERENCES certstore_user(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  spec JSONB NOT NULL,
+  updated TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  PRIMARY KEY(userid, name)
+);
+
+-- Certificates shared with other users. Grants go away with the certificate or with either user.
+CREATE TABLE certstore_cert_grant (
+  certid CHAR(64) NOT NULL,
+  ownerid INT NOT NULL,
+  userid INT NOT NULL REFERENCES certstore_user(id) ON DELETE CASCADE,
+  access TEXT NOT NULL, -- "read" or "deploy"
+  PRIMARY KEY(certid, ownerid, userid),
+  FOREIGN KEY(certid, ownerid) REFERENCES certstore_cert(id, userid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX ON certstore_cert_grant (userid);
+
+-- Small files kept with a user's copy of a certificate (a CSR, the CA's response, ...). Like grants, they follow
+-- the certificate when it is transferred and go away with it. If the receiving user already holds the certificate,
+-- the sender's copy and its attachments are deleted.
+CREATE TABLE certstore_attachment (
+  certid CHAR(64) NOT NULL,
+  userid INT NOT NULL,
+  name TEXT NOT NULL,
+  type TEXT NOT NULL, -- Media type
+  size INT NOT NULL, -- Size of the data in bytes, before compression
+  created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  data BYTEA NOT NULL, -- Always a gzip stream, compressed or not depending on the StorageCompression option
+  PRIMARY KEY(certid, userid, name),
+  FOREIGN KEY(certid, userid) REFERENCES certstore_cert(id, userid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- Pending private key exports. Each export can be downloaded once, before it expires. Like the audit log, the ids
+-- are not foreign keys: an export of a certificate that has since been deleted or transferred just can't be used.
+CREATE TABLE certstore_export (
+  id CHAR(64) PRIMARY KEY, -- SHA256 hash (hex-encoded) of the id in the download link
+  ownerid INT NOT NULL,
+  certid CHAR(64) NOT NULL,
+  userid INT NOT NULL, -- The user the key is exported to
+  expires TIMESTAMP WITH TIME ZONE NOT NULL,
+  used BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX ON certstore_export (expires);
+
+-- The audit log. Ids are deliberately not foreign keys, since audit entries outlive what they refer to.
+CREATE TABLE certstore_audit (
+  id BIGSERIAL PRIMARY KEY,
+  time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  action TEXT NOT NULL,
+  userid TEXT NOT NULL,
+  targetid TEXT NOT NULL DEFAULT '',
+  certid TEXT NOT NULL DEFAULT '',
+  detail JSONB NOT NULL DEFAULT '{}',
+  reason TEXT NOT NULL DEFAULT '', -- Why the change was made, as given by the client
+  prevhash TEXT NOT NULL DEFAULT '', -- The hash of the entry before, chaining the entries together
+  hash TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX ON certstore_audit (userid);
+CREATE INDEX ON certstore_audit (targetid);
+
+-- Timestamps from a timestamp authority (RFC 3161) over the hash of an audit entry
+CREATE TABLE certstore_audit_anchor (
+  id BIGSERIAL PRIMARY KEY,
+  auditid BIGINT NOT NULL,
+  hash TEXT NOT NULL,
+  time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  token BYTEA NOT NULL
+);
+
+-- How far the audit log has been forwarded to the SIEM (see siem.go). There is only ever one row.
+CREATE TABLE certstore_siem (
+  id INT PRIMARY KEY CHECK (id = 1),
+  auditid BIGINT NOT NULL
+);
+
+-- The event log, which a standby follows (see replication.go). Like the audit log, ids are not foreign keys.
+CREATE TABLE certstore_event (
+  id BIGSERIAL PRIMARY KEY,
+  time TIMESTAMP WITH TIME ZONE NOT NULL,
+  type TEXT NOT NULL,
+  userid TEXT NOT NULL,
+  targetid TEXT NOT NULL DEFAULT '',
+  certid TEXT NOT NULL DEFAULT ''
+);
+
+-- How far a standby has replicated from its primary. There is only ever one row.
+CREATE TABLE certstore_replica (
+  id INT PRIMARY KEY CHECK (id = 1),
+  eventid BIGINT NOT NULL DEFAULT 0, -- The last event applied from the primary's event log
+  auditid BIGINT NOT NULL DEFAULT 0, -- The last entry copied from the primary's audit log
+  copyuser BIGINT NOT NULL DEFAULT 0, -- The last user copied, while the first copy is running
+  copied BOOLEAN NOT NULL DEFAULT false,
+  promoted BOOLEAN NOT NULL DEFAULT false -- Promoted to primary: stop following
+);
+
+-- Usage by month and user, for chargeback (see usage.go). Requests that aren't for a user have an empty userid.
+CREATE TABLE certstore_usage (
+  month CHAR(7) NOT NULL, -- YYYY-MM, in UTC
+  userid TEXT NOT NULL,
+  metric TEXT NOT NULL,
+  count BIGINT NOT NULL,
+  PRIMARY KEY(month, userid, metric)
+);
+
+-- The latest compliance evaluation (see compliance.go). There is only ever one row.
+CREATE TABLE certstore_compliance (
+  id INT PRIMARY KEY CHECK (id = 1),
+  generated TIMESTAMP WITH TIME ZONE NOT NULL,
+  policy TEXT NOT NULL, -- Fingerprint of the policy the certificates were evaluated against
+  checked INT NOT NULL -- The number of certificates evaluated
+);
+
+-- The certificates that broke the policy at the latest compliance evaluation. Ids are not foreign keys, so
+-- deleting a certificate doesn't wait on the evaluation; findings for deleted certificates are left out when read.
+CREATE TABLE certstore_compliance_finding (
+  userid INT NOT NULL,
+  certid CHAR(64) NOT NULL,
+  commonname TEXT NOT NULL,
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  violations JSONB NOT NULL,
+  PRIMARY KEY(userid, certid)
+);
+
+-- Renewal campaigns (see campaign.go), with the certificates each selected when it was created. Certificate ids are
+-- not foreign keys, so a deleted certificate stays in its campaigns until a refresh retires it.
+CREATE TABLE certstore_campaign (
+  id BIGSERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  selector JSONB NOT NULL,
+  due TIMESTAMP WITH TIME ZONE, -- NULL for no deadline
+  created TIMESTAMP WITH TIME ZONE NOT NULL,
+  createdby TEXT NOT NULL
+);
+
+CREATE TABLE certstore_campaign_cert (
+  campaignid BIGINT NOT NULL REFERENCES certstore_campaign(id) ON DELETE CASCADE,
+  userid INT NOT NULL,
+  certid CHAR(64) NOT NULL,
+  commonname TEXT NOT NULL,
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  owner TEXT NOT NULL DEFAULT '',
+  status TEXT NOT NULL DEFAULT 'pending', -- pending, in-progress, renewed or retired
+  note TEXT NOT NULL DEFAULT '',
+  renewedby TEXT NOT NULL DEFAULT '', -- The certificate that replaced it, found by a refresh
+  updated TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY(campaignid, userid, certid)
+);
+
+-- CRLs named by stored certificates (see crl.go), cached between refreshes
+CREATE TABLE certstore_crl (
+  url TEXT PRIMARY KEY,
+  issuer TEXT NOT NULL DEFAULT '',
+  thisupdate TIMESTAMP WITH TIME ZONE,
+  nextupdate TIMESTAMP WITH TIME ZONE,
+  fetched TIMESTAMP WITH TIME ZONE, -- When the cached CRL was fetched. Null if it never has been.
+  checked TIMESTAMP WITH TIME ZONE NOT NULL, -- When it was last refreshed, or tried to be
+  entries INT NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '', -- Why the last refresh failed
+  data BYTEA -- DER. Null if it has never been fetched.
+);
+
+-- Roots and intermediates trusted for verifying chains, added with the API (see trustroots.go)
+CREATE TABLE certstore_trust_root (
+  id CHAR(64) PRIMARY KEY, -- The SHA256 hash of the certificate (hex-encoded)
+  kind TEXT NOT NULL, -- root or intermediate
+  cert TEXT NOT NULL, -- PEM
+  subject TEXT NOT NULL,
+  notafter TIMESTAMP WITH TIME ZONE NOT NULL,
+  added TIMESTAMP WITH TIME ZONE NOT NULL,
+  addedby TEXT NOT NULL DEFAULT ''
+);
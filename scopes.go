@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Scopes grant access to sensitive endpoints, on top of the access every client has
+const (
+	ScopeKeyExport      = "key-export"      // Export private keys
+	ScopeAdmin          = "admin"           // Use the /admin endpoints, for machines. People log in instead (see session.go).
+	ScopeFreezeOverride = "freeze-override" // Make bulk changes during a change freeze, in an emergency (see freeze.go)
+	ScopeMint           = "mint"            // Mint certificates from a stored CA certificate (see mint.go and provision.go)
+	ScopeCSRSubmit      = "csr-submit"      // Submit CSRs for approval, if any tokens are configured for it (see csrqueue.go)
+)
+
+var (
+	ErrMissingScope        = NewError("missing-scope", http.StatusForbidden, "This request needs an elevated scope. Please present a token for the scope in the Authorization header.")
+	ErrUnknownScope        = NewError("unknown-scope", http.StatusBadRequest, "Unknown scope.")
+	ErrInvalidScopeToken   = NewError("invalid-scope-token", http.StatusBadRequest, "Invalid scope token hash. Tokens are configured by their SHA256 hash (hex-encoded).")
+	ErrKeyExportNotGranted = NewError("key-export-not-granted", http.StatusForbidden, "The certificate was not shared with deploy access, so its private key may not be exported.")
+)
+
+// Every known scope
+var Scopes = map[string]bool{
+	ScopeKeyExport:      true,
+	ScopeAdmin:          true,
+	ScopeFreezeOverride: true,
+	ScopeMint:           true,
+	ScopeCSRSubmit:      true,
+}
+
+// Check if a request presents a token for a scope, as "Authorization: Bearer <token>".
+// Tokens are configured (in the ScopeTokens option) by their SHA256 hash, so the configuration never holds a
+// usable token, even though it can be read at /admin/config.
+func HasScope(r *http.Request, scope string, config *RuntimeConfig) bool {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSpace(auth[7:])))
+	presented := hex.EncodeToString(hash[:])
+
+	found := false
+	for _, tokenHash := range config.ScopeTokens[scope] {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(strings.ToLower(tokenHash))) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// Only serve a handler to requests that present a token for a scope
+func RequireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowAttempt(w, r, ClientIPKey(r)) {
+			return
+		}
+		if !HasScope(r, scope, Config()) {
+			// Only a wrong token counts as a failed attempt, not a missing one
+			if r.Header.Get("Authorization") != "" {
+				failedAttempt(r, "scope-token", ClientIPKey(r))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrMissingScope, 0)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Validate the configured token hashes for each scope
+func validateScopeTokens(scopeTokens map[string][]string, errs *ValidationErrors) {
+	for scope, hashes := range scopeTokens {
+		if !Scopes[scope] {
+			errs.Add("scopeTokens."+scope, ErrUnknownScope)
+			continue
+		}
+		for _, hash := range hashes {
+			if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+				errs.Add("scopeTokens."+scope, ErrInvalidScopeToken)
+			}
+		}
+	}
+}
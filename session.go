@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	SessionCookie = "certstore_session" // Cookie holding an administrator's session token
+	CSRFHeader    = "X-CSRF-Token"      // Header carrying the session's CSRF token on state-changing requests
+)
+
+var (
+	ErrInvalidLogin       = NewError("invalid-login", http.StatusUnauthorized, "Invalid username or password.")
+	ErrNotAuthenticated   = NewError("not-authenticated", http.StatusUnauthorized, "Please log in, or present a token for the admin scope in the Authorization header.")
+	ErrInvalidCSRFToken   = NewError("invalid-csrf-token", http.StatusForbidden, "Missing or invalid CSRF token. Please send your session's CSRF token in the X-CSRF-Token header.")
+	ErrInvalidAdminSecret = NewError("invalid-admin-password-hash", http.StatusBadRequest, "Invalid administrator password hash. Passwords are configured as bcrypt hashes.")
+)
+
+// An AdminAuthenticator checks an administrator's username and password.
+// Directory integrations (OIDC, LDAP) plug in here. The only one so far is ConfigAuthenticator.
+type AdminAuthenticator interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// The authenticator used by the login endpoint
+var AdminAuth AdminAuthenticator = ConfigAuthenticator{}
+
+// ConfigAuthenticator checks credentials against the AdminUsers option: usernames and bcrypt password hashes
+type ConfigAuthenticator struct{}
+
+// Compared against when the username is unknown, so that unknown users take as long to reject as wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func (ConfigAuthenticator) Authenticate(username, password string) (bool, error) {
+	hash, ok := Config().AdminUsers[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// An AdminSession is a logged in administrator, for the admin UI. Machines don't use sessions: they present a
+// token for the admin scope instead (see scopes.go), and so don't need CSRF tokens.
+type AdminSession struct {
+	Admin     string  `json:"admin"`
+	CSRFToken string  `json:"csrfToken"` // Must be sent in the X-CSRF-Token header on state-changing requests
+	Expires   UTCTime `json:"expires"`
+}
+
+// SessionStore holds the sessions of this process, keyed by the SHA256 hash of the session token
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*AdminSession
+}
+
+// Sessions are the admin sessions of this process
+var Sessions = &SessionStore{sessions: make(map[string]*AdminSession)}
+
+// Start a session, returning the token to set in the session cookie
+func (s *SessionStore) Create(admin string, ttl time.Duration) (string, *AdminSession, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	session := &AdminSession{
+		Admin:     admin,
+		CSRFToken: csrfToken,
+		Expires:   NewUTCTime(Now().Add(ttl)),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget expired sessions while we are here
+	for key, old := range s.sessions {
+		if Now().After(old.Expires.Time) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[hashSessionToken(token)] = session
+	return token, session, nil
+}
+
+// Get the session for a token, or nil if there isn't one or it has expired
+func (s *SessionStore) Get(token string) *AdminSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[hashSessionToken(token)]
+	if !ok || Now().After(session.Expires.Time) {
+		return nil
+	}
+	return session
+}
+
+// End a session
+func (s *SessionStore) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, hashSessionToken(token))
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Get the session for a request's session cookie, or nil if there isn't one
+func RequestSession(r *http.Request) (string, *AdminSession) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+	return cookie.Value, Sessions.Get(cookie.Value)
+}
+
+// Only serve a handler to administrators: either a logged in session, or a token for the admin scope.
+// Sessions must also send their CSRF token on anything other than GET, HEAD and OPTIONS.
+func RequireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowAttempt(w, r, ClientIPKey(r)) {
+			return
+		}
+		if HasScope(r, ScopeAdmin, Config()) {
+			handler(w, r)
+			return
+		}
+
+		_, session := RequestSession(r)
+		if session == nil {
+			if r.Header.Get("Authorization") != "" {
+				failedAttempt(r, "scope-token", ClientIPKey(r))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			HandleError(w, r, ErrNotAuthenticated, 0)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			csrfToken := r.Header.Get(CSRFHeader)
+			if subtle.ConstantTimeCompare([]byte(csrfToken), []byte(session.CSRFToken)) != 1 {
+				w.Header().Set("Content-Type", "application/json")
+				HandleError(w, r, ErrInvalidCSRFToken, 0)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func sessionCookie(token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/", // Not just /admin: some admin routes, such as /usage, are outside it
+		Expires:  expires,
+		Secure:   OptSecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	login := new(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	})
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(login)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	// Failures are counted against both the client and the account, so neither many passwords against one
+	// account nor one password against many accounts gets far
+	keys := []string{ClientIPKey(r), "user:" + login.Username}
+	if !allowAttempt(w, r, keys...) {
+		return
+	}
+	ok, err := AdminAuth.Authenticate(login.Username, login.Password)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if !ok {
+		failedAttempt(r, "login", keys...)
+		HandleError(w, r, ErrInvalidLogin, 0)
+		return
+	}
+	AuthAttempts.Succeed(keys[1])
+
+	token, session, err := Sessions.Create(login.Username, time.Duration(Config().SessionTTL))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	http.SetCookie(w, sessionCookie(token, session.Expires.Time))
+
+	// Send the result
+	SendResult(w, r, session)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, session := RequestSession(r)
+	if session != nil {
+		Sessions.Delete(token)
+	}
+	http.SetCookie(w, sessionCookie("", time.Unix(0, 0)))
+
+	// Send the result
+	SendResult(w, r, nil)
+}
+
+// Get the current session, so that the admin UI can find its CSRF token again after a reload
+func ReadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, session := RequestSession(r)
+	if session == nil {
+		HandleError(w, r, ErrNotAuthenticated, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, session)
+}
+
+// Validate the configured administrators' password hashes
+func validateAdminUsers(adminUsers map[string]string, errs *ValidationErrors) {
+	for username, hash := range adminUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil || username == "" {
+			errs.Add("adminUsers."+username, ErrInvalidAdminSecret)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SIEM event formats
+const (
+	SIEMFormatJSON = "json"
+	SIEMFormatCEF  = "cef" // ArcSight Common Event Format
+)
+
+// The most audit entries sent to the SIEM at once
+const siemBatchSize = 100
+
+// The longest the SIEM forwarder waits before retrying
+const siemMaxBackoff = 5 * time.Minute
+
+var (
+	ErrInvalidSIEMURL    = NewError("invalid-siem-url", http.StatusBadRequest, "Invalid SIEM URL. Use udp://, tcp:// or tls:// for syslog, or http:// or https://.")
+	ErrInvalidSIEMFormat = NewError("invalid-siem-format", http.StatusBadRequest, "Invalid SIEM format. Use json or cef.")
+	ErrSIEMRejected      = NewError("siem-rejected", http.StatusBadGateway, "The SIEM rejected the events.")
+)
+
+// A SIEMEvent is an audit entry as sent to a SIEM. Security events (lockouts and anomalies) are audit entries too,
+// so everything the security team needs comes from the audit log, in order.
+type SIEMEvent struct {
+	Source   string      `json:"source"`
+	Id       int64       `json:"id"`
+	Time     time.Time   `json:"time"`
+	Action   string      `json:"action"`
+	Severity int         `json:"severity"` // 0 to 10, as in CEF
+	UserId   string      `json:"user,omitempty"`
+	TargetId string      `json:"target,omitempty"`
+	CertId   string      `json:"cert,omitempty"`
+	Detail   AuditDetail `json:"detail,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+	Hash     string      `json:"hash,omitempty"`
+}
+
+// How severe each audit action is, from 0 to 10. Other actions are 3.
+var siemSeverities = map[string]int{
+	AuditActionDeleteUser:  5,
+	AuditActionDeleteCert:  5,
+	AuditActionMergeUsers:  5,
+	AuditActionMintCert:    5,
+	AuditActionCreateBatch: 5,
+	AuditActionApproveCSR:  5,
+	AuditActionExportBatch: 7,
+	AuditActionExportKey:   7,
+	AuditActionDownloadKey: 7,
+	AuditActionAuthLockout: 8,
+	AuditActionImpersonate: 7,
+	AuditActionAnomaly:     9,
+}
+
+func NewSIEMEvent(entry *AuditEntry) *SIEMEvent {
+	severity, ok := siemSeverities[entry.Action]
+	if !ok {
+		severity = 3
+	}
+	return &SIEMEvent{
+		Source:   "certstore",
+		Id:       entry.Id,
+		Time:     entry.Time.UTC(),
+		Action:   entry.Action,
+		Severity: severity,
+		UserId:   entry.UserId,
+		TargetId: entry.TargetId,
+		CertId:   entry.CertId,
+		Detail:   entry.Detail,
+		Reason:   entry.Reason,
+		Hash:     entry.Hash,
+	}
+}
+
+// Format an event as a single line of JSON
+func (e *SIEMEvent) JSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Format an event in CEF
+func (e *SIEMEvent) CEF() ([]byte, error) {
+	detail, err := json.Marshal(e.Detail)
+	if err != nil {
+		return nil, err
+	}
+	ext := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10),
+		"externalId=" + strconv.FormatInt(e.Id, 10),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtension(value))
+		}
+	}
+	add("duser", e.UserId)
+	add("cs1Label", "target")
+	add("cs1", e.TargetId)
+	add("cs2Label", "cert")
+	add("cs2", e.CertId)
+	add("cs3Label", "hash")
+	add("cs3", e.Hash)
+	add("reason", e.Reason)
+	if len(e.Detail) > 0 {
+		add("msg", string(detail))
+	}
+	line := fmt.Sprintf("CEF:0|phayes|certstore|1.0|%s|%s|%d|%s",
+		cefHeader(e.Action), cefHeader(e.Action), e.Severity, strings.Join(ext, " "))
+	return []byte(line), nil
+}
+
+// Escape a CEF header field
+func cefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+// Escape a CEF extension value
+func cefExtension(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// Format an event in the configured format
+func (e *SIEMEvent) Format(format string) ([]byte, error) {
+	if format == SIEMFormatCEF {
+		return e.CEF()
+	}
+	return e.JSON()
+}
+
+// A SIEMSink delivers formatted events to a SIEM. Send either delivers all of them, or returns an error.
+type SIEMSink interface {
+	Send(events [][]byte) error
+}
+
+// Get the sink for a URL: syslog over udp://, tcp:// or tls://, or an HTTP collector (such as Splunk's HEC)
+// over http:// or https://. Authorization is sent to HTTP collectors as the Authorization header.
+func NewSIEMSink(rawurl, authorization string) (SIEMSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidSIEMURL
+	}
+	var sink SIEMSink
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		hostname, _ := os.Hostname()
+		sink = &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}
+	case "http", "https":
+		sink = &httpSink{url: rawurl, authorization: authorization, client: &http.Client{Timeout: 30 * time.Second}}
+	default:
+		return nil, ErrInvalidSIEMURL
+	}
+	// A sandbox captures the events instead (see sandbox.go)
+	if OptSandbox {
+		return &sandboxSink{url: rawurl}, nil
+	}
+	return sink, nil
+}
+
+// syslogSink sends each event as an RFC 5424 syslog message, one per line (or per datagram over UDP)
+type syslogSink struct {
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func (s *syslogSink) Send(events [][]byte) error {
+	if s.conn == nil {
+		var err error
+		switch s.network {
+		case "tls":
+			s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", s.addr, nil)
+		default:
+			s.conn, err = net.DialTimeout(s.network, s.addr, 30*time.Second)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		// Facility 13 (log audit), severity 5 (notice)
+		msg := fmt.Sprintf("<109>1 %s %s certstore - - - %s\n", time.Now().UTC().Format(time.RFC3339), s.hostname, event)
+		s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		_, err := s.conn.Write([]byte(msg))
+		if err != nil {
+			// Reconnect next time. Events already written may be sent again.
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// httpSink posts events to an HTTP collector, one event per line
+type httpSink struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+func (s *httpSink) Send(events [][]byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(append(bytes.Join(events, []byte("\n")), '\n')))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		// The URL may hold a token, so don't log it
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return ErrSIEMRejected
+	}
+	return nil
+}
+
+// Forward the audit log to the OptSIEMURL, if it is set. Entries are read from the database in order and the
+// position reached is saved there, so nothing is lost if the SIEM is down or certstore restarts: entries are
+// retried, with a growing delay, until they are delivered. The first time, forwarding starts from the newest entry.
+func ForwardAuditToSIEM(interval time.Duration) {
+	if OptSIEMURL == "" {
+		return
+	}
+	sink, err := NewSIEMSink(OptSIEMURL, OptSIEMAuthorization)
+	if err != nil {
+		log.Println("Unable to forward audit log to SIEM:", err)
+		return
+	}
+
+	var cursor int64
+	for {
+		cursor, err = DatabaseReadSIEMCursor()
+		if err == nil {
+			break
+		}
+		log.Println("Unable to forward audit log to SIEM:", err)
+		<-clock.After(interval)
+	}
+
+	backoff := interval
+	for {
+		sent, err := forwardAuditBatch(sink, cursor)
+		if err != nil {
+			log.Println("Unable to forward audit log to SIEM:", err)
+			<-clock.After(backoff)
+			backoff *= 2
+			if backoff > siemMaxBackoff {
+				backoff = siemMaxBackoff
+			}
+			continue
+		}
+		backoff = interval
+		if sent == cursor {
+			<-clock.After(interval)
+			continue
+		}
+		cursor = sent
+	}
+}
+
+// Send the audit entries after the cursor, returning the new cursor
+func forwardAuditBatch(sink SIEMSink, cursor int64) (int64, error) {
+	entries, err := DatabaseListAuditAfter(cursor, siemBatchSize)
+	if err != nil || len(entries) == 0 {
+		return cursor, err
+	}
+	events := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		event, err := NewSIEMEvent(entry).Format(OptSIEMFormat)
+		if err != nil {
+			return cursor, err
+		}
+		events = append(events, event)
+	}
+	err = sink.Send(events)
+	if err != nil {
+		return cursor, err
+	}
+	last := entries[len(entries)-1].Id
+	return last, DatabaseUpdateSIEMCursor(last)
+}
+
+// Validate the SIEM options, which need a restart to change
+func validateSIEMOptions() error {
+	if OptSIEMFormat != SIEMFormatJSON && OptSIEMFormat != SIEMFormatCEF {
+		return ErrInvalidSIEMFormat
+	}
+	if OptSIEMURL != "" {
+		_, err := NewSIEMSink(OptSIEMURL, OptSIEMAuthorization)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/mux"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How often clients should fetch a trust bundle again, as its spiffe_refresh_hint
+const spiffeRefreshHint = 5 * time.Minute
+
+var (
+	ErrInvalidSPIFFEID     = NewError("invalid-spiffe-id", http.StatusBadRequest, "Invalid SPIFFE ID. It must be of the form spiffe://trust-domain/path.")
+	ErrUnknownTrustDomain  = NewError("unknown-trust-domain", http.StatusNotFound, "Unknown trust domain.")
+	ErrNotTrustDomainCA    = NewError("not-trust-domain-ca", http.StatusForbidden, "The certificate isn't one of the trust domain's CAs, so it can't mint SVIDs for it.")
+	ErrInvalidTrustDomain  = NewError("invalid-trust-domain", http.StatusBadRequest, "Invalid trust domain. Trust domains are lower case letters, digits, dots, dashes and underscores.")
+	ErrInvalidBundleFormat = NewError("invalid-bundle-format", http.StatusBadRequest, "Invalid format. Use spiffe or pem.")
+)
+
+// Trust bundle formats
+const (
+	BundleFormatSPIFFE = "spiffe" // The SPIFFE bundle format: a JWK set
+	BundleFormatPEM    = "pem"    // The CA certificates, concatenated
+)
+
+// Service meshes can source their workloads' identities from certstore as SPIFFE X.509-SVIDs: short-lived
+// certificates (see mint.go) whose only URI SAN is a SPIFFE ID, spiffe://trust-domain/path. Each trust domain is
+// configured (in the TrustDomains option) with the user holding its CA certificates and their cert-ids. Only those
+// certificates can mint SVIDs in the trust domain, and they make up its trust bundle, which is served unauthenticated
+// at /spiffe/{trust-domain}/bundle, for the mesh to verify SVIDs against. Listing a new CA certificate alongside the
+// old one before switching to it lets the bundle carry both while SVIDs from either are in use.
+
+// A SPIFFE trust domain
+type TrustDomain struct {
+	UserId string   `json:"user"` // The user holding the CA certificates
+	CAs    []string `json:"cas"`  // The cert-ids of the CA certificates that mint its SVIDs
+}
+
+// Trust domains, by name
+type TrustDomains map[string]*TrustDomain
+
+// A trust bundle in the SPIFFE bundle format
+type SPIFFEBundle struct {
+	Keys        []*SPIFFEKey `json:"keys"`
+	RefreshHint int          `json:"spiffe_refresh_hint"` // Seconds
+}
+
+// A CA certificate in a trust bundle, as a JWK
+type SPIFFEKey struct {
+	Use string   `json:"use"` // Always "x509-svid"
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv,omitempty"` // EC keys
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"` // RSA keys
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"` // The certificate, base64-encoded DER
+}
+
+var trustDomainPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+var spiffePathPattern = regexp.MustCompile(`^(/[a-zA-Z0-9._-]+)+$`)
+
+// Parse a SPIFFE ID. Its host is the trust domain.
+func ParseSPIFFEID(s string) (*url.URL, error) {
+	if len(s) > 2048 {
+		return nil, ErrInvalidSPIFFEID
+	}
+	id, err := url.Parse(s)
+	if err != nil || id.Scheme != "spiffe" || id.User != nil || id.Port() != "" || id.RawQuery != "" || id.Fragment != "" {
+		return nil, ErrInvalidSPIFFEID
+	}
+	if !trustDomainPattern.MatchString(id.Host) || !spiffePathPattern.MatchString(id.Path) {
+		return nil, ErrInvalidSPIFFEID
+	}
+	for _, segment := range strings.Split(id.Path[1:], "/") {
+		if segment == "." || segment == ".." {
+			return nil, ErrInvalidSPIFFEID
+		}
+	}
+	return id, nil
+}
+
+// Check that a certificate is one of a trust domain's CAs, so it may mint SVIDs in it
+func checkTrustDomainCA(config *RuntimeConfig, trustDomain string, parent *CertificateData) error {
+	domain, ok := config.TrustDomains[trustDomain]
+	if !ok {
+		return ErrUnknownTrustDomain
+	}
+	if domain.UserId != parent.UserId {
+		return ErrNotTrustDomainCA
+	}
+	for _, id := range domain.CAs {
+		if id == parent.Id {
+			return nil
+		}
+	}
+	return ErrNotTrustDomainCA
+}
+
+// Encode a big-endian integer for a JWK, padded to size bytes
+func jwkInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Describe a CA certificate as a JWK. Certificates with other kinds of keys are left out.
+func NewSPIFFEKey(cert *x509.Certificate) *SPIFFEKey {
+	key := &SPIFFEKey{Use: "x509-svid", X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)}}
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		key.Kty, key.Crv = "EC", pub.Curve.Params().Name
+		key.X, key.Y = jwkInt(pub.X, size), jwkInt(pub.Y, size)
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N, key.E = jwkInt(pub.N, 0), jwkInt(big.NewInt(int64(pub.E)), 0)
+	default:
+		return nil
+	}
+	return key
+}
+
+// Get a trust domain's CA certificates: those of its configured certificates that are stored and haven't expired
+func TrustBundleCerts(config *RuntimeConfig, trustDomain string, now time.Time) ([]*x509.Certificate, error) {
+	domain, ok := config.TrustDomains[trustDomain]
+	if !ok {
+		return nil, ErrUnknownTrustDomain
+	}
+	certs := []*x509.Certificate{}
+	for _, id := range domain.CAs {
+		certData, err := DatabaseReadCert(domain.UserId, id)
+		if err == ErrNotFound {
+			log.Printf("Trust domain %s's CA certificate %s isn't stored", trustDomain, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cert, err := ParseCertificatePEM(string(certData.Cert))
+		if err != nil {
+			return nil, err
+		}
+		if IsValidAt(cert.NotBefore, cert.NotAfter, now) {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// Get a trust bundle in the SPIFFE bundle format
+func NewSPIFFEBundle(certs []*x509.Certificate) *SPIFFEBundle {
+	bundle := &SPIFFEBundle{Keys: []*SPIFFEKey{}, RefreshHint: int(spiffeRefreshHint.Seconds())}
+	for _, cert := range certs {
+		if key := NewSPIFFEKey(cert); key != nil {
+			bundle.Keys = append(bundle.Keys, key)
+		}
+	}
+	return bundle
+}
+
+// Validate the configured trust domains
+func validateTrustDomains(domains TrustDomains, errs *ValidationErrors) {
+	for name, domain := range domains {
+		field := "trustDomains." + name
+		if !trustDomainPattern.MatchString(name) {
+			errs.Add(field, ErrInvalidTrustDomain)
+		}
+		if domain == nil || domain.UserId == "" || len(domain.CAs) == 0 {
+			errs.Add(field, ErrInvalidConfig)
+			continue
+		}
+		for _, id := range domain.CAs {
+			ref, err := ParseCertRef(id)
+			if err != nil || !ref.IsCertId() {
+				errs.Add(field+".cas", ErrInvalidCertificateId)
+			}
+		}
+	}
+}
+
+// Get a trust domain's trust bundle. It is sent as is, not in the usual result, since it is read by service meshes.
+func ReadTrustBundleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != BundleFormatSPIFFE && format != BundleFormatPEM {
+		HandleError(w, r, &FieldError{"format", ErrInvalidBundleFormat}, 0)
+		return
+	}
+
+	certs, err := TrustBundleCerts(Config(), mux.Vars(r)["trust-domain"], Now())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	if format == BundleFormatPEM {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, cert := range certs {
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+		return
+	}
+	body, err := json.Marshal(NewSPIFFEBundle(certs))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	w.Write(body)
+}
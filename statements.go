@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+)
+
+// The SQL dialect statements are written in, unless they give one for the database's backend
+const DefaultDialect = "postgres"
+
+var (
+	errDatabaseNotOpen = errors.New("the statements haven't been opened on a database")
+	errNamedArgs       = errors.New("a named statement takes exactly one argument, the struct or map its parameters are bound from")
+)
+
+// Statements are prepared lazily. Each is registered with its SQL when the program starts (see the Query* variables
+// in database.go), and is prepared the first time it is used, so startup doesn't wait on a round trip for every
+// statement, and statements that are never used are never prepared. A statement is prepared again after the
+// registry is opened on another database (see StatementRegistry.Open), such as when the connection is re-established,
+// and after Postgres reports that it no longer has the statement (which a connection pooler handing the connection to
+// another server process causes).
+//
+// The SQL is written for Postgres. A statement can also be given in the dialect of another backend (see
+// Statement.Dialect), chosen by the driver name of the database the registry is opened on. Named statements have
+// their ":name" parameters bound with the backend's placeholders by sqlx.
+
+// A StatementRegistry holds statements, and prepares them on the database it is open on
+type StatementRegistry struct {
+	mu         sync.RWMutex
+	db         *sqlx.DB
+	dialect    string
+	statements []*Statement
+}
+
+// The statements in database.go
+var Statements = NewStatementRegistry()
+
+func NewStatementRegistry() *StatementRegistry {
+	return &StatementRegistry{dialect: DefaultDialect}
+}
+
+// A Statement is a query registered with a StatementRegistry. It is prepared the first time it is used.
+type Statement struct {
+	registry *StatementRegistry
+	sql      map[string]string // By dialect
+	named    bool
+
+	mu        sync.Mutex
+	db        *sqlx.DB // The database it is prepared on. Nil until it is prepared.
+	stmt      *sqlx.Stmt
+	namedStmt *sqlx.NamedStmt
+}
+
+// Register a statement with positional parameters ($1, $2, ...)
+func (r *StatementRegistry) Register(query string) *Statement {
+	return r.register(query, false)
+}
+
+// Register a statement with named parameters (:name), bound from a struct or map
+func (r *StatementRegistry) RegisterNamed(query string) *Statement {
+	return r.register(query, true)
+}
+
+func (r *StatementRegistry) register(query string, named bool) *Statement {
+	s := &Statement{registry: r, sql: map[string]string{DefaultDialect: query}, named: named}
+	r.mu.Lock()
+	r.statements = append(r.statements, s)
+	r.mu.Unlock()
+	return s
+}
+
+// Open the registry on a database, closing the statements prepared on the database it was open on before. Every
+// statement must have SQL in the database's dialect. They are each prepared on it the next time they are used.
+func (r *StatementRegistry) Open(db *sqlx.DB) error {
+	dialect := db.DriverName()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.statements {
+		if _, ok := s.sql[dialect]; !ok {
+			return errors.New("no SQL in the " + dialect + " dialect for: " + s.sql[DefaultDialect])
+		}
+	}
+	r.db, r.dialect = db, dialect
+	for _, s := range r.statements {
+		s.reset()
+	}
+	return nil
+}
+
+// Get the number of statements registered, and how many of them are prepared
+func (r *StatementRegistry) Count() (registered, prepared int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.statements {
+		s.mu.Lock()
+		if s.db != nil && s.db == r.db {
+			prepared++
+		}
+		s.mu.Unlock()
+	}
+	return len(r.statements), prepared
+}
+
+// Give the statement's SQL in another dialect, used when the registry is open on a database with that driver name.
+// Dialects are given as statements are registered, before the registry is opened.
+func (s *Statement) Dialect(dialect, query string) *Statement {
+	s.sql[dialect] = query
+	return s
+}
+
+// Get the statement's SQL, in the dialect of the database the registry is open on
+func (s *Statement) SQL() string {
+	s.registry.mu.RLock()
+	defer s.registry.mu.RUnlock()
+	return s.sql[s.registry.dialect]
+}
+
+// Close the prepared statement, if it is prepared, so it is prepared again the next time it is used
+func (s *Statement) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.stmt != nil {
+		err = s.stmt.Close()
+	}
+	if s.namedStmt != nil {
+		err = s.namedStmt.Close()
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	s.db, s.stmt, s.namedStmt = nil, nil, nil
+}
+
+// Prepare the statement on the database the registry is open on, unless it is already prepared there
+func (s *Statement) prepare() (*sqlx.Stmt, *sqlx.NamedStmt, error) {
+	s.registry.mu.RLock()
+	db, query := s.registry.db, s.sql[s.registry.dialect]
+	s.registry.mu.RUnlock()
+	if db == nil {
+		return nil, nil, errDatabaseNotOpen
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == db {
+		return s.stmt, s.namedStmt, nil
+	}
+	var err error
+	if s.named {
+		s.namedStmt, err = db.PrepareNamed(query)
+	} else {
+		s.stmt, err = db.Preparex(query)
+	}
+	if err != nil {
+		s.stmt, s.namedStmt = nil, nil
+		return nil, nil, err
+	}
+	s.db = db
+	return s.stmt, s.namedStmt, nil
+}
+
+// Prepare the statement, for running on the database or, if tx isn't nil, in the transaction
+func (s *Statement) bind(tx *sqlx.Tx) *BoundStatement {
+	stmt, namedStmt, err := s.prepare()
+	if err != nil {
+		return &BoundStatement{statement: s, err: err}
+	}
+	if tx != nil {
+		if s.named {
+			namedStmt = tx.NamedStmt(namedStmt)
+		} else {
+			stmt = tx.Stmtx(stmt)
+		}
+	}
+	return &BoundStatement{statement: s, stmt: stmt, namedStmt: namedStmt}
+}
+
+// Get the statement for running in a transaction
+func (s *Statement) Tx(tx *sqlx.Tx) *BoundStatement {
+	return s.bind(tx)
+}
+
+func (s *Statement) Exec(args ...interface{}) (sql.Result, error) {
+	return s.bind(nil).Exec(args...)
+}
+
+func (s *Statement) Get(dest interface{}, args ...interface{}) error {
+	return s.bind(nil).Get(dest, args...)
+}
+
+func (s *Statement) Select(dest interface{}, args ...interface{}) error {
+	return s.bind(nil).Select(dest, args...)
+}
+
+func (s *Statement) Queryx(args ...interface{}) (*sqlx.Rows, error) {
+	return s.bind(nil).Queryx(args...)
+}
+
+func (s *Statement) QueryRowx(args ...interface{}) RowScanner {
+	return s.bind(nil).QueryRowx(args...)
+}
+
+// A single row returned by a statement
+type RowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// The row returned by a statement that couldn't be run
+type errRow struct{ err error }
+
+func (row errRow) Scan(...interface{}) error {
+	return row.err
+}
+
+// A BoundStatement is a Statement prepared for running on the database or in a transaction, or the error preparing
+// it. Named statements take a single argument, the struct or map their parameters are bound from.
+type BoundStatement struct {
+	statement *Statement
+	stmt      *sqlx.Stmt
+	namedStmt *sqlx.NamedStmt
+	err       error
+}
+
+// Get the single argument of a named statement
+func namedArg(args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errNamedArgs
+	}
+	return args[0], nil
+}
+
+// Note the error a statement returned. If Postgres no longer has the prepared statement, it is prepared again the
+// next time it is used. It isn't retried, since it may not be safe to run it twice.
+func (b *BoundStatement) done(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "invalid_sql_statement_name" {
+		b.statement.reset()
+	}
+	return err
+}
+
+func (b *BoundStatement) Exec(args ...interface{}) (sql.Result, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.namedStmt != nil {
+		arg, err := namedArg(args)
+		if err != nil {
+			return nil, err
+		}
+		result, err := b.namedStmt.Exec(arg)
+		return result, b.done(err)
+	}
+	result, err := b.stmt.Exec(args...)
+	return result, b.done(err)
+}
+
+func (b *BoundStatement) Get(dest interface{}, args ...interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.namedStmt != nil {
+		arg, err := namedArg(args)
+		if err != nil {
+			return err
+		}
+		return b.done(b.namedStmt.Get(dest, arg))
+	}
+	return b.done(b.stmt.Get(dest, args...))
+}
+
+func (b *BoundStatement) Select(dest interface{}, args ...interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.namedStmt != nil {
+		arg, err := namedArg(args)
+		if err != nil {
+			return err
+		}
+		return b.done(b.namedStmt.Select(dest, arg))
+	}
+	return b.done(b.stmt.Select(dest, args...))
+}
+
+func (b *BoundStatement) Queryx(args ...interface{}) (*sqlx.Rows, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.namedStmt != nil {
+		arg, err := namedArg(args)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := b.namedStmt.Queryx(arg)
+		return rows, b.done(err)
+	}
+	rows, err := b.stmt.Queryx(args...)
+	return rows, b.done(err)
+}
+
+func (b *BoundStatement) QueryRowx(args ...interface{}) RowScanner {
+	if b.err != nil {
+		return errRow{b.err}
+	}
+	if b.namedStmt != nil {
+		arg, err := namedArg(args)
+		if err != nil {
+			return errRow{err}
+		}
+		return boundRow{b, b.namedStmt.QueryRowx(arg)}
+	}
+	return boundRow{b, b.stmt.QueryRowx(args...)}
+}
+
+// A row returned by a BoundStatement, noting the error scanning it
+type boundRow struct {
+	statement *BoundStatement
+	row       *sqlx.Row
+}
+
+func (row boundRow) Scan(dest ...interface{}) error {
+	return row.statement.done(row.row.Scan(dest...))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long the status is reused for, so a busy status page doesn't count certificates on every request
+const statusCacheTTL = 30 * time.Second
+
+var (
+	ErrRateLimited = NewError("rate-limited", http.StatusTooManyRequests, "Too many requests. Please wait before trying again.")
+)
+
+// The public status is a summary of the service's health, for an internal status page to show. It needs no
+// authentication, so it holds nothing identifying: no users, certificates or names, only counts. Each client may
+// ask for it StatusRateLimit times a minute, and the counts are reused for statusCacheTTL.
+type ServiceStatus struct {
+	Status   string       `json:"status"`   // "ok", or "degraded" if the database can't be reached or a standby can't sync
+	Database string       `json:"database"` // "ok" or "unavailable"
+	Role     string       `json:"role"`     // "primary" or "standby" (see replication.go)
+	Certs    *StatusCerts `json:"certs"`    // Null if the database can't be reached
+	Checked  UTCTime      `json:"checked"`
+}
+
+// Counts of active certificates, by how soon they expire
+type StatusCerts struct {
+	Active      int `json:"active"`
+	Expired     int `json:"expired"`     // Still active, but expired
+	Expiring7d  int `json:"expiring7d"`  // Expiring within 7 days
+	Expiring30d int `json:"expiring30d"` // Expiring within 30 days, including those within 7
+}
+
+// A RateLimiter allows each key a number of requests in each fixed window of time
+type RateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	swept   time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{windows: make(map[string]*rateWindow)}
+}
+
+// Count a request by a key. Returns zero if it is allowed, or how long until the key may try again.
+func (l *RateLimiter) Allow(key string, limit int, window time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := Now()
+
+	// Forget keys whose windows are over, once a window
+	if now.Sub(l.swept) >= window {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= window {
+				delete(l.windows, k)
+			}
+		}
+		l.swept = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= window {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.count >= limit {
+		return w.start.Add(window).Sub(now)
+	}
+	w.count++
+	return 0
+}
+
+// StatusLimiter limits requests for the public status, by client
+var StatusLimiter = NewRateLimiter()
+
+var statusCache struct {
+	mu      sync.Mutex
+	status  *ServiceStatus
+	expires time.Time
+}
+
+// Check the service's health and count the certificates expiring soon
+func NewServiceStatus() *ServiceStatus {
+	now := Now()
+	replica := Replica.Status()
+	status := &ServiceStatus{Status: "ok", Database: "ok", Role: replica.Role, Checked: NewUTCTime(now)}
+	certs, err := DatabaseStatusCounts(now)
+	if err != nil {
+		log.Println("Unable to count certificates for the status:", err)
+		status.Status, status.Database = "degraded", "unavailable"
+	} else {
+		status.Certs = certs
+	}
+	if replica.LastError != "" {
+		status.Status = "degraded"
+	}
+	return status
+}
+
+// The status, as checked within the last statusCacheTTL
+func CurrentStatus() *ServiceStatus {
+	statusCache.mu.Lock()
+	defer statusCache.mu.Unlock()
+	if statusCache.status == nil || !Now().Before(statusCache.expires) {
+		statusCache.status = NewServiceStatus()
+		statusCache.expires = Now().Add(statusCacheTTL)
+	}
+	return statusCache.status
+}
+
+// Get the public status. Any origin may read it, so a status page can fetch it from the browser.
+func ReadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if wait := StatusLimiter.Allow(ClientIPKey(r), Config().StatusRateLimit, time.Minute); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		HandleError(w, r, ErrRateLimited, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, CurrentStatus())
+}
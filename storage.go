@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+)
+
+var (
+	ErrInvalidStoredPEM  = NewError("invalid-stored-pem", http.StatusInternalServerError, "Unable to read stored PEM data from the database.")
+	ErrInvalidStoredBlob = NewError("invalid-stored-blob", http.StatusInternalServerError, "Unable to read stored file data from the database.")
+
+	// The first two bytes of any gzip stream. A PEM block always starts with "-----" so the two can't be confused.
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// StoredPEM is PEM data (a certificate or a private key) that is stored canonically, as DER, and rendered as PEM
+// when it is read back. Whatever whitespace, line length or headers the client uploaded, the same certificate is
+// always stored as the same bytes: the bytes its cert-id is the hash of. Private keys are stored as PKCS#8 DER, and
+// rendered in the KeyFormat option's format.
+// The DER is transparently compressed when it is written to the database and decompressed when it is read back.
+// Whether or not new data is compressed is controlled by the StorageCompression option. Data is always
+// decompressed on read, so existing uncompressed rows keep working when compression is turned on. Rows written
+// as PEM by older versions are read too, and rendered canonically like the rest. Private keys are also wrapped by a
+// key management service, if there is one (see vault.go).
+type StoredPEM string
+
+// Value implements driver.Valuer for writing to the database.
+func (p StoredPEM) Value() (driver.Value, error) {
+	if p == "" {
+		return []byte{}, nil
+	}
+	der, err := canonicalDER(string(p))
+	if err != nil {
+		return nil, err
+	}
+	data := der
+	if Config().StorageCompression {
+		data, err = gzipBytes(der, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Private keys are wrapped by a key management service, if there is one (see vault.go)
+	if KeyWrap == nil {
+		return data, nil
+	}
+	isCert, err := isCertificateDER(der)
+	if err != nil || isCert {
+		return data, err
+	}
+	return KeyWrap.WrapKey(data)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (p *StoredPEM) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*p = ""
+		return nil
+	default:
+		return ErrInvalidStoredPEM
+	}
+
+	if isWrappedKey(data) {
+		unwrapped, err := unwrapKey(data)
+		if err != nil {
+			return err
+		}
+		data = unwrapped
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		decompressed, err := gunzipBytes(data)
+		if err != nil {
+			return err
+		}
+		data = decompressed
+	}
+	if len(data) == 0 {
+		*p = ""
+		return nil
+	}
+
+	// Older rows are PEM
+	if bytes.HasPrefix(data, pemMagic) {
+		der, err := canonicalDER(string(data))
+		if err != nil {
+			return err
+		}
+		data = der
+	}
+	rendered, err := renderDER(data)
+	if err != nil {
+		return err
+	}
+	*p = StoredPEM(rendered)
+	return nil
+}
+
+// The start of any PEM block. DER always starts with a SEQUENCE tag (0x30), so neither can be confused with the other,
+// or with gzip.
+var pemMagic = []byte("-----")
+
+// Get the canonical DER of a PEM encoded certificate or private key
+func canonicalDER(data string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, ErrInvalidStoredPEM
+	}
+	if block.Type == "CERTIFICATE" {
+		return block.Bytes, nil
+	}
+	key, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, ErrInvalidStoredPEM
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// Is stored DER a certificate, rather than a private key? A PKCS#8 private key is a SEQUENCE starting with its
+// version, an INTEGER, while a certificate is a SEQUENCE starting with another SEQUENCE, so the two can be told
+// apart without being labeled.
+func isCertificateDER(der []byte) (bool, error) {
+	var outer asn1.RawValue
+	_, err := asn1.Unmarshal(der, &outer)
+	if err != nil {
+		return false, ErrInvalidStoredPEM
+	}
+	var first asn1.RawValue
+	_, err = asn1.Unmarshal(outer.Bytes, &first)
+	if err != nil {
+		return false, ErrInvalidStoredPEM
+	}
+	return first.Tag == asn1.TagSequence, nil
+}
+
+// Render stored DER as PEM
+func renderDER(der []byte) ([]byte, error) {
+	isCert, err := isCertificateDER(der)
+	if err != nil {
+		return nil, err
+	}
+	if isCert {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, ErrInvalidStoredPEM
+	}
+	return EncodePrivateKeyPEM(key, Config().KeyFormat)
+}
+
+// StoredBlob is arbitrary binary data, such as a certificate attachment, stored like StoredPEM.
+// Binary data could itself start with the gzip magic number, so a blob is always written as a gzip stream.
+// When the StorageCompression option is off, the stream is simply not compressed.
+type StoredBlob []byte
+
+// Value implements driver.Valuer for writing to the database.
+func (b StoredBlob) Value() (driver.Value, error) {
+	level := gzip.NoCompression
+	if Config().StorageCompression {
+		level = gzip.DefaultCompression
+	}
+	return gzipBytes(b, level)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (b *StoredBlob) Scan(src interface{}) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return ErrInvalidStoredBlob
+	}
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return ErrInvalidStoredBlob
+	}
+	decompressed, err := gunzipBytes(data)
+	if err != nil {
+		return err
+	}
+	*b = decompressed
+	return nil
+}
+
+// StoredChain is a chain of PEM certificates (see chain.go), stored like StoredPEM: as the certificates' DER, one
+// after another, compressed if the StorageCompression option is on. An empty chain is stored as NULL.
+type StoredChain string
+
+// Value implements driver.Valuer for writing to the database.
+func (c StoredChain) Value() (driver.Value, error) {
+	if c == "" {
+		return nil, nil
+	}
+	var der []byte
+	rest := []byte(c)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, ErrInvalidStoredPEM
+		}
+		der = append(der, block.Bytes...)
+	}
+	if len(der) == 0 {
+		return nil, ErrInvalidStoredPEM
+	}
+	if !Config().StorageCompression {
+		return der, nil
+	}
+	return gzipBytes(der, gzip.DefaultCompression)
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (c *StoredChain) Scan(src interface{}) error {
+	if src == nil {
+		*c = ""
+		return nil
+	}
+	data, ok := src.([]byte)
+	if !ok {
+		return ErrInvalidStoredPEM
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		decompressed, err := gunzipBytes(data)
+		if err != nil {
+			return err
+		}
+		data = decompressed
+	}
+	var rendered []byte
+	for len(data) != 0 {
+		var cert asn1.RawValue
+		rest, err := asn1.Unmarshal(data, &cert)
+		if err != nil {
+			return ErrInvalidStoredPEM
+		}
+		rendered = append(rendered, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.FullBytes})...)
+		data = rest
+	}
+	*c = StoredChain(rendered)
+	return nil
+}
+
+func gzipBytes(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Template key types
+const (
+	TemplateKeyRSA2048 = "rsa-2048"
+	TemplateKeyRSA3072 = "rsa-3072"
+	TemplateKeyRSA4096 = "rsa-4096"
+	TemplateKeyECP256  = "ec-p256"
+	TemplateKeyECP384  = "ec-p384"
+)
+
+var (
+	ErrInvalidTemplate        = NewError("invalid-template", http.StatusBadRequest, "Invalid template. Placeholders are written {param}, in lower case letters, digits and hyphens. A template needs a common name or names.")
+	ErrInvalidTemplateKeyType = NewError("invalid-template-key-type", http.StatusBadRequest, "Invalid key type. Use rsa-2048, rsa-3072, rsa-4096, ec-p256 or ec-p384, no shorter than the minimumRSABits and minimumECBits options allow.")
+	ErrUnknownTemplateParam   = NewError("unknown-template-param", http.StatusBadRequest, "The template has no such parameter.")
+	ErrInvalidTemplateParam   = NewError("invalid-template-param", http.StatusBadRequest, "Invalid parameter. Give a value without control characters.")
+	ErrInvalidTemplateResult  = NewError("invalid-template-result", http.StatusBadRequest, "With these parameters, the name isn't a DNS name, IP address or email address. DNS names may be wildcards only in their first label.")
+)
+
+// Hand-built CSRs are easy to get wrong: a typo in a name, the wrong organization, a key too short. A user can save
+// request templates that fix everything but a few parameters: the subject, the names as patterns, the key type, and
+// the validity to ask for. Placeholders such as {service} in the subject and names are filled in from the
+// parameters when the template is used, so that "{service}.internal.example.com" always follows the naming scheme.
+//
+// Using a template generates a new key of the template's type and a CSR for it, which are returned and not stored:
+// the CSR goes to a CA, or the CSR queue (see csrqueue.go), and the certificate is uploaded with its key once issued.
+// Since the response holds a private key, using a template needs a key-export scope token, as exports do (see
+// scopes.go). Every parameter must be given, and no others, so a misspelt parameter isn't silently left out.
+// Templates aren't replicated to a standby.
+
+var (
+	templateNamePattern        = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	templatePlaceholderPattern = regexp.MustCompile(`\{([a-z][a-z0-9-]*)\}`)
+)
+
+// The subject of a template's CSRs. Every field may have placeholders.
+type TemplateSubject struct {
+	CommonName         string `json:"commonName,omitempty"`
+	Organization       string `json:"organization,omitempty"`
+	OrganizationalUnit string `json:"organizationalUnit,omitempty"`
+	Locality           string `json:"locality,omitempty"`
+	Province           string `json:"province,omitempty"`
+	Country            string `json:"country,omitempty"`
+}
+
+// A saved request template
+type RequestTemplate struct {
+	UserId      string          `json:"user"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Subject     TemplateSubject `json:"subject"`
+	Names       []string        `json:"names"`    // DNS names, IP addresses and email addresses, with placeholders
+	KeyType     string          `json:"keyType"`  // Such as "ec-p256", the default
+	Validity    Duration        `json:"validity"` // The validity to ask the CA for. Zero for the CA's default.
+	Params      []string        `json:"params"`   // The placeholders, in order. Not stored: found from the template.
+	Updated     UTCTime         `json:"updated"`
+}
+
+// The parameters a template is used with
+type TemplateParams struct {
+	Params map[string]string `json:"params"`
+}
+
+// A CSR made from a template, with its new key
+type TemplateRequest struct {
+	Template string   `json:"template"`
+	Subject  string   `json:"subject"`
+	Names    []string `json:"names"`
+	CSR      string   `json:"csr"`
+	Key      string   `json:"key"`                // In the KeyFormat option's format
+	Validity string   `json:"validity,omitempty"` // The validity to ask for, such as "2160h", as in a CSR approval
+}
+
+// Every field with placeholders, by the field's name
+func (t *RequestTemplate) fields() map[string]*string {
+	fields := map[string]*string{
+		"subject.commonName":         &t.Subject.CommonName,
+		"subject.organization":       &t.Subject.Organization,
+		"subject.organizationalUnit": &t.Subject.OrganizationalUnit,
+		"subject.locality":           &t.Subject.Locality,
+		"subject.province":           &t.Subject.Province,
+		"subject.country":            &t.Subject.Country,
+	}
+	for i := range t.Names {
+		fields["names["+strconv.Itoa(i)+"]"] = &t.Names[i]
+	}
+	return fields
+}
+
+// Find the template's placeholders, filling in its Params
+func (t *RequestTemplate) findParams() {
+	found := make(map[string]bool)
+	t.Params = []string{}
+	for _, value := range t.fields() {
+		for _, match := range templatePlaceholderPattern.FindAllStringSubmatch(*value, -1) {
+			if !found[match[1]] {
+				found[match[1]] = true
+				t.Params = append(t.Params, match[1])
+			}
+		}
+	}
+	sort.Strings(t.Params)
+}
+
+// Validate a template, filling in its defaults and Params
+func ValidateRequestTemplate(t *RequestTemplate, config *RuntimeConfig) error {
+	var errs ValidationErrors
+	if !templateNamePattern.MatchString(t.Name) {
+		errs.Add("name", ErrInvalidTemplate)
+	}
+	if len(t.Description) > config.MaxNotesLength {
+		errs.Add("description", ErrNotesTooLong)
+	}
+	if t.Subject.CommonName == "" && len(t.Names) == 0 {
+		errs.Add("names", ErrInvalidTemplate)
+	}
+	for field, value := range t.fields() {
+		unplaced := templatePlaceholderPattern.ReplaceAllString(*value, "")
+		if strings.ContainsAny(unplaced, "{}") || (strings.HasPrefix(field, "names") && strings.TrimSpace(*value) == "") {
+			errs.Add(field, ErrInvalidTemplate)
+		}
+	}
+	if t.KeyType == "" {
+		t.KeyType = TemplateKeyECP256
+	}
+	if _, err := templateKeyBits(t.KeyType, config); err != nil {
+		errs.Add("keyType", err)
+	}
+	if t.Validity < 0 {
+		errs.Add("validity", ErrInvalidTemplate)
+	}
+	t.findParams()
+	return errs.Err()
+}
+
+// Get the size of a template key type, checking it is no shorter than allowed
+func templateKeyBits(keyType string, config *RuntimeConfig) (int, error) {
+	var bits, minimum int
+	switch keyType {
+	case TemplateKeyRSA2048, TemplateKeyRSA3072, TemplateKeyRSA4096:
+		bits, _ = strconv.Atoi(strings.TrimPrefix(keyType, "rsa-"))
+		minimum = config.MinimumRSABits
+	case TemplateKeyECP256, TemplateKeyECP384:
+		bits, _ = strconv.Atoi(strings.TrimPrefix(keyType, "ec-p"))
+		minimum = config.MinimumECBits
+	default:
+		return 0, ErrInvalidTemplateKeyType
+	}
+	if bits < minimum {
+		return 0, ErrInvalidTemplateKeyType
+	}
+	return bits, nil
+}
+
+// Generate a new key of a template key type
+func generateTemplateKey(keyType string, bits int) (crypto.Signer, error) {
+	if strings.HasPrefix(keyType, "rsa-") {
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	if bits == 384 {
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Fill in a template's placeholders, giving a copy of the template. Every parameter must be given, and no others.
+func FillTemplate(t *RequestTemplate, params map[string]string) (*RequestTemplate, error) {
+	var errs ValidationErrors
+	needed := make(map[string]bool, len(t.Params))
+	for _, param := range t.Params {
+		needed[param] = true
+		value, ok := params[param]
+		if !ok || strings.TrimSpace(value) == "" {
+			errs.Add("params."+param, ErrRequiredField)
+			continue
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			errs.Add("params."+param, ErrInvalidTemplateParam)
+		}
+	}
+	for param := range params {
+		if !needed[param] {
+			errs.Add("params."+param, ErrUnknownTemplateParam)
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	filled := *t
+	filled.Names = append([]string(nil), t.Names...)
+	for _, value := range filled.fields() {
+		*value = templatePlaceholderPattern.ReplaceAllStringFunc(*value, func(placeholder string) string {
+			return strings.TrimSpace(params[placeholder[1:len(placeholder)-1]])
+		})
+	}
+	return &filled, nil
+}
+
+// Make a new key and a CSR for it from a template, with its parameters
+func NewTemplateRequest(t *RequestTemplate, params map[string]string, config *RuntimeConfig) (*TemplateRequest, error) {
+	filled, err := FillTemplate(t, params)
+	if err != nil {
+		return nil, err
+	}
+
+	csrTemplate := &x509.CertificateRequest{Subject: pkix.Name{CommonName: filled.Subject.CommonName}}
+	for _, attr := range []struct {
+		value string
+		to    *[]string
+	}{
+		{filled.Subject.Organization, &csrTemplate.Subject.Organization},
+		{filled.Subject.OrganizationalUnit, &csrTemplate.Subject.OrganizationalUnit},
+		{filled.Subject.Locality, &csrTemplate.Subject.Locality},
+		{filled.Subject.Province, &csrTemplate.Subject.Province},
+		{filled.Subject.Country, &csrTemplate.Subject.Country},
+	} {
+		if attr.value != "" {
+			*attr.to = []string{attr.value}
+		}
+	}
+	var errs ValidationErrors
+	for i, name := range filled.Names {
+		name = strings.TrimSpace(name)
+		if ip := net.ParseIP(name); ip != nil {
+			csrTemplate.IPAddresses = append(csrTemplate.IPAddresses, ip)
+		} else if strings.Contains(name, "@") {
+			csrTemplate.EmailAddresses = append(csrTemplate.EmailAddresses, name)
+		} else if name = strings.ToLower(name); isDNSName(strings.TrimPrefix(name, "*.")) {
+			csrTemplate.DNSNames = append(csrTemplate.DNSNames, name)
+		} else {
+			errs.Add("names["+strconv.Itoa(i)+"]", ErrInvalidTemplateResult)
+		}
+		filled.Names[i] = name
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	bits, err := templateKeyBits(t.KeyType, config)
+	if err != nil {
+		return nil, err
+	}
+	key, err := generateTemplateKey(t.KeyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodePrivateKeyPEM(key, config.KeyFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &TemplateRequest{
+		Template: t.Name,
+		Subject:  csrTemplate.Subject.String(),
+		Names:    filled.Names,
+		CSR:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+		Key:      string(keyPEM),
+	}
+	if t.Validity != 0 {
+		request.Validity = time.Duration(t.Validity).String()
+	}
+	return request, nil
+}
+
+// Get the user-id and template name from a request
+func GetUserTemplate(r *http.Request) (string, string, error) {
+	userid, err := GetUserID(r)
+	if err != nil {
+		return "", "", err
+	}
+	name := mux.Vars(r)["template"]
+	if !templateNamePattern.MatchString(name) {
+		return "", "", ErrNotFound
+	}
+	return userid, name, nil
+}
+
+// List a user's templates
+func ListTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	q, err := ParseListQuery(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	templates, page, err := DatabaseListTemplates(userid, q)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendPagedResult(w, r, templates, page)
+}
+
+// Get one of a user's templates
+func ReadTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserTemplate(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	template, err := DatabaseReadTemplate(userid, name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, template)
+}
+
+// Save a template for a user, replacing any with the same name
+func SaveTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, err := GetUserID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	template := new(RequestTemplate)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(template)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	template.UserId, template.Name = userid, mux.Vars(r)["template"]
+	err = ValidateRequestTemplate(template, Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	template.Updated = NewUTCTime(Now())
+	err = DatabaseSaveTemplate(r.Context(), template, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, template)
+}
+
+// Delete one of a user's templates
+func DeleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserTemplate(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	template, err := DatabaseDeleteTemplate(r.Context(), userid, name, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, template)
+}
+
+// Make a new key and CSR from one of a user's templates
+func TemplateRequestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userid, name, err := GetUserTemplate(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// The parameters are optional, for templates without any
+	params := new(TemplateParams)
+	d := json.NewDecoder(r.Body)
+	err = d.Decode(params)
+	if err != nil && err != io.EOF {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	template, err := DatabaseReadTemplate(userid, name)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	request, err := NewTemplateRequest(template, params.Params, Config())
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, request)
+}
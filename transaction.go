@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"log"
+)
+
+// Operations that make several changes run them in a transaction with WithTx, which commits the transaction if the
+// operation succeeds and rolls it back if it fails, or panics. A rollback that fails is logged, and the operation's
+// own error returned, since that is the one that explains what went wrong.
+//
+// Part of an operation can be nested in a savepoint with WithSavepoint, so that if the part fails, only its changes
+// are rolled back and the operation can carry on. Savepoints can be nested in each other.
+
+// The options of transactions that see the database as it was when they began, and change nothing
+var snapshotTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// The name of savepoints. Postgres lets a name be reused, with ROLLBACK TO and RELEASE using the latest savepoint of
+// that name, so nested savepoints can share it. Sharing it also keeps them to one statement in the query stats.
+const savepointName = "certstore_savepoint"
+
+// Run fn in a transaction, committing it if fn returns nil and rolling it back if fn returns an error or panics.
+// A panic is raised again once the transaction is rolled back.
+func WithTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return WithTxOptions(ctx, nil, fn)
+}
+
+// Run fn in a transaction with the given options (see WithTx). Nil options are the database's defaults.
+func WithTxOptions(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return runTx(tx.Commit, tx.Rollback, func() error { return fn(tx) })
+}
+
+// Run fn in a savepoint of a transaction, releasing the savepoint if fn returns nil and rolling back to it if fn
+// returns an error or panics. Either way the transaction carries on. A panic is raised again once the savepoint is
+// rolled back.
+func WithSavepoint(tx *sqlx.Tx, fn func(tx *sqlx.Tx) error) error {
+	_, err := tx.Exec("SAVEPOINT " + savepointName)
+	if err != nil {
+		return err
+	}
+	release := func() error {
+		_, err := tx.Exec("RELEASE SAVEPOINT " + savepointName)
+		return err
+	}
+	rollback := func() error {
+		_, err := tx.Exec("ROLLBACK TO SAVEPOINT " + savepointName)
+		if err != nil {
+			return err
+		}
+		return release()
+	}
+	return runTx(release, rollback, func() error { return fn(tx) })
+}
+
+// Run fn, then commit if it succeeded or roll back if it failed or panicked
+func runTx(commit, rollback func() error, fn func() error) error {
+	defer func() {
+		if p := recover(); p != nil {
+			logRollback(rollback())
+			panic(p)
+		}
+	}()
+
+	err := fn()
+	if err != nil {
+		logRollback(rollback())
+		return err
+	}
+	return commit()
+}
+
+// Log the error rolling back, if there was one
+func logRollback(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
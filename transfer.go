@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrInvalidTransferUser = NewError("invalid-transfer-user", http.StatusBadRequest, "Invalid transfer. The other user is malformed or does not exist.")
+	ErrTransferToSelf      = NewError("transfer-to-self", http.StatusBadRequest, "Invalid transfer. Certificates can not be transfered from a user to themselves.")
+)
+
+// A Transfer moves certificates from one user to another. If Certs is empty, all of the user's certificates are moved.
+type Transfer struct {
+	FromId string   `json:"from"`
+	ToId   string   `json:"to"`
+	Certs  []string `json:"certs"`
+}
+
+// A Merge moves everything belonging to one user (their certificates and the certificates shared with them)
+// into another user, and then deletes the merged user.
+type Merge struct {
+	IntoId string `json:"into"`
+	FromId string `json:"from"`
+}
+
+// Validate that both user ids are numeric and different, and that any cert ids look like cert ids
+func (t *Transfer) Validate() error {
+	if checkid, err := strconv.Atoi(t.ToId); err != nil || checkid <= 0 {
+		return ErrInvalidTransferUser
+	}
+	if t.FromId == t.ToId {
+		return ErrTransferToSelf
+	}
+	for _, certid := range t.Certs {
+		if len(certid) != 64 {
+			return ErrInvalidCertificateId
+		}
+	}
+	return nil
+}
+
+// Validate that both user ids are numeric and different
+func (m *Merge) Validate() error {
+	if checkid, err := strconv.Atoi(m.FromId); err != nil || checkid <= 0 {
+		return ErrInvalidTransferUser
+	}
+	if m.FromId == m.IntoId {
+		return ErrTransferToSelf
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// The kinds of trusted certificate
+const (
+	TrustKindRoot         = "root"         // A trust anchor: chains are verified up to it
+	TrustKindIntermediate = "intermediate" // Used to complete chains that leave it out, but not trusted itself
+)
+
+// Where a trusted certificate comes from
+const (
+	TrustSourceFile     = "file"     // OptTrustRoots or OptTrustIntermediates, reloaded with the configuration
+	TrustSourceDatabase = "database" // Added with the API
+)
+
+var (
+	ErrInvalidTrustFile  = NewError("invalid-trust-file", http.StatusBadRequest, "Invalid trust root file. It must contain PEM encoded certificates.")
+	ErrInvalidTrustKind  = NewError("invalid-trust-kind", http.StatusBadRequest, "Invalid kind. It must be root or intermediate.")
+	ErrTrustRootNotCA    = NewError("trust-root-not-ca", http.StatusBadRequest, "The certificate isn't a CA certificate, so it can't issue the certificates it would be trusted for.")
+	ErrTrustRootExists   = NewError("trust-root-exists", http.StatusConflict, "The certificate is already trusted.")
+	ErrTrustRootReadOnly = NewError("trust-root-read-only", http.StatusConflict, "The certificate is trusted by a trust root file, so it can only be removed from the file.")
+)
+
+// With the VerifyCertificate option on, a certificate's chain is verified up to a trusted root. By default those are
+// the system's roots, which only covers publicly trusted certificates. For certificates from a private PKI, roots and
+// intermediates can be added:
+//
+// - From PEM files, OptTrustRoots and OptTrustIntermediates, read again whenever the configuration is reloaded.
+// - With the API, at /admin/trust/roots. These are kept in the database, with an audit entry for each change, and
+//   are read again on each change, and whenever the configuration is reloaded (so other instances pick them up).
+//
+// Once there are custom roots, the system's roots are still trusted as well, unless the TrustSystemRoots option is
+// off. Trusted intermediates are only used to build chains, as if they were in every certificate's chain: a chain
+// still needs a trusted root. In a sandbox, chains are verified against the sandbox's test CA instead of the roots.
+
+// A certificate trusted for verifying chains
+type TrustRoot struct {
+	Id        string  `json:"id"` // The SHA256 hash of the certificate (hex-encoded), as for a cert-id
+	Kind      string  `json:"kind"`
+	Cert      string  `json:"cert"` // PEM
+	Subject   string  `json:"subject"`
+	NotAfter  UTCTime `json:"notAfter"`
+	Source    string  `json:"source" db:"-"`
+	Added     UTCTime `json:"added"`   // Null for certificates from a file
+	AddedBy   string  `json:"addedBy"` // Empty for certificates from a file
+	certValue *x509.Certificate
+}
+
+// Fill in a trusted certificate's details from its PEM
+func (root *TrustRoot) parse() error {
+	cert, err := ParseCertificatePEM(root.Cert)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(cert.Raw)
+	root.Id, root.Subject, root.NotAfter = hex.EncodeToString(hash[:]), cert.Subject.String(), NewUTCTime(cert.NotAfter)
+	root.Cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	root.certValue = cert
+	return nil
+}
+
+// Validate a certificate to be trusted, filling in its details
+func validateTrustRoot(root *TrustRoot) error {
+	var errs ValidationErrors
+	if root.Kind != TrustKindRoot && root.Kind != TrustKindIntermediate {
+		errs.Add("kind", ErrInvalidTrustKind)
+	}
+	err := root.parse()
+	if err != nil {
+		errs.Add("cert", err)
+	} else if !root.certValue.BasicConstraintsValid || !root.certValue.IsCA {
+		errs.Add("cert", ErrTrustRootNotCA)
+	}
+	return errs.Err()
+}
+
+// Read the trusted certificates of a kind from a PEM file
+func readTrustFile(filename, kind string) ([]*TrustRoot, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*TrustRoot
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		root := &TrustRoot{Kind: kind, Source: TrustSourceFile, Cert: string(pem.EncodeToMemory(block))}
+		err = root.parse()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		return nil, ErrInvalidTrustFile
+	}
+	return roots, nil
+}
+
+// TrustStore holds the trusted certificates, from the files and from the database
+type TrustStore struct {
+	mu     sync.RWMutex
+	files  []*TrustRoot
+	stored []*TrustRoot
+}
+
+// The certificates trusted for verifying chains
+var TrustRoots = new(TrustStore)
+
+// Read the trust root files again. Nothing changes if either can't be read.
+func (store *TrustStore) LoadFiles() error {
+	var files []*TrustRoot
+	for _, f := range []struct{ filename, kind string }{{OptTrustRoots, TrustKindRoot}, {OptTrustIntermediates, TrustKindIntermediate}} {
+		if f.filename == "" {
+			continue
+		}
+		roots, err := readTrustFile(f.filename, f.kind)
+		if err != nil {
+			return err
+		}
+		files = append(files, roots...)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.files = files
+	return nil
+}
+
+// Read the certificates added with the API from the database again
+func (store *TrustStore) LoadStored() error {
+	stored, err := DatabaseListTrustRoots()
+	if err != nil {
+		return err
+	}
+	for _, root := range stored {
+		root.Source = TrustSourceDatabase
+		err = root.parse()
+		if err != nil {
+			return err
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.stored = stored
+	return nil
+}
+
+// List the trusted certificates, roots first, then by subject
+func (store *TrustStore) List() []*TrustRoot {
+	store.mu.RLock()
+	roots := append(append([]*TrustRoot{}, store.files...), store.stored...)
+	store.mu.RUnlock()
+	sort.SliceStable(roots, func(i, j int) bool {
+		if roots[i].Kind != roots[j].Kind {
+			return roots[i].Kind == TrustKindRoot
+		}
+		return roots[i].Subject < roots[j].Subject
+	})
+	return roots
+}
+
+// Find a trusted certificate by its id. Nil if it isn't trusted.
+func (store *TrustStore) Find(id string) *TrustRoot {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, root := range append(append([]*TrustRoot{}, store.files...), store.stored...) {
+		if root.Id == id {
+			return root
+		}
+	}
+	return nil
+}
+
+// Get the pools to verify chains with. roots is nil, for the system's roots, if there are no custom roots.
+// intermediates is nil if there are no trusted intermediates. New pools are made each time, so callers may add to
+// them.
+func (store *TrustStore) Pools(systemRoots bool) (roots, intermediates *x509.CertPool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, root := range append(append([]*TrustRoot{}, store.files...), store.stored...) {
+		if root.Kind == TrustKindIntermediate {
+			if intermediates == nil {
+				intermediates = x509.NewCertPool()
+			}
+			intermediates.AddCert(root.certValue)
+			continue
+		}
+		if roots == nil {
+			roots = x509.NewCertPool()
+			if systemRoots {
+				system, err := x509.SystemCertPool()
+				if err != nil {
+					log.Println("Unable to load the system roots:", err)
+				} else {
+					roots = system
+				}
+			}
+		}
+		roots.AddCert(root.certValue)
+	}
+	return roots, intermediates
+}
+
+// Get the options for verifying a certificate chain against the trusted certificates
+func trustVerifyOptions(config *RuntimeConfig) x509.VerifyOptions {
+	roots, intermediates := TrustRoots.Pools(config.TrustSystemRoots)
+	return x509.VerifyOptions{Roots: roots, Intermediates: intermediates}
+}
+
+// Read the trust root files, and the certificates added with the API if the database is set up
+func LoadTrustRoots() error {
+	err := TrustRoots.LoadFiles()
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return nil
+	}
+	return TrustRoots.LoadStored()
+}
+
+func GetTrustRootID(r *http.Request) (string, error) {
+	ref, err := ParseCertRef(mux.Vars(r)["root-id"])
+	if err != nil || !ref.IsCertId() {
+		return "", ErrNotFound
+	}
+	return ref.Value, nil
+}
+
+// List the certificates trusted for verifying chains, from the files and added with the API
+func ListTrustRootsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	SendResult(w, r, TrustRoots.List())
+}
+
+// Trust a root or an intermediate certificate
+func CreateTrustRootHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Load the certificate from the body
+	root := new(TrustRoot)
+	d := json.NewDecoder(r.Body)
+	err := d.Decode(root)
+	if err != nil {
+		HandleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	err = validateTrustRoot(root)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if TrustRoots.Find(root.Id) != nil {
+		HandleError(w, r, ErrTrustRootExists, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	root.Source, root.Added, root.AddedBy = TrustSourceDatabase, NewUTCTime(Now()), RequestPrincipal(r)
+	err = DatabaseCreateTrustRoot(r.Context(), root, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = TrustRoots.LoadStored()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, root)
+}
+
+// Stop trusting a certificate added with the API
+func DeleteTrustRootHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rootid, err := GetTrustRootID(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	if root := TrustRoots.Find(rootid); root != nil && root.Source == TrustSourceFile {
+		HandleError(w, r, ErrTrustRootReadOnly, 0)
+		return
+	}
+
+	reason, err := ChangeReason(r)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	root, err := DatabaseDeleteTrustRoot(r.Context(), rootid, reason)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	err = TrustRoots.LoadStored()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	root.Source = TrustSourceDatabase
+
+	// Send the result
+	SendResult(w, r, root)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Usage metrics
+const (
+	UsageAPICalls     = "api-calls"     // Requests to the API
+	UsageCertsCreated = "certs-created" // Certificates stored, by upload or with a new user
+	UsageKeyExports   = "key-exports"   // Private key export links made
+	UsageLegacyPEM    = "legacy-pem"    // Requests sending or asking for deprecated space-normalized PEM (see pemformat.go)
+)
+
+// The format of a usage month
+const usageMonthFormat = "2006-01"
+
+var (
+	ErrInvalidUsageMonth = NewError("invalid-usage-month", http.StatusBadRequest, "Invalid month. Months are given as YYYY-MM.")
+)
+
+// Usage is metered per user and per month, for chargeback. It would be metered per organization, but there are no
+// organizations yet (see main.go): a user is the unit of accounting, and totals cover the whole server.
+// certstore stores certificates but doesn't issue or sign them, so there are no signing operations or issued
+// certificates to count. Storing a certificate is counted instead.
+//
+// Counts are kept in memory and added to the database every OptUsageInterval, so a crash loses at most that much usage.
+
+type usageKey struct {
+	month  string
+	userid string
+	metric string
+}
+
+// UsageMeter counts usage until it is flushed to the database
+type UsageMeter struct {
+	mu     sync.Mutex
+	counts map[usageKey]int64
+}
+
+// The usage counted in this process
+var Usage = &UsageMeter{counts: make(map[usageKey]int64)}
+
+// Count usage by a user, who may be "" for requests that aren't for a user
+func (m *UsageMeter) Record(userid, metric string, n int64) {
+	key := usageKey{month: Now().UTC().Format(usageMonthFormat), userid: userid, metric: metric}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key] += n
+}
+
+// Take the counts so far, and start counting again
+func (m *UsageMeter) take() map[usageKey]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.counts
+	m.counts = make(map[usageKey]int64)
+	return counts
+}
+
+// Put back counts that couldn't be saved
+func (m *UsageMeter) restore(counts map[usageKey]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, n := range counts {
+		m.counts[key] += n
+	}
+}
+
+// Add the counts to the database
+func (m *UsageMeter) Flush() error {
+	counts := m.take()
+	if len(counts) == 0 {
+		return nil
+	}
+	err := DatabaseAddUsage(counts)
+	if err != nil {
+		m.restore(counts)
+	}
+	return err
+}
+
+// Flush the counts to the database every interval
+func (m *UsageMeter) FlushEvery(interval time.Duration) {
+	for {
+		<-clock.After(interval)
+		// A standby's counts are kept until it is promoted, since its database follows the primary's
+		if Replica.Standby() {
+			continue
+		}
+		err := m.Flush()
+		if err != nil {
+			log.Println("Unable to save usage:", err)
+		}
+	}
+}
+
+// Middleware that counts each API call against the user it is for. It is used on the router, so the user-id
+// is known.
+func UsageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Malformed user-ids are counted as not for a user, so they can't make up users
+		userid, err := GetUserID(r)
+		if err != nil {
+			userid = ""
+		}
+		Usage.Record(userid, UsageAPICalls, 1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// A month of usage
+type UsageMonth struct {
+	Month string           `json:"month"` // YYYY-MM, in UTC
+	Usage map[string]int64 `json:"usage"` // Count of each metric
+}
+
+// Usage over a range of months, for one user or for the whole server
+type UsageReport struct {
+	UserId      string        `json:"user,omitempty"`
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	StoredCerts int64         `json:"storedCerts"` // Certificates stored now
+	Months      []*UsageMonth `json:"months"`      // Months with any usage, oldest first
+}
+
+// Roll up counts into months
+func usageMonths(rows []*UsageRow) []*UsageMonth {
+	byMonth := make(map[string]*UsageMonth)
+	for _, row := range rows {
+		month, ok := byMonth[row.Month]
+		if !ok {
+			month = &UsageMonth{Month: row.Month, Usage: make(map[string]int64)}
+			byMonth[row.Month] = month
+		}
+		month.Usage[row.Metric] += row.Count
+	}
+	months := make([]*UsageMonth, 0, len(byMonth))
+	for _, month := range byMonth {
+		months = append(months, month)
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Month < months[j].Month })
+	return months
+}
+
+// A count from the database
+type UsageRow struct {
+	Month  string
+	Metric string
+	Count  int64
+}
+
+// Parse a month. Empty gives the default.
+func parseUsageMonth(s string, def time.Time) (string, error) {
+	if s == "" {
+		return def.UTC().Format(usageMonthFormat), nil
+	}
+	month, err := time.Parse(usageMonthFormat, s)
+	if err != nil {
+		return "", ErrInvalidUsageMonth
+	}
+	return month.Format(usageMonthFormat), nil
+}
+
+// Get usage by month, for a user (?user=) or the whole server, from ?from= to ?to= (by default, the last 12 months)
+func ReadUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	now := Now().UTC()
+	from, err := parseUsageMonth(query.Get("from"), time.Date(now.Year(), now.Month()-11, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	to, err := parseUsageMonth(query.Get("to"), now)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	userid := query.Get("user")
+	if userid != "" {
+		if checkid, err := strconv.Atoi(userid); err != nil || checkid <= 0 {
+			HandleError(w, r, ErrInvalidUserId, 0)
+			return
+		}
+	}
+
+	// Include what hasn't been flushed yet
+	err = Usage.Flush()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+	rows, stored, err := DatabaseReadUsage(userid, from, to)
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, &UsageReport{UserId: userid, From: from, To: to, StoredCerts: stored, Months: usageMonths(rows)})
+}
@@ -1,20 +1,16 @@
 package main
 
 import (
-	"errors"
-	"regexp"
+	"log"
+	"net/http"
 	"strconv"
-	"unicode/utf8"
 )
 
 var (
-	ErrInvalidUserId    = errors.New("Invalid User. The User ID is malformed.")
-	ErrInvalidUserName  = errors.New("Invalid User. The User Name is too long.")
-	ErrInvalidUserEmail = errors.New("Invalid User. The User email is malformed.")
-
-	// Proper regex for case sensitive email address. From https://github.com/asaskevich/govalidator.
-	// TODO: Confirm that this works with IDN hostnames.
-	RegExpEmail = regexp.MustCompile("^(((([a-zA-Z]|\\d|[!#\\$%&'\\*\\+\\-\\/=\\?\\^_`{\\|}~]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])+(\\.([a-zA-Z]|\\d|[!#\\$%&'\\*\\+\\-\\/=\\?\\^_`{\\|}~]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])+)*)|((\\x22)((((\\x20|\\x09)*(\\x0d\\x0a))?(\\x20|\\x09)+)?(([\\x01-\\x08\\x0b\\x0c\\x0e-\\x1f\\x7f]|\\x21|[\\x23-\\x5b]|[\\x5d-\\x7e]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(\\([\\x01-\\x09\\x0b\\x0c\\x0d-\\x7f]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}]))))*(((\\x20|\\x09)*(\\x0d\\x0a))?(\\x20|\\x09)+)?(\\x22)))@((([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])([a-zA-Z]|\\d|-|\\.|_|~|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])*([a-zA-Z]|\\d|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])))\\.)+(([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])|(([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])([a-zA-Z]|\\d|-|\\.|_|~|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])*([a-zA-Z]|[\\x{00A0}-\\x{D7FF}\\x{F900}-\\x{FDCF}\\x{FDF0}-\\x{FFEF}])))\\.?$")
+	ErrInvalidUserId    = NewError("invalid-user-id", http.StatusBadRequest, "Invalid User. The User ID is malformed.")
+	ErrInvalidUserName  = NewError("invalid-user-name", http.StatusBadRequest, "Invalid User. The User Name is too long.")
+	ErrInvalidUserEmail = NewError("invalid-user-email", http.StatusBadRequest, "Invalid User. The User email is malformed.")
+	WarnDuplicateEmail  = NewError("duplicate-email", 0, "Another user has the same email address. Check that they aren't the same person.")
 )
 
 type User struct {
@@ -22,44 +18,58 @@ type User struct {
 	Name  string             `json:"name"`
 	Email string             `json:"email"`
 	Certs []*CertificateData `json:"certs"`
+
+	// How many certificates the user holds, of those the read asked for (see UserCertsQuery). Ignored on input.
+	CertCount int `json:"certCount"`
+
+	warnings ValidationErrors // About the certificates, as they were uploaded
 }
 
-// Validate that the Id is numeric, the name isn't too long, and the email address is valid
+// Validate that the Id is numeric, and normalize and validate the name and email address (see validation.go)
 // Also validate all attached Certificates and normalizes them
+// Every invalid field is reported, as ValidationErrors
 func (u *User) ValidateNormalize() error {
+	var errs ValidationErrors
+
 	// Verify the userid is numeric and postive (if specified)
 	if u.Id != "" {
 		if checkid, err := strconv.Atoi(u.Id); err != nil || checkid <= 0 {
-			return ErrInvalidUserId
+			errs.Add("id", ErrInvalidUserId)
 		}
 	}
 
-	// Verify the name is not longer than 746 characters
-	// The longeset name in the world thus far is that of Hubert Blaine Wolfeschlegelsteinhausenbergerdorff... with 746 characters.
-	// TODO: Normalize name (trim)
-	if utf8.RuneCountInString(u.Name) > 746 {
-		return ErrInvalidUserName
+	// Normalize and verify the name and email address
+	name, err := NormalizeName(u.Name)
+	errs.Add("name", err)
+	if err == nil {
+		u.Name = name
 	}
-
-	// Verify the email address
-	// TOOD: Normalize email address (trim and lowcase the domain)
-	if !RegExpEmail.MatchString(u.Email) {
-		return ErrInvalidUserEmail
+	email, err := NormalizeEmail(u.Email)
+	errs.Add("email", err)
+	if err == nil {
+		u.Email = email
 	}
 
 	// Verify and Normalize CertificateData
-	if len(u.Certs) > 0 {
-		for i, certData := range u.Certs {
-			cert, err := NewCertificateFromData(certData)
-			if err != nil {
-				return err
-			}
-			u.Certs[i] = cert.GetData()
+	for i, certData := range u.Certs {
+		cert, err := NewCertificateFromData(certData)
+		if err == nil {
+			err = cert.CheckOCSP(Config(), Now())
+		}
+		if err == nil {
+			err = cert.CheckCT(Config(), Now())
+		}
+		if err != nil {
+			errs.Add("certs["+strconv.Itoa(i)+"]", err)
+			continue
+		}
+		for _, warning := range cert.Warnings {
+			u.warnings.Add("certs["+strconv.Itoa(i)+"]."+warning.Field, warning.Err)
 		}
+		u.Certs[i] = cert.GetData()
 	}
 
-	// All is well
-	return nil
+	return errs.Err()
 }
 
 // Get a slice of Certificate structs for this User
@@ -78,3 +88,24 @@ func (u *User) GetCerts() ([]*Certificate, error) {
 	}
 	return certs, nil
 }
+
+// Warn if another user has a user's email address, whatever its case. Encrypted addresses are found by their blind
+// index (see pii.go).
+func duplicateEmailWarnings(user *User) ValidationErrors {
+	var warnings ValidationErrors
+	if user.Email == "" {
+		return nil
+	}
+	users, err := DatabaseListUsersByEmail(user.Email)
+	if err != nil {
+		log.Println("Unable to check for duplicate email addresses:", err)
+		return nil
+	}
+	for _, other := range users {
+		if other.Id != user.Id {
+			warnings.Add("email", WarnDuplicateEmail)
+			break
+		}
+	}
+	return warnings
+}
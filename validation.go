@@ -0,0 +1,150 @@
+package main
+
+import (
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+	"net"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrMissingUserName    = NewError("missing-user-name", http.StatusBadRequest, "Invalid User. The User Name is required.")
+	ErrMissingUserEmail   = NewError("missing-user-email", http.StatusBadRequest, "Invalid User. The User email is required.")
+	ErrUserEmailTooLong   = NewError("user-email-too-long", http.StatusBadRequest, "Invalid User. The User email is too long.")
+	ErrUserEmailNoMailbox = NewError("user-email-no-mailbox", http.StatusBadRequest, "Invalid User. The User email domain does not accept mail.")
+)
+
+// A FieldError is a validation error for a single field of a request body
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors collects every field that failed validation, so clients can report all the problems at once.
+// The first error is treated as the overall error when working out the error code and HTTP status.
+type ValidationErrors []*FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, fieldErr := range v {
+		messages[i] = fieldErr.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v ValidationErrors) Unwrap() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v[0]
+}
+
+// Add a field error to the list. A nil error is ignored.
+func (v *ValidationErrors) Add(field string, err error) {
+	if err != nil {
+		*v = append(*v, &FieldError{field, err})
+	}
+}
+
+// Get the collected errors as an error, or nil if there are none
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// The JSON representation of a FieldError delivered to clients
+type FieldErrorResult struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Get the JSON representation of field errors (or warnings), localized for the client
+func fieldErrorResults(w http.ResponseWriter, r *http.Request, fieldErrs []*FieldError) []*FieldErrorResult {
+	var results []*FieldErrorResult
+	for _, fieldErr := range fieldErrs {
+		results = append(results, &FieldErrorResult{
+			Field:   fieldErr.Field,
+			Code:    ErrorCode(fieldErr.Err),
+			Message: LocalizeError(w, r, fieldErr.Err),
+		})
+	}
+	return results
+}
+
+// Normalize and validate a person's name.
+// Surrounding whitespace is trimmed and the name is put into Unicode NFC form, so the same name
+// typed on different systems is stored the same way. The length limit is counted in characters.
+func NormalizeName(name string) (string, error) {
+	name = norm.NFC.String(strings.TrimSpace(name))
+	if name == "" {
+		return "", ErrMissingUserName
+	}
+	if utf8.RuneCountInString(name) > Config().MaxNameLength {
+		return "", ErrInvalidUserName
+	}
+	return name, nil
+}
+
+// Normalize and validate an email address.
+// The local part is put into Unicode NFC form but otherwise left alone, since it may be case sensitive.
+// The domain is lower-cased and converted to its ASCII (punycode) form, so IDN domains are stored consistently.
+// If the VerifyEmailMX option is set, the domain must be able to receive mail.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", ErrMissingUserEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", ErrInvalidUserEmail
+	}
+	local := norm.NFC.String(email[:at])
+	domain, err := idna.Lookup.ToASCII(norm.NFC.String(email[at+1:]))
+	if err != nil || !strings.Contains(strings.TrimSuffix(domain, "."), ".") {
+		return "", ErrInvalidUserEmail
+	}
+	email = local + "@" + domain
+
+	// Let net/mail do the heavy lifting on the local part (quoted strings, dot-atoms etc).
+	// Anything it would interpret as having a display name is not a bare address.
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" {
+		return "", ErrInvalidUserEmail
+	}
+	config := Config()
+	if len(email) > config.MaxEmailLength {
+		return "", ErrUserEmailTooLong
+	}
+
+	if config.VerifyEmailMX && !domainAcceptsMail(domain) {
+		return "", ErrUserEmailNoMailbox
+	}
+
+	return email, nil
+}
+
+// Check if a domain can receive mail. Per RFC 5321 a domain without MX records falls back to its address records.
+func domainAcceptsMail(domain string) bool {
+	mxs, err := net.LookupMX(domain)
+	if err == nil && len(mxs) != 0 {
+		// A single "." MX is a null MX (RFC 7505), meaning the domain explicitly accepts no mail
+		return !(len(mxs) == 1 && mxs[0].Host == ".")
+	}
+	addrs, err := net.LookupHost(domain)
+	return err == nil && len(addrs) != 0
+}
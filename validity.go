@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	LimitValidityValid   = "valid"
+	LimitValidityInvalid = "invalid"
+)
+
+var (
+	ErrInvalidTimestamp = NewError("invalid-timestamp", http.StatusBadRequest, "Invalid timestamp. Timestamps must be in RFC 3339 format.")
+)
+
+// UTCTime is a time.Time that is always rendered to clients in RFC 3339 format in UTC, no matter
+// which time-zone the database connection or the server happen to be in.
+type UTCTime struct {
+	time.Time
+}
+
+func NewUTCTime(t time.Time) UTCTime {
+	return UTCTime{t.UTC()}
+}
+
+func (t UTCTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UTC().Format(time.RFC3339))
+}
+
+func (t *UTCTime) UnmarshalJSON(data []byte) error {
+	var s *string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if s == nil || *s == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, *s)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	t.Time = parsed.UTC()
+	return nil
+}
+
+// Value implements driver.Valuer for writing to the database. The zero time is written as NULL.
+func (t UTCTime) Value() (driver.Value, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	return t.UTC(), nil
+}
+
+// Scan implements sql.Scanner for reading from the database.
+func (t *UTCTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v.UTC()
+	case nil:
+		t.Time = time.Time{}
+	default:
+		return ErrInvalidTimestamp
+	}
+	return nil
+}
+
+// Check if a validity period covers the given time, allowing for the ClockSkew option either side.
+// This is the one place "is currently valid" is decided, so all filters and checks agree.
+func IsValidAt(notBefore, notAfter, at time.Time) bool {
+	skew := time.Duration(Config().ClockSkew)
+	return !at.Add(skew).Before(notBefore) && !at.Add(-skew).After(notAfter)
+}
+
+// Check if the certificate is currently valid, allowing for clock skew
+func (cert *Certificate) IsCurrentlyValid() bool {
+	return IsValidAt(cert.Cert.NotBefore, cert.Cert.NotAfter, Now())
+}
+
+// Check if the certificate is currently valid, allowing for clock skew
+func (certData *CertificateData) IsCurrentlyValid() bool {
+	return IsValidAt(certData.NotBefore.Time, certData.NotAfter.Time, Now())
+}
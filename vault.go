@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrVaultUnavailable    = NewError("vault-unavailable", http.StatusServiceUnavailable, "The private key could not be encrypted or decrypted with Vault. Try again later.")
+	ErrInvalidVaultAddress = NewError("invalid-vault-address", http.StatusBadRequest, "Invalid Vault address. It must be an http:// or https:// URL, such as https://vault.example.com:8200.")
+	ErrMissingVaultToken   = NewError("missing-vault-token", http.StatusBadRequest, "Vault needs a token. Set the VaultToken option, or the VAULT_TOKEN environment variable.")
+	ErrKeyWrapped          = NewError("key-wrapped", http.StatusInternalServerError, "The private key was encrypted with Vault, which isn't configured.")
+)
+
+// Private keys can be encrypted before they are stored by a key management service, so that the database alone
+// doesn't give them away, and no key encryption secret is kept here. The only service so far is the transit
+// secrets engine of HashiCorp Vault: with the VaultAddress option set, each private key (compressed, if the
+// StorageCompression option is on) is sent to Vault's encrypt endpoint, and the ciphertext Vault gives back is
+// stored. Keys are decrypted with Vault again when they are read, which is only when they are exported.
+//
+// Keys stored before Vault was configured stay as they are, and are read as they are, until they are next written.
+// Rotating the transit key in Vault doesn't need anything here: Vault decrypts with whichever version encrypted.
+// A standby is sent the ciphertexts as they are stored, so it needs access to the same transit key.
+//
+// The token is looked up when the server starts, and renewed when half of its time to live is left, for as long as
+// Vault lets it be renewed. A token that can't be renewed has to be replaced, with a restart, before it expires.
+
+// How long to wait before trying Vault again, after failing to look up or renew the token
+const vaultRetryInterval = time.Minute
+
+// Ciphertexts from Vault start with "vault:" and the key's version, such as "vault:v1:". Stored DER starts with
+// 0x30, gzip with 0x1f 0x8b and PEM with "-----", so none can be confused with a ciphertext.
+var vaultCiphertextPrefix = []byte("vault:")
+
+// A KeyWrapper encrypts private keys before they are stored, and decrypts them when they are read back.
+// Key management services plug in here. The only one so far is VaultTransit.
+type KeyWrapper interface {
+	WrapKey(data []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// The key wrapper private keys are stored with. Nil means they are stored as they are.
+var KeyWrap KeyWrapper
+
+// Is stored data a wrapped private key?
+func isWrappedKey(data []byte) bool {
+	return bytes.HasPrefix(data, vaultCiphertextPrefix)
+}
+
+// Unwrap a stored private key
+func unwrapKey(data []byte) ([]byte, error) {
+	if KeyWrap == nil {
+		return nil, ErrKeyWrapped
+	}
+	return KeyWrap.UnwrapKey(data)
+}
+
+// Use Vault to wrap private keys, if the VaultAddress option is set. Vault's options need a restart to change.
+func setupKeyWrap() error {
+	if OptVaultAddress == "" {
+		return nil
+	}
+	token := OptVaultToken
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	vault, err := NewVaultTransit(OptVaultAddress, OptVaultNamespace, OptVaultTransitMount, OptVaultTransitKey, token)
+	if err != nil {
+		return err
+	}
+	KeyWrap = vault
+	go vault.RenewTokenEvery(vaultRetryInterval)
+	return nil
+}
+
+// VaultTransit wraps private keys with a key in Vault's transit secrets engine
+type VaultTransit struct {
+	address   string // Such as https://vault.example.com:8200
+	namespace string // Vault Enterprise namespace. Empty for none.
+	mount     string // Where the transit engine is mounted, such as "transit"
+	key       string // The transit key's name
+	token     string
+	client    *http.Client
+}
+
+// Make a transit key wrapper. Nothing is sent to Vault until it is used.
+func NewVaultTransit(address, namespace, mount, key, token string) (*VaultTransit, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidVaultAddress
+	}
+	if token == "" {
+		return nil, ErrMissingVaultToken
+	}
+	return &VaultTransit{
+		address:   strings.TrimSuffix(address, "/"),
+		namespace: namespace,
+		mount:     strings.Trim(mount, "/"),
+		key:       key,
+		token:     token,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// A response from Vault's HTTP API. Only the parts used here are read.
+type vaultResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+		TTL        int64  `json:"ttl"` // Seconds
+		Renewable  bool   `json:"renewable"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// Make a request of Vault's HTTP API, such as POST transit/encrypt/certstore
+func (v *VaultTransit) request(method, path string, body interface{}) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, v.address+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		log.Println("Unable to reach Vault:", err)
+		return nil, ErrVaultUnavailable
+	}
+	defer res.Body.Close()
+
+	response := new(vaultResponse)
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(response)
+	if res.StatusCode != http.StatusOK {
+		log.Println("Vault refused", method, path+":", res.Status, strings.Join(response.Errors, "; "))
+		return nil, ErrVaultUnavailable
+	}
+	if err != nil {
+		return nil, ErrVaultUnavailable
+	}
+	return response, nil
+}
+
+// WrapKey encrypts a private key with the transit key
+func (v *VaultTransit) WrapKey(data []byte) ([]byte, error) {
+	response, err := v.request("POST", v.mount+"/encrypt/"+url.PathEscape(v.key), map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !isWrappedKey([]byte(response.Data.Ciphertext)) {
+		return nil, ErrVaultUnavailable
+	}
+	return []byte(response.Data.Ciphertext), nil
+}
+
+// UnwrapKey decrypts a private key with the transit key
+func (v *VaultTransit) UnwrapKey(wrapped []byte) ([]byte, error) {
+	response, err := v.request("POST", v.mount+"/decrypt/"+url.PathEscape(v.key), map[string]string{
+		"ciphertext": string(wrapped),
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(response.Data.Plaintext)
+	if err != nil {
+		return nil, ErrVaultUnavailable
+	}
+	return data, nil
+}
+
+// Look up the token's time to live, and whether it can be renewed. Tokens that never expire have no time to live.
+func (v *VaultTransit) lookupToken() (time.Duration, bool, error) {
+	response, err := v.request("GET", "auth/token/lookup-self", nil)
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(response.Data.TTL) * time.Second, response.Data.Renewable, nil
+}
+
+// Renew the token, for as long as Vault gives it
+func (v *VaultTransit) renewToken() error {
+	_, err := v.request("POST", "auth/token/renew-self", map[string]string{})
+	return err
+}
+
+// Keep the token renewed, renewing it when half of its time to live is left. It returns once the token can't be
+// renewed any more, or never expires.
+func (v *VaultTransit) RenewTokenEvery(retry time.Duration) {
+	var waited time.Duration
+	for {
+		ttl, renewable, err := v.lookupToken()
+		if err != nil {
+			log.Println("Unable to look up the Vault token:", err)
+			<-clock.After(retry)
+			continue
+		}
+		if ttl == 0 {
+			return
+		}
+		// A token that has reached its maximum time to live is renewable, but renewing it doesn't extend it
+		if !renewable || (waited > 0 && ttl <= waited) {
+			log.Println("The Vault token can't be renewed, and expires in", ttl, "- restart with a new token before then")
+			return
+		}
+		waited = ttl / 2
+		<-clock.After(waited)
+		err = v.renewToken()
+		if err != nil {
+			log.Println("Unable to renew the Vault token:", err)
+			waited = 0
+			<-clock.After(retry)
+		}
+	}
+}
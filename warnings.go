@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// Warnings are reported alongside a successful result, when something is allowed but is close to not being,
+// so clients can see problems coming before they become errors. They use the same codes and message catalogs as errors.
+var (
+	WarnKeyNearMinimum = NewError("key-near-minimum", 0, "The key is only just long enough to be accepted. It should be replaced with a longer key.")
+	WarnLongValidity   = NewError("long-validity", 0, "The certificate is valid for an unusually long time.")
+)
+
+// Check a certificate against the warning thresholds. The warnings are reported against the given field.
+func (details *CertificateDetails) Warnings(field string) ValidationErrors {
+	config := Config()
+	var warnings ValidationErrors
+	switch details.KeyType {
+	case KeyTypeRSA:
+		if details.KeyBits < config.MinimumRSABits {
+			warnings.Add(field, WarnSandboxKeySize)
+		} else if details.KeyBits < config.WarnRSABits {
+			warnings.Add(field, WarnKeyNearMinimum)
+		}
+	case KeyTypeEC:
+		if details.KeyBits < config.MinimumECBits {
+			warnings.Add(field, WarnSandboxKeySize)
+		} else if details.KeyBits < config.WarnECBits {
+			warnings.Add(field, WarnKeyNearMinimum)
+		}
+	}
+	if details.NotAfter.Sub(details.NotBefore.Time) > time.Duration(config.WarnValidity) {
+		warnings.Add(field, WarnLongValidity)
+	}
+	return warnings
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WebSocket message types
+const (
+	WSTypeSubscribe   = "subscribe"   // Client -> server: receive events involving "user" ("" for all users)
+	WSTypeUnsubscribe = "unsubscribe" // Client -> server: stop receiving events involving "user"
+	WSTypeRequest     = "request"     // Client -> server: run an API request ("method", "path", "body")
+	WSTypeResponse    = "response"    // Server -> client: the result of a request, or an acknowledgement of a (un)subscribe
+	WSTypeEvent       = "event"       // Server -> client: an event for a subscription
+)
+
+var (
+	ErrInvalidWSMessage = NewError("invalid-ws-message", http.StatusBadRequest, "Invalid WebSocket message. The type must be subscribe, unsubscribe or request.")
+	ErrInvalidWSPath    = NewError("invalid-ws-path", http.StatusBadRequest, "Invalid WebSocket request. The path must be an API path starting with /.")
+)
+
+// A message sent over a WebSocket in either direction.
+// Responses carry the "id" of the message they answer, so clients can have several requests in flight.
+type WSMessage struct {
+	Id     string          `json:"id,omitempty"`
+	Type   string          `json:"type"`
+	User   string          `json:"user,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Path   string          `json:"path,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`   // For requests, the request body. For responses, the HTTPResult.
+	Status int             `json:"status,omitempty"` // HTTP status of the response
+	Event  *Event          `json:"event,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{}
+
+// Serve the /ws endpoint. A single connection can subscribe to certificate and user events, and run any API
+// request, which is dispatched to handler exactly as if it had been made over HTTP. The handler should be the whole
+// server (see ServerMiddleware), so requests over a WebSocket are refused on a standby, and counted for anomalies.
+func WebSocketHandler(handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already replied to the client
+			return
+		}
+		ws := &wsConn{
+			conn:    conn,
+			handler: handler,
+			upgrade: r,
+			out:     make(chan *WSMessage, Config().WebSocketBuffer),
+			subs:    make(map[string]*EventSubscription),
+		}
+		ws.serve()
+	}
+}
+
+// State of a single WebSocket connection
+type wsConn struct {
+	conn    *websocket.Conn
+	handler http.Handler
+	upgrade *http.Request // The original upgrade request. Its headers are passed on to API requests.
+	out     chan *WSMessage
+	wg      sync.WaitGroup // Goroutines sending to out
+	subsMu  sync.Mutex
+	subs    map[string]*EventSubscription
+}
+
+func (ws *wsConn) serve() {
+	writerDone := make(chan struct{})
+	go ws.writeLoop(writerDone)
+
+	ws.readLoop()
+
+	// The client has gone away. Stop the subscriptions, wait for anything still sending, and stop the writer.
+	ws.subsMu.Lock()
+	for userid, sub := range ws.subs {
+		sub.Close()
+		delete(ws.subs, userid)
+	}
+	ws.subsMu.Unlock()
+	ws.wg.Wait()
+	close(ws.out)
+	<-writerDone
+	ws.conn.Close()
+}
+
+func (ws *wsConn) writeLoop(done chan struct{}) {
+	defer close(done)
+	for msg := range ws.out {
+		err := ws.conn.WriteJSON(msg)
+		if err != nil {
+			// Keep draining so senders don't block. The read loop will notice the broken connection.
+			ws.conn.Close()
+		}
+	}
+}
+
+func (ws *wsConn) readLoop() {
+	for {
+		msg := new(WSMessage)
+		err := ws.conn.ReadJSON(msg)
+		if err != nil {
+			// A message that isn't valid JSON doesn't break the connection, anything else does
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				ws.sendError(msg.Id, err, http.StatusBadRequest)
+				continue
+			}
+			return
+		}
+
+		switch msg.Type {
+		case WSTypeSubscribe:
+			ws.subscribe(msg)
+		case WSTypeUnsubscribe:
+			ws.unsubscribe(msg)
+		case WSTypeRequest:
+			// Requests run concurrently so a slow request doesn't hold up the connection
+			ws.wg.Add(1)
+			go func() {
+				defer ws.wg.Done()
+				ws.request(msg)
+			}()
+		default:
+			ws.sendError(msg.Id, ErrInvalidWSMessage, 0)
+		}
+	}
+}
+
+func (ws *wsConn) subscribe(msg *WSMessage) {
+	if msg.User != "" {
+		if checkid, err := strconv.Atoi(msg.User); err != nil || checkid <= 0 {
+			ws.sendError(msg.Id, ErrInvalidUserId, 0)
+			return
+		}
+	}
+
+	ws.subsMu.Lock()
+	if _, ok := ws.subs[msg.User]; !ok {
+		sub := Events.Subscribe(msg.User, Config().WebSocketBuffer)
+		ws.subs[msg.User] = sub
+		ws.wg.Add(1)
+		go func() {
+			defer ws.wg.Done()
+			for e := range sub.C {
+				ws.out <- &WSMessage{Type: WSTypeEvent, User: sub.UserId, Event: e}
+			}
+		}()
+	}
+	ws.subsMu.Unlock()
+
+	ws.sendResult(msg.Id, msg.User)
+}
+
+func (ws *wsConn) unsubscribe(msg *WSMessage) {
+	ws.subsMu.Lock()
+	if sub, ok := ws.subs[msg.User]; ok {
+		sub.Close()
+		delete(ws.subs, msg.User)
+	}
+	ws.subsMu.Unlock()
+
+	ws.sendResult(msg.Id, msg.User)
+}
+
+// Run an API request, and send back the response
+func (ws *wsConn) request(msg *WSMessage) {
+	if !strings.HasPrefix(msg.Path, "/") || strings.HasPrefix(msg.Path, "/ws") {
+		ws.sendError(msg.Id, ErrInvalidWSPath, 0)
+		return
+	}
+	method := strings.ToUpper(msg.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequest(method, msg.Path, bytes.NewReader(msg.Body))
+	if err != nil {
+		ws.sendError(msg.Id, err, http.StatusBadRequest)
+		return
+	}
+	req = req.WithContext(ws.upgrade.Context())
+	req.RemoteAddr = ws.upgrade.RemoteAddr
+	for name, values := range ws.upgrade.Header {
+		if !strings.HasPrefix(name, "Sec-Websocket") && name != "Upgrade" && name != "Connection" {
+			req.Header[name] = values
+		}
+	}
+	// Responses are embedded in a JSON message, so they must be JSON
+	req.Header.Set("Accept", MediaTypeJSON)
+	req.Header.Set("Content-Type", MediaTypeJSON)
+
+	rw := &wsResponseWriter{header: make(http.Header)}
+	ws.handler.ServeHTTP(rw, req)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	res := &WSMessage{Id: msg.Id, Type: WSTypeResponse, Status: rw.status}
+	body := bytes.TrimSpace(rw.body.Bytes())
+	if json.Valid(body) {
+		res.Body = body
+	} else {
+		// Not one of our JSON results (eg. a 404 or 405 from the router). Wrap it so the client always gets an HTTPResult.
+		res.Body, _ = json.Marshal(HTTPResult{Success: false, Error: string(body)})
+	}
+	ws.out <- res
+}
+
+func (ws *wsConn) sendResult(id string, result interface{}) {
+	body, err := json.Marshal(HTTPResult{Success: true, Result: result})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ws.out <- &WSMessage{Id: id, Type: WSTypeResponse, Status: http.StatusOK, Body: body}
+}
+
+func (ws *wsConn) sendError(id string, e error, status int) {
+	if status == 0 {
+		status = http.StatusInternalServerError
+		var apiErr *Error
+		if errors.As(e, &apiErr) && apiErr.StatusCode != 0 {
+			status = apiErr.StatusCode
+		}
+	}
+	body, err := json.Marshal(HTTPResult{Success: false, Error: LocalizeError(&wsResponseWriter{header: make(http.Header)}, ws.upgrade, e), Code: ErrorCode(e)})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ws.out <- &WSMessage{Id: id, Type: WSTypeResponse, Status: status, Body: body}
+}
+
+// Collects the response to an API request made over a WebSocket
+type wsResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *wsResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *wsResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *wsResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.body.Write(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The wildcard report lists every active certificate covering a wildcard name, with where it is deployed: by the
+// user holding it, and by the users it is shared with for deployment. A wildcard deployed by more than its holder
+// is shared between services, which is what phasing out shared wildcards needs to find first. Wildcards are also
+// flagged in listings, by the certificate summary's "wildcard". The report uses the names index (see conflicts.go).
+
+// An active certificate covering a wildcard name
+type WildcardCert struct {
+	UserId     string   `json:"user"` // The user holding the certificate
+	CertId     string   `json:"cert"`
+	NotAfter   UTCTime  `json:"notAfter"`
+	Wildcards  []string `json:"wildcards"`  // The wildcard names it covers
+	DeployedBy []string `json:"deployedBy"` // The users it is shared with for deployment
+	Shared     bool     `json:"shared"`     // Is it deployed by anyone but its holder?
+}
+
+type WildcardReport struct {
+	Certs  int             `json:"certs"`  // How many active certificates cover a wildcard
+	Shared int             `json:"shared"` // How many of them are shared for deployment
+	Items  []*WildcardCert `json:"items"`  // Shared certificates first
+}
+
+// Does a certificate cover a wildcard name?
+func hasWildcard(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Report the wildcard certificates, shared ones first
+func newWildcardReport(certs []*WildcardCert) *WildcardReport {
+	report := &WildcardReport{Certs: len(certs), Items: []*WildcardCert{}}
+	var unshared []*WildcardCert
+	for _, cert := range certs {
+		cert.Shared = len(cert.DeployedBy) != 0
+		if cert.Shared {
+			report.Shared++
+			report.Items = append(report.Items, cert)
+		} else {
+			unshared = append(unshared, cert)
+		}
+	}
+	report.Items = append(report.Items, unshared...)
+	return report
+}
+
+// List every active wildcard certificate, with where it is deployed
+func ReadWildcardsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	certs, err := DatabaseListWildcardCerts()
+	if err != nil {
+		HandleError(w, r, err, 0)
+		return
+	}
+
+	// Send the result
+	SendResult(w, r, newWildcardReport(certs))
+}